@@ -0,0 +1,154 @@
+package jsonrpc
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// adaptiveWindow is the number of recent call latencies the adaptive
+	// timeout of a method is computed from
+	adaptiveWindow = 200
+
+	// adaptiveMinSamples is the number of calls to a method before its calls
+	// get an adaptive timeout
+	adaptiveMinSamples = 20
+
+	// adaptiveMinTimeout is the lowest adaptive timeout, so that very fast
+	// methods aren't cut off by scheduling or GC pauses
+	adaptiveMinTimeout = 10 * time.Millisecond
+)
+
+// adaptiveRecompute is the number of new samples after which the adaptive
+// timeout of a method is recomputed
+const adaptiveRecompute = 10
+
+// latencyWindow holds the recent latencies of calls to a method
+type latencyWindow struct {
+	lk sync.Mutex
+
+	samples []time.Duration
+	next    int
+
+	// pending is the number of samples added since timeout was computed
+	pending int
+
+	// timeout is the adaptive timeout computed from samples, 0 until there
+	// are enough samples
+	timeout time.Duration
+}
+
+func (lw *latencyWindow) add(d time.Duration, factor float64) {
+	lw.lk.Lock()
+	defer lw.lk.Unlock()
+
+	if len(lw.samples) < adaptiveWindow {
+		lw.samples = append(lw.samples, d)
+	} else {
+		lw.samples[lw.next] = d
+		lw.next = (lw.next + 1) % adaptiveWindow
+	}
+	lw.pending++
+
+	if len(lw.samples) < adaptiveMinSamples {
+		return
+	}
+	// sorting the window on every call is too costly for hot methods, so the
+	// timeout is only refreshed every few calls
+	if lw.timeout != 0 && lw.pending < adaptiveRecompute {
+		return
+	}
+	lw.pending = 0
+
+	sorted := make([]time.Duration, len(lw.samples))
+	copy(sorted, lw.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	p99 := sorted[(len(sorted)*99-1)/100]
+	lw.timeout = time.Duration(float64(p99) * factor)
+	if lw.timeout < adaptiveMinTimeout {
+		lw.timeout = adaptiveMinTimeout
+	}
+}
+
+func (lw *latencyWindow) current() time.Duration {
+	lw.lk.Lock()
+	defer lw.lk.Unlock()
+	return lw.timeout
+}
+
+// adaptiveTimeouts tracks per-method call latencies, and derives timeouts from
+// them, see WithAdaptiveTimeout
+type adaptiveTimeouts struct {
+	factor float64
+
+	// lk only guards the map, each window has its own lock
+	lk      sync.RWMutex
+	methods map[string]*latencyWindow
+}
+
+func newAdaptiveTimeouts(factor float64) *adaptiveTimeouts {
+	return &adaptiveTimeouts{
+		factor:  factor,
+		methods: map[string]*latencyWindow{},
+	}
+}
+
+func (a *adaptiveTimeouts) window(method string) *latencyWindow {
+	a.lk.RLock()
+	lw, ok := a.methods[method]
+	a.lk.RUnlock()
+	if ok {
+		return lw
+	}
+
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	lw, ok = a.methods[method]
+	if !ok {
+		lw = &latencyWindow{}
+		a.methods[method] = lw
+	}
+	return lw
+}
+
+// timeout returns the adaptive timeout of a method, false if there aren't
+// enough samples yet
+func (a *adaptiveTimeouts) timeout(method string) (time.Duration, bool) {
+	a.lk.RLock()
+	lw, ok := a.methods[method]
+	a.lk.RUnlock()
+	if !ok {
+		return 0, false
+	}
+
+	timeout := lw.current()
+	return timeout, timeout != 0
+}
+
+// observe records the latency of a call, calls cut off by the timeout are
+// recorded as lasting the timeout
+func (a *adaptiveTimeouts) observe(method string, d time.Duration) {
+	a.window(method).add(d, a.factor)
+}
+
+// AdaptiveTimeouts returns the current adaptive timeouts of methods, on
+// servers with WithAdaptiveTimeout. Methods without enough calls to compute a
+// timeout from aren't included.
+func (s *RPCServer) AdaptiveTimeouts() map[string]time.Duration {
+	out := map[string]time.Duration{}
+	if s.adaptiveTimeouts == nil {
+		return out
+	}
+
+	s.adaptiveTimeouts.lk.RLock()
+	defer s.adaptiveTimeouts.lk.RUnlock()
+
+	for method, lw := range s.adaptiveTimeouts.methods {
+		if timeout := lw.current(); timeout > 0 {
+			out[method] = timeout
+		}
+	}
+	return out
+}
@@ -0,0 +1,47 @@
+package jsonrpc
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// MethodAllowlistFunc computes the set of wire method names which can be
+// called, see WithMethodAllowlistFunc
+type MethodAllowlistFunc func(ctx context.Context) (map[string]bool, error)
+
+type methodAllowlistKey struct{}
+
+// methodAllowlist is the allowlist of a connection (or of an http request),
+// computed on the first call
+type methodAllowlist struct {
+	once    sync.Once
+	methods map[string]bool
+	err     error
+}
+
+func withMethodAllowlist(ctx context.Context) context.Context {
+	return context.WithValue(ctx, methodAllowlistKey{}, &methodAllowlist{})
+}
+
+// checkAllowed returns an access denied error if the method isn't in the
+// allowlist of the connection
+func (s *handler) checkAllowed(ctx context.Context, method string) error {
+	al, ok := ctx.Value(methodAllowlistKey{}).(*methodAllowlist)
+	if !ok {
+		// not called through ServeHTTP, compute for this call only
+		al = &methodAllowlist{}
+	}
+
+	al.once.Do(func() {
+		al.methods, al.err = s.methodAllowlist(ctx)
+	})
+	if al.err != nil {
+		return xerrors.Errorf("access denied: computing allowed methods: %w", al.err)
+	}
+	if !al.methods[method] {
+		return xerrors.Errorf("access denied: method '%s' not allowed", method)
+	}
+	return nil
+}
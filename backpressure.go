@@ -0,0 +1,97 @@
+package jsonrpc
+
+import (
+	"context"
+	"reflect"
+	"time"
+)
+
+// BackpressureMode selects what happens to a subscription (a channel returned
+// by a method) when the client doesn't read values as fast as they are produced
+type BackpressureMode int
+
+const (
+	// BackpressureBlock blocks forwarding until the client catches up, which
+	// in turn blocks the handler sending to the channel. This is the default.
+	BackpressureBlock BackpressureMode = iota
+
+	// BackpressureDisconnect blocks like BackpressureBlock, but closes the
+	// connection when sending a value to the client takes longer than the
+	// policy timeout.
+	BackpressureDisconnect
+
+	// BackpressureConflate keeps receiving from the channel while the client
+	// is behind, and only sends the latest value received once it catches up;
+	// intermediate values are dropped. Useful for subscriptions where each
+	// value supersedes the previous one, e.g. chain head updates.
+	BackpressureConflate
+)
+
+// Backpressure is a policy for slow subscription clients, see
+// WithSubscriptionBackpressure and SetSubscriptionBackpressure
+type Backpressure struct {
+	Mode BackpressureMode
+
+	// Timeout is how long a value may take to be sent with
+	// BackpressureDisconnect
+	Timeout time.Duration
+}
+
+type backpressureKey struct{}
+
+// SetSubscriptionBackpressure sets the backpressure policy of the channel
+// returned by the method handled with ctx, overriding the server default set
+// with WithSubscriptionBackpressure. It must be called before the handler
+// returns. For methods which don't return channels (and outside of handlers)
+// it's a no-op.
+func SetSubscriptionBackpressure(ctx context.Context, policy Backpressure) {
+	bp, ok := ctx.Value(backpressureKey{}).(*Backpressure)
+	if !ok {
+		return
+	}
+	*bp = policy
+}
+
+// conflate returns a channel carrying the values of ch, which keeps receiving
+// from ch when the returned channel isn't read, keeping only the latest value.
+// The returned channel is closed after ch is closed and the last value was
+// received, or when exiting is closed.
+func conflate(ch reflect.Value, exiting <-chan struct{}) reflect.Value {
+	out := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, ch.Type().Elem()), 0)
+
+	go func() {
+		defer out.Close()
+
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(exiting)},
+			{Dir: reflect.SelectRecv, Chan: ch},
+			{Dir: reflect.SelectSend, Chan: out},
+		}
+		var pending bool
+		for cases[1].Chan.IsValid() || pending {
+			active := cases
+			if !pending {
+				active = cases[:2]
+			}
+
+			chosen, val, ok := reflect.Select(active)
+			switch chosen {
+			case 0:
+				return
+			case 1:
+				if !ok {
+					// a zero Value is never selected, which stops receiving
+					cases[1].Chan = reflect.Value{}
+					continue
+				}
+				cases[2].Send = val
+				pending = true
+			case 2:
+				cases[2].Send = reflect.Value{}
+				pending = false
+			}
+		}
+	}()
+
+	return out
+}
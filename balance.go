@@ -0,0 +1,314 @@
+package jsonrpc
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// BalanceStrategy selects the endpoint used for each call of a client created
+// with NewClientWithEndpoints
+type BalanceStrategy int
+
+const (
+	// RoundRobin uses healthy endpoints in turn
+	RoundRobin BalanceStrategy = iota
+	// Random picks a random healthy endpoint
+	Random
+	// LeastInFlight picks the healthy endpoint with the fewest calls in flight
+	LeastInFlight
+)
+
+const healthCheckTimeout = 5 * time.Second
+
+type endpoint struct {
+	addr string
+
+	// client is nil until the endpoint is connected (websocket endpoints which
+	// were down when the client was created)
+	client *client
+	closer ClientCloser
+
+	inflight int64
+	ejected  bool
+}
+
+type balancer struct {
+	strategy BalanceStrategy
+
+	lk        sync.Mutex
+	endpoints []*endpoint
+	next      int // next round-robin position
+}
+
+// NewClientWithEndpoints creates a Client which distributes calls across
+// multiple servers, selecting the server for each call with the given strategy.
+// Addresses may mix http(s):// and ws(s):// endpoints.
+//
+// When a call fails with a connection error, or is rejected by a server which
+// is shutting down (see RPCServer.Shutdown), the endpoint is ejected, and the
+// call is retried on another endpoint. Note that this means that a call may
+// be executed twice, if the connection broke after the server received it.
+// Ejected endpoints are health-checked (with a TCP dial) every health check
+// interval (see WithHealthCheckInterval), and are used again once they're up.
+//
+// Creating the client fails if no endpoint could be connected to.
+func NewClientWithEndpoints(ctx context.Context, addrs []string, strategy BalanceStrategy, requestHeader http.Header, opts ...Option) (*Client, error) {
+	if len(addrs) == 0 {
+		return nil, xerrors.New("no endpoints")
+	}
+
+	config := defaultConfig()
+	for _, o := range opts {
+		o(&config)
+	}
+
+	b := &balancer{
+		strategy: strategy,
+	}
+
+	closeEndpoints := func() {
+		for _, ep := range b.endpoints {
+			if ep.closer != nil {
+				ep.closer()
+			}
+		}
+	}
+
+	var connected bool
+	for _, addr := range addrs {
+		ep := &endpoint{addr: addr}
+
+		c, closer, err := newClient(ctx, addr, requestHeader, opts...)
+		if err != nil {
+			var cerr *RPCConnectionError
+			if !errors.As(err, &cerr) {
+				closeEndpoints()
+				return nil, xerrors.Errorf("creating client for %s: %w", addr, err)
+			}
+			log.Warnw("endpoint unreachable, ejecting", "addr", addr, "error", err)
+			ep.ejected = true
+		} else {
+			ep.client, ep.closer = c, closer
+			connected = true
+		}
+
+		b.endpoints = append(b.endpoints, ep)
+	}
+
+	if !connected {
+		return nil, &RPCConnectionError{xerrors.New("no endpoint could be connected to")}
+	}
+
+	stop := make(chan struct{})
+
+	c := &client{
+		paramEncoders:   config.paramEncoders,
+		namespaceCodecs: config.namespaceCodecs,
+		errors:          config.errors,
+
+		protocolVersion: config.protocolVersion,
+		idempotencyKeys: config.idempotencyKeys,
+		resultTransform: config.resultTransform,
+
+		doRequest: b.doRequest,
+		exiting:   stop,
+	}
+
+	go b.healthCheck(ctx, config.healthCheckInterval, stop, func(addr string) (*client, ClientCloser, error) {
+		return newClient(ctx, addr, requestHeader, opts...)
+	})
+
+	return &Client{
+		client: c,
+		closer: func() {
+			b.lk.Lock()
+			defer b.lk.Unlock()
+
+			close(stop)
+			closeEndpoints()
+		},
+	}, nil
+}
+
+func (b *balancer) doRequest(ctx context.Context, cr clientRequest) (clientResponse, error) {
+	tried := map[*endpoint]bool{}
+
+	var lastResp clientResponse
+	var lastErr error = &RPCConnectionError{xerrors.New("no healthy endpoints")}
+
+	for {
+		ep := b.pick(tried)
+		if ep == nil {
+			return lastResp, lastErr
+		}
+
+		atomic.AddInt64(&ep.inflight, 1)
+		resp, err := ep.client.doRequest(ctx, cr)
+		atomic.AddInt64(&ep.inflight, -1)
+
+		if !isConnFailure(resp, err) {
+			return resp, err
+		}
+
+		logErr := err
+		if logErr == nil {
+			logErr = resp.Error
+		}
+		log.Warnw("endpoint failed, ejecting", "addr", ep.addr, "error", logErr)
+		b.eject(ep)
+
+		if ctx != nil && ctx.Err() != nil {
+			return resp, err
+		}
+
+		tried[ep] = true
+		lastResp, lastErr = resp, err
+	}
+}
+
+// pick selects a healthy endpoint which wasn't tried yet, nil if there is none
+func (b *balancer) pick(tried map[*endpoint]bool) *endpoint {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	var healthy []*endpoint
+	for _, ep := range b.endpoints {
+		if !ep.ejected && !tried[ep] {
+			healthy = append(healthy, ep)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	switch b.strategy {
+	case Random:
+		return healthy[rand.Intn(len(healthy))]
+	case LeastInFlight:
+		best := healthy[0]
+		for _, ep := range healthy[1:] {
+			if atomic.LoadInt64(&ep.inflight) < atomic.LoadInt64(&best.inflight) {
+				best = ep
+			}
+		}
+		return best
+	default: // RoundRobin
+		ep := healthy[b.next%len(healthy)]
+		b.next++
+		return ep
+	}
+}
+
+func (b *balancer) eject(ep *endpoint) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	ep.ejected = true
+}
+
+// healthCheck periodically checks ejected endpoints, and makes them available
+// again once they're reachable
+func (b *balancer) healthCheck(ctx context.Context, interval time.Duration, stop <-chan struct{}, connect func(addr string) (*client, ClientCloser, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		b.lk.Lock()
+		var ejected []*endpoint
+		for _, ep := range b.endpoints {
+			if ep.ejected {
+				ejected = append(ejected, ep)
+			}
+		}
+		b.lk.Unlock()
+
+		for _, ep := range ejected {
+			if err := probeEndpoint(ep.addr); err != nil {
+				log.Debugw("ejected endpoint still unreachable", "addr", ep.addr, "error", err)
+				continue
+			}
+
+			// only this goroutine sets clients after startup, no need to lock
+			var c *client
+			var closer ClientCloser
+			if ep.client == nil {
+				var err error
+				c, closer, err = connect(ep.addr)
+				if err != nil {
+					log.Debugw("connecting to endpoint failed", "addr", ep.addr, "error", err)
+					continue
+				}
+			}
+
+			b.lk.Lock()
+			select {
+			case <-stop:
+				// the client was closed while connecting
+				b.lk.Unlock()
+				if closer != nil {
+					closer()
+				}
+				return
+			default:
+			}
+
+			if c != nil {
+				ep.client, ep.closer = c, closer
+			}
+			ep.ejected = false
+			log.Infow("endpoint healthy again", "addr", ep.addr)
+			b.lk.Unlock()
+		}
+	}
+}
+
+// probeEndpoint checks if the endpoint host accepts connections
+func probeEndpoint(addr string) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return err
+	}
+
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https", "wss":
+			port = "443"
+		default:
+			port = "80"
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(u.Hostname(), port), healthCheckTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// isConnFailure checks if a call failed because the endpoint couldn't be
+// reached or is shutting down, as opposed to errors returned by the server
+func isConnFailure(resp clientResponse, err error) bool {
+	if err != nil {
+		var cerr *RPCConnectionError
+		return errors.As(err, &cerr)
+	}
+	return resp.Error != nil && (resp.Error.Code == eTempWSError || resp.Error.Code == ServerDraining)
+}
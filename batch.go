@@ -0,0 +1,159 @@
+package jsonrpc
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// Batch collects calls to be sent together, see Client.NewBatch
+type Batch struct {
+	client *client
+
+	reqs   []request
+	codecs []Codec
+
+	// err is the first error encountered when adding calls
+	err error
+}
+
+// BatchCall is a handle for a call added to a Batch, used to access the call
+// result in the BatchResponse
+type BatchCall struct {
+	batch *Batch
+	idx   int
+}
+
+// BatchResponse holds results of all calls in a batch
+type BatchResponse struct {
+	batch *Batch
+
+	resps []clientResponse
+	// errs are client-side errors of individual calls, e.g. a missing response
+	errs []error
+}
+
+// NewBatch creates a new batch of calls. Over http the calls are sent in a
+// single JSON-RPC batch request, over websocket the calls are sent as separate
+// requests on the connection, at the same time.
+func (c *Client) NewBatch() *Batch {
+	return &Batch{
+		client: c.client,
+	}
+}
+
+// Add adds a call to the batch. Errors encoding params are returned from Send.
+func (b *Batch) Add(method string, params ...interface{}) *BatchCall {
+	codec := b.client.namespaceCodecs[wireNamespace(method)]
+
+	req, err := b.client.makeRequest(codec, method, params)
+	if err != nil && b.err == nil {
+		b.err = xerrors.Errorf("call %d (%s): %w", len(b.reqs), method, err)
+	}
+
+	b.reqs = append(b.reqs, req)
+	b.codecs = append(b.codecs, codec)
+
+	return &BatchCall{
+		batch: b,
+		idx:   len(b.reqs) - 1,
+	}
+}
+
+// Send sends all calls in the batch, and waits for all responses. The returned
+// error is only set when the batch as a whole failed, errors of individual
+// calls are available from the BatchResponse.
+func (b *Batch) Send(ctx context.Context) (*BatchResponse, error) {
+	if b.err != nil {
+		return nil, &ErrClient{b.err}
+	}
+	if len(b.reqs) == 0 {
+		return nil, &ErrClient{xerrors.New("empty batch")}
+	}
+
+	out := &BatchResponse{
+		batch: b,
+		resps: make([]clientResponse, len(b.reqs)),
+		errs:  make([]error, len(b.reqs)),
+	}
+
+	if b.client.doBatch == nil {
+		// no batch support in the transport, send calls in parallel
+		var wg sync.WaitGroup
+		for i := range b.reqs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				resp, err := b.client.sendRequest(ctx, b.reqs[i], nil, nil)
+				if err != nil {
+					out.errs[i] = &ErrClient{xerrors.Errorf("sendRequest failed: %w", err)}
+					return
+				}
+				out.resps[i] = resp
+			}(i)
+		}
+		wg.Wait()
+
+		return out, nil
+	}
+
+	resps, err := b.client.doBatch(ctx, b.reqs)
+	if err != nil {
+		return nil, &ErrClient{xerrors.Errorf("sending batch failed: %w", err)}
+	}
+
+	// responses may come in any order, pair them with calls by ID
+	byID := make(map[interface{}]clientResponse, len(resps))
+	for _, resp := range resps {
+		byID[resp.ID] = resp
+	}
+	for i, req := range b.reqs {
+		resp, ok := byID[req.ID]
+		if !ok {
+			out.errs[i] = &ErrClient{xerrors.Errorf("no response for call %d (%s)", i, req.Method)}
+			continue
+		}
+		out.resps[i] = resp
+	}
+
+	return out, nil
+}
+
+// Err returns the error of the call, nil if the call succeeded
+func (r *BatchResponse) Err(call *BatchCall) error {
+	if call.batch != r.batch {
+		return &ErrClient{xerrors.New("call is not a part of this batch")}
+	}
+	if r.errs[call.idx] != nil {
+		return r.errs[call.idx]
+	}
+	if resp := r.resps[call.idx]; resp.Error != nil {
+		return resp.Error.val(r.batch.client.errors).Interface().(error)
+	}
+	return nil
+}
+
+// Decode decodes the result of the call into out, which must be a pointer. If
+// the call failed, its error is returned.
+func (r *BatchResponse) Decode(call *BatchCall, out interface{}) error {
+	if err := r.Err(call); err != nil {
+		return err
+	}
+	if err := checkResultTarget(out); err != nil {
+		return &ErrClient{err}
+	}
+
+	return r.batch.client.processResult(r.batch.codecs[call.idx], r.batch.reqs[call.idx].Method, r.resps[call.idx], out)
+}
+
+// Failed returns true if any call in the batch failed
+func (r *BatchResponse) Failed() bool {
+	for i := range r.resps {
+		if r.errs[i] != nil || r.resps[i].Error != nil {
+			return true
+		}
+	}
+	return false
+}
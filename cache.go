@@ -0,0 +1,40 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// CacheStore stores responses of methods with result caching enabled, see
+// WithMethodCache. It's the same interface as for idempotency keys, e.g.
+// NewMemoryIdempotencyStore creates an in-memory store.
+type CacheStore = IdempotencyStore
+
+// methodCaches are the result caches of methods with caching enabled, by wire
+// method name. Concurrent identical calls are deduplicated the same way as
+// calls with idempotency keys.
+type methodCaches map[string]*idempotencyCache
+
+func newMethodCaches(ttls map[string]time.Duration, store CacheStore) methodCaches {
+	if len(ttls) == 0 {
+		return nil
+	}
+	if store == nil {
+		store = NewMemoryIdempotencyStore()
+	}
+
+	mc := methodCaches{}
+	for method, ttl := range ttls {
+		if ttl > 0 {
+			mc[method] = newIdempotencyCache(ttl, store)
+		}
+	}
+	return mc
+}
+
+// methodCacheKey is the cache key of a call of the caller (also used to
+// deduplicate notifications), params differing only in whitespace map to the
+// same key
+func methodCacheKey(caller, method string, params json.RawMessage) string {
+	return "cache/" + caller + "/" + method + "/" + paramsHash(params)
+}
@@ -0,0 +1,217 @@
+package jsonrpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-jsonrpc/metrics"
+)
+
+// ErrCircuitOpen is returned (wrapped in RPCConnectionError) for calls which
+// were rejected because the client circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitState is the state of a client circuit breaker
+type CircuitState int
+
+const (
+	// CircuitClosed means that calls are sent normally
+	CircuitClosed CircuitState = iota
+	// CircuitOpen means that calls fail immediately, until the cooldown passes
+	CircuitOpen
+	// CircuitHalfOpen means that a single trial call is sent to check if the
+	// server recovered
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreakerSettings configures the client circuit breaker, see
+// WithCircuitBreaker
+type CircuitBreakerSettings struct {
+	// FailureThreshold is the number of consecutive transport failures which
+	// opens the circuit
+	FailureThreshold int
+	// Cooldown is how long the circuit stays open before a trial call is sent
+	Cooldown time.Duration
+
+	// OnStateChange is called on each state change, if set. It's called
+	// synchronously from the call which caused the change (without holding
+	// breaker locks, so it can call Client.CircuitState), so it shouldn't block.
+	OnStateChange func(from, to CircuitState)
+}
+
+type circuitBreaker struct {
+	settings CircuitBreakerSettings
+
+	lk       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	// trial is set when the half-open trial call is in flight
+	trial bool
+}
+
+func newCircuitBreaker(settings CircuitBreakerSettings) *circuitBreaker {
+	if settings.FailureThreshold < 1 {
+		settings.FailureThreshold = 1
+	}
+
+	return &circuitBreaker{
+		settings: settings,
+	}
+}
+
+func (cb *circuitBreaker) State() CircuitState {
+	cb.lk.Lock()
+	defer cb.lk.Unlock()
+
+	return cb.state
+}
+
+// circuitTransition is a state change, passed to OnStateChange once lk is
+// released, so that callbacks can query the breaker
+type circuitTransition struct {
+	from, to CircuitState
+}
+
+// allow checks if a call can be sent, if it returns nil, done must be called
+// with the outcome of the call, and whether it's the half-open trial call
+func (cb *circuitBreaker) allow() (trial bool, err error) {
+	var changes []circuitTransition
+	defer func() { cb.notify(changes) }()
+
+	cb.lk.Lock()
+	defer cb.lk.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		if time.Since(cb.openedAt) < cb.settings.Cooldown {
+			return false, ErrCircuitOpen
+		}
+		cb.setState(CircuitHalfOpen, &changes)
+		cb.trial = true
+		return true, nil
+	case CircuitHalfOpen:
+		if cb.trial {
+			return false, ErrCircuitOpen
+		}
+		cb.trial = true
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// done records the outcome of a call allowed by allow. Calls which didn't
+// complete for reasons not related to the server (e.g. a cancelled context)
+// are neither successes nor failures. While the circuit isn't closed only the
+// trial call counts, calls allowed before it opened don't change its state.
+func (cb *circuitBreaker) done(trial, failure, ignore bool) {
+	var changes []circuitTransition
+	defer func() { cb.notify(changes) }()
+
+	cb.lk.Lock()
+	defer cb.lk.Unlock()
+
+	if trial {
+		cb.trial = false
+	}
+
+	if ignore || (!trial && cb.state != CircuitClosed) {
+		return
+	}
+
+	if !failure {
+		cb.failures = 0
+		if cb.state != CircuitClosed {
+			cb.setState(CircuitClosed, &changes)
+		}
+		return
+	}
+
+	cb.failures++
+	if trial || cb.failures >= cb.settings.FailureThreshold {
+		cb.openedAt = time.Now()
+		cb.setState(CircuitOpen, &changes)
+	}
+}
+
+// setState must be called with lk held, the change is added to changes for
+// notify
+func (cb *circuitBreaker) setState(s CircuitState, changes *[]circuitTransition) {
+	from := cb.state
+	cb.state = s
+
+	log.Infow("circuit breaker state change", "from", from, "to", s)
+	*changes = append(*changes, circuitTransition{from: from, to: s})
+}
+
+// notify calls OnStateChange with the changes, must be called without lk held
+func (cb *circuitBreaker) notify(changes []circuitTransition) {
+	if cb.settings.OnStateChange == nil {
+		return
+	}
+	for _, c := range changes {
+		cb.settings.OnStateChange(c.from, c.to)
+	}
+}
+
+// withCircuitBreaker wraps the client transport with the circuit breaker. Only
+// transport failures count as failures, JSON-RPC error responses don't.
+func (c *client) withCircuitBreaker(cb *circuitBreaker) {
+	c.breaker = cb
+
+	doRequest := c.doRequest
+	c.doRequest = func(ctx context.Context, cr clientRequest) (clientResponse, error) {
+		trial, err := cb.allow()
+		if err != nil {
+			stats.Record(context.Background(), metrics.RPCCircuitRejected.M(1))
+			return clientResponse{}, &RPCConnectionError{xerrors.Errorf("calling %s: %w", cr.req.Method, err)}
+		}
+
+		resp, err := doRequest(ctx, cr)
+		cb.done(trial, isConnFailure(resp, err), ctx != nil && ctx.Err() != nil)
+		return resp, err
+	}
+
+	if c.doBatch != nil {
+		doBatch := c.doBatch
+		c.doBatch = func(ctx context.Context, reqs []request) ([]clientResponse, error) {
+			trial, err := cb.allow()
+			if err != nil {
+				stats.Record(context.Background(), metrics.RPCCircuitRejected.M(1))
+				return nil, &RPCConnectionError{xerrors.Errorf("sending batch: %w", err)}
+			}
+
+			resps, err := doBatch(ctx, reqs)
+			cb.done(trial, isConnFailure(clientResponse{}, err), ctx != nil && ctx.Err() != nil)
+			return resps, err
+		}
+	}
+}
+
+// CircuitState returns the state of the client circuit breaker, CircuitClosed
+// if the client doesn't have one
+func (c *Client) CircuitState() CircuitState {
+	if c.client.breaker == nil {
+		return CircuitClosed
+	}
+	return c.client.breaker.State()
+}
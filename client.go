@@ -7,11 +7,14 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"reflect"
 	"runtime/pprof"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -73,7 +76,14 @@ type clientResponse struct {
 	Error   *respError      `json:"error,omitempty"`
 }
 
-type makeChanSink func() (context.Context, func([]byte, bool))
+// makeChanSink creates a sink for channel messages. The sink is called with
+// ok=false when the channel is closed, err is set when the channel was closed
+// abnormally (e.g. because the connection was lost).
+type makeChanSink func() (context.Context, func(m []byte, ok bool, err error))
+
+// makeChanSinks is like makeChanSink, for calls returning structs of channels,
+// with sinks keyed by field name
+type makeChanSinks func() (context.Context, map[string]func(m []byte, ok bool, err error))
 
 type clientRequest struct {
 	req   request
@@ -81,6 +91,14 @@ type clientRequest struct {
 
 	// retCh provides a context and sink for handling incoming channel messages
 	retCh makeChanSink
+	// retChs is retCh for calls returning structs of channels
+	retChs makeChanSinks
+
+	// progress is called with progress reports for the request, may be nil
+	progress ProgressFunc
+
+	// trailer receives the trailer of the returned channel, may be nil
+	trailer *StreamTrailer
 }
 
 // ClientCloser is used to close Client from further use
@@ -96,44 +114,315 @@ func NewClient(ctx context.Context, addr string, namespace string, handler inter
 }
 
 type client struct {
-	namespace     string
-	paramEncoders map[reflect.Type]ParamEncoder
-	errors        *Errors
+	paramEncoders   map[reflect.Type]ParamEncoder
+	namespaceCodecs map[string]Codec
+	errors          *Errors
+
+	conflateSubscriptions bool
+
+	protocolVersion string
+	idempotencyKeys bool
+
+	// resultTransform transforms results before decoding, nil if disabled
+	resultTransform func(method string, raw json.RawMessage) (json.RawMessage, error)
 
 	doRequest func(context.Context, clientRequest) (clientResponse, error)
-	exiting   <-chan struct{}
-	idCtr     int64
+	// doBatch sends requests as a single JSON-RPC batch, nil if the transport
+	// doesn't support batches
+	doBatch func(context.Context, []request) ([]clientResponse, error)
+	exiting <-chan struct{}
+	idCtr   int64
+	// idScheme maps idCtr values to request ids, nil for plain numbers
+	idScheme IDScheme
+
+	// breaker is the circuit breaker wrapping doRequest, nil if disabled
+	breaker *circuitBreaker
 }
 
 // NewMergeClient is like NewClient, but allows to specify multiple structs
 // to be filled in the same namespace, using one connection
 func NewMergeClient(ctx context.Context, addr string, namespace string, outs []interface{}, requestHeader http.Header, opts ...Option) (ClientCloser, error) {
+	handlers := make([]clientHandler, len(outs))
+	for i, out := range outs {
+		handlers[i] = clientHandler{namespace, out}
+	}
+
+	return newMergeClient(ctx, addr, handlers, requestHeader, opts...)
+}
+
+// NewNamespacedMergeClient is like NewMergeClient, but fills each proxy struct
+// with calls in its own namespace, keyed by namespace in the handlers map. All
+// proxies share one underlying connection.
+func NewNamespacedMergeClient(ctx context.Context, addr string, handlers map[string]interface{}, requestHeader http.Header, opts ...Option) (ClientCloser, error) {
+	outs := make([]clientHandler, 0, len(handlers))
+	for ns, hnd := range handlers {
+		outs = append(outs, clientHandler{ns, hnd})
+	}
+
+	return newMergeClient(ctx, addr, outs, requestHeader, opts...)
+}
+
+// Client is a jsonrpc 2.0 client which makes calls by method name, which is
+// useful when proxy structs don't fit, e.g. for batches (see Client.NewBatch)
+type Client struct {
+	client *client
+	closer ClientCloser
+}
+
+// Dial creates a new Client for the given address (http(s):// or ws(s)://)
+func Dial(ctx context.Context, addr string, requestHeader http.Header, opts ...Option) (*Client, error) {
+	c, closer, err := newClient(ctx, addr, requestHeader, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		client: c,
+		closer: closer,
+	}, nil
+}
+
+// Call calls the method with the given params, and decodes the result into
+// result, which must be a pointer, or nil to discard the result. The result of
+// a method returning a single value is that value (not wrapped in an array),
+// so result is a pointer to the type the method returns.
+func (c *Client) Call(ctx context.Context, method string, result interface{}, params ...interface{}) error {
+	// checked before the call is made, so that its result isn't lost
+	if err := checkResultTarget(result); err != nil {
+		return &ErrClient{err}
+	}
+
+	codec := c.client.namespaceCodecs[wireNamespace(method)]
+
+	req, err := c.client.makeRequest(codec, method, params)
+	if err != nil {
+		return &ErrClient{err}
+	}
+
+	c.client.setIdempotencyKey(ctx, &req)
+	c.client.setTraceID(ctx, &req)
+
+	resp, err := c.client.sendRequest(ctx, req, nil, nil)
+	if err != nil {
+		return &ErrClient{xerrors.Errorf("sendRequest failed: %w", err)}
+	}
+
+	return c.client.processResult(codec, method, resp, result)
+}
+
+// Close closes the client connection
+func (c *Client) Close() {
+	c.closer()
+}
+
+// Do makes a single call to the method at addr, and decodes the result into
+// out (a pointer, or nil to discard the result). It's meant for scripts and
+// other simple uses; it dials, calls and closes the client each time, so
+// programs making many calls should use Dial instead.
+//
+// http(s) addresses use the default http client of this package. Calls made
+// with Do can't take client options, e.g. custom errors or codecs.
+func Do(ctx context.Context, addr string, method string, out interface{}, params ...interface{}) error {
+	c, err := Dial(ctx, addr, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return c.Call(ctx, method, out, params...)
+}
+
+// makeRequest creates a request for a call made by method name
+func (c *client) makeRequest(codec Codec, method string, params []interface{}) (request, error) {
+	args := make([]reflect.Value, len(params))
+	for i, p := range params {
+		if p == nil {
+			// untyped nil, reflect.ValueOf would return an invalid Value
+			args[i] = reflect.ValueOf(&params[i]).Elem()
+			continue
+		}
+		args[i] = reflect.ValueOf(p)
+	}
+
+	serializedParams, err := c.encodeParams(codec, args)
+	if err != nil {
+		return request{}, err
+	}
+
+	return request{
+		Jsonrpc: c.protocolVersion,
+		ID:      c.nextID(),
+		Method:  method,
+		Params:  serializedParams,
+	}, nil
+}
+
+// setIdempotencyKey sets the idempotency key of the request, either from the
+// context, or a random one if the client has keys enabled
+func (c *client) setIdempotencyKey(ctx context.Context, req *request) {
+	key, ok := idempotencyKey(ctx)
+	if !ok && c.idempotencyKeys {
+		key, ok = uuid.New().String(), true
+	}
+	if !ok {
+		return
+	}
+
+	if req.Meta == nil {
+		req.Meta = map[string]string{}
+	}
+	req.Meta[metaIdempotencyKey] = key
+}
+
+// processResult returns the error from a response to a call made by method
+// name, or decodes the result into out
+func (c *client) processResult(codec Codec, method string, resp clientResponse, out interface{}) error {
+	if resp.Error != nil {
+		return resp.Error.val(c.errors).Interface().(error)
+	}
+
+	if out == nil {
+		return nil
+	}
+	result, err := c.transformResult(method, resp.Result)
+	if err != nil {
+		return &ErrClient{err}
+	}
+	if err := c.decodeResult(codec, result, out); err != nil {
+		return &ErrClient{err}
+	}
+	return nil
+}
+
+func newMergeClient(ctx context.Context, addr string, outs []clientHandler, requestHeader http.Header, opts ...Option) (ClientCloser, error) {
+	c, closer, err := newClient(ctx, addr, requestHeader, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.provide(outs); err != nil {
+		closer()
+		return nil, err
+	}
+
+	return closer, nil
+}
+
+func newClient(ctx context.Context, addr string, requestHeader http.Header, opts ...Option) (*client, ClientCloser, error) {
 	config := defaultConfig()
 	for _, o := range opts {
 		o(&config)
 	}
 
-	u, err := url.Parse(addr)
-	if err != nil {
-		return nil, xerrors.Errorf("parsing address: %w", err)
+	var c *client
+	var closer ClientCloser
+	if config.transport != nil {
+		c, closer = transportClient(config.transport, config)
+	} else {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("parsing address: %w", err)
+		}
+
+		switch u.Scheme {
+		case "ws", "wss":
+			c, closer, err = websocketClient(ctx, addr, requestHeader, config)
+		case "http", "https":
+			c, closer, err = httpClient(ctx, addr, requestHeader, config)
+		default:
+			return nil, nil, xerrors.Errorf("unknown url scheme '%s'", u.Scheme)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
-	switch u.Scheme {
-	case "ws", "wss":
-		return websocketClient(ctx, addr, namespace, outs, requestHeader, config)
-	case "http", "https":
-		return httpClient(ctx, addr, namespace, outs, requestHeader, config)
-	default:
-		return nil, xerrors.Errorf("unknown url scheme '%s'", u.Scheme)
+	if config.followMovedMethods {
+		c.withFollowMovedMethods()
 	}
+	if config.circuitBreaker != nil {
+		c.withCircuitBreaker(newCircuitBreaker(*config.circuitBreaker))
+	}
+
+	return c, closer, nil
+}
 
+// StreamTrailer receives the trailer of a channel returned by a call, see
+// WithStreamTrailer
+type StreamTrailer struct {
+	lk   sync.Mutex
+	meta map[string]string
 }
 
-func httpClient(ctx context.Context, addr string, namespace string, outs []interface{}, requestHeader http.Header, config Config) (ClientCloser, error) {
-	c := client{
-		namespace:     namespace,
-		paramEncoders: config.paramEncoders,
-		errors:        config.errors,
+// Get returns the trailer set by the server with SetStreamTrailer. The trailer
+// is received before the channel is closed, so all keys are available once the
+// channel is closed (unless the connection was lost).
+func (t *StreamTrailer) Get() map[string]string {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	out := make(map[string]string, len(t.meta))
+	for k, v := range t.meta {
+		out[k] = v
+	}
+	return out
+}
+
+func (t *StreamTrailer) set(meta map[string]string) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	t.meta = meta
+}
+
+type clientTrailerKey struct{}
+
+// WithStreamTrailer returns a context which makes the trailer of the channel
+// returned by a websocket call made with it be stored in t, see
+// SetStreamTrailer. It should only be used for a single call.
+func WithStreamTrailer(ctx context.Context, t *StreamTrailer) context.Context {
+	return context.WithValue(ctx, clientTrailerKey{}, t)
+}
+
+func streamTrailer(ctx context.Context) *StreamTrailer {
+	if ctx == nil {
+		return nil
+	}
+	t, _ := ctx.Value(clientTrailerKey{}).(*StreamTrailer)
+	return t
+}
+
+type callHeaderKey struct{}
+
+// WithCallHeader returns a context which makes http calls made with it carry
+// the given headers, in addition to the request headers passed when creating
+// the client (per-call values replace client values of the same header). The
+// headers only apply to calls made with the returned context.
+//
+// Websocket calls share a connection, so per-call headers are ignored there.
+func WithCallHeader(ctx context.Context, header http.Header) context.Context {
+	return context.WithValue(ctx, callHeaderKey{}, header.Clone())
+}
+
+func callHeader(ctx context.Context) http.Header {
+	if ctx == nil {
+		return nil
+	}
+	h, _ := ctx.Value(callHeaderKey{}).(http.Header)
+	return h
+}
+
+func httpClient(ctx context.Context, addr string, requestHeader http.Header, config Config) (*client, ClientCloser, error) {
+	c := &client{
+		paramEncoders:   config.paramEncoders,
+		namespaceCodecs: config.namespaceCodecs,
+		errors:          config.errors,
+
+		conflateSubscriptions: config.conflateSubscriptions,
+
+		protocolVersion: config.protocolVersion,
+		idempotencyKeys: config.idempotencyKeys,
+		resultTransform: config.resultTransform,
 	}
 
 	stop := make(chan struct{})
@@ -143,18 +432,23 @@ func httpClient(ctx context.Context, addr string, namespace string, outs []inter
 		requestHeader = http.Header{}
 	}
 
-	c.doRequest = func(ctx context.Context, cr clientRequest) (clientResponse, error) {
-		b, err := json.Marshal(&cr.req)
-		if err != nil {
-			return clientResponse{}, xerrors.Errorf("marshalling request: %w", err)
+	envelope := newEnvelopeMapping(config.envelopeFields)
+
+	// post sends the marshaled request body, and returns the response body
+	post := func(ctx context.Context, b []byte) ([]byte, error) {
+		if envelope != nil {
+			b = envelope.encode(b)
 		}
 
 		hreq, err := http.NewRequest("POST", addr, bytes.NewReader(b))
 		if err != nil {
-			return clientResponse{}, &RPCConnectionError{err}
+			return nil, &RPCConnectionError{err}
 		}
 
 		hreq.Header = requestHeader.Clone()
+		for k, v := range callHeader(ctx) {
+			hreq.Header[k] = append([]string(nil), v...)
+		}
 
 		if ctx != nil {
 			hreq = hreq.WithContext(ctx)
@@ -162,51 +456,194 @@ func httpClient(ctx context.Context, addr string, namespace string, outs []inter
 
 		hreq.Header.Set("Content-Type", "application/json")
 
+		if config.requestSigner != nil {
+			sig, err := config.requestSigner.sign(hreq.Method, hreq.URL, b)
+			if err != nil {
+				return nil, xerrors.Errorf("signing request: %w", err)
+			}
+			hreq.Header.Set(RequestSignatureHeader, sig)
+		}
+
+		var nonce string
+		if config.signingSecret != nil {
+			nonce, err = newSignatureNonce()
+			if err != nil {
+				return nil, xerrors.Errorf("generating signature nonce: %w", err)
+			}
+			hreq.Header.Set(SignatureNonceHeader, nonce)
+		}
+
 		httpResp, err := config.httpClient.Do(hreq)
 		if err != nil {
-			return clientResponse{}, &RPCConnectionError{err}
+			return nil, &RPCConnectionError{err}
 		}
 
-		// may be fail
-		if httpResp.StatusCode >= http.StatusBadRequest {
-			return clientResponse{}, xerrors.Errorf("request failed, http status %s", httpResp.Status)
+		defer httpResp.Body.Close()
+
+		var body io.Reader = httpResp.Body
+		if config.maxResponseSize > 0 {
+			// read one byte over the limit to detect oversized responses
+			body = io.LimitReader(body, config.maxResponseSize+1)
 		}
 
-		defer httpResp.Body.Close()
+		rb, err := io.ReadAll(body)
+		if err != nil {
+			return nil, xerrors.Errorf("http status %s reading response: %w", httpResp.Status, err)
+		}
+		if config.maxResponseSize > 0 && int64(len(rb)) > config.maxResponseSize {
+			return nil, xerrors.Errorf("response over %d bytes: %w", config.maxResponseSize, ErrResponseTooLarge)
+		}
+
+		decoded := rb
+		if envelope != nil {
+			decoded = envelope.decode(rb)
+		}
+
+		// may be fail; servers send JSON-RPC errors with error statuses, so
+		// only fail if there's no JSON-RPC response in the body (e.g. JSON
+		// error bodies of proxies aren't responses)
+		if httpResp.StatusCode >= http.StatusBadRequest && !isRPCResponse(decoded) {
+			return nil, xerrors.Errorf("request failed, http status %s", httpResp.Status)
+		}
+		if config.signingSecret != nil && !verifyBody(config.signingSecret, nonce, rb, httpResp.Header.Get(SignatureHeader)) {
+			return nil, xerrors.Errorf("http status %s: %w", httpResp.Status, ErrInvalidSignature)
+		}
+
+		return decoded, nil
+	}
+
+	c.doRequest = func(ctx context.Context, cr clientRequest) (clientResponse, error) {
+		b, err := json.Marshal(&cr.req)
+		if err != nil {
+			return clientResponse{}, xerrors.Errorf("marshalling request: %w", err)
+		}
+
+		rb, err := post(ctx, b)
+		if err != nil {
+			return clientResponse{}, err
+		}
 
 		var resp clientResponse
+		if _, bare := config.bareResultMethods[cr.req.Method]; bare && cr.req.ID != nil && !isResponseEnvelope(rb) {
+			return clientResponse{
+				Jsonrpc: c.protocolVersion,
+				ID:      cr.req.ID,
+				Result:  rb,
+			}, nil
+		}
 		if cr.req.ID != nil { // non-notification
-			if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
-				return clientResponse{}, xerrors.Errorf("http status %s unmarshaling response: %w", httpResp.Status, err)
-			}
+			return unmarshalResponse(rb, cr.req.ID, config.lenientResponseIDs)
+		}
 
-			if resp.ID, err = normalizeID(resp.ID); err != nil {
-				return clientResponse{}, xerrors.Errorf("failed to response ID: %w", err)
-			}
+		return resp, nil
+	}
 
-			if resp.ID != cr.req.ID {
-				return clientResponse{}, xerrors.New("request and response id didn't match")
+	c.doBatch = func(ctx context.Context, reqs []request) ([]clientResponse, error) {
+		b, err := json.Marshal(reqs)
+		if err != nil {
+			return nil, xerrors.Errorf("marshalling batch request: %w", err)
+		}
+
+		rb, err := post(ctx, b)
+		if err != nil {
+			return nil, err
+		}
+
+		var resps []clientResponse
+		if len(bytes.TrimSpace(rb)) > 0 { // empty if the batch only has notifications
+			if err := json.Unmarshal(rb, &resps); err != nil {
+				return nil, xerrors.Errorf("unmarshaling batch response: %w", err)
 			}
 		}
 
-		return resp, nil
-	}
+		for i := range resps {
+			if resps[i].ID, err = normalizeID(resps[i].ID); err != nil {
+				return nil, xerrors.Errorf("failed to response ID: %w", err)
+			}
+		}
+		if err := matchBatchIDs(reqs, resps, config.lenientResponseIDs); err != nil {
+			return nil, err
+		}
 
-	if err := c.provide(outs); err != nil {
-		return nil, err
+		return resps, nil
 	}
 
-	return func() {
+	return c, func() {
 		close(stop)
 	}, nil
 }
 
-func websocketClient(ctx context.Context, addr string, namespace string, outs []interface{}, requestHeader http.Header, config Config) (ClientCloser, error) {
+// unmarshalResponse decodes the response to the request with the given id.
+// With lenient, responses with another id are taken as the response to the
+// request.
+func unmarshalResponse(rb []byte, id interface{}, lenient bool) (clientResponse, error) {
+	var resp clientResponse
+	if err := json.Unmarshal(rb, &resp); err != nil {
+		return clientResponse{}, xerrors.Errorf("unmarshaling response: %w", err)
+	}
+
+	var err error
+	if resp.ID, err = normalizeID(resp.ID); err != nil {
+		return clientResponse{}, xerrors.Errorf("failed to response ID: %w", err)
+	}
+
+	if resp.ID != id {
+		if !lenient {
+			return clientResponse{}, xerrors.Errorf("response id %v for request id %v: %w", resp.ID, id, ErrResponseIDMismatch)
+		}
+		log.Debugw("accepting response with a mismatched id", "id", id, "responseID", resp.ID)
+		resp.ID = id
+	}
+
+	return resp, nil
+}
+
+// matchBatchIDs checks that each batch response answers a distinct request of
+// the batch. With lenient, responses with unknown ids are paired in order with
+// requests which have no response.
+func matchBatchIDs(reqs []request, resps []clientResponse, lenient bool) error {
+	pending := map[interface{}]bool{}
+	for _, req := range reqs {
+		if req.ID != nil {
+			pending[req.ID] = true
+		}
+	}
+
+	var unmatched []int
+	for i, resp := range resps {
+		if !pending[resp.ID] {
+			if !lenient {
+				return xerrors.Errorf("batch response %d has unexpected id %v: %w", i, resp.ID, ErrResponseIDMismatch)
+			}
+			unmatched = append(unmatched, i)
+			continue
+		}
+		delete(pending, resp.ID)
+	}
+
+	for _, req := range reqs {
+		if len(unmatched) == 0 {
+			break
+		}
+		if req.ID == nil || !pending[req.ID] {
+			continue
+		}
+		resps[unmatched[0]].ID = req.ID
+		unmatched = unmatched[1:]
+		delete(pending, req.ID)
+	}
+	return nil
+}
+
+func websocketClient(ctx context.Context, addr string, requestHeader http.Header, config Config) (*client, ClientCloser, error) {
 	connFactory := func() (*websocket.Conn, error) {
 		conn, _, err := websocket.DefaultDialer.Dial(addr, requestHeader)
 		if err != nil {
 			return nil, &RPCConnectionError{xerrors.Errorf("cannot dial address %s for %w", addr, err)}
 		}
+		if config.maxResponseSize > 0 {
+			conn.SetReadLimit(config.maxResponseSize)
+		}
 		return conn, nil
 	}
 
@@ -217,17 +654,23 @@ func websocketClient(ctx context.Context, addr string, namespace string, outs []
 
 	conn, err := connFactory()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if config.noReconnect {
 		connFactory = nil
 	}
 
-	c := client{
-		namespace:     namespace,
-		paramEncoders: config.paramEncoders,
-		errors:        config.errors,
+	c := &client{
+		paramEncoders:   config.paramEncoders,
+		namespaceCodecs: config.namespaceCodecs,
+		errors:          config.errors,
+
+		conflateSubscriptions: config.conflateSubscriptions,
+
+		protocolVersion: config.protocolVersion,
+		idempotencyKeys: config.idempotencyKeys,
+		resultTransform: config.resultTransform,
 	}
 
 	requests := c.setupRequestChan()
@@ -238,24 +681,30 @@ func websocketClient(ctx context.Context, addr string, namespace string, outs []
 
 	var hnd reqestHandler
 	if len(config.reverseHandlers) > 0 {
-		h := makeHandler(defaultServerConfig())
+		sc := defaultServerConfig()
+		sc.protocolVersion = config.protocolVersion
+		h := makeHandler(sc)
 		h.aliasedMethods = config.aliasedHandlerMethods
 		for _, reverseHandler := range config.reverseHandlers {
-			h.register(reverseHandler.ns, reverseHandler.hnd)
+			h.register(reverseHandler.ns, reverseHandler.hnd, nil)
 		}
 		hnd = h
 	}
 
 	wconn := &wsConn{
-		conn:             conn,
-		connFactory:      connFactory,
-		reconnectBackoff: config.reconnectBackoff,
-		pingInterval:     config.pingInterval,
-		timeout:          config.timeout,
-		handler:          hnd,
-		requests:         requests,
-		stop:             stop,
-		exiting:          exiting,
+		conn:                conn,
+		connFactory:         connFactory,
+		reconnectBackoff:    config.reconnectBackoff,
+		pingInterval:        config.pingInterval,
+		timeout:             config.timeout,
+		envelope:            newEnvelopeMapping(config.envelopeFields),
+		version:             config.protocolVersion,
+		notifyBatches:       true,
+		onNotificationError: config.onNotificationError,
+		handler:             hnd,
+		requests:            requests,
+		stop:                stop,
+		exiting:             exiting,
 	}
 
 	go func() {
@@ -265,11 +714,7 @@ func websocketClient(ctx context.Context, addr string, namespace string, outs []
 		})
 	}()
 
-	if err := c.provide(outs); err != nil {
-		return nil, err
-	}
-
-	return func() {
+	return c, func() {
 		close(stop)
 		<-exiting
 	}, nil
@@ -308,7 +753,7 @@ func (c *client) setupRequestChan() chan clientRequest {
 
 				cancelReq := clientRequest{
 					req: request{
-						Jsonrpc: "2.0",
+						Jsonrpc: c.protocolVersion,
 						Method:  wsCancel,
 						Params:  rp,
 					},
@@ -329,8 +774,9 @@ func (c *client) setupRequestChan() chan clientRequest {
 	return requests
 }
 
-func (c *client) provide(outs []interface{}) error {
-	for _, handler := range outs {
+func (c *client) provide(outs []clientHandler) error {
+	for _, out := range outs {
+		handler := out.hnd
 		htyp := reflect.TypeOf(handler)
 		if htyp.Kind() != reflect.Ptr {
 			return xerrors.New("expected handler to be a pointer")
@@ -343,7 +789,7 @@ func (c *client) provide(outs []interface{}) error {
 		val := reflect.ValueOf(handler)
 
 		for i := 0; i < typ.NumField(); i++ {
-			fn, err := c.makeRpcFunc(typ.Field(i))
+			fn, err := c.makeRpcFunc(typ.Field(i), out.ns)
 			if err != nil {
 				return err
 			}
@@ -355,16 +801,42 @@ func (c *client) provide(outs []interface{}) error {
 	return nil
 }
 
-func (c *client) makeOutChan(ctx context.Context, ftyp reflect.Type, valOut int) (func() reflect.Value, makeChanSink) {
-	retVal := reflect.Zero(ftyp.Out(valOut))
+// chanItem is a single item delivered to client-side output channels, either
+// a decoded value or an error
+type chanItem struct {
+	val reflect.Value
+	err error
+}
+
+// makeOutChan creates the sink of a returned channel of type chType, with a
+// paired error channel of type errChType unless it's nil
+func (c *client) makeOutChan(ctx context.Context, chType, errChType reflect.Type) (func() reflect.Value, func() reflect.Value, makeChanSink) {
+	retVal := reflect.Zero(chType)
+	retErrCh := reflect.Value{}
+	if errChType != nil {
+		retErrCh = reflect.Zero(errChType)
+	}
 
-	chCtor := func() (context.Context, func([]byte, bool)) {
+	chCtor := func() (context.Context, func([]byte, bool, error)) {
 		// unpack chan type to make sure it's reflect.BothDir
-		ctyp := reflect.ChanOf(reflect.BothDir, ftyp.Out(valOut).Elem())
+		ctyp := reflect.ChanOf(reflect.BothDir, chType.Elem())
 		ch := reflect.MakeChan(ctyp, 0) // todo: buffer?
-		retVal = ch.Convert(ftyp.Out(valOut))
+		retVal = ch.Convert(chType)
 
-		incoming := make(chan reflect.Value, 32)
+		var errCh reflect.Value
+		if errChType != nil {
+			errCh = reflect.MakeChan(reflect.ChanOf(reflect.BothDir, errorType), 0)
+			retErrCh = errCh.Convert(errChType)
+		}
+
+		closeChans := func() {
+			ch.Close()
+			if errCh.IsValid() {
+				errCh.Close()
+			}
+		}
+
+		incoming := make(chan chanItem, 32)
 
 		// gorotuine to handle buffering of items
 		go func() {
@@ -385,23 +857,38 @@ func (c *client) makeOutChan(ctx context.Context, ftyp reflect.Type, valOut int)
 				}
 
 				if front != nil {
-					cases = append(cases, reflect.SelectCase{
-						Dir:  reflect.SelectSend,
-						Chan: ch,
-						Send: front.Value.(reflect.Value).Elem(),
-					})
+					item := front.Value.(chanItem)
+					if item.err != nil {
+						cases = append(cases, reflect.SelectCase{
+							Dir:  reflect.SelectSend,
+							Chan: errCh,
+							Send: reflect.ValueOf(&item.err).Elem(),
+						})
+					} else {
+						cases = append(cases, reflect.SelectCase{
+							Dir:  reflect.SelectSend,
+							Chan: ch,
+							Send: item.val.Elem(),
+						})
+					}
 				}
 
 				chosen, val, ok := reflect.Select(cases)
 
 				switch chosen {
 				case 0:
-					ch.Close()
+					closeChans()
 					return
 				case 1:
 					if ok {
-						vvval := val.Interface().(reflect.Value)
-						buf.PushBack(vvval)
+						item := val.Interface().(chanItem)
+						if c.conflateSubscriptions && item.err == nil {
+							// keep only the latest value not yet received
+							if back := buf.Back(); back != nil && back.Value.(chanItem).err == nil {
+								buf.Remove(back)
+							}
+						}
+						buf.PushBack(item)
 						if buf.Len() > 1 {
 							if buf.Len() > 10 {
 								log.Warnw("rpc output message buffer", "n", buf.Len())
@@ -418,21 +905,38 @@ func (c *client) makeOutChan(ctx context.Context, ftyp reflect.Type, valOut int)
 				}
 
 				if incoming == nil && buf.Len() == 0 {
-					ch.Close()
+					closeChans()
 					return
 				}
 			}
 		}()
 
-		return ctx, func(result []byte, ok bool) {
+		// pushErr queues an error for delivery on the error channel, if the
+		// method has one
+		pushErr := func(err error) {
+			if !errCh.IsValid() {
+				return
+			}
+
+			select {
+			case incoming <- chanItem{err: err}:
+			case <-ctx.Done():
+			}
+		}
+
+		return ctx, func(result []byte, ok bool, err error) {
 			if !ok {
+				if err != nil {
+					pushErr(&ErrClient{err})
+				}
 				close(incoming)
 				return
 			}
 
-			val := reflect.New(ftyp.Out(valOut).Elem())
+			val := reflect.New(chType.Elem())
 			if err := json.Unmarshal(result, val.Interface()); err != nil {
 				log.Errorf("error unmarshaling chan response: %s", err)
+				pushErr(&ErrClient{xerrors.Errorf("unmarshaling chan response: %w", err)})
 				return
 			}
 
@@ -442,21 +946,53 @@ func (c *client) makeOutChan(ctx context.Context, ftyp reflect.Type, valOut int)
 			}
 
 			select {
-			case incoming <- val:
+			case incoming <- chanItem{val: val}:
 			case <-ctx.Done():
 			}
 		}
 	}
 
-	return func() reflect.Value { return retVal }, chCtor
+	return func() reflect.Value { return retVal }, func() reflect.Value { return retErrCh }, chCtor
+}
+
+// makeOutChanStruct creates the sinks of a returned struct of channels (see
+// isChanStruct), keyed by field name. All channels share the call context.
+func (c *client) makeOutChanStruct(ctx context.Context, st reflect.Type) (func() reflect.Value, makeChanSinks) {
+	vals := make([]func() reflect.Value, st.NumField())
+	ctors := make([]makeChanSink, st.NumField())
+	for i := range vals {
+		vals[i], _, ctors[i] = c.makeOutChan(ctx, st.Field(i).Type, nil)
+	}
+
+	retVal := func() reflect.Value {
+		v := reflect.New(st).Elem()
+		for i, val := range vals {
+			v.Field(i).Set(val())
+		}
+		return v
+	}
+
+	chsCtor := func() (context.Context, map[string]func([]byte, bool, error)) {
+		sinks := make(map[string]func([]byte, bool, error), len(ctors))
+		for i, ctor := range ctors {
+			_, sinks[st.Field(i).Name] = ctor()
+		}
+		return ctx, sinks
+	}
+
+	return retVal, chsCtor
 }
 
-func (c *client) sendRequest(ctx context.Context, req request, chCtor makeChanSink) (clientResponse, error) {
+func (c *client) sendRequest(ctx context.Context, req request, chCtor makeChanSink, progress ProgressFunc) (clientResponse, error) {
 	creq := clientRequest{
 		req:   req,
 		ready: make(chan clientResponse, 1),
 
-		retCh: chCtor,
+		retCh:    chCtor,
+		progress: progress,
+	}
+	if chCtor != nil {
+		creq.trailer = streamTrailer(ctx)
 	}
 
 	return c.doRequest(ctx, creq)
@@ -472,23 +1008,50 @@ type rpcFunc struct {
 	valOut int
 	errOut int
 
+	// errChOut is the index of the `<-chan error` return value paired with
+	// a returned value channel, -1 if the method doesn't have one
+	errChOut int
+
+	// snapOut is the index of the snapshot returned with the value channel,
+	// -1 if the method doesn't return one, see isSnapshotStream
+	snapOut int
+
 	// hasCtx is 1 if the function has a context.Context as its first argument.
 	// Used as the number of the first non-context argument.
 	hasCtx int
 
 	hasRawParams         bool
+	hasProgress          bool
 	returnValueIsChannel bool
+	// returnsChanStruct is set for methods returning structs of channels
+	returnsChanStruct bool
 
 	retry  bool
 	notify bool
+
+	// codec is the namespace codec, nil for plain JSON
+	codec Codec
 }
 
-func (fn *rpcFunc) processResponse(resp clientResponse, rval reflect.Value) []reflect.Value {
+func (fn *rpcFunc) processResponse(resp clientResponse, rval, rerrch reflect.Value) []reflect.Value {
 	out := make([]reflect.Value, fn.nout)
 
 	if fn.valOut != -1 {
 		out[fn.valOut] = rval
 	}
+	if fn.errChOut != -1 {
+		out[fn.errChOut] = rerrch
+	}
+	if fn.snapOut != -1 {
+		out[fn.snapOut] = reflect.New(fn.ftyp.Out(fn.snapOut)).Elem()
+		if resp.Error == nil && resp.Result != nil {
+			snapshot, err := decodeSnapshot(resp.Result, fn.ftyp.Out(fn.snapOut))
+			if err != nil {
+				return fn.processError(err)
+			}
+			out[fn.snapOut] = snapshot
+		}
+	}
 	if fn.errOut != -1 {
 		out[fn.errOut] = reflect.New(errorType).Elem()
 		if resp.Error != nil {
@@ -506,6 +1069,12 @@ func (fn *rpcFunc) processError(err error) []reflect.Value {
 	if fn.valOut != -1 {
 		out[fn.valOut] = reflect.New(fn.ftyp.Out(fn.valOut)).Elem()
 	}
+	if fn.errChOut != -1 {
+		out[fn.errChOut] = reflect.New(fn.ftyp.Out(fn.errChOut)).Elem()
+	}
+	if fn.snapOut != -1 {
+		out[fn.snapOut] = reflect.New(fn.ftyp.Out(fn.snapOut)).Elem()
+	}
 	if fn.errOut != -1 {
 		out[fn.errOut] = reflect.New(errorType).Elem()
 		out[fn.errOut].Set(reflect.ValueOf(&ErrClient{err}))
@@ -514,21 +1083,114 @@ func (fn *rpcFunc) processError(err error) []reflect.Value {
 	return out
 }
 
+// encodeParams encodes call args into a JSONRPC param array
+func (c *client) encodeParams(codec Codec, args []reflect.Value) (json.RawMessage, error) {
+	params := make([]param, len(args))
+	for i, arg := range args {
+		enc, found := c.paramEncoders[arg.Type()]
+		if found {
+			// custom param encoder
+			var err error
+			arg, err = enc(arg)
+			if err != nil {
+				return nil, fmt.Errorf("sendRequest failed: %w", err)
+			}
+		}
+
+		if codec != nil {
+			enc, err := encodeCodecValue(codec, arg.Interface())
+			if err != nil {
+				return nil, fmt.Errorf("encoding params failed: %w", err)
+			}
+			arg = reflect.ValueOf(enc)
+		}
+
+		params[i] = param{
+			v: arg,
+		}
+	}
+
+	b, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling params failed: %w", err)
+	}
+	return b, nil
+}
+
+// transformResult applies the client result transform (see
+// WithResultTransform) to a successful call result
+func (c *client) transformResult(method string, result json.RawMessage) (json.RawMessage, error) {
+	if c.resultTransform == nil || result == nil {
+		return result, nil
+	}
+
+	result, err := c.resultTransform(method, result)
+	if err != nil {
+		return nil, xerrors.Errorf("transforming result of '%s': %w", method, err)
+	}
+	return result, nil
+}
+
+// checkResultTarget checks that out can be decoded into: a non-nil pointer, or
+// nil to discard the result
+func checkResultTarget(out interface{}) error {
+	if out == nil {
+		return nil
+	}
+	if v := reflect.ValueOf(out); v.Kind() != reflect.Ptr || v.IsNil() {
+		return xerrors.Errorf("result must be a non-nil pointer, got %T", out)
+	}
+	return nil
+}
+
+// decodeResult decodes a successful call result into out
+func (c *client) decodeResult(codec Codec, result json.RawMessage, out interface{}) error {
+	if result == nil {
+		return nil
+	}
+
+	if codec != nil {
+		if err := decodeCodecValue(codec, result, out); err != nil {
+			return xerrors.Errorf("decoding result: %w", err)
+		}
+		return nil
+	}
+
+	if err := json.Unmarshal(result, out); err != nil {
+		log.Warnw("unmarshaling failed", "message", string(result))
+		return xerrors.Errorf("unmarshaling result: %w", err)
+	}
+	return nil
+}
+
+// nextID returns a new request ID, normalized as it will be decoded from
+// responses
+func (c *client) nextID() interface{} {
+	// We track int64 ids as float64 in the inflight map (because that's what
+	// they'll be decoded to). encoding/json outputs numbers with their minimal
+	// encoding, avoding the decimal point when possible, i.e. 3 will never get
+	// converted to 3.0.
+	seq := atomic.AddInt64(&c.idCtr, 1)
+	if c.idScheme != nil {
+		id, err := normalizeID(c.idScheme(seq))
+		if err == nil {
+			return id
+		}
+		log.Errorf("invalid request id from id scheme: %s", err)
+	}
+	return float64(seq)
+}
+
 func (fn *rpcFunc) handleRpcCall(args []reflect.Value) (results []reflect.Value) {
 	var id interface{}
 	if !fn.notify {
-		id = atomic.AddInt64(&fn.client.idCtr, 1)
+		id = fn.client.nextID()
+	}
 
-		// Prepare the ID to send on the wire.
-		// We track int64 ids as float64 in the inflight map (because that's what
-		// they'll be decoded to). encoding/json outputs numbers with their minimal
-		// encoding, avoding the decimal point when possible, i.e. 3 will never get
-		// converted to 3.0.
-		var err error
-		id, err = normalizeID(id)
-		if err != nil {
-			return fn.processError(fmt.Errorf("failed to normalize id")) // should probably panic
-		}
+	var progress ProgressFunc
+	if fn.hasProgress {
+		progress = args[len(args)-1].Interface().(ProgressFunc)
+		args = args[:len(args)-1]
 	}
 
 	var serializedParams json.RawMessage
@@ -536,26 +1198,10 @@ func (fn *rpcFunc) handleRpcCall(args []reflect.Value) (results []reflect.Value)
 	if fn.hasRawParams {
 		serializedParams = json.RawMessage(args[fn.hasCtx].Interface().(RawParams))
 	} else {
-		params := make([]param, len(args)-fn.hasCtx)
-		for i, arg := range args[fn.hasCtx:] {
-			enc, found := fn.client.paramEncoders[arg.Type()]
-			if found {
-				// custom param encoder
-				var err error
-				arg, err = enc(arg)
-				if err != nil {
-					return fn.processError(fmt.Errorf("sendRequest failed: %w", err))
-				}
-			}
-
-			params[i] = param{
-				v: arg,
-			}
-		}
 		var err error
-		serializedParams, err = json.Marshal(params)
+		serializedParams, err = fn.client.encodeParams(fn.codec, args[fn.hasCtx:])
 		if err != nil {
-			return fn.processError(fmt.Errorf("marshaling params failed: %w", err))
+			return fn.processError(err)
 		}
 	}
 
@@ -568,16 +1214,26 @@ func (fn *rpcFunc) handleRpcCall(args []reflect.Value) (results []reflect.Value)
 	}
 
 	retVal := func() reflect.Value { return reflect.Value{} }
+	retErrCh := func() reflect.Value { return reflect.Value{} }
 
 	// if the function returns a channel, we need to provide a sink for the
 	// messages
 	var chCtor makeChanSink
+	var chsCtor makeChanSinks
 	if fn.returnValueIsChannel {
-		retVal, chCtor = fn.client.makeOutChan(ctx, fn.ftyp, fn.valOut)
+		if fn.returnsChanStruct {
+			retVal, chsCtor = fn.client.makeOutChanStruct(ctx, fn.ftyp.Out(fn.valOut))
+		} else {
+			var errChType reflect.Type
+			if fn.errChOut != -1 {
+				errChType = fn.ftyp.Out(fn.errChOut)
+			}
+			retVal, retErrCh, chCtor = fn.client.makeOutChan(ctx, fn.ftyp.Out(fn.valOut), errChType)
+		}
 	}
 
 	req := request{
-		Jsonrpc: "2.0",
+		Jsonrpc: fn.client.protocolVersion,
 		ID:      id,
 		Method:  fn.name,
 		Params:  serializedParams,
@@ -593,6 +1249,19 @@ func (fn *rpcFunc) handleRpcCall(args []reflect.Value) (results []reflect.Value)
 		}
 	}
 
+	if p, ok := callPriority(ctx); ok {
+		if req.Meta == nil {
+			req.Meta = map[string]string{}
+		}
+		req.Meta[metaPriority] = strconv.Itoa(p)
+	}
+
+	fn.client.setTraceID(ctx, &req)
+
+	if !fn.notify {
+		fn.client.setIdempotencyKey(ctx, &req)
+	}
+
 	b := backoff{
 		maxDelay: methodMaxRetryDelay,
 		minDelay: methodMinRetryDelay,
@@ -603,19 +1272,39 @@ func (fn *rpcFunc) handleRpcCall(args []reflect.Value) (results []reflect.Value)
 	// keep retrying if got a forced closed websocket conn and calling method
 	// has retry annotation
 	for attempt := 0; true; attempt++ {
-		resp, err = fn.client.sendRequest(ctx, req, chCtor)
+		if chsCtor != nil {
+			resp, err = fn.client.doRequest(ctx, clientRequest{
+				req:      req,
+				ready:    make(chan clientResponse, 1),
+				retChs:   chsCtor,
+				progress: progress,
+			})
+		} else {
+			resp, err = fn.client.sendRequest(ctx, req, chCtor, progress)
+		}
 		if err != nil {
 			return fn.processError(fmt.Errorf("sendRequest failed: %w", err))
 		}
 
 		if !fn.notify && resp.ID != req.ID {
-			return fn.processError(xerrors.New("request and response id didn't match"))
+			return fn.processError(ErrResponseIDMismatch)
 		}
 
 		if fn.valOut != -1 && !fn.returnValueIsChannel {
 			val := reflect.New(fn.ftyp.Out(fn.valOut))
 
-			if resp.Result != nil {
+			if resp.Error == nil {
+				resp.Result, err = fn.client.transformResult(fn.name, resp.Result)
+				if err != nil {
+					return fn.processError(err)
+				}
+			}
+
+			if resp.Result != nil && fn.codec != nil && resp.Error == nil {
+				if err := decodeCodecValue(fn.codec, resp.Result, val.Interface()); err != nil {
+					return fn.processError(xerrors.Errorf("decoding result: %w", err))
+				}
+			} else if resp.Result != nil {
 				log.Debugw("rpc result", "type", fn.ftyp.Out(fn.valOut))
 				if err := json.Unmarshal(resp.Result, val.Interface()); err != nil {
 					log.Warnw("unmarshaling failed", "message", string(resp.Result))
@@ -633,7 +1322,7 @@ func (fn *rpcFunc) handleRpcCall(args []reflect.Value) (results []reflect.Value)
 		time.Sleep(b.next(attempt))
 	}
 
-	return fn.processResponse(resp, retVal())
+	return fn.processResponse(resp, retVal(), retErrCh())
 }
 
 const (
@@ -642,13 +1331,13 @@ const (
 	ProxyTagRPCMethod = "rpc_method"
 )
 
-func (c *client) makeRpcFunc(f reflect.StructField) (reflect.Value, error) {
+func (c *client) makeRpcFunc(f reflect.StructField, namespace string) (reflect.Value, error) {
 	ftyp := f.Type
 	if ftyp.Kind() != reflect.Func {
 		return reflect.Value{}, xerrors.New("handler field not a func")
 	}
 
-	name := c.namespace + "." + f.Name
+	name := namespace + "." + f.Name
 	if tag, ok := f.Tag.Lookup(ProxyTagRPCMethod); ok {
 		name = tag
 	}
@@ -659,21 +1348,36 @@ func (c *client) makeRpcFunc(f reflect.StructField) (reflect.Value, error) {
 		name:   name,
 		retry:  f.Tag.Get(ProxyTagRetry) == "true",
 		notify: f.Tag.Get(ProxyTagNotify) == "true",
+		codec:  c.namespaceCodecs[wireNamespace(name)],
+	}
+	fun.errChOut, fun.snapOut = -1, -1
+	switch {
+	case isStreamWithErrors(ftyp):
+		fun.valOut, fun.errChOut, fun.errOut, fun.nout = 0, 1, 2, 3
+	case isSnapshotStream(ftyp):
+		fun.snapOut, fun.valOut, fun.errOut, fun.nout = 0, 1, 2, 3
+	default:
+		fun.valOut, fun.errOut, fun.nout = processFuncOut(ftyp)
 	}
-	fun.valOut, fun.errOut, fun.nout = processFuncOut(ftyp)
 
 	if fun.valOut != -1 && fun.notify {
 		return reflect.Value{}, xerrors.New("notify methods cannot return values")
 	}
 
-	fun.returnValueIsChannel = fun.valOut != -1 && ftyp.Out(fun.valOut).Kind() == reflect.Chan
+	fun.returnsChanStruct = fun.valOut != -1 && isChanStruct(ftyp.Out(fun.valOut))
+	fun.returnValueIsChannel = fun.valOut != -1 && (ftyp.Out(fun.valOut).Kind() == reflect.Chan || fun.returnsChanStruct)
 
 	if ftyp.NumIn() > 0 && ftyp.In(0) == contextType {
 		fun.hasCtx = 1
 	}
+	nIn := ftyp.NumIn()
+	if nIn > fun.hasCtx && ftyp.In(nIn-1) == rtProgressFunc {
+		fun.hasProgress = true
+		nIn--
+	}
 	// note: hasCtx is also the number of the first non-context argument
-	if ftyp.NumIn() > fun.hasCtx && ftyp.In(fun.hasCtx) == rtRawParams {
-		if ftyp.NumIn() > fun.hasCtx+1 {
+	if nIn > fun.hasCtx && ftyp.In(fun.hasCtx) == rtRawParams {
+		if nIn > fun.hasCtx+1 {
 			return reflect.Value{}, xerrors.New("raw params can't be mixed with other arguments")
 		}
 		fun.hasRawParams = true
@@ -0,0 +1,52 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+
+	"golang.org/x/xerrors"
+)
+
+// Codec encodes and decodes param and result values of methods in a namespace.
+//
+// By default all values are encoded as plain JSON. When a namespace is configured
+// with a custom codec (see WithServerNamespaceCodec and WithNamespaceCodec), each
+// param value and the result value of methods in that namespace are encoded with
+// the codec, and embedded in the JSON-RPC envelope as JSON strings containing the
+// base64-encoded codec output. This means that codecs don't need to produce
+// valid JSON, so compact binary formats can be used.
+//
+// Per-namespace codecs don't affect the transport layer - the request / response
+// envelope (jsonrpc, id, method, error, meta) is always JSON, and is what HTTP
+// Content-Type negotiation and websocket framing apply to. The codec can only be
+// selected after the envelope is decoded and the method name is known, so the
+// same endpoint can serve namespaces with different codecs at the same time.
+//
+// Note that channel values and errors are always JSON-encoded.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// encodeCodecValue encodes v with the codec into a JSON-embeddable value
+func encodeCodecValue(c Codec, v interface{}) (json.RawMessage, error) {
+	b, err := c.Marshal(v)
+	if err != nil {
+		return nil, xerrors.Errorf("codec marshal: %w", err)
+	}
+
+	return json.Marshal(b)
+}
+
+// decodeCodecValue decodes a value encoded with encodeCodecValue into v
+func decodeCodecValue(c Codec, data []byte, v interface{}) error {
+	var b []byte
+	if err := json.Unmarshal(data, &b); err != nil {
+		return xerrors.Errorf("unmarshaling codec data: %w", err)
+	}
+
+	if err := c.Unmarshal(b, v); err != nil {
+		return xerrors.Errorf("codec unmarshal: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrNoConnection is returned by Notify for calls which weren't received over a
+// websocket connection, e.g. http calls, which have no way to send the client
+// notifications
+var ErrNoConnection = errors.New("call not received over a websocket connection")
+
+// Connection is a handle of the websocket connection a call was received on,
+// see ConnectionFromContext
+type Connection struct {
+	conn *wsConn
+}
+
+// Subscription is a channel returned by a method, which is forwarded to the
+// client
+type Subscription struct {
+	// ID is the channel id, as sent to the client
+	ID uint64
+
+	// Method is the method which returned the channel
+	Method string
+}
+
+// outSub is an active subscription of a connection
+type outSub struct {
+	method string
+	reqID  interface{}
+}
+
+type connectionKey struct{}
+
+// ConnectionFromContext returns the handle of the websocket connection a call
+// was received on. ok is false for calls received over http.
+func ConnectionFromContext(ctx context.Context) (conn *Connection, ok bool) {
+	conn, ok = ctx.Value(connectionKey{}).(*Connection)
+	return conn, ok
+}
+
+// Subscriptions returns the active subscriptions of the connection, by id. A
+// method returning a struct of channels has a subscription for each channel.
+func (c *Connection) Subscriptions() []Subscription {
+	c.conn.subsLk.Lock()
+	defer c.conn.subsLk.Unlock()
+
+	subs := make([]Subscription, 0, len(c.conn.subs))
+	for id, s := range c.conn.subs {
+		subs = append(subs, Subscription{ID: id, Method: s.method})
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].ID < subs[j].ID
+	})
+	return subs
+}
+
+// CancelSubscription cancels the context of the call which returned the
+// subscription with the given id, like when the client cancels it; the handler
+// is expected to close the channel when the context is done. It returns false
+// if there is no such active subscription. Cancelling one channel of a struct
+// of channels cancels the whole call.
+func (c *Connection) CancelSubscription(id uint64) bool {
+	c.conn.subsLk.Lock()
+	s, ok := c.conn.subs[id]
+	c.conn.subsLk.Unlock()
+	if !ok {
+		return false
+	}
+
+	c.conn.handlingLk.Lock()
+	defer c.conn.handlingLk.Unlock()
+
+	cancel, ok := c.conn.handling[s.reqID]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// CancelAllSubscriptions cancels all active subscriptions of the connection,
+// see CancelSubscription
+func (c *Connection) CancelAllSubscriptions() {
+	for _, s := range c.Subscriptions() {
+		c.CancelSubscription(s.ID)
+	}
+}
+
+// Notify sends a notification (a request without an id) calling method with
+// params to the client on the connection, e.g. to report progress of a call
+// before it returns. Clients handle it like calls to their handlers, see
+// WithClientHandler.
+func (c *Connection) Notify(method string, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	rp, err := json.Marshal(params)
+	if err != nil {
+		return xerrors.Errorf("marshaling notification params: %w", err)
+	}
+
+	return c.conn.sendRequest(request{
+		Jsonrpc: c.conn.version,
+		Method:  method,
+		Params:  rp,
+	})
+}
+
+// Notify sends a notification to the client on the websocket connection the
+// call handled with ctx was received on, see Connection.Notify. Notifications
+// sent before the handler returns reach the client before the response. It
+// returns ErrNoConnection for calls received over http.
+func Notify(ctx context.Context, method string, params ...interface{}) error {
+	conn, ok := ConnectionFromContext(ctx)
+	if !ok {
+		return ErrNoConnection
+	}
+	return conn.Notify(method, params...)
+}
@@ -0,0 +1,166 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+const jsonContentType = "application/json"
+
+// contentCodecs are codecs for http request and response bodies, keyed by
+// media type, see WithCodecForContentType
+type contentCodecs map[string]Codec
+
+// negotiate selects the codecs for the request body (by Content-Type) and for
+// the response body (by Accept, falling back to the request codec). Nil codecs
+// mean JSON.
+func (cc contentCodecs) negotiate(r *http.Request) (reqCodec Codec, respCodec Codec, respType string) {
+	reqType := mediaType(r.Header.Get("Content-Type"))
+	reqCodec = cc[reqType]
+
+	respCodec, respType = reqCodec, reqType
+	if accept := r.Header.Get("Accept"); accept != "" {
+		for _, part := range strings.Split(accept, ",") {
+			t := mediaType(part)
+			if t == jsonContentType {
+				return reqCodec, nil, t
+			}
+			if c, ok := cc[t]; ok {
+				return reqCodec, c, t
+			}
+		}
+	}
+
+	return reqCodec, respCodec, respType
+}
+
+func mediaType(v string) string {
+	t, _, err := mime.ParseMediaType(strings.TrimSpace(v))
+	if err != nil {
+		return ""
+	}
+	return t
+}
+
+// transcode re-encodes a body from one codec to another, through generic
+// values. Nil codecs are JSON. JSON numbers are decoded as json.Number, and
+// passed to other codecs as int64 or uint64 if they're integers which fit, so
+// they don't lose precision as float64.
+func transcode(data []byte, from, to Codec) ([]byte, error) {
+	var v interface{}
+	if from == nil {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		if to != nil {
+			v = nativeNumbers(v)
+		}
+	} else if err := from.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+
+	if to == nil {
+		return json.Marshal(v)
+	}
+	return to.Marshal(v)
+}
+
+// nativeNumbers converts json.Number values in generic JSON values to int64,
+// uint64 or float64
+func nativeNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			return u
+		}
+		f, _ := strconv.ParseFloat(v.String(), 64)
+		return f
+	case []interface{}:
+		for i, e := range v {
+			v[i] = nativeNumbers(e)
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = nativeNumbers(e)
+		}
+	}
+	return v
+}
+
+// decodeBody returns the request body transcoded to JSON. Oversized bodies are
+// passed through (truncated past the limit) for the handler to reject.
+func decodeBody(r io.Reader, codec Codec, maxSize int64) (io.Reader, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return bytes.NewReader(data), nil
+	}
+
+	js, err := transcode(data, codec, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding request body: %w", err)
+	}
+	return bytes.NewReader(js), nil
+}
+
+// codecResponseWriter buffers the JSON response, so that it can be encoded
+// with the response codec before it's sent
+type codecResponseWriter struct {
+	http.ResponseWriter
+	buf    bytes.Buffer
+	status int
+}
+
+func (w *codecResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *codecResponseWriter) Write(b []byte) (int, error) {
+	return w.buf.Write(b)
+}
+
+// flush writes the buffered response encoded with the codec. Responses which
+// aren't JSON (e.g. text output of methods with io.Writer params) are written
+// unchanged.
+func (w *codecResponseWriter) flush(codec Codec, contentType string) error {
+	if t := mediaType(w.ResponseWriter.Header().Get("Content-Type")); t != "" && t != jsonContentType {
+		if w.status != 0 {
+			w.ResponseWriter.WriteHeader(w.status)
+		}
+		_, err := w.ResponseWriter.Write(w.buf.Bytes())
+		return err
+	}
+
+	var out []byte
+	if w.buf.Len() > 0 {
+		var err error
+		out, err = transcode(w.buf.Bytes(), nil, codec)
+		if err != nil {
+			w.ResponseWriter.WriteHeader(http.StatusInternalServerError)
+			return xerrors.Errorf("encoding response body: %w", err)
+		}
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", contentType)
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	_, err := w.ResponseWriter.Write(out)
+	return err
+}
@@ -0,0 +1,48 @@
+package jsonrpc
+
+import (
+	"sync"
+	"time"
+)
+
+// notificationDedup remembers recently handled notifications, see
+// WithNotificationDedup
+type notificationDedup struct {
+	ttl time.Duration
+
+	lk        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+func newNotificationDedup(ttl time.Duration) *notificationDedup {
+	return &notificationDedup{
+		ttl:       ttl,
+		seen:      map[string]time.Time{},
+		lastSweep: time.Now(),
+	}
+}
+
+// repeated returns true if a notification with the key was handled within the
+// ttl, otherwise it records the key as handled now
+func (d *notificationDedup) repeated(key string) bool {
+	now := time.Now()
+
+	d.lk.Lock()
+	defer d.lk.Unlock()
+
+	if now.Sub(d.lastSweep) > d.ttl {
+		for k, at := range d.seen {
+			if now.Sub(at) > d.ttl {
+				delete(d.seen, k)
+			}
+		}
+		d.lastSweep = now
+	}
+
+	if at, ok := d.seen[key]; ok && now.Sub(at) <= d.ttl {
+		return true
+	}
+	d.seen[key] = now
+	return false
+}
@@ -0,0 +1,109 @@
+package jsonrpc
+
+import (
+	"encoding"
+	"reflect"
+	"strconv"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// defaultTag is the struct tag with default values of struct param fields,
+// see WithParamDefaults
+const defaultTag = "default"
+
+var (
+	durationType        = reflect.TypeOf(time.Duration(0))
+	textUnmarshalerType = reflect.TypeOf(new(encoding.TextUnmarshaler)).Elem()
+)
+
+// setParamDefaults sets the default values of the struct param pointed to by
+// v, before it's decoded, so that fields omitted by the client keep them, and
+// fields sent explicitly (even as zero values) override them
+func setParamDefaults(v reflect.Value) error {
+	t := v.Type().Elem()
+	switch {
+	case t.Kind() == reflect.Struct:
+		return setStructDefaults(v.Elem())
+	case t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct:
+		sv := reflect.New(t.Elem())
+		if err := setStructDefaults(sv.Elem()); err != nil {
+			return err
+		}
+		v.Elem().Set(sv)
+	}
+	return nil
+}
+
+func setStructDefaults(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+
+		def, ok := f.Tag.Lookup(defaultTag)
+		if !ok {
+			// nested structs get their own defaults
+			if f.Type.Kind() == reflect.Struct {
+				if err := setStructDefaults(v.Field(i)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if err := setDefault(v.Field(i), def); err != nil {
+			return xerrors.Errorf("default of field %s.%s: %w", t.Name(), f.Name, err)
+		}
+	}
+	return nil
+}
+
+func setDefault(f reflect.Value, def string) error {
+	if reflect.PtrTo(f.Type()).Implements(textUnmarshalerType) {
+		return f.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(def))
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(def)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(def)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if f.Type() == durationType {
+			d, err := time.ParseDuration(def)
+			if err != nil {
+				return err
+			}
+			f.SetInt(int64(d))
+			return nil
+		}
+		n, err := strconv.ParseInt(def, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(def, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(def, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	default:
+		return xerrors.Errorf("defaults not supported for type %s", f.Type())
+	}
+	return nil
+}
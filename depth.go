@@ -0,0 +1,93 @@
+package jsonrpc
+
+import (
+	"bytes"
+
+	"golang.org/x/xerrors"
+)
+
+// checkJSONDepth returns an error if arrays and objects in data are nested
+// deeper than max. It only scans the bytes, without decoding anything, so it's
+// cheap to run before decoding untrusted input. Malformed JSON is left for the
+// decoder to reject.
+func checkJSONDepth(data []byte, max int) error {
+	depth := 0
+	inString := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inString {
+			switch c {
+			case '\\':
+				i++ // skip the escaped byte
+			case '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inString = true
+		case '[', '{':
+			depth++
+			if depth > max {
+				return xerrors.Errorf("params nested deeper than the maximum depth of %d", max)
+			}
+		case ']', '}':
+			depth--
+		}
+	}
+	return nil
+}
+
+// countParams returns the number of elements of a params array, 0 if params
+// aren't an array. Like checkJSONDepth it only scans the bytes.
+func countParams(data []byte) int {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '[' {
+		return 0
+	}
+
+	// depth is relative to the params array
+	depth := 0
+	commas := 0
+	empty := true
+	inString := false
+scan:
+	for i := 1; i < len(data); i++ {
+		c := data[i]
+		if inString {
+			switch c {
+			case '\\':
+				i++ // skip the escaped byte
+			case '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '"':
+			inString = true
+		case '[', '{':
+			depth++
+		case ']', '}':
+			if depth == 0 {
+				break scan // end of the params array
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				commas++
+			}
+		}
+		empty = false
+	}
+
+	if empty {
+		return 0
+	}
+	return commas + 1
+}
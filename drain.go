@@ -0,0 +1,77 @@
+package jsonrpc
+
+import (
+	"context"
+	"sync"
+)
+
+// drain tracks calls being handled, so that the server can stop taking new
+// calls and wait for the handled ones to return, see RPCServer.Shutdown
+type drain struct {
+	lk       sync.Mutex
+	draining bool
+	inflight int
+
+	// idle is closed once draining and no calls are handled
+	idle chan struct{}
+}
+
+// enter registers a new call, returning false if the server is draining
+func (d *drain) enter() bool {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+
+	if d.draining {
+		return false
+	}
+	d.inflight++
+	return true
+}
+
+// exit unregisters a call registered with enter
+func (d *drain) exit() {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+
+	d.inflight--
+	if d.draining && d.inflight == 0 {
+		close(d.idle)
+	}
+}
+
+// start starts draining, returning a channel closed once no calls are handled
+func (d *drain) start() <-chan struct{} {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+
+	if !d.draining {
+		d.draining = true
+		d.idle = make(chan struct{})
+		if d.inflight == 0 {
+			close(d.idle)
+		}
+	}
+	return d.idle
+}
+
+// Shutdown starts draining the server: new calls are rejected with a server
+// draining error (code -32004), which tells clients to retry the call on
+// another server, while calls being handled run to completion. Shutdown
+// returns once all handled calls returned, or with the context error if ctx is
+// done first. The server can't be used again after Shutdown.
+//
+// Shutdown doesn't close connections, and doesn't stop channels returned by
+// methods; it's meant to be called before shutting down the http server
+// serving the RPCServer (e.g. with http.Server.Shutdown). Once the handled
+// calls returned, the goroutines of the worker pool (see WithWorkerPool) exit.
+func (s *RPCServer) Shutdown(ctx context.Context) error {
+	select {
+	case <-s.drain.start():
+		if s.workers != nil {
+			s.workers.close()
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
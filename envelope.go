@@ -0,0 +1,124 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+// EnvelopeFields configures the JSON field names used in the request / response
+// envelope, making it possible to talk to servers and clients speaking
+// near-JSON-RPC dialects (e.g. using "func" instead of "method"). Empty fields
+// keep the standard names.
+//
+// Only top-level envelope fields are renamed (in batches, top-level fields of
+// each batch element), param and result values are never modified.
+type EnvelopeFields struct {
+	Method string // "method"
+	Params string // "params"
+	Result string // "result"
+	Error  string // "error"
+}
+
+// envelopeMapping renames envelope fields on the wire
+type envelopeMapping struct {
+	toWire   map[string]string
+	fromWire map[string]string
+}
+
+// newEnvelopeMapping returns nil if the fields don't change any names
+func newEnvelopeMapping(f EnvelopeFields) *envelopeMapping {
+	m := &envelopeMapping{
+		toWire:   map[string]string{},
+		fromWire: map[string]string{},
+	}
+
+	for std, custom := range map[string]string{
+		"method": f.Method,
+		"params": f.Params,
+		"result": f.Result,
+		"error":  f.Error,
+	} {
+		if custom == "" || custom == std {
+			continue
+		}
+		m.toWire[std] = custom
+		m.fromWire[custom] = std
+	}
+
+	if len(m.toWire) == 0 {
+		return nil
+	}
+	return m
+}
+
+// encode renames standard envelope fields to their wire names
+func (m *envelopeMapping) encode(data []byte) []byte {
+	return renameFields(data, m.toWire)
+}
+
+// decode renames wire envelope fields to their standard names
+func (m *envelopeMapping) decode(data []byte) []byte {
+	return renameFields(data, m.fromWire)
+}
+
+// renameFields renames top-level fields of a JSON object, or of objects in a
+// JSON array. Data which can't be parsed is returned unchanged, so that the
+// usual parse errors are reported.
+func renameFields(data []byte, names map[string]string) []byte {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return data
+	}
+
+	if trimmed[0] == '[' {
+		var elems []json.RawMessage
+		if err := json.Unmarshal(trimmed, &elems); err != nil {
+			return data
+		}
+		for i, elem := range elems {
+			elems[i] = renameFields(elem, names)
+		}
+		out, err := json.Marshal(elems)
+		if err != nil {
+			return data
+		}
+		return out
+	}
+
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(trimmed, &obj); err != nil {
+		return data
+	}
+	renamed := make(map[string]json.RawMessage, len(obj))
+	for k, v := range obj {
+		if n, ok := names[k]; ok {
+			k = n
+		}
+		renamed[k] = v
+	}
+	out, err := json.Marshal(renamed)
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+// envelopeResponseWriter buffers the response body, so that envelope fields
+// can be renamed before it's sent
+type envelopeResponseWriter struct {
+	http.ResponseWriter
+	buf bytes.Buffer
+}
+
+func (w *envelopeResponseWriter) Write(b []byte) (int, error) {
+	return w.buf.Write(b)
+}
+
+func (w *envelopeResponseWriter) flush(m *envelopeMapping) error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(m.encode(w.buf.Bytes()))
+	return err
+}
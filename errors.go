@@ -3,11 +3,102 @@ package jsonrpc
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"reflect"
 )
 
 const eTempWSError = -1111111
 
+// ErrNoResponse can be returned by handlers (possibly wrapped) to make the
+// server not send any response to the call, even if the request had an id.
+//
+// This is NOT standard JSON-RPC behaviour, and is meant for advanced cases like
+// gateways implementing event sinks; callers waiting for a response will never
+// get one (over http the response body is empty). Don't use it for methods
+// called by regular clients.
+var ErrNoResponse = errors.New("no response")
+
+// ErrResponseTooLarge is returned by the client when a response exceeds the
+// size set with WithMaxResponseSize
+var ErrResponseTooLarge = errors.New("response exceeds maximum size")
+
+// ErrResponseIDMismatch is returned by calls answered with a response whose id
+// isn't the id of the request, unless the client has WithLenientResponseIDs
+var ErrResponseIDMismatch = errors.New("request and response id didn't match")
+
+// Error is an error with an explicit JSON-RPC error code. When returned by a
+// handler (possibly wrapped), the server sends it with its code instead of the
+// code of a registered error type. See ErrInvalidParams and others for errors
+// with the codes reserved by the spec.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ErrInvalidRequest returns an Error with the spec's invalid request code
+// (-32600)
+func ErrInvalidRequest(msg string) error {
+	return &Error{Code: InvalidRequest, Message: msg}
+}
+
+// ErrMethodNotFound returns an Error with the spec's method not found code
+// (-32601), e.g. for handlers dispatching methods themselves
+func ErrMethodNotFound(method string) error {
+	return &Error{Code: MethodNotFound, Message: fmt.Sprintf("method '%s' not found", method)}
+}
+
+// ErrInvalidParams returns an Error with the spec's invalid params code (-32602),
+// for params which decode but aren't valid
+func ErrInvalidParams(msg string) error {
+	return &Error{Code: InvalidParams, Message: msg}
+}
+
+// ErrInternal returns an Error with the spec's internal error code (-32603)
+func ErrInternal(msg string) error {
+	return &Error{Code: InternalError, Message: msg}
+}
+
+// dataError is an error sent with the given error data (the "data" field of
+// the JSON-RPC error object)
+type dataError struct {
+	err  error
+	data interface{}
+}
+
+func (e *dataError) Error() string {
+	return e.err.Error()
+}
+
+func (e *dataError) Unwrap() error {
+	return e.err
+}
+
+// ErrorWithData returns an error which, when returned by a handler, is sent
+// with data encoded as the "data" field of the JSON-RPC error object. Clients
+// can decode the data into a concrete type with Errors.RegisterErrorData.
+func ErrorWithData(err error, data interface{}) error {
+	return &dataError{err: err, data: data}
+}
+
+// errorData returns the error data of the error, nil if it has none
+func errorData(err error) json.RawMessage {
+	var de *dataError
+	if !errors.As(err, &de) {
+		return nil
+	}
+
+	data, merr := json.Marshal(de.data)
+	if merr != nil {
+		log.Warnf("failed to marshal error data: %s", merr)
+		return nil
+	}
+	return data
+}
+
 type RPCConnectionError struct {
 	err error
 }
@@ -29,10 +120,60 @@ func (e *RPCConnectionError) Unwrap() error {
 type Errors struct {
 	byType map[reflect.Type]ErrorCode
 	byCode map[ErrorCode]reflect.Type
+
+	dataByCode map[ErrorCode]reflect.Type
 }
 
 type ErrorCode int
 
+// Error codes reserved by the JSON-RPC 2.0 spec
+const (
+	ParseError     ErrorCode = -32700
+	InvalidRequest ErrorCode = -32600
+	MethodNotFound ErrorCode = -32601
+	InvalidParams  ErrorCode = -32602
+	InternalError  ErrorCode = -32603
+
+	// ServerErrorMin and ServerErrorMax bound the range of implementation-defined
+	// server errors
+	ServerErrorMin ErrorCode = -32099
+	ServerErrorMax ErrorCode = -32000
+)
+
+// Server error codes sent by this package
+const (
+	// ServerBusy is sent for calls rejected because of connection or worker
+	// pool limits, see WithMaxInflightPerConn and WithWorkerPool
+	ServerBusy ErrorCode = -32001
+
+	// AccessDenied is sent for calls to methods not in the method allowlist,
+	// see WithMethodAllowlistFunc
+	AccessDenied ErrorCode = -32002
+
+	// MethodMoved is sent for calls to moved methods, see
+	// RPCServer.RegisterMovedMethod
+	MethodMoved ErrorCode = -32003
+
+	// ServerDraining is sent for calls received after RPCServer.Shutdown
+	ServerDraining ErrorCode = -32004
+
+	// RequestCancelled is sent for calls cancelled by the client, the same
+	// code as used by LSP
+	RequestCancelled ErrorCode = -32800
+)
+
+// IsReserved checks if the code is in the range reserved by the spec for
+// pre-defined errors (-32768 to -32000)
+func (c ErrorCode) IsReserved() bool {
+	return c >= -32768 && c <= -32000
+}
+
+// IsServerError checks if the code is in the range of implementation-defined
+// server errors (-32099 to -32000)
+func (c ErrorCode) IsServerError() bool {
+	return c >= ServerErrorMin && c <= ServerErrorMax
+}
+
 const FirstUserCode = 2
 
 func NewErrors() Errors {
@@ -41,6 +182,7 @@ func NewErrors() Errors {
 		byCode: map[ErrorCode]reflect.Type{
 			-1111111: reflect.TypeOf(&RPCConnectionError{}),
 		},
+		dataByCode: map[ErrorCode]reflect.Type{},
 	}
 }
 
@@ -54,6 +196,36 @@ func (e *Errors) Register(c ErrorCode, typ interface{}) {
 	e.byCode[c] = rt
 }
 
+// RegisterErrorData associates the type of prototype with the error code. On
+// the client, the data of errors with the code is decoded into a value of that
+// type, which can be extracted from the returned error with ErrorDataAs, or
+// with errors.As if the type implements error. On the server, errors with the
+// code carrying data of another type (see ErrorWithData) are logged.
+//
+// Errors with codes registered with Register are returned as the registered
+// error type, and don't carry decoded data.
+func (e *Errors) RegisterErrorData(c ErrorCode, prototype interface{}) {
+	if prototype == nil {
+		panic("can't register nil error data prototype")
+	}
+	if e.dataByCode == nil {
+		e.dataByCode = map[ErrorCode]reflect.Type{}
+	}
+	e.dataByCode[c] = reflect.TypeOf(prototype)
+}
+
+// ErrorDataAs returns the error data of an error returned by the client,
+// decoded into the type registered with Errors.RegisterErrorData for its code
+func ErrorDataAs[T any](err error) (T, bool) {
+	var re *respError
+	if errors.As(err, &re) {
+		if d, ok := re.data.(T); ok {
+			return d, true
+		}
+	}
+	return *new(T), false
+}
+
 type marshalable interface {
 	json.Marshaler
 	json.Unmarshaler
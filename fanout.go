@@ -0,0 +1,77 @@
+package jsonrpc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// FanOutResult is the result of the call to one of the clients passed to
+// FanOut
+type FanOutResult[T any] struct {
+	Result T
+	Err    error
+}
+
+// FanOut makes the same call on all clients concurrently, e.g. for quorum
+// reads, and returns the results in the order of clients once all calls
+// finished. Cancelling ctx cancels the calls still in flight.
+func FanOut[T any](ctx context.Context, clients []*Client, method string, params ...interface{}) []FanOutResult[T] {
+	results := make([]FanOutResult[T], len(clients))
+
+	done := make(chan struct{}, len(clients))
+	for i, c := range clients {
+		go func(i int, c *Client) {
+			defer func() { done <- struct{}{} }()
+			results[i].Err = c.Call(ctx, method, &results[i].Result, params...)
+		}(i, c)
+	}
+	for range clients {
+		<-done
+	}
+
+	return results
+}
+
+// FirstSuccess makes the same call on all clients concurrently, and returns the
+// first successful result. The remaining calls are cancelled as soon as one
+// succeeds, without waiting for them to finish. If all calls fail, the returned
+// error lists the errors of all clients.
+func FirstSuccess[T any](ctx context.Context, clients []*Client, method string, params ...interface{}) (T, error) {
+	var zero T
+	if len(clients) == 0 {
+		return zero, xerrors.New("no clients")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type indexed struct {
+		i int
+		FanOutResult[T]
+	}
+
+	// buffered, so that calls finishing after we returned don't block
+	results := make(chan indexed, len(clients))
+	for i, c := range clients {
+		go func(i int, c *Client) {
+			var r indexed
+			r.i = i
+			r.Err = c.Call(ctx, method, &r.Result, params...)
+			results <- r
+		}(i, c)
+	}
+
+	errs := make([]string, len(clients))
+	for range clients {
+		r := <-results
+		if r.Err == nil {
+			return r.Result, nil
+		}
+		errs[r.i] = fmt.Sprintf("client %d: %s", r.i, r.Err)
+	}
+
+	return zero, xerrors.Errorf("all %d calls to '%s' failed: %s", len(clients), method, strings.Join(errs, "; "))
+}
@@ -5,9 +5,15 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
@@ -24,6 +30,95 @@ type RawParams json.RawMessage
 
 var rtRawParams = reflect.TypeOf(RawParams{})
 
+// ProgressFunc is a progress callback, which handlers can accept as their last
+// parameter to report progress of long-running calls. It isn't a JSONRPC param,
+// instead over websocket each call sends a `xrpc.progress` notification with
+// params [requestID, progress] to the client. In http mode, and for notifications,
+// progress reports are discarded. Progress reported after the handler returns is
+// also discarded.
+//
+// On the client side, a ProgressFunc as the last param of a proxy func is called
+// with progress reports for the call. It's called from the connection read loop,
+// so it shouldn't block.
+type ProgressFunc = func(progress float64)
+
+var rtProgressFunc = reflect.TypeOf(ProgressFunc(nil))
+
+type notificationKey struct{}
+
+type responseMetaKey struct{}
+
+// responseMeta collects response meta set by a handler
+type responseMeta struct {
+	lk   sync.Mutex
+	meta map[string]string
+}
+
+// SetResponseMeta sets a key in the "meta" object of the response to the call
+// handled with ctx, e.g. to return pagination cursors alongside the result.
+// This is a non-standard extension, which needs to be enabled on the server
+// with WithResponseMeta, otherwise (and outside of handlers) it's a no-op.
+func SetResponseMeta(ctx context.Context, key, value string) {
+	rm, ok := ctx.Value(responseMetaKey{}).(*responseMeta)
+	if !ok {
+		return
+	}
+
+	rm.lk.Lock()
+	defer rm.lk.Unlock()
+	rm.meta[key] = value
+}
+
+type streamTrailerKey struct{}
+
+// SetStreamTrailer sets a key in the trailer of the channel returned by the
+// method handled with ctx, e.g. the total number of items produced. The trailer
+// is sent to the client after the last value, when the channel is closed, see
+// WithStreamTrailer. Keys must be set before the channel is closed. For methods
+// which don't return channels (and outside of handlers) it's a no-op.
+func SetStreamTrailer(ctx context.Context, key, value string) {
+	t, ok := ctx.Value(streamTrailerKey{}).(*responseMeta)
+	if !ok {
+		return
+	}
+
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if t.meta == nil {
+		log.Warnw("stream trailer set after the channel was closed", "key", key)
+		return
+	}
+	t.meta[key] = value
+}
+
+type batchSizeKey struct{}
+
+func withBatchSize(ctx context.Context, size int) context.Context {
+	return context.WithValue(ctx, batchSizeKey{}, size)
+}
+
+// InBatch returns true if the handler was invoked by a call which is part of a
+// JSON-RPC batch, e.g. so that handlers can share work between the calls of a batch
+func InBatch(ctx context.Context) bool {
+	_, ok := ctx.Value(batchSizeKey{}).(int)
+	return ok
+}
+
+// BatchSize returns the number of calls in the batch the handler was invoked
+// by (including notifications and malformed calls), 0 outside of batches
+func BatchSize(ctx context.Context) int {
+	n, _ := ctx.Value(batchSizeKey{}).(int)
+	return n
+}
+
+// IsNotification returns true if the handler was invoked by a notification (a
+// call without an id), in which case the result will not be sent to the caller,
+// so handlers can skip building it.
+func IsNotification(ctx context.Context) bool {
+	n, _ := ctx.Value(notificationKey{}).(bool)
+	return n
+}
+
 // todo is there a better way to tell 'struct with any number of fields'?
 func DecodeParams[T any](p RawParams) (T, error) {
 	var t T
@@ -44,9 +139,22 @@ type methodHandler struct {
 
 	hasCtx       int
 	hasRawParams bool
+	hasProgress  bool
 
 	errOut int
 	valOut int
+
+	// snapOut is the index of the snapshot returned with the value channel,
+	// -1 if the method doesn't return one, see isSnapshotStream
+	snapOut int
+
+	// structFields are JSON names of the fields of the param of methods with a
+	// single struct param, which can also be called with named (object) or
+	// per-field positional params with WithStructParams
+	structFields []string
+
+	// codec is the namespace codec, nil for plain JSON
+	codec Codec
 }
 
 // Request / response
@@ -59,6 +167,13 @@ type request struct {
 	Meta    map[string]string `json:"meta,omitempty"`
 }
 
+// Request meta keys used for opting into non-standard response extensions, and
+// the response meta keys they produce.
+const (
+	metaResponseTiming = "ResponseTiming"
+	metaServerDuration = "ServerDuration"
+)
+
 // Limit request size. Ideally this limit should be specific for each field
 // in the JSON request but as a simple defensive measure we just limit the
 // entire HTTP body.
@@ -69,10 +184,15 @@ type respError struct {
 	Code    ErrorCode       `json:"code"`
 	Message string          `json:"message"`
 	Meta    json.RawMessage `json:"meta,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+
+	// data is Data decoded into the type registered for the code, set on the
+	// client side
+	data interface{}
 }
 
 func (e *respError) Error() string {
-	if e.Code >= -32768 && e.Code <= -32000 {
+	if e.Code.IsReserved() {
 		return fmt.Sprintf("RPC error (%d): %s", e.Code, e.Message)
 	}
 	return e.Message
@@ -100,14 +220,52 @@ func (e *respError) val(errors *Errors) reflect.Value {
 		}
 	}
 
+	if errors != nil && len(e.Data) > 0 {
+		if t, ok := errors.dataByCode[e.Code]; ok {
+			v := reflect.New(t)
+			if err := json.Unmarshal(e.Data, v.Interface()); err != nil {
+				log.Warnf("failed to decode data of error %d: %s", e.Code, err)
+			} else {
+				e.data = v.Elem().Interface()
+			}
+		}
+	}
+
 	return reflect.ValueOf(e)
 }
 
+// As makes the error available to errors.As as an *Error with the same code
+// and message, and the decoded error data as its type
+func (e *respError) As(target interface{}) bool {
+	if t, ok := target.(**Error); ok {
+		*t = &Error{Code: e.Code, Message: e.Message}
+		return true
+	}
+
+	if e.data == nil {
+		return false
+	}
+
+	tv := reflect.ValueOf(target)
+	if tv.Kind() != reflect.Ptr || tv.IsNil() {
+		return false
+	}
+	dv := reflect.ValueOf(e.data)
+	if !dv.Type().AssignableTo(tv.Elem().Type()) {
+		return false
+	}
+	tv.Elem().Set(dv)
+	return true
+}
+
 type response struct {
 	Jsonrpc string
 	Result  interface{}
 	ID      interface{}
 	Error   *respError
+
+	// Meta is a non-standard extension, only emitted when not empty
+	Meta map[string]string
 }
 
 func (r response) MarshalJSON() ([]byte, error) {
@@ -127,84 +285,397 @@ func (r response) MarshalJSON() ([]byte, error) {
 	} else {
 		data["result"] = r.Result
 	}
+	if len(r.Meta) > 0 {
+		data["meta"] = r.Meta
+	}
 	return json.Marshal(data)
 }
 
+// jsonIndent configures pretty-printing of responses, see WithIndent
+type jsonIndent struct {
+	prefix string
+	indent string
+}
+
+// apply pretty-prints encoded JSON, i may be nil for compact output
+func (i *jsonIndent) apply(data []byte) []byte {
+	if i == nil {
+		return data
+	}
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, i.prefix, i.indent); err != nil {
+		return data
+	}
+	return buf.Bytes()
+}
+
 type handler struct {
 	methods map[string]methodHandler
 	errors  *Errors
 
 	maxRequestSize int64
 
+	// namespaces are the namespaces of registered wire method names, used for
+	// telling apart unknown namespaces from unknown methods
+	namespaces map[string]struct{}
+
 	// aliasedMethods contains a map of alias:original method names.
 	// These are used as fallbacks if a method is not found by the given method name.
 	aliasedMethods map[string]string
 
-	paramDecoders map[reflect.Type]ParamDecoder
+	// movedMethods maps names of moved methods to their new names, see
+	// RPCServer.RegisterMovedMethod
+	movedMethods map[string]string
+
+	// methodRewrite rewrites method names before lookup, nil if disabled
+	methodRewrite func(method string) string
+
+	// paramInterceptor modifies params before decoding, nil if disabled
+	paramInterceptor ParamInterceptor
+
+	// maxJSONDepth limits nesting in params, 0 for no limit
+	maxJSONDepth int
+
+	// maxParams limits the number of params, 0 for no limit
+	maxParams int
+
+	// paramSchemas validate params of methods, by method name
+	paramSchemas map[string]*paramSchema
+
+	// strictBody rejects http requests with data after the request
+	strictBody bool
+
+	paramDecoders   map[reflect.Type]ParamDecoder
+	namespaceCodecs map[string]Codec
+
+	responseTiming bool
+	traceIDs       bool
+	responseMeta   bool
+
+	// envelope renames envelope fields on the wire, nil for standard names
+	envelope *envelopeMapping
+
+	lenientParams   bool
+	structParams    bool
+	numericCoercion bool
+	paramDefaults   bool
+	streamingArrays bool
+
+	// largeResponseThreshold is the size of responses handled according to
+	// largeResponseMode, 0 if disabled
+	largeResponseThreshold int
+	largeResponseMode      LargeResponseMode
+
+	// backpressure is the default policy of returned channels
+	backpressure Backpressure
+
+	// errorTypes are error types registered with RegisterErrorType, in
+	// registration order
+	errorTypes []registeredErrorType
+
+	// protocolVersion is the emitted and accepted "jsonrpc" version
+	protocolVersion string
+	rpcError        rpcErrFunc
+
+	// idempotency deduplicates calls with idempotency keys, nil if disabled
+	idempotency *idempotencyCache
+	// callerIdentity scopes idempotency keys and cached results to callers,
+	// nil if not set with WithCallerIdentity, see cacheCaller
+	callerIdentity CallerIdentity
+
+	// methodCache caches results of methods with caching enabled
+	methodCache methodCaches
+
+	// notificationDedup skips repeated notifications, nil if disabled
+	notificationDedup *notificationDedup
+
+	// indent pretty-prints responses, nil for compact responses
+	indent *jsonIndent
+
+	// wireLogger logs requests and responses, nil if disabled
+	wireLogger    WireLogger
+	wireLogFormat WireLogFormat
+	redaction     redactionRules
+
+	// protocolErrorHandler is called for requests rejected for format reasons,
+	// nil if not set
+	protocolErrorHandler ProtocolErrorHandler
+
+	// methodAllowlist computes the methods callable on a connection, nil if
+	// all methods can be called
+	methodAllowlist MethodAllowlistFunc
+
+	// drain tracks handled calls for RPCServer.Shutdown
+	drain drain
+
+	// resultMarshalers encode results of registered types
+	resultMarshalers map[reflect.Type]ResultMarshaler
+
+	// adaptiveTimeouts bounds calls by their method latency, nil if disabled
+	adaptiveTimeouts *adaptiveTimeouts
+
+	// invokeFunc calls methods instead of calling them directly, nil if not
+	// set
+	invokeFunc InvokeFunc
+
+	// baseLogger is the logger call loggers are derived from, nil if calls
+	// don't get loggers
+	baseLogger *zap.SugaredLogger
+
+	// notificationErrorHandler is called with errors of notifications, nil if
+	// not set. notificationErrorFrames sends them to websocket clients.
+	notificationErrorHandler NotificationErrorHandler
+	notificationErrorFrames  bool
+}
+
+type registeredErrorType struct {
+	typ  reflect.Type
+	code ErrorCode
 }
 
 func makeHandler(sc ServerConfig) *handler {
-	return &handler{
+	h := &handler{
 		methods: make(map[string]methodHandler),
 		errors:  sc.errors,
 
-		aliasedMethods: map[string]string{},
-		paramDecoders:  sc.paramDecoders,
+		namespaces:       map[string]struct{}{},
+		aliasedMethods:   map[string]string{},
+		movedMethods:     map[string]string{},
+		resultMarshalers: map[reflect.Type]ResultMarshaler{},
+		methodRewrite:    sc.methodRewrite,
+		paramInterceptor: sc.paramInterceptor,
+		maxJSONDepth:     sc.maxJSONDepth,
+		maxParams:        sc.maxParams,
+		paramSchemas:     sc.paramSchemas,
+		strictBody:       sc.strictBody,
+		paramDecoders:    sc.paramDecoders,
+		namespaceCodecs:  sc.namespaceCodecs,
 
 		maxRequestSize: sc.maxRequestSize,
+
+		responseTiming: sc.responseTiming,
+		traceIDs:       sc.traceIDs,
+		responseMeta:   sc.responseMeta,
+
+		envelope: newEnvelopeMapping(sc.envelopeFields),
+
+		lenientParams:   sc.lenientParams,
+		structParams:    sc.structParams,
+		numericCoercion: sc.numericCoercion,
+		paramDefaults:   sc.paramDefaults,
+		backpressure:    sc.backpressure,
+
+		streamingArrays: sc.streamingArrays,
+
+		largeResponseThreshold: sc.largeResponseThreshold,
+		largeResponseMode:      sc.largeResponseMode,
+
+		protocolVersion: sc.protocolVersion,
+		rpcError:        makeRPCError(sc.protocolVersion, sc.indent),
+
+		indent: sc.indent,
+
+		methodCache: newMethodCaches(sc.methodCacheTTL, sc.cacheStore),
+
+		wireLogger:    sc.wireLogger,
+		wireLogFormat: sc.wireLogFormat,
+		redaction:     sc.redaction,
+
+		methodAllowlist:      sc.methodAllowlist,
+		protocolErrorHandler: sc.protocolErrorHandler,
+
+		invokeFunc: sc.invokeFunc,
+		baseLogger: sc.baseLogger,
+
+		notificationErrorHandler: sc.notificationErrorHandler,
+		notificationErrorFrames:  sc.notificationErrorFrames,
+	}
+	if sc.idempotencyTTL > 0 {
+		h.idempotency = newIdempotencyCache(sc.idempotencyTTL, sc.idempotencyStore)
 	}
+	h.callerIdentity = sc.callerIdentity
+	if sc.notificationDedupTTL > 0 {
+		h.notificationDedup = newNotificationDedup(sc.notificationDedupTTL)
+	}
+	if sc.adaptiveTimeoutFactor > 0 {
+		h.adaptiveTimeouts = newAdaptiveTimeouts(sc.adaptiveTimeoutFactor)
+	}
+	return h
 }
 
 // Register
 
-func (s *handler) register(namespace string, r interface{}) {
+// MethodNameFunc produces the wire name of a registered method from the
+// namespace and the Go method name, see RPCServer.RegisterWithMethodNames
+type MethodNameFunc func(namespace, method string) string
+
+func defaultMethodName(namespace, method string) string {
+	return namespace + "." + method
+}
+
+func (s *handler) register(namespace string, r interface{}, methodName MethodNameFunc) {
 	val := reflect.ValueOf(r)
 	// TODO: expect ptr
 
+	if methodName == nil {
+		methodName = defaultMethodName
+	}
+
 	for i := 0; i < val.NumMethod(); i++ {
 		method := val.Type().Method(i)
+		s.registerMethod(namespace, methodName(namespace, method.Name), method.Func, val)
+	}
+}
 
-		funcType := method.Func.Type()
-		hasCtx := 0
-		if funcType.NumIn() >= 2 && funcType.In(1) == contextType {
-			hasCtx = 1
+// registerFuncs registers plain funcs as methods of the namespace. Each func
+// is wrapped into a func taking an unused receiver, so that it's called like
+// the methods of a registered handler.
+func (s *handler) registerFuncs(namespace string, funcs map[string]interface{}) error {
+	var invalid []string
+	for name, f := range funcs {
+		if err := validateHandlerFunc(reflect.TypeOf(f)); err != nil {
+			invalid = append(invalid, fmt.Sprintf("'%s': %s", name, err))
 		}
+	}
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return xerrors.Errorf("invalid funcs in namespace '%s': %s", namespace, strings.Join(invalid, "; "))
+	}
 
-		hasRawParams := false
-		ins := funcType.NumIn() - 1 - hasCtx
-		recvs := make([]reflect.Type, ins)
-		for i := 0; i < ins; i++ {
-			if hasRawParams && i > 0 {
-				panic("raw params must be the last parameter")
-			}
-			if funcType.In(i+1+hasCtx) == rtRawParams {
-				hasRawParams = true
-			}
-			recvs[i] = method.Type.In(i + 1 + hasCtx)
+	receiver := reflect.ValueOf(struct{}{})
+	for name, f := range funcs {
+		fn := reflect.ValueOf(f)
+		funcType := fn.Type()
+
+		ins := make([]reflect.Type, funcType.NumIn()+1)
+		ins[0] = receiver.Type()
+		for i := 0; i < funcType.NumIn(); i++ {
+			ins[i+1] = funcType.In(i)
+		}
+		outs := make([]reflect.Type, funcType.NumOut())
+		for i := range outs {
+			outs[i] = funcType.Out(i)
 		}
 
-		valOut, errOut, _ := processFuncOut(funcType)
+		wrapped := reflect.MakeFunc(reflect.FuncOf(ins, outs, false), func(args []reflect.Value) []reflect.Value {
+			return fn.Call(args[1:])
+		})
+		s.registerMethod(namespace, defaultMethodName(namespace, name), wrapped, receiver)
+	}
+	return nil
+}
 
-		s.methods[namespace+"."+method.Name] = methodHandler{
-			paramReceivers: recvs,
-			nParams:        ins,
+// validateHandlerFunc checks that a func can be registered as a method,
+// without a receiver
+func validateHandlerFunc(funcType reflect.Type) error {
+	if funcType == nil || funcType.Kind() != reflect.Func {
+		return xerrors.Errorf("expected a func, got %v", funcType)
+	}
+	if funcType.IsVariadic() {
+		return xerrors.New("variadic funcs aren't supported")
+	}
 
-			handlerFunc: method.Func,
-			receiver:    val,
+	start := 0
+	if funcType.NumIn() > 0 && funcType.In(0) == contextType {
+		start = 1
+	}
+	end := funcType.NumIn()
+	if end > start && funcType.In(end-1) == rtProgressFunc {
+		end--
+	}
+	for i := start; i < end-1; i++ {
+		if funcType.In(i) == rtRawParams {
+			return xerrors.New("raw params must be the last parameter")
+		}
+	}
 
-			hasCtx:       hasCtx,
-			hasRawParams: hasRawParams,
+	switch funcType.NumOut() {
+	case 0, 1:
+	case 2:
+		if funcType.Out(1) != errorType {
+			return xerrors.New("expected error as second return value")
+		}
+	default:
+		return xerrors.Errorf("too many return values: %s", funcType)
+	}
+	return nil
+}
 
-			errOut: errOut,
-			valOut: valOut,
+// registerMethod registers fn, a func taking receiver as the first param, under
+// the wire name
+func (s *handler) registerMethod(namespace, name string, fn reflect.Value, receiver reflect.Value) {
+	funcType := fn.Type()
+	hasCtx := 0
+	if funcType.NumIn() >= 2 && funcType.In(1) == contextType {
+		hasCtx = 1
+	}
+
+	hasRawParams := false
+	ins := funcType.NumIn() - 1 - hasCtx
+	hasProgress := ins > 0 && funcType.In(funcType.NumIn()-1) == rtProgressFunc
+	if hasProgress {
+		ins--
+	}
+	recvs := make([]reflect.Type, ins)
+	for i := 0; i < ins; i++ {
+		if hasRawParams && i > 0 {
+			panic("raw params must be the last parameter")
+		}
+		if funcType.In(i+1+hasCtx) == rtRawParams {
+			hasRawParams = true
 		}
+		recvs[i] = funcType.In(i + 1 + hasCtx)
+	}
+
+	snapOut := -1
+	var valOut, errOut int
+	if isSnapshotStream(funcType) {
+		snapOut, valOut, errOut = 0, 1, 2
+	} else {
+		valOut, errOut, _ = processFuncOut(funcType)
+	}
+
+	var structFields []string
+	if ins == 1 && !hasRawParams && positionalStruct(recvs[0]) {
+		structFields = jsonFieldNames(recvs[0])
+	}
+
+	s.namespaces[wireNamespace(name)] = struct{}{}
+
+	s.methods[name] = methodHandler{
+		paramReceivers: recvs,
+		nParams:        ins,
+
+		handlerFunc: fn,
+		receiver:    receiver,
+
+		hasCtx:       hasCtx,
+		hasRawParams: hasRawParams,
+		hasProgress:  hasProgress,
+
+		errOut:  errOut,
+		valOut:  valOut,
+		snapOut: snapOut,
+
+		structFields: structFields,
+
+		codec: s.namespaceCodecs[namespace],
 	}
 }
 
 // Handle
 
+// ParamInterceptor is called with the method and params of each call before
+// the params are decoded, see WithParamInterceptor. It returns the params to
+// decode, which may be modified (e.g. with normalized values or injected
+// defaults); returning an error rejects the call with an invalid params error.
+// Object params of methods with a single struct param (or in lenient mode)
+// are passed as a single param. Methods taking RawParams aren't intercepted.
+type ParamInterceptor func(method string, params []json.RawMessage) ([]json.RawMessage, error)
+
 type rpcErrFunc func(w func(func(io.Writer)), req *request, code ErrorCode, err error)
-type chanOut func(reflect.Value, interface{}) error
+type chanOut func(ch reflect.Value, snapshot reflect.Value, id interface{}, method string, trailer *responseMeta, backpressure Backpressure) error
 
 func (s *handler) handleReader(ctx context.Context, r io.Reader, w io.Writer, rpcError rpcErrFunc) {
 	wf := func(cb func(io.Writer)) {
@@ -224,64 +695,116 @@ func (s *handler) handleReader(ctx context.Context, r io.Reader, w io.Writer, rp
 	if err != nil {
 		// ReadFrom will discard EOF so any error here is unexpected and should
 		// be reported.
-		rpcError(wf, nil, rpcParseError, xerrors.Errorf("reading request: %w", err))
+		rpcError(wf, nil, ParseError, xerrors.Errorf("reading request: %w", err))
 		return
 	}
 	if reqSize > s.maxRequestSize {
-		rpcError(wf, nil, rpcParseError,
-			// rpcParseError is the closest we have from the standard errors defined
-			// in [jsonrpc spec](https://www.jsonrpc.org/specification#error_object)
-			// to report the maximum limit.
-			xerrors.Errorf("request bigger than maximum %d allowed",
-				s.maxRequestSize))
+		err := xerrors.Errorf("request bigger than maximum %d allowed", s.maxRequestSize)
+		s.protocolError(ctx, bufferedRequest.Bytes(), err)
+		// ParseError is the closest we have from the standard errors defined
+		// in [jsonrpc spec](https://www.jsonrpc.org/specification#error_object)
+		// to report the maximum limit.
+		rpcError(wf, nil, ParseError, err)
 		return
 	}
 
+	if s.envelope != nil {
+		bufferedRequest = bytes.NewBuffer(s.envelope.decode(bufferedRequest.Bytes()))
+	}
+
 	// Trim spaces to avoid issues with batch request detection.
 	bufferedRequest = bytes.NewBuffer(bytes.TrimSpace(bufferedRequest.Bytes()))
 	reqSize = int64(bufferedRequest.Len())
 
 	if reqSize == 0 {
-		rpcError(wf, nil, rpcInvalidRequest, xerrors.New("Invalid request"))
+		s.protocolError(ctx, nil, xerrors.New("empty request"))
+		rpcError(wf, nil, InvalidRequest, xerrors.New("Invalid request"))
 		return
 	}
 
 	if bufferedRequest.Bytes()[0] == '[' && bufferedRequest.Bytes()[reqSize-1] == ']' {
-		var reqs []request
-
-		if err := json.NewDecoder(bufferedRequest).Decode(&reqs); err != nil {
-			rpcError(wf, nil, rpcParseError, xerrors.New("Parse error"))
+		reqs, err := decodeBatch(bufferedRequest.Bytes())
+		if err != nil {
+			s.protocolError(ctx, bufferedRequest.Bytes(), xerrors.Errorf("parsing batch: %w", err))
+			rpcError(wf, nil, ParseError, xerrors.New("Parse error"))
 			return
 		}
 
 		if len(reqs) == 0 {
-			rpcError(wf, nil, rpcInvalidRequest, xerrors.New("Invalid request"))
+			s.protocolError(ctx, bufferedRequest.Bytes(), xerrors.New("empty batch"))
+			rpcError(wf, nil, InvalidRequest, xerrors.New("Invalid request"))
 			return
 		}
 
-		_, _ = w.Write([]byte("[")) // todo consider handling this error
-		for idx, req := range reqs {
+		// Each element is handled into its own buffer, so that responses are
+		// only emitted for elements which need one. Per the spec notifications
+		// aren't answered (not even with errors), and if the batch only contains
+		// notifications nothing is written at all. Responses are written in
+		// request order and echo the request id as-is, so reused ids are fine.
+		// writer params (see outputStream) aren't supported in batches
+		ctx := context.WithValue(ctx, outputStreamKey{}, (*outputStream)(nil))
+		ctx = withBatchSize(ctx, len(reqs))
+
+		var resps [][]byte
+		for _, breq := range reqs {
+			var buf bytes.Buffer
+			ewf := func(cb func(io.Writer)) {
+				cb(&buf)
+			}
+
+			if breq.err != nil {
+				// malformed elements get their own error, with a null id
+				s.protocolError(ctx, breq.raw, breq.err)
+				rpcError(ewf, nil, InvalidRequest, breq.err)
+				resps = append(resps, bytes.TrimSpace(buf.Bytes()))
+				continue
+			}
+			req := breq.req
+
 			if req.ID, err = normalizeID(req.ID); err != nil {
-				rpcError(wf, &req, rpcParseError, xerrors.Errorf("failed to parse ID: %w", err))
-				return
+				s.protocolError(ctx, breq.raw, xerrors.Errorf("failed to parse ID: %w", err))
+				// we can't tell which request this was, reply with a null id
+				rpcError(ewf, &req, ParseError, xerrors.Errorf("failed to parse ID: %w", err))
+				resps = append(resps, bytes.TrimSpace(buf.Bytes()))
+				continue
 			}
 
-			s.handle(ctx, req, wf, rpcError, func(bool) {}, nil)
+			s.handle(ctx, req, ewf, rpcError, func(bool) {}, nil)
 
-			if idx != len(reqs)-1 {
-				_, _ = w.Write([]byte(",")) // todo consider handling this error
+			if req.ID == nil || buf.Len() == 0 {
+				continue
 			}
+			resps = append(resps, bytes.TrimSpace(buf.Bytes()))
 		}
-		_, _ = w.Write([]byte("]")) // todo consider handling this error
+
+		if len(resps) == 0 {
+			return
+		}
+
+		out := []byte("[")
+		out = append(out, bytes.Join(resps, []byte(","))...)
+		out = append(out, ']')
+		_, _ = w.Write(s.indent.apply(out)) // todo consider handling this error
 	} else {
+		raw := bufferedRequest.Bytes()
+
 		var req request
-		if err := json.NewDecoder(bufferedRequest).Decode(&req); err != nil {
-			rpcError(wf, &req, rpcParseError, xerrors.New("Parse error"))
+		decode := json.NewDecoder(bufferedRequest).Decode
+		if s.strictBody {
+			// unlike the decoder, Unmarshal rejects data after the request
+			decode = func(v interface{}) error {
+				return json.Unmarshal(raw, v)
+			}
+		}
+		if err := decode(&req); err != nil {
+			s.protocolError(ctx, raw, xerrors.Errorf("parsing request: %w", err))
+			rpcError(wf, &req, ParseError, xerrors.New("Parse error"))
 			return
 		}
 
 		if req.ID, err = normalizeID(req.ID); err != nil {
-			rpcError(wf, &req, rpcParseError, xerrors.Errorf("failed to parse ID: %w", err))
+			s.protocolError(ctx, raw, xerrors.Errorf("failed to parse ID: %w", err))
+			rpcError(wf, &req, ParseError, xerrors.Errorf("failed to parse ID: %w", err))
 			return
 		}
 
@@ -289,7 +812,61 @@ func (s *handler) handleReader(ctx context.Context, r io.Reader, w io.Writer, rp
 	}
 }
 
-func doCall(methodName string, f reflect.Value, params []reflect.Value) (out []reflect.Value, err error) {
+// ProtocolError describes a request rejected for version or format reasons,
+// see WithProtocolErrorHandler
+type ProtocolError struct {
+	// Raw is the rejected request; for batches, the rejected element if only
+	// the element was rejected. Requests rejected after parsing (e.g. for the
+	// jsonrpc version) are re-encoded, so they may differ in formatting from the
+	// bytes received.
+	Raw []byte
+	// Reason is why the request was rejected
+	Reason error
+}
+
+// ProtocolErrorHandler is called with requests rejected for version or format
+// reasons, see WithProtocolErrorHandler
+type ProtocolErrorHandler func(ctx context.Context, perr ProtocolError)
+
+func (s *handler) protocolError(ctx context.Context, raw []byte, reason error) {
+	if s.protocolErrorHandler == nil {
+		return
+	}
+	s.protocolErrorHandler(ctx, ProtocolError{Raw: raw, Reason: reason})
+}
+
+// batchRequest is an element of a batch, err is set for elements which aren't
+// valid requests
+type batchRequest struct {
+	req request
+	raw json.RawMessage
+	err error
+}
+
+// decodeBatch decodes the elements of a batch separately, so that a malformed
+// element doesn't fail the whole batch. It only errors if data isn't a JSON
+// array.
+func decodeBatch(data []byte) ([]batchRequest, error) {
+	var elems []json.RawMessage
+	if err := json.Unmarshal(data, &elems); err != nil {
+		return nil, err
+	}
+
+	reqs := make([]batchRequest, len(elems))
+	for i, elem := range elems {
+		reqs[i].raw = elem
+		if !isJSONObject(elem) {
+			reqs[i].err = xerrors.Errorf("Invalid request: batch element %d is not an object", i)
+			continue
+		}
+		if err := json.Unmarshal(elem, &reqs[i].req); err != nil {
+			reqs[i].err = xerrors.Errorf("Invalid request: batch element %d: %w", i, err)
+		}
+	}
+	return reqs, nil
+}
+
+func doCall(methodName string, call func() []reflect.Value) (out []reflect.Value, err error) {
 	defer func() {
 		if i := recover(); i != nil {
 			err = xerrors.Errorf("panic in rpc method '%s': %s", methodName, i)
@@ -297,7 +874,7 @@ func doCall(methodName string, f reflect.Value, params []reflect.Value) (out []r
 		}
 	}()
 
-	out = f.Call(params)
+	out = call()
 	return out, nil
 }
 
@@ -330,19 +907,49 @@ func (s *handler) getSpan(ctx context.Context, req request) (context.Context, *t
 
 func (s *handler) createError(err error) *respError {
 	var code ErrorCode = 1
-	if s.errors != nil {
+	var found bool
+
+	// errors with explicit codes take precedence over registered error types
+	var coded *Error
+	if errors.As(err, &coded) {
+		code = coded.Code
+		found = true
+	} else if s.errors != nil {
 		c, ok := s.errors.byType[reflect.TypeOf(err)]
 		if ok {
 			code = c
+			found = true
+		}
+	}
+
+	// fall back to error types registered with RegisterErrorType, which also
+	// match wrapped errors
+	metaErr := err
+	if !found {
+		for _, et := range s.errorTypes {
+			target := reflect.New(et.typ)
+			if errors.As(err, target.Interface()) {
+				code = et.code
+				metaErr = target.Elem().Interface().(error)
+				break
+			}
 		}
 	}
 
 	out := &respError{
 		Code:    code,
 		Message: err.Error(),
+		Data:    errorData(err),
 	}
 
-	if m, ok := err.(marshalable); ok {
+	if s.errors != nil && out.Data != nil {
+		var de *dataError
+		if t, ok := s.errors.dataByCode[code]; ok && errors.As(err, &de) && reflect.TypeOf(de.data) != t {
+			log.Warnf("error %d sent with data of type %T, registered data type is %s", code, de.data, t)
+		}
+	}
+
+	if m, ok := metaErr.(marshalable); ok {
 		meta, err := m.MarshalJSON()
 		if err == nil {
 			out.Meta = meta
@@ -352,114 +959,532 @@ func (s *handler) createError(err error) *respError {
 	return out
 }
 
+// sendProgress sends a progress notification for the call identified by id
+func (s *handler) sendProgress(w func(func(io.Writer)), id interface{}, progress float64) {
+	params, err := json.Marshal([]param{{v: reflect.ValueOf(id)}, {v: reflect.ValueOf(progress)}})
+	if err != nil {
+		log.Errorw("marshaling progress params failed", "err", err)
+		return
+	}
+
+	w(func(w io.Writer) {
+		if err := json.NewEncoder(w).Encode(request{
+			Jsonrpc: s.protocolVersion,
+			ID:      nil, // notification
+			Method:  wsProgress,
+			Params:  params,
+		}); err != nil {
+			log.Warnf("sending progress failed: %s", err)
+		}
+	})
+}
+
+// rewriteMethod applies the method rewrite to the method name of a call,
+// returning false if the call is rejected
+func (s *handler) rewriteMethod(method string) (string, bool) {
+	if s.methodRewrite == nil {
+		return method, true
+	}
+	rewritten := s.methodRewrite(method)
+	if rewritten == "" {
+		return method, false
+	}
+	return rewritten, true
+}
+
+// lookupMethod finds the handler of a method, falling back to aliases
+func (s *handler) lookupMethod(method string) (methodHandler, bool) {
+	handler, ok := s.methods[method]
+	if !ok {
+		aliasTo, ok := s.aliasedMethods[method]
+		if ok {
+			handler, ok = s.methods[aliasTo]
+		}
+		return handler, ok
+	}
+	return handler, true
+}
+
+// wireNamespace returns the namespace part of a wire method name, everything
+// before the last dot
+func wireNamespace(method string) string {
+	if i := strings.LastIndex(method, "."); i >= 0 {
+		return method[:i]
+	}
+	return ""
+}
+
+// methodNotFoundData is the error data of method not found errors
+type methodNotFoundData struct {
+	Namespace       string `json:"namespace"`
+	NamespaceExists bool   `json:"namespaceExists"`
+}
+
+// methodNotFound returns the error for calls to unknown methods, with error
+// data telling if the namespace of the method is registered
+func (s *handler) methodNotFound(method string) error {
+	ns := wireNamespace(method)
+	_, nsExists := s.namespaces[ns]
+
+	err := fmt.Errorf("method '%s' not found", method)
+	if !nsExists && ns != "" {
+		err = fmt.Errorf("method '%s' not found (namespace '%s' not registered)", method, ns)
+	}
+
+	return &dataError{
+		err:  err,
+		data: methodNotFoundData{Namespace: ns, NamespaceExists: nsExists},
+	}
+}
+
+// paramErrorData is the error data of param decoding errors
+type paramErrorData struct {
+	// Param is the index of the param which failed to decode
+	Param int `json:"param"`
+}
+
+func paramError(i int, err error) error {
+	return &dataError{err: err, data: paramErrorData{Param: i}}
+}
+
+// isEmptyParams checks if the params are missing, null or an empty array
+func isEmptyParams(params json.RawMessage) bool {
+	p := bytes.TrimSpace(params)
+	if len(p) == 0 || string(p) == "null" {
+		return true
+	}
+	if p[0] != '[' || p[len(p)-1] != ']' {
+		return false
+	}
+	return len(bytes.TrimSpace(p[1:len(p)-1])) == 0
+}
+
+// decodeParams decodes the params of a call to the method handler, returning
+// the param values (not including the context and progress callback), or the
+// error code and error to reply with
+func (s *handler) decodeParams(ctx context.Context, req request, handler methodHandler) ([]reflect.Value, ErrorCode, error) {
+	if s.maxParams > 0 {
+		if n := countParams(req.Params); n > s.maxParams {
+			return nil, InvalidParams, xerrors.Errorf("too many params for '%s': got %d, the maximum is %d", req.Method, n, s.maxParams)
+		}
+	}
+
+	if s.maxJSONDepth > 0 {
+		if err := checkJSONDepth(req.Params, s.maxJSONDepth); err != nil {
+			return nil, InvalidParams, xerrors.Errorf("decoding params for '%s': %w", req.Method, err)
+		}
+	}
+
+	if ps, ok := s.paramSchemas[req.Method]; ok {
+		if err := ps.validate(req.Method, req.Params); err != nil {
+			return nil, InvalidParams, err
+		}
+	}
+
+	if handler.hasRawParams {
+		// When hasRawParams is true, there is only one parameter and it is a
+		// json.RawMessage.
+
+		return []reflect.Value{reflect.ValueOf(RawParams(req.Params))}, 0, nil
+	}
+
+	if handler.nParams == 0 && isEmptyParams(req.Params) && s.paramInterceptor == nil {
+		// fast path for methods without params, nothing to decode
+		return nil, 0, nil
+	}
+
+	// "normal" param list; no good way to do named params in Golang
+
+	structParam := s.structParams && handler.structFields != nil && handler.codec == nil
+	if structParam {
+		_, customDecoder := s.paramDecoders[handler.paramReceivers[0]]
+		structParam = !customDecoder
+	}
+
+	var ps []param
+	if (s.lenientParams || structParam) && handler.nParams == 1 && isJSONObject(req.Params) {
+		// lenient mode / struct param: bare object param for a one-param method
+		ps = []param{{data: req.Params}}
+	} else if len(req.Params) > 0 {
+		err := json.Unmarshal(req.Params, &ps)
+		if err != nil {
+			return nil, ParseError, xerrors.Errorf("unmarshaling param array: %w", err)
+		}
+	}
+
+	if s.paramInterceptor != nil {
+		raw := make([]json.RawMessage, len(ps))
+		for i, p := range ps {
+			raw[i] = p.data
+		}
+		raw, err := s.paramInterceptor(req.Method, raw)
+		if err != nil {
+			return nil, InvalidParams, xerrors.Errorf("params of '%s' rejected: %w", req.Method, err)
+		}
+		ps = make([]param, len(raw))
+		for i, p := range raw {
+			ps[i] = param{data: p}
+		}
+	}
+
+	// a single object is the struct param itself, otherwise params map to
+	// struct fields by position
+	if structParam && len(ps) > 0 && !(len(ps) == 1 && isJSONObject(ps[0].data)) && len(ps) <= len(handler.structFields) {
+		fields := make(map[string]json.RawMessage, len(ps))
+		for i, p := range ps {
+			fields[handler.structFields[i]] = p.data
+		}
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return nil, ParseError, xerrors.Errorf("mapping positional params to struct fields: %w", err)
+		}
+		ps = []param{{data: data}}
+	}
+
+	if len(ps) != handler.nParams {
+		return nil, InvalidParams, fmt.Errorf("wrong param count (method '%s'): %d != %d", req.Method, len(ps), handler.nParams)
+	}
+
+	params := make([]reflect.Value, handler.nParams)
+	for i := 0; i < handler.nParams; i++ {
+		var rp reflect.Value
+
+		typ := handler.paramReceivers[i]
+		if sb, ok := ctx.Value(streamBodyKey{}).(*streamBody); ok && typ == readerType {
+			// streamed param, see StreamContentType
+			r, err := sb.take()
+			if err != nil {
+				return nil, InvalidParams, paramError(i, xerrors.Errorf("decoding params for '%s' (param %d): %w", req.Method, i, err))
+			}
+			params[i] = reflect.ValueOf(r)
+			continue
+		}
+		if typ == writerType {
+			// output param, see outputStream
+			stream, _ := ctx.Value(outputStreamKey{}).(*outputStream)
+			if stream == nil {
+				return nil, InvalidParams, paramError(i, xerrors.Errorf("param %d of '%s' is an io.Writer, which is only supported for single http calls", i, req.Method))
+			}
+			out, err := stream.take()
+			if err != nil {
+				return nil, InvalidParams, paramError(i, xerrors.Errorf("decoding params for '%s' (param %d): %w", req.Method, i, err))
+			}
+			params[i] = reflect.ValueOf(out)
+			continue
+		}
+
+		dec, found := s.paramDecoders[typ]
+		if !found {
+			rp = reflect.New(typ)
+			if s.paramDefaults && handler.codec == nil {
+				if err := setParamDefaults(rp); err != nil {
+					return nil, InternalError, xerrors.Errorf("setting param defaults for '%s' (param %d: %T): %w", req.Method, i, rp.Interface(), err)
+				}
+			}
+			if handler.codec != nil {
+				if err := decodeCodecValue(handler.codec, ps[i].data, rp.Interface()); err != nil {
+					return nil, ParseError, paramError(i, xerrors.Errorf("decoding params for '%s' (param %d: %T; namespace codec): %w", req.Method, i, rp.Interface(), err))
+				}
+			} else if s.numericCoercion && coercibleNumber(typ) {
+				if err := decodeNumericParam(ps[i].data, rp); err != nil {
+					return nil, InvalidParams, paramError(i, xerrors.Errorf("decoding params for '%s' (param %d: %T): %w", req.Method, i, rp.Interface(), err))
+				}
+			} else if err := decodeJSONParam(ps[i].data, rp); err != nil {
+				return nil, ParseError, paramError(i, xerrors.Errorf("unmarshaling params for '%s' (param %d: %T): %w", req.Method, i, rp.Interface(), err))
+			}
+			rp = rp.Elem()
+		} else {
+			var err error
+			rp, err = dec(ctx, ps[i].data)
+			if err != nil {
+				return nil, ParseError, paramError(i, xerrors.Errorf("decoding params for '%s' (param %d; custom decoder): %w", req.Method, i, err))
+			}
+		}
+
+		params[i] = reflect.ValueOf(rp.Interface())
+	}
+
+	return params, 0, nil
+}
+
 func (s *handler) handle(ctx context.Context, req request, w func(func(io.Writer)), rpcError rpcErrFunc, done func(keepCtx bool), chOut chanOut) {
+	start := time.Now()
+
+	// the method is rewritten once, so that everything after this (e.g. the
+	// allowlist, caches and metrics) sees the rewritten name
+	var methodAllowed bool
+	req.Method, methodAllowed = s.rewriteMethod(req.Method)
+
 	// Not sure if we need to sanitize the incoming req.Method or not.
 	ctx, span := s.getSpan(ctx, req)
 	ctx, _ = tag.New(ctx, tag.Insert(metrics.RPCMethod, req.Method))
+	ctx = context.WithValue(ctx, notificationKey{}, req.ID == nil)
+
+	var rmeta *responseMeta
+	if s.responseMeta {
+		rmeta = &responseMeta{meta: map[string]string{}}
+		ctx = context.WithValue(ctx, responseMetaKey{}, rmeta)
+	}
+	var traceID string
+	if s.traceIDs {
+		traceID = callTraceID(ctx, req)
+		ctx = WithTraceID(ctx, traceID)
+	}
+	if s.baseLogger != nil {
+		ctx = context.WithValue(ctx, loggerKey{}, callLogger(ctx, s.baseLogger, req))
+	}
+	if req.ID == nil && s.notificationErrorHandler != nil {
+		rpcError = s.notificationRPCError(ctx, req, rpcError)
+	}
 	defer span.End()
 
-	handler, ok := s.methods[req.Method]
-	if !ok {
-		aliasTo, ok := s.aliasedMethods[req.Method]
-		if ok {
-			handler, ok = s.methods[aliasTo]
+	if s.wireLogger != nil {
+		s.logRequest(ctx, req)
+		w = s.loggingWriter(ctx, req.Method, w)
+	}
+
+	if !s.drain.enter() {
+		rpcError(w, &req, ServerDraining, xerrors.New("server draining"))
+		stats.Record(ctx, metrics.RPCRequestError.M(1))
+		done(false)
+		return
+	}
+	defer s.drain.exit()
+
+	if req.Jsonrpc != s.protocolVersion {
+		err := fmt.Errorf("unsupported jsonrpc version '%s', expected '%s'", req.Jsonrpc, s.protocolVersion)
+		if s.protocolErrorHandler != nil {
+			raw, _ := json.Marshal(req)
+			s.protocolError(ctx, raw, err)
 		}
-		if !ok {
-			rpcError(w, &req, rpcMethodNotFound, fmt.Errorf("method '%s' not found", req.Method))
-			stats.Record(ctx, metrics.RPCInvalidMethod.M(1))
+		rpcError(w, &req, InvalidRequest, err)
+		stats.Record(ctx, metrics.RPCRequestError.M(1))
+		done(false)
+		return
+	}
+
+	if !methodAllowed {
+		rpcError(w, &req, MethodNotFound, s.methodNotFound(req.Method))
+		stats.Record(ctx, metrics.RPCInvalidMethod.M(1))
+		done(false)
+		return
+	}
+
+	if s.methodAllowlist != nil {
+		if err := s.checkAllowed(ctx, req.Method); err != nil {
+			rpcError(w, &req, AccessDenied, err)
+			stats.Record(ctx, metrics.RPCRequestError.M(1))
 			done(false)
 			return
 		}
 	}
 
-	outCh := handler.valOut != -1 && handler.handlerFunc.Type().Out(handler.valOut).Kind() == reflect.Chan
+	if err := s.movedError(req.Method); err != nil {
+		rpcError(w, &req, MethodMoved, err)
+		stats.Record(ctx, metrics.RPCInvalidMethod.M(1))
+		done(false)
+		return
+	}
+
+	handler, ok := s.lookupMethod(req.Method)
+	if !ok {
+		rpcError(w, &req, MethodNotFound, s.methodNotFound(req.Method))
+		stats.Record(ctx, metrics.RPCInvalidMethod.M(1))
+		done(false)
+		return
+	}
+
+	if req.ID == nil && s.notificationDedup != nil && s.notificationDedup.repeated(methodCacheKey("", req.Method, req.Params)) {
+		log.Debugw("skipping repeated notification", "method", req.Method)
+		done(false)
+		return
+	}
+
+	outCh := false
+	if handler.valOut != -1 {
+		outType := handler.handlerFunc.Type().Out(handler.valOut)
+		outCh = outType.Kind() == reflect.Chan || isChanStruct(outType)
+	}
 	defer done(outCh)
 
 	if chOut == nil && outCh {
-		rpcError(w, &req, rpcMethodNotFound, fmt.Errorf("method '%s' not supported in this mode (no out channel support)", req.Method))
+		rpcError(w, &req, MethodNotFound, fmt.Errorf("method '%s' not supported in this mode (no out channel support)", req.Method))
 		stats.Record(ctx, metrics.RPCRequestError.M(1))
 		return
 	}
 
-	callParams := make([]reflect.Value, 1+handler.hasCtx+handler.nParams)
+	var trailer *responseMeta
+	backpressure := s.backpressure
+	if outCh {
+		trailer = &responseMeta{meta: map[string]string{}}
+		ctx = context.WithValue(ctx, streamTrailerKey{}, trailer)
+		ctx = context.WithValue(ctx, backpressureKey{}, &backpressure)
+	}
+
+	nCallParams := 1 + handler.hasCtx + handler.nParams
+	if handler.hasProgress {
+		nCallParams++
+	}
+
+	callParams := make([]reflect.Value, nCallParams)
 	callParams[0] = handler.receiver
 	if handler.hasCtx == 1 {
 		callParams[1] = reflect.ValueOf(ctx)
 	}
 
-	if handler.hasRawParams {
-		// When hasRawParams is true, there is only one parameter and it is a
-		// json.RawMessage.
-
-		callParams[1+handler.hasCtx] = reflect.ValueOf(RawParams(req.Params))
-	} else {
-		// "normal" param list; no good way to do named params in Golang
-
-		var ps []param
-		if len(req.Params) > 0 {
-			err := json.Unmarshal(req.Params, &ps)
-			if err != nil {
-				rpcError(w, &req, rpcParseError, xerrors.Errorf("unmarshaling param array: %w", err))
-				stats.Record(ctx, metrics.RPCRequestError.M(1))
+	var progressDone int32
+	if handler.hasProgress {
+		// progress is only sent over websocket (which supports out channels),
+		// and only for calls the client is waiting on
+		sendProgress := chOut != nil && req.ID != nil
+		callParams[nCallParams-1] = reflect.ValueOf(func(progress float64) {
+			if !sendProgress || atomic.LoadInt32(&progressDone) != 0 {
 				return
 			}
-		}
+			s.sendProgress(w, req.ID, progress)
+		})
+		defer atomic.StoreInt32(&progressDone, 1)
+	}
 
-		if len(ps) != handler.nParams {
-			rpcError(w, &req, rpcInvalidParams, fmt.Errorf("wrong param count (method '%s'): %d != %d", req.Method, len(ps), handler.nParams))
-			stats.Record(ctx, metrics.RPCRequestError.M(1))
+	params, code, err := s.decodeParams(ctx, req, handler)
+	if err != nil {
+		rpcError(w, &req, code, err)
+		stats.Record(ctx, metrics.RPCRequestError.M(1))
+		if code == InvalidParams {
 			done(false)
-			return
 		}
+		return
+	}
+	copy(callParams[1+handler.hasCtx:], params)
 
-		for i := 0; i < handler.nParams; i++ {
-			var rp reflect.Value
+	// calls with idempotency keys return the cached response of the first call
+	// with the key, if there is one
+	var idemKey, idemParams string
+	var idemResp []byte
+	if key, ok := req.Meta[metaIdempotencyKey]; ok && s.idempotency != nil && req.ID != nil && !outCh {
+		idemKey = s.idempotencyCaller(ctx) + "/" + req.Method + "/" + key
+		idemParams = paramsHash(req.Params)
 
-			typ := handler.paramReceivers[i]
-			dec, found := s.paramDecoders[typ]
-			if !found {
-				rp = reflect.New(typ)
-				if err := json.NewDecoder(bytes.NewReader(ps[i].data)).Decode(rp.Interface()); err != nil {
-					rpcError(w, &req, rpcParseError, xerrors.Errorf("unmarshaling params for '%s' (param: %T): %w", req.Method, rp.Interface(), err))
-					stats.Record(ctx, metrics.RPCRequestError.M(1))
-					return
-				}
-				rp = rp.Elem()
-			} else {
-				var err error
-				rp, err = dec(ctx, ps[i].data)
-				if err != nil {
-					rpcError(w, &req, rpcParseError, xerrors.Errorf("decoding params for '%s' (param: %d; custom decoder): %w", req.Method, i, err))
-					stats.Record(ctx, metrics.RPCRequestError.M(1))
-					return
-				}
+		cached, ok, err := s.idempotency.begin(ctx, idemKey, idemParams)
+		if err != nil {
+			code := ErrorCode(0)
+			if errors.Is(err, errIdempotencyParams) {
+				code = InvalidRequest
 			}
+			rpcError(w, &req, code, xerrors.Errorf("call to '%s' with idempotency key '%s': %w", req.Method, key, err))
+			stats.Record(ctx, metrics.RPCRequestError.M(1))
+			return
+		}
+		if ok {
+			s.writeCachedResponse(ctx, w, cached, req.ID, traceIDMeta(traceID))
+			return
+		}
+		defer func() {
+			s.idempotency.finish(idemKey, idemParams, idemResp)
+		}()
+	}
+
+	// calls to cached methods return the cached response of an identical call,
+	// if there is one
+	var cacheKey string
+	var cacheResp []byte
+	cache, cacheable := s.methodCache[req.Method]
+	if cacheable && req.ID != nil && !outCh {
+		if caller, ok := s.cacheCaller(ctx); ok {
+			cacheKey = methodCacheKey(caller, req.Method, req.Params)
+		}
+	}
+	if cacheKey != "" {
+		cached, ok, err := cache.begin(ctx, cacheKey, "")
+		if err != nil {
+			rpcError(w, &req, 0, xerrors.Errorf("call to cached method '%s': %w", req.Method, err))
+			stats.Record(ctx, metrics.RPCRequestError.M(1))
+			return
+		}
+		if ok {
+			// cached responses don't have meta of the call they were cached
+			// from, only the trace id of this call
+			s.writeCachedResponse(ctx, w, cached, req.ID, traceIDMeta(traceID))
+			return
+		}
+		defer func() {
+			cache.finish(cacheKey, "", cacheResp)
+		}()
+	}
 
-			callParams[i+1+handler.hasCtx] = reflect.ValueOf(rp.Interface())
+	// calls to methods with an adaptive timeout are cut off at the timeout;
+	// channel methods aren't, as they run until the channel is closed
+	var adaptiveCtx context.Context
+	var adaptiveTimeout time.Duration
+	if s.adaptiveTimeouts != nil && !outCh {
+		if timeout, ok := s.adaptiveTimeouts.timeout(req.Method); ok && handler.hasCtx == 1 {
+			var cancel context.CancelFunc
+			adaptiveTimeout = timeout
+			adaptiveCtx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+			callParams[1] = reflect.ValueOf(adaptiveCtx)
 		}
 	}
+	callStart := time.Now()
 
 	// /////////////////
 
-	callResult, err := doCall(req.Method, handler.handlerFunc, callParams)
+	callResult, err := s.invoke(req.Method, handler, callParams)
+	atomic.StoreInt32(&progressDone, 1)
+
+	if s.adaptiveTimeouts != nil && !outCh {
+		// cancelled calls don't tell how long the method takes. Calls cut off
+		// took at least the timeout, recording that lets the timeout grow
+		// when the method gets slower for good, instead of cutting off every
+		// call from then on.
+		switch {
+		case ctx.Err() != nil:
+		case adaptiveCtx != nil && adaptiveCtx.Err() == context.DeadlineExceeded:
+			stats.Record(ctx, metrics.RPCAdaptiveTimeout.M(1))
+			s.adaptiveTimeouts.observe(req.Method, adaptiveTimeout)
+		default:
+			s.adaptiveTimeouts.observe(req.Method, time.Since(callStart))
+		}
+	}
+
+	// methods with writer params respond with their output, see outputStream
+	outputStarted := false
+	if stream, _ := ctx.Value(outputStreamKey{}).(*outputStream); stream != nil {
+		outputStarted = stream.finish()
+	}
 	if err != nil {
 		rpcError(w, &req, 0, xerrors.Errorf("fatal error calling '%s': %w", req.Method, err))
 		stats.Record(ctx, metrics.RPCRequestError.M(1))
 		return
 	}
 	if req.ID == nil {
-		return // notification
+		// notification; its error has no response to carry it
+		if handler.errOut != -1 && !cancelledByClient(ctx) {
+			if err, _ := callResult[handler.errOut].Interface().(error); err != nil && !errors.Is(err, ErrNoResponse) {
+				s.notificationFailed(ctx, req, err)
+			}
+		}
+		return
 	}
 
 	// /////////////////
 
 	resp := response{
-		Jsonrpc: "2.0",
+		Jsonrpc: s.protocolVersion,
 		ID:      req.ID,
 	}
 
-	if handler.errOut != -1 {
+	if cancelledByClient(ctx) {
+		stats.Record(ctx, metrics.RPCResponseError.M(1))
+		resp.Error = &respError{
+			Code:    RequestCancelled,
+			Message: fmt.Sprintf("call to '%s' cancelled", req.Method),
+		}
+	} else if handler.errOut != -1 {
 		err := callResult[handler.errOut].Interface()
+		if err != nil && errors.Is(err.(error), ErrNoResponse) {
+			return // handler asked for no response
+		}
 		if err != nil {
 			log.Warnf("error in RPC call to '%s': %+v", req.Method, err)
 			stats.Record(ctx, metrics.RPCResponseError.M(1))
@@ -468,33 +1493,72 @@ func (s *handler) handle(ctx context.Context, req request, w func(func(io.Writer
 		}
 	}
 
-	var kind reflect.Kind
 	var res interface{}
-	var nonZero bool
+	var nonZero, customResult bool
 	if handler.valOut != -1 {
 		res = callResult[handler.valOut].Interface()
-		kind = callResult[handler.valOut].Kind()
 		nonZero = !callResult[handler.valOut].IsZero()
 	}
 
 	// check error as JSON-RPC spec prohibits error and value at the same time
 	if resp.Error == nil {
-		if res != nil && kind == reflect.Chan {
+		if res != nil && outCh {
 			// Channel responses are sent from channel control goroutine.
 			// Sending responses here could cause deadlocks on writeLk, or allow
 			// sending channel messages before this rpc call returns
 
-			//noinspection GoNilness // already checked above
-			err = chOut(callResult[handler.valOut], req.ID)
-			if err == nil {
-				return // channel goroutine handles responding
+			// the snapshot is marshaled here, so that if it can't be
+			// serialized the call is still answered, with an error
+			var snapshot reflect.Value
+			var snapErr error
+			if handler.snapOut != -1 {
+				var data []byte
+				data, snapErr = json.Marshal(callResult[handler.snapOut].Interface())
+				snapshot = reflect.ValueOf(json.RawMessage(data))
 			}
 
-			log.Warnf("failed to setup channel in RPC call to '%s': %+v", req.Method, err)
-			stats.Record(ctx, metrics.RPCResponseError.M(1))
-			resp.Error = &respError{
-				Code:    1,
-				Message: err.Error(),
+			if snapErr != nil {
+				log.Warnf("failed to serialize snapshot of RPC call to '%s': %+v", req.Method, snapErr)
+				stats.Record(ctx, metrics.RPCResponseError.M(1))
+				resp.Error = &respError{
+					Code:    InternalError,
+					Message: fmt.Sprintf("failed to serialize snapshot of '%s': %s", req.Method, snapErr),
+				}
+			} else {
+				//noinspection GoNilness // already checked above
+				err = chOut(callResult[handler.valOut], snapshot, req.ID, req.Method, trailer, backpressure)
+				if err == nil {
+					return // channel goroutine handles responding
+				}
+
+				log.Warnf("failed to setup channel in RPC call to '%s': %+v", req.Method, err)
+				stats.Record(ctx, metrics.RPCResponseError.M(1))
+				resp.Error = &respError{
+					Code:    1,
+					Message: err.Error(),
+				}
+			}
+		} else if handler.codec != nil && handler.valOut != -1 {
+			resp.Result, err = encodeCodecValue(handler.codec, res)
+			if err != nil {
+				log.Warnf("failed to encode result of RPC call to '%s': %+v", req.Method, err)
+				stats.Record(ctx, metrics.RPCResponseError.M(1))
+				resp.Error = &respError{
+					Code:    1,
+					Message: err.Error(),
+				}
+			}
+		} else if raw, ok, err := s.marshalResult(res); ok {
+			customResult = true
+			if err != nil {
+				log.Warnf("failed to encode result of RPC call to '%s': %+v", req.Method, err)
+				stats.Record(ctx, metrics.RPCResponseError.M(1))
+				resp.Error = &respError{
+					Code:    1,
+					Message: err.Error(),
+				}
+			} else {
+				resp.Result = raw
 			}
 		} else {
 			resp.Result = res
@@ -504,48 +1568,110 @@ func (s *handler) handle(ctx context.Context, req request, w func(func(io.Writer
 		log.Errorw("error and res returned", "request", req, "r.err", resp.Error, "res", res)
 	}
 
-	withLazyWriter(w, func(w io.Writer) {
-		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Error(err)
-			stats.Record(ctx, metrics.RPCResponseError.M(1))
-			return
+	if outputStarted {
+		if resp.Error != nil {
+			log.Warnf("RPC call to '%s' failed after its output started, the error can't be sent: %s", req.Method, resp.Error.Message)
 		}
-	})
-}
+		return
+	}
 
-// withLazyWriter makes it possible to defer acquiring a writer until the first write.
-// This is useful because json.Encode needs to marshal the response fully before writing, which may be
-// a problem for very large responses.
-func withLazyWriter(withWriterFunc func(func(io.Writer)), cb func(io.Writer)) {
-	lw := &lazyWriter{
-		withWriterFunc: withWriterFunc,
+	if rmeta != nil {
+		rmeta.lk.Lock()
+		if len(rmeta.meta) > 0 {
+			resp.Meta = rmeta.meta
+		}
+		rmeta.lk.Unlock()
+	}
 
-		done: make(chan struct{}),
+	if s.responseTiming {
+		if _, ok := req.Meta[metaResponseTiming]; ok {
+			if resp.Meta == nil {
+				resp.Meta = map[string]string{}
+			}
+			resp.Meta[metaServerDuration] = time.Since(start).String()
+		}
 	}
 
-	defer close(lw.done)
-	cb(lw)
-}
+	if traceID != "" {
+		if resp.Meta == nil {
+			resp.Meta = map[string]string{}
+		}
+		resp.Meta[metaTraceID] = traceID
+	}
 
-type lazyWriter struct {
-	withWriterFunc func(func(io.Writer))
+	// responses which are cached or indented need the entire encoded result.
+	// With LargeResponseStream arrays are streamed too, as that's how they're
+	// written without being held in memory whole.
+	streamArrays := s.streamingArrays || (s.largeResponseThreshold > 0 && s.largeResponseMode == LargeResponseStream)
+	if streamArrays && resp.Error == nil && handler.codec == nil && handler.valOut != -1 && !customResult &&
+		idemKey == "" && cacheKey == "" && s.indent == nil && streamableArray(callResult[handler.valOut]) {
+		s.writeStreamingArray(ctx, w, rpcError, &req, resp, callResult[handler.valOut])
+		return
+	}
+
+	// marshal before writing, so that if the result can't be serialized a
+	// well-formed error response can be sent instead
+	data, err := json.Marshal(resp)
+	if err != nil {
+		stats.Record(ctx, metrics.RPCResponseError.M(1))
+		rpcError(w, &req, InternalError, xerrors.Errorf("failed to serialize result of '%s': %w", req.Method, err))
+		return
+	}
+	if s.largeResponseThreshold > 0 && len(data) > s.largeResponseThreshold && s.largeResponseMode == LargeResponseReject {
+		log.Warnf("response of RPC call to '%s' is too large: %d bytes", req.Method, len(data))
+		stats.Record(ctx, metrics.RPCResponseError.M(1))
+		rpcError(w, &req, InternalError, xerrors.Errorf("response of '%s' is %d bytes, over the limit of %d bytes", req.Method, len(data), s.largeResponseThreshold))
+		return
+	}
+	if idemKey != "" || (cacheKey != "" && resp.Error == nil) {
+		// per-call meta (e.g. trace ids and timing) isn't stored, replayed
+		// responses get the meta of the call they answer
+		stored := resp
+		stored.Meta = nil
+		storedResp, err := json.Marshal(stored)
+		if err != nil {
+			log.Errorf("encoding stored response: %s", err)
+			storedResp = nil
+		}
+		if idemKey != "" {
+			idemResp = storedResp
+		}
+		if cacheKey != "" && resp.Error == nil {
+			cacheResp = storedResp
+		}
+	}
+	data = s.indent.apply(data)
+
+	w(func(w io.Writer) {
+		if _, err := w.Write(append(data, '\n')); err != nil {
+			log.Error(err)
+			stats.Record(ctx, metrics.RPCResponseError.M(1))
+		}
+	})
+}
 
-	w    io.Writer
-	done chan struct{}
+// traceIDMeta is the meta of responses replayed for a call, only its trace id
+func traceIDMeta(traceID string) map[string]string {
+	if traceID == "" {
+		return nil
+	}
+	return map[string]string{metaTraceID: traceID}
 }
 
-func (lw *lazyWriter) Write(p []byte) (n int, err error) {
-	if lw.w == nil {
-		acquired := make(chan struct{})
-		go func() {
-			lw.withWriterFunc(func(w io.Writer) {
-				lw.w = w
-				close(acquired)
-				<-lw.done
-			})
-		}()
-		<-acquired
+// writeCachedResponse writes an encoded response, with the id of the current
+// request, and its meta if not nil
+func (s *handler) writeCachedResponse(ctx context.Context, w func(func(io.Writer)), resp []byte, id interface{}, meta map[string]string) {
+	resp, err := withResponseID(resp, id, meta)
+	if err != nil {
+		log.Errorf("preparing cached response: %s", err)
+		stats.Record(ctx, metrics.RPCResponseError.M(1))
+		return
 	}
 
-	return lw.w.Write(p)
+	w(func(w io.Writer) {
+		if _, err := w.Write(append(s.indent.apply(resp), '\n')); err != nil {
+			log.Error(err)
+			stats.Record(ctx, metrics.RPCResponseError.M(1))
+		}
+	})
 }
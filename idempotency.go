@@ -0,0 +1,222 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// metaIdempotencyKey is the request meta key carrying the idempotency key
+const metaIdempotencyKey = "IdempotencyKey"
+
+type idempotencyKeyKey struct{}
+
+// WithIdempotencyKey returns a context which makes calls made with it carry the
+// given idempotency key. On servers with an idempotency cache (see
+// WithIdempotencyCache) repeated calls to the same method with the same key
+// return the cached response of the first call instead of executing again.
+//
+// This is useful for retrying calls at the application level; with the
+// WithIdempotencyKeys client option each call gets a random key, which is kept
+// across the automatic retries of `retry:"true"` methods.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyKey{}, key)
+}
+
+func idempotencyKey(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	k, ok := ctx.Value(idempotencyKeyKey{}).(string)
+	return k, ok
+}
+
+// IdempotencyStore stores responses of calls made with idempotency keys. It
+// must be safe for concurrent use.
+type IdempotencyStore interface {
+	// Get returns the response stored for the key, if it didn't expire
+	Get(key string) ([]byte, bool)
+	// Put stores the response for the key, for the ttl duration
+	Put(key string, resp []byte, ttl time.Duration)
+}
+
+type memIdempotencyEntry struct {
+	resp    []byte
+	expires time.Time
+}
+
+type memIdempotencyStore struct {
+	lk      sync.Mutex
+	entries map[string]memIdempotencyEntry
+	expiry  expiryHeap
+}
+
+// NewMemoryIdempotencyStore creates an in-memory IdempotencyStore. Expired
+// entries are removed when new entries are stored.
+func NewMemoryIdempotencyStore() IdempotencyStore {
+	return &memIdempotencyStore{
+		entries: map[string]memIdempotencyEntry{},
+	}
+}
+
+func (s *memIdempotencyStore) Get(key string) ([]byte, bool) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.resp, true
+}
+
+func (s *memIdempotencyStore) Put(key string, resp []byte, ttl time.Duration) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	now := time.Now()
+	for _, k := range s.expiry.popExpired(now) {
+		// the key may have been stored again with a later expiry
+		if e, ok := s.entries[k]; ok && now.After(e.expires) {
+			delete(s.entries, k)
+		}
+	}
+
+	expires := now.Add(ttl)
+	s.entries[key] = memIdempotencyEntry{
+		resp:    resp,
+		expires: expires,
+	}
+	s.expiry.push(key, expires)
+}
+
+// idempotencyRecord is a stored response, with the hash of the params of the
+// call it's the response to
+type idempotencyRecord struct {
+	Params string          `json:"params,omitempty"`
+	Resp   json.RawMessage `json:"resp"`
+}
+
+// idempotencyCache deduplicates calls with idempotency keys. Calls with a key
+// which is already being executed wait for the first call to finish.
+type idempotencyCache struct {
+	ttl   time.Duration
+	store IdempotencyStore
+
+	lk       sync.Mutex
+	inflight map[string]chan struct{}
+}
+
+func newIdempotencyCache(ttl time.Duration, store IdempotencyStore) *idempotencyCache {
+	if store == nil {
+		store = NewMemoryIdempotencyStore()
+	}
+
+	return &idempotencyCache{
+		ttl:      ttl,
+		store:    store,
+		inflight: map[string]chan struct{}{},
+	}
+}
+
+// errIdempotencyParams is the error of calls reusing an idempotency key with
+// other params
+var errIdempotencyParams = errors.New("idempotency key was used with different params")
+
+// begin returns the cached response for the key. If there is none, ok is
+// false, and the caller must execute the call, and then call finish. The
+// params hash, if not empty, must match the one of the cached call, see
+// paramsHash. If the context is cancelled while waiting for a call with the
+// same key, its error is returned.
+func (c *idempotencyCache) begin(ctx context.Context, key, params string) (cached []byte, ok bool, err error) {
+	for {
+		if b, ok := c.store.Get(key); ok {
+			var rec idempotencyRecord
+			if err := json.Unmarshal(b, &rec); err != nil {
+				return nil, false, xerrors.Errorf("decoding stored response: %w", err)
+			}
+			if rec.Params != params {
+				return nil, false, errIdempotencyParams
+			}
+			return rec.Resp, true, nil
+		}
+
+		c.lk.Lock()
+		wait, running := c.inflight[key]
+		if !running {
+			c.inflight[key] = make(chan struct{})
+			c.lk.Unlock()
+			return nil, false, nil
+		}
+		c.lk.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+// finish stores the response of a call started with begin, resp is nil if
+// there is no response to store (e.g. the call failed to execute)
+func (c *idempotencyCache) finish(key, params string, resp []byte) {
+	if resp != nil {
+		b, err := json.Marshal(idempotencyRecord{Params: params, Resp: resp})
+		if err != nil {
+			log.Errorf("storing response: %s", err)
+		} else {
+			c.store.Put(key, b, c.ttl)
+		}
+	}
+
+	c.lk.Lock()
+	close(c.inflight[key])
+	delete(c.inflight, key)
+	c.lk.Unlock()
+}
+
+// paramsHash is the hash of call params stored with responses to calls with
+// idempotency keys, params differing only in whitespace have the same hash
+func paramsHash(params json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, params); err != nil {
+		buf.Reset()
+		buf.Write(params)
+	}
+
+	h := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(h[:])
+}
+
+// withResponseID returns the cached response with the id of the current
+// request, and its meta if not empty
+func withResponseID(resp []byte, id interface{}, meta map[string]string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(resp, &fields); err != nil {
+		return nil, err
+	}
+
+	rid, err := json.Marshal(id)
+	if err != nil {
+		return nil, err
+	}
+	fields["id"] = rid
+
+	if len(meta) > 0 {
+		m, err := json.Marshal(meta)
+		if err != nil {
+			return nil, err
+		}
+		fields["meta"] = m
+	}
+
+	return json.Marshal(fields)
+}
@@ -0,0 +1,49 @@
+package jsonrpc
+
+import (
+	"reflect"
+
+	"golang.org/x/xerrors"
+)
+
+// InvokeFunc invokes a method in place of the server, see WithInvokeFunc. fn
+// is the registered method as a function taking the receiver as its first
+// param, and params are the values the server would call it with: the
+// receiver, then the context, the decoded params and the progress callback,
+// if the method takes them. The returned values must match the method return
+// types (MethodInfo.ReturnTypes); calling fn.Call(params) does the regular
+// call.
+type InvokeFunc func(method MethodInfo, fn reflect.Value, params []reflect.Value) []reflect.Value
+
+// invoke calls a method, with the invoke func if one is set
+func (s *handler) invoke(name string, m methodHandler, params []reflect.Value) ([]reflect.Value, error) {
+	if s.invokeFunc == nil {
+		return doCall(name, func() []reflect.Value {
+			return m.handlerFunc.Call(params)
+		})
+	}
+
+	info := m.info(name)
+	out, err := doCall(name, func() []reflect.Value {
+		return s.invokeFunc(info, m.handlerFunc, params)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the response is built from the results by the method return types
+	if len(out) != len(info.ReturnTypes) {
+		return nil, xerrors.Errorf("invoke func returned %d values for '%s', expected %d", len(out), name, len(info.ReturnTypes))
+	}
+	for i, v := range out {
+		if !v.IsValid() || !v.Type().AssignableTo(info.ReturnTypes[i]) {
+			return nil, xerrors.Errorf("invoke func returned an invalid value %d for '%s', expected %s", i, name, info.ReturnTypes[i])
+		}
+		// values of interface return types (e.g. the error) are expected to
+		// have the interface type
+		rv := reflect.New(info.ReturnTypes[i]).Elem()
+		rv.Set(v)
+		out[i] = rv
+	}
+	return out, nil
+}
@@ -0,0 +1,313 @@
+package jsonrpc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/xerrors"
+)
+
+// RequestSignatureHeader is the http request header carrying the request
+// signature, see WithRequestSignatureAuth
+const RequestSignatureHeader = "X-Jsonrpc-Request-Signature"
+
+// SignatureKeys maps key ids (the "kid" of JWS headers) to the keys verifying
+// request signatures, see WithRequestSignatureAuth. Keys are []byte HMAC
+// secrets (HS256), ed25519.PublicKey (EdDSA), *ecdsa.PublicKey on the P-256
+// curve (ES256) or *rsa.PublicKey (RS256). The JWS algorithm must match the
+// type of the key.
+type SignatureKeys map[string]interface{}
+
+// requestClaims are the claims of signed requests; other claims are passed to
+// handlers, see RequestClaims
+type requestClaims struct {
+	// BodyHash is the base64url encoded SHA-256 of the request body
+	BodyHash string `json:"bodyHash"`
+
+	// Method and URI are the http method and request URI (path and query) of
+	// the request, so that signatures can't be used with other endpoints, or
+	// with other params of GET requests
+	Method string `json:"method"`
+	URI    string `json:"uri"`
+
+	// Jti is a unique id of the signature; signatures with an id can only be
+	// used once
+	Jti string `json:"jti,omitempty"`
+
+	Exp int64 `json:"exp"`
+	Nbf int64 `json:"nbf,omitempty"`
+}
+
+type jwsHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// jwsAlg returns the JWS algorithm of a signing or verification key
+func jwsAlg(key interface{}) (string, error) {
+	switch k := key.(type) {
+	case []byte:
+		return "HS256", nil
+	case ed25519.PrivateKey, ed25519.PublicKey:
+		return "EdDSA", nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return "", xerrors.New("only P-256 ecdsa keys are supported")
+		}
+		return "ES256", nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return "", xerrors.New("only P-256 ecdsa keys are supported")
+		}
+		return "ES256", nil
+	case *rsa.PrivateKey, *rsa.PublicKey:
+		return "RS256", nil
+	default:
+		return "", xerrors.Errorf("unsupported key type %T", key)
+	}
+}
+
+// signJWS creates a compact JWS of the payload
+func signJWS(kid string, key interface{}, payload []byte) (string, error) {
+	alg, err := jwsAlg(key)
+	if err != nil {
+		return "", err
+	}
+
+	hdr, err := json.Marshal(jwsHeader{Alg: alg, Kid: kid})
+	if err != nil {
+		return "", err
+	}
+	signed := b64.EncodeToString(hdr) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed)) // nolint:errcheck
+		sig = mac.Sum(nil)
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			return "", err
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", xerrors.Errorf("can't sign with key type %T", key)
+	}
+
+	return signed + "." + b64.EncodeToString(sig), nil
+}
+
+// verifyJWS verifies a compact JWS with the key selected by its key id, and
+// returns its payload
+func verifyJWS(token string, keys SignatureKeys) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, xerrors.New("malformed JWS")
+	}
+
+	hb, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, xerrors.Errorf("decoding JWS header: %w", err)
+	}
+	var hdr jwsHeader
+	if err := json.Unmarshal(hb, &hdr); err != nil {
+		return nil, xerrors.Errorf("decoding JWS header: %w", err)
+	}
+
+	key, ok := keys[hdr.Kid]
+	if !ok {
+		return nil, xerrors.Errorf("unknown key id '%s'", hdr.Kid)
+	}
+	// the algorithm is set by the key, so that a JWS can't pick a weaker one
+	alg, err := jwsAlg(key)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Alg != alg {
+		return nil, xerrors.Errorf("JWS algorithm '%s' doesn't match the key algorithm '%s'", hdr.Alg, alg)
+	}
+
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, xerrors.Errorf("decoding JWS signature: %w", err)
+	}
+
+	signed := parts[0] + "." + parts[1]
+	digest := sha256.Sum256([]byte(signed))
+
+	var valid bool
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed)) // nolint:errcheck
+		valid = hmac.Equal(sig, mac.Sum(nil))
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(k, []byte(signed), sig)
+	case *ecdsa.PublicKey:
+		if len(sig) == 64 {
+			r := new(big.Int).SetBytes(sig[:32])
+			s := new(big.Int).SetBytes(sig[32:])
+			valid = ecdsa.Verify(k, digest[:], r, s)
+		}
+	case *rsa.PublicKey:
+		valid = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+	default:
+		return nil, xerrors.Errorf("can't verify with key type %T", key)
+	}
+	if !valid {
+		return nil, xerrors.New("invalid JWS signature")
+	}
+
+	payload, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, xerrors.Errorf("decoding JWS payload: %w", err)
+	}
+	return payload, nil
+}
+
+// requestSigner signs client requests, see WithRequestSigning
+type requestSigner struct {
+	kid string
+	key interface{}
+	ttl time.Duration
+}
+
+// sign returns the signature of a request
+func (rs *requestSigner) sign(method string, u *url.URL, body []byte) (string, error) {
+	hash := sha256.Sum256(body)
+	payload, err := json.Marshal(requestClaims{
+		BodyHash: b64.EncodeToString(hash[:]),
+		Method:   method,
+		URI:      u.RequestURI(),
+		Jti:      uuid.New().String(),
+		Exp:      time.Now().Add(rs.ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return signJWS(rs.kid, rs.key, payload)
+}
+
+// verifyRequest verifies the signature of a request, and returns its claims
+func verifyRequest(token string, keys SignatureKeys, seen *seenSignatures, r *http.Request, body []byte) (map[string]interface{}, error) {
+	if token == "" {
+		return nil, xerrors.New("missing request signature")
+	}
+
+	payload, err := verifyJWS(token, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var rc requestClaims
+	if err := json.Unmarshal(payload, &rc); err != nil {
+		return nil, xerrors.Errorf("decoding claims: %w", err)
+	}
+
+	now := time.Now().Unix()
+	if rc.Exp == 0 {
+		return nil, xerrors.New("signature without an expiry")
+	}
+	if now >= rc.Exp {
+		return nil, xerrors.New("signature expired")
+	}
+	if rc.Nbf != 0 && now < rc.Nbf {
+		return nil, xerrors.New("signature not valid yet")
+	}
+
+	hash := sha256.Sum256(body)
+	if !hmac.Equal([]byte(rc.BodyHash), []byte(b64.EncodeToString(hash[:]))) {
+		return nil, xerrors.New("signature doesn't match the request body")
+	}
+	if rc.Method != r.Method || rc.URI != r.URL.RequestURI() {
+		return nil, xerrors.Errorf("signature doesn't match the request method and URI (signed for %s %s)", rc.Method, rc.URI)
+	}
+	if rc.Jti != "" && !seen.add(rc.Jti, rc.Exp) {
+		return nil, xerrors.New("signature already used")
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, xerrors.Errorf("decoding claims: %w", err)
+	}
+	return claims, nil
+}
+
+// seenSignatures are the ids of signatures used before they expire, to
+// reject replayed requests
+type seenSignatures struct {
+	lk     sync.Mutex
+	ids    map[string]struct{}
+	expiry expiryHeap
+}
+
+func newSeenSignatures() *seenSignatures {
+	return &seenSignatures{ids: map[string]struct{}{}}
+}
+
+// add records a signature id, returning false if it was already used
+func (ss *seenSignatures) add(id string, exp int64) bool {
+	ss.lk.Lock()
+	defer ss.lk.Unlock()
+
+	for _, expired := range ss.expiry.popExpired(time.Now()) {
+		delete(ss.ids, expired)
+	}
+
+	if _, ok := ss.ids[id]; ok {
+		return false
+	}
+	ss.ids[id] = struct{}{}
+	ss.expiry.push(id, time.Unix(exp, 0))
+	return true
+}
+
+// errUnsignedWebsocket is the error of websocket connections to servers
+// requiring request signatures
+var errUnsignedWebsocket = errors.New("websocket connections can't be used with request signatures")
+
+// errUnsignedStream is the error of streamed requests (see StreamContentType)
+// to servers requiring request signatures, as the body can't be verified
+// before the call is made
+var errUnsignedStream = errors.New("streamed requests can't be used with request signatures")
+
+type requestClaimsKey struct{}
+
+// RequestClaims returns the claims of the signature of the request a call was
+// received in, on servers with WithRequestSignatureAuth. Claims are decoded as
+// with encoding/json into an interface{}.
+func RequestClaims(ctx context.Context) (map[string]interface{}, bool) {
+	claims, ok := ctx.Value(requestClaimsKey{}).(map[string]interface{})
+	return claims, ok
+}
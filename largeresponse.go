@@ -0,0 +1,20 @@
+package jsonrpc
+
+// LargeResponseMode selects what happens to responses over the size threshold
+// set with WithLargeResponsePolicy
+type LargeResponseMode int
+
+const (
+	// LargeResponseReject replaces responses over the threshold with an
+	// internal error
+	LargeResponseReject LargeResponseMode = iota
+
+	// LargeResponseStream writes array results one element at a time (as with
+	// WithStreamingArrays), so that the encoded response is never held in
+	// memory whole, and flushes http responses over the threshold every
+	// threshold bytes, so they're sent with chunked transfer encoding as
+	// they're written. Other results can't be encoded in parts, so they're
+	// written as usual. Websocket messages are always written in frames as
+	// they're written, so flushing doesn't change them.
+	LargeResponseStream
+)
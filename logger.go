@@ -0,0 +1,32 @@
+package jsonrpc
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+type loggerKey struct{}
+
+// Logger returns the logger of the call handled with ctx, on servers with
+// WithBaseLogger: the base logger with the "method", "id" (not set for
+// notifications) and "peer" (the remote address) fields. Without one, the
+// logger of this package is returned, so that the result is always usable.
+func Logger(ctx context.Context) *zap.SugaredLogger {
+	if l, ok := ctx.Value(loggerKey{}).(*zap.SugaredLogger); ok {
+		return l
+	}
+	return &log.SugaredLogger
+}
+
+// callLogger returns the base logger tagged with the call fields
+func callLogger(ctx context.Context, base *zap.SugaredLogger, req request) *zap.SugaredLogger {
+	fields := []interface{}{"method", req.Method}
+	if req.ID != nil {
+		fields = append(fields, "id", req.ID)
+	}
+	if peer, ok := PeerFromContext(ctx); ok {
+		fields = append(fields, "peer", peer.RemoteAddr)
+	}
+	return base.With(fields...)
+}
@@ -16,6 +16,10 @@ var (
 	RPCInvalidMethod = stats.Int64("rpc/invalid_method", "Total number of invalid RPC methods called", stats.UnitDimensionless)
 	RPCRequestError  = stats.Int64("rpc/request_error", "Total number of request errors handled", stats.UnitDimensionless)
 	RPCResponseError = stats.Int64("rpc/response_error", "Total number of responses errors handled", stats.UnitDimensionless)
+
+	RPCAdaptiveTimeout = stats.Int64("rpc/adaptive_timeout", "Total number of calls cut off by an adaptive timeout", stats.UnitDimensionless)
+
+	RPCCircuitRejected = stats.Int64("rpc/circuit_rejected", "Total number of client calls rejected by an open circuit breaker", stats.UnitDimensionless)
 )
 
 var (
@@ -35,6 +39,15 @@ var (
 		Aggregation: view.Count(),
 		TagKeys:     []tag.Key{RPCMethod},
 	}
+	RPCAdaptiveTimeoutView = &view.View{
+		Measure:     RPCAdaptiveTimeout,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{RPCMethod},
+	}
+	RPCCircuitRejectedView = &view.View{
+		Measure:     RPCCircuitRejected,
+		Aggregation: view.Count(),
+	}
 )
 
 // DefaultViews is an array of OpenCensus views for metric gathering purposes
@@ -42,4 +55,6 @@ var DefaultViews = []*view.View{
 	RPCInvalidMethodView,
 	RPCRequestErrorView,
 	RPCResponseErrorView,
+	RPCAdaptiveTimeoutView,
+	RPCCircuitRejectedView,
 }
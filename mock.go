@@ -0,0 +1,340 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/xerrors"
+)
+
+// MockServer is a JSON-RPC server with programmed responses, for testing code
+// using the client without a real backend. It's an http.Handler serving the
+// same http and websocket protocol as RPCServer, so clients connect to it like
+// to a real server:
+//
+//	mock := jsonrpc.NewMockServer()
+//	mock.Expect("Ns.Add").WithParams(1, 2).Return(3)
+//
+//	srv := httptest.NewServer(mock)
+//	defer srv.Close()
+//	// create a client for srv.URL, exercise the code under test
+//
+//	if err := mock.Verify(); err != nil {
+//		t.Fatal(err)
+//	}
+//
+// Calls without a matching expectation get a method not found error, and make
+// Verify fail. Methods returning channels aren't supported.
+type MockServer struct {
+	lk           sync.Mutex
+	expectations []*MockExpectation
+	calls        []MockCall
+	unexpected   []MockCall
+}
+
+// MockCall is a call received by a MockServer
+type MockCall struct {
+	Method string
+	Params json.RawMessage
+}
+
+// MockExpectation is a programmed response of a MockServer, see
+// MockServer.Expect
+type MockExpectation struct {
+	// mock guards the fields below with its lock, so that expectations can
+	// be changed while clients are calling the mock
+	mock *MockServer
+
+	method string
+	params interface{} // generic JSON value, nil to match any params
+
+	result  json.RawMessage
+	errCode ErrorCode
+	errMsg  string
+	isErr   bool
+
+	times int // 0 for any number of times
+	calls int
+}
+
+// NewMockServer creates a MockServer without expectations
+func NewMockServer() *MockServer {
+	return &MockServer{}
+}
+
+// Expect adds an expectation for calls to the method, answered with a null
+// result unless set with Return or ReturnError. When multiple expectations
+// match a call, the first one added which isn't exhausted (see Times) is used.
+func (m *MockServer) Expect(method string) *MockExpectation {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	e := &MockExpectation{mock: m, method: method, result: json.RawMessage("null")}
+	m.expectations = append(m.expectations, e)
+	return e
+}
+
+// WithParams makes the expectation only match calls with the given params,
+// compared by their JSON encoding
+func (e *MockExpectation) WithParams(params ...interface{}) *MockExpectation {
+	if params == nil {
+		params = []interface{}{}
+	}
+	generic := mustGeneric(params)
+
+	e.mock.lk.Lock()
+	defer e.mock.lk.Unlock()
+	e.params = generic
+	return e
+}
+
+// Return sets the result returned for matching calls
+func (e *MockExpectation) Return(result interface{}) *MockExpectation {
+	b, err := json.Marshal(result)
+	if err != nil {
+		panic(fmt.Sprintf("mock: marshaling result: %s", err))
+	}
+
+	e.mock.lk.Lock()
+	defer e.mock.lk.Unlock()
+	e.result = b
+	e.isErr = false
+	return e
+}
+
+// ReturnError makes matching calls fail with the given error
+func (e *MockExpectation) ReturnError(code ErrorCode, message string) *MockExpectation {
+	e.mock.lk.Lock()
+	defer e.mock.lk.Unlock()
+	e.errCode, e.errMsg, e.isErr = code, message, true
+	return e
+}
+
+// Times makes the expectation match exactly n calls; by default it matches
+// any number of calls, at least one
+func (e *MockExpectation) Times(n int) *MockExpectation {
+	e.mock.lk.Lock()
+	defer e.mock.lk.Unlock()
+	e.times = n
+	return e
+}
+
+// Calls returns all calls received, in order
+func (m *MockServer) Calls() []MockCall {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	return append([]MockCall(nil), m.calls...)
+}
+
+// Verify returns an error describing unmet expectations and unexpected calls,
+// nil if all expectations were met
+func (m *MockServer) Verify() error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	var problems []string
+	for _, e := range m.expectations {
+		switch {
+		case e.times == 0 && e.calls == 0:
+			problems = append(problems, fmt.Sprintf("expected call to '%s'%s not made", e.method, e.paramsDesc()))
+		case e.times > 0 && e.calls != e.times:
+			problems = append(problems, fmt.Sprintf("expected %d calls to '%s'%s, got %d", e.times, e.method, e.paramsDesc(), e.calls))
+		}
+	}
+	for _, c := range m.unexpected {
+		problems = append(problems, fmt.Sprintf("unexpected call to '%s' with params %s", c.Method, string(c.Params)))
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return xerrors.Errorf("mock: %s", strings.Join(problems, "; "))
+}
+
+func (e *MockExpectation) paramsDesc() string {
+	if e.params == nil {
+		return ""
+	}
+	b, _ := json.Marshal(e.params)
+	return " with params " + string(b)
+}
+
+func (e *MockExpectation) matches(method string, params interface{}) bool {
+	if e.method != method || (e.times > 0 && e.calls >= e.times) {
+		return false
+	}
+	return e.params == nil || reflect.DeepEqual(e.params, params)
+}
+
+// call records the call, and returns the response for it
+func (m *MockServer) call(req request) response {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	c := MockCall{Method: req.Method, Params: req.Params}
+	m.calls = append(m.calls, c)
+
+	resp := response{
+		Jsonrpc: defaultProtocolVersion,
+		ID:      req.ID,
+	}
+
+	var params interface{}
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			resp.Error = &respError{Code: ParseError, Message: err.Error()}
+			return resp
+		}
+	} else {
+		params = []interface{}{}
+	}
+
+	for _, e := range m.expectations {
+		if !e.matches(req.Method, params) {
+			continue
+		}
+
+		e.calls++
+		if e.isErr {
+			resp.Error = &respError{Code: e.errCode, Message: e.errMsg}
+		} else {
+			resp.Result = e.result
+		}
+		return resp
+	}
+
+	m.unexpected = append(m.unexpected, c)
+	resp.Error = &respError{
+		Code:    MethodNotFound,
+		Message: fmt.Sprintf("mock: unexpected call to '%s'", req.Method),
+	}
+	return resp
+}
+
+// handleMessage handles a request or a batch, and returns the encoded response,
+// nil if nothing should be sent
+func (m *MockServer) handleMessage(data []byte) []byte {
+	data = bytes.TrimSpace(data)
+
+	var reqs []request
+	batch := isJSONArray(data)
+	if batch {
+		if err := json.Unmarshal(data, &reqs); err != nil {
+			return mockError(ParseError, err)
+		}
+	} else {
+		var req request
+		if err := json.Unmarshal(data, &req); err != nil {
+			return mockError(ParseError, err)
+		}
+		reqs = []request{req}
+	}
+
+	var resps []response
+	for _, req := range reqs {
+		var err error
+		if req.ID, err = normalizeID(req.ID); err != nil {
+			return mockError(ParseError, err)
+		}
+
+		resp := m.call(req)
+		if req.ID != nil {
+			resps = append(resps, resp)
+		}
+	}
+
+	if len(resps) == 0 {
+		return nil
+	}
+
+	var out []byte
+	var err error
+	if batch {
+		out, err = json.Marshal(resps)
+	} else {
+		out, err = json.Marshal(resps[0])
+	}
+	if err != nil {
+		return mockError(InternalError, err)
+	}
+	return out
+}
+
+func mockError(code ErrorCode, err error) []byte {
+	out, _ := json.Marshal(response{
+		Jsonrpc: defaultProtocolVersion,
+		Error:   &respError{Code: code, Message: err.Error()},
+	})
+	return out
+}
+
+func (m *MockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		m.serveWS(w, r)
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if out := m.handleMessage(data); out != nil {
+		_, _ = w.Write(out)
+	}
+}
+
+func (m *MockServer) serveWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Errorw("mock: upgrading connection", "error", err)
+		return
+	}
+	defer conn.Close() // nolint:errcheck
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		// cancellation notifications from the client aren't calls
+		if !isJSONArray(data) {
+			var req request
+			if json.Unmarshal(data, &req) == nil && (req.Method == wsCancel || req.Method == rpcCancel) {
+				continue
+			}
+		}
+
+		out := m.handleMessage(data)
+		if out == nil {
+			continue
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, out); err != nil {
+			return
+		}
+	}
+}
+
+func mustGeneric(v interface{}) interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("mock: marshaling params: %s", err))
+	}
+
+	var out interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		panic(fmt.Sprintf("mock: unmarshaling params: %s", err))
+	}
+	return out
+}
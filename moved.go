@@ -0,0 +1,65 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// maxMovedHops limits how many moved method errors a client follows for a
+// single call, so that cycles of moved methods don't loop forever
+const maxMovedHops = 5
+
+// movedMethodData is the error data of method moved errors, see
+// RPCServer.RegisterMovedMethod
+type movedMethodData struct {
+	MovedTo string `json:"movedTo"`
+}
+
+// RegisterMovedMethod makes calls to the old method name fail with a method
+// moved error (code -32003), with the new method name in the error data:
+//
+//	{"code": -32003, "message": "method 'Old.Name' moved to 'New.Name'", "data": {"movedTo": "New.Name"}}
+//
+// Clients created with WithFollowMovedMethods repeat such calls with the new
+// name. Moved methods take precedence over registered methods and aliases with
+// the same name.
+func (s *RPCServer) RegisterMovedMethod(oldName, newName string) {
+	s.movedMethods[oldName] = newName
+}
+
+// movedError returns the method moved error of the method, nil if it didn't
+// move
+func (s *handler) movedError(method string) error {
+	newName, ok := s.movedMethods[method]
+	if !ok {
+		return nil
+	}
+
+	return &dataError{
+		err:  fmt.Errorf("method '%s' moved to '%s'", method, newName),
+		data: movedMethodData{MovedTo: newName},
+	}
+}
+
+// withFollowMovedMethods makes the client repeat calls failing with method
+// moved errors with the new method name, see WithFollowMovedMethods
+func (c *client) withFollowMovedMethods() {
+	doRequest := c.doRequest
+	c.doRequest = func(ctx context.Context, cr clientRequest) (clientResponse, error) {
+		for hop := 0; ; hop++ {
+			resp, err := doRequest(ctx, cr)
+			if err != nil || resp.Error == nil || resp.Error.Code != MethodMoved || hop == maxMovedHops {
+				return resp, err
+			}
+
+			var moved movedMethodData
+			if err := json.Unmarshal(resp.Error.Data, &moved); err != nil || moved.MovedTo == "" {
+				return resp, nil
+			}
+
+			log.Debugw("following moved method", "method", cr.req.Method, "movedTo", moved.MovedTo)
+			cr.req.Method = moved.MovedTo
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// notificationBatch coalesces notifications sent on a websocket connection
+// into batch frames, see WithNotificationBatching
+type notificationBatch struct {
+	maxDelay time.Duration
+	maxCount int
+
+	// take inside writeLk
+	pending [][]byte
+	timer   *time.Timer
+}
+
+// queueNotification queues a notification for the next batch frame, flushing
+// the batch when it's full; take inside writeLk
+func (c *wsConn) queueNotification(req request) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	nb := c.notifications
+	nb.pending = append(nb.pending, b)
+	if nb.maxCount > 0 && len(nb.pending) >= nb.maxCount {
+		return c.flushNotifications()
+	}
+	if nb.timer == nil {
+		nb.timer = time.AfterFunc(nb.maxDelay, func() {
+			c.writeLk.Lock()
+			defer c.writeLk.Unlock()
+
+			if err := c.flushNotifications(); err != nil {
+				log.Warnf("sending notification batch failed: %s", err)
+			}
+		})
+	}
+	return nil
+}
+
+// flushNotifications sends the queued notifications, as a single frame; take
+// inside writeLk. It's called before any other message is sent, so that
+// messages are sent in order.
+func (c *wsConn) flushNotifications() error {
+	nb := c.notifications
+	if nb == nil || len(nb.pending) == 0 {
+		return nil
+	}
+	if nb.timer != nil {
+		nb.timer.Stop()
+		nb.timer = nil
+	}
+
+	var frame []byte
+	if len(nb.pending) == 1 {
+		frame = nb.pending[0]
+	} else {
+		frame = append(append([]byte{'['}, bytes.Join(nb.pending, []byte{','})...), ']')
+	}
+	nb.pending = nil
+
+	if c.envelope != nil {
+		frame = c.envelope.encode(frame)
+	}
+	return c.conn.WriteMessage(websocket.TextMessage, frame)
+}
+
+// stopNotifications drops queued notifications once the connection is closed
+func (c *wsConn) stopNotifications() {
+	c.writeLk.Lock()
+	defer c.writeLk.Unlock()
+
+	if c.notifications.timer != nil {
+		c.notifications.timer.Stop()
+		c.notifications.timer = nil
+	}
+	c.notifications.pending = nil
+}
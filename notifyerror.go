@@ -0,0 +1,77 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+)
+
+// wsNotificationError is the method of notifications sent to clients when the
+// handler of one of their notifications failed, see
+// WithNotificationErrorFrames. The params are the method of the failed
+// notification, and the JSON-RPC error object.
+const wsNotificationError = "xrpc.notification.err"
+
+// NotificationErrorHandler is called with the errors of notifications, which
+// have no response to carry them, see WithNotificationErrorHandler. ctx is the
+// context of the call (with its peer, trace id and logger), and params are the
+// raw params of the notification.
+type NotificationErrorHandler func(ctx context.Context, method string, params json.RawMessage, err error)
+
+// notificationRPCError reports errors of a notification sent with rpcError
+// (e.g. unknown methods and invalid params) to the notification error handler
+func (s *handler) notificationRPCError(ctx context.Context, req request, rpcError rpcErrFunc) rpcErrFunc {
+	return func(w func(func(io.Writer)), r *request, code ErrorCode, err error) {
+		s.notificationErrorHandler(ctx, req.Method, req.Params, err)
+		rpcError(w, r, code, err)
+	}
+}
+
+// notificationFailed handles an error returned by the handler of a
+// notification
+func (s *handler) notificationFailed(ctx context.Context, req request, err error) {
+	log.Warnf("error in RPC notification to '%s': %+v", req.Method, err)
+
+	if s.notificationErrorHandler != nil {
+		s.notificationErrorHandler(ctx, req.Method, req.Params, err)
+	}
+
+	if !s.notificationErrorFrames {
+		return
+	}
+	conn, ok := ConnectionFromContext(ctx)
+	if !ok {
+		return // http, no way to tell the client
+	}
+	if err := conn.Notify(wsNotificationError, req.Method, s.createError(err)); err != nil {
+		log.Warnf("sending notification error failed: %s", err)
+	}
+}
+
+// handleNotificationError handles a notification error frame on the client
+func (c *wsConn) handleNotificationError(frame frame) {
+	var params []param
+	if err := json.Unmarshal(frame.Params, &params); err != nil || len(params) != 2 {
+		log.Errorf("failed to unmarshal %s params: %v", wsNotificationError, err)
+		return
+	}
+
+	var method string
+	if err := json.Unmarshal(params[0].data, &method); err != nil {
+		log.Errorf("failed to unmarshal method in %s: %s", wsNotificationError, err)
+		return
+	}
+
+	var rerr respError
+	if err := json.Unmarshal(params[1].data, &rerr); err != nil {
+		log.Errorf("failed to unmarshal error in %s: %s", wsNotificationError, err)
+		return
+	}
+
+	nerr := &Error{Code: rerr.Code, Message: rerr.Message}
+	if c.onNotificationError == nil {
+		log.Warnw("notification failed on the server", "method", method, "error", nerr)
+		return
+	}
+	c.onNotificationError(method, nerr)
+}
@@ -0,0 +1,130 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+var jsonUnmarshalerType = reflect.TypeOf(new(json.Unmarshaler)).Elem()
+
+// coercibleNumber checks if params of the type are decoded with
+// decodeNumericParam in numeric coercion mode (see WithNumericCoercion): types
+// with a numeric underlying type, which don't decode themselves
+func coercibleNumber(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+	default:
+		return false
+	}
+
+	pt := reflect.PtrTo(t)
+	return !pt.Implements(jsonUnmarshalerType) && !pt.Implements(textUnmarshalerType)
+}
+
+// decodeNumericParam decodes a JSON number, or a string holding a number, into
+// v, which must be a pointer to a numeric type. Integers are accepted in any
+// notation (e.g. 1e3 or 2.0) as long as they fit the type exactly.
+func decodeNumericParam(data []byte, v reflect.Value) error {
+	data = bytes.TrimSpace(data)
+	if string(data) == "null" {
+		return nil
+	}
+
+	num := string(data)
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &num); err != nil {
+			return err
+		}
+	}
+
+	m := jsonNumber.FindStringSubmatch(num)
+	if m == nil {
+		return xerrors.Errorf("'%s' isn't a number", num)
+	}
+
+	out := v.Elem()
+	switch out.Kind() {
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(num, out.Type().Bits())
+		if err != nil {
+			return xerrors.Errorf("'%s' isn't a valid %s: %w", num, out.Type(), err)
+		}
+		out.SetFloat(f)
+		return nil
+	}
+
+	digits, isInt, fits := integerDigits(m[2], m[3], m[4])
+	if !isInt {
+		return xerrors.Errorf("%s isn't an integer, can't decode it into %s", num, out.Type())
+	}
+	if !fits {
+		return xerrors.Errorf("%s overflows %s", num, out.Type())
+	}
+	if m[1] == "-" && digits != "0" {
+		digits = "-" + digits
+	}
+
+	switch out.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(digits, 10, 64)
+		if err != nil || out.OverflowUint(n) {
+			return xerrors.Errorf("%s overflows %s", num, out.Type())
+		}
+		out.SetUint(n)
+	default:
+		n, err := strconv.ParseInt(digits, 10, 64)
+		if err != nil || out.OverflowInt(n) {
+			return xerrors.Errorf("%s overflows %s", num, out.Type())
+		}
+		out.SetInt(n)
+	}
+	return nil
+}
+
+// jsonNumber matches the JSON number grammar, capturing the sign, integer
+// part, fraction and exponent
+var jsonNumber = regexp.MustCompile(`^(-?)(0|[1-9][0-9]*)(?:\.([0-9]+))?(?:[eE]([+-]?[0-9]+))?$`)
+
+// maxIntegerDigits is the number of digits of the largest 64 bit integers
+const maxIntegerDigits = 20
+
+// integerDigits returns the decimal digits of the number with the integer
+// part, fraction and exponent of a JSON number, without a sign, if it's an
+// integer which may fit 64 bits. This is checked before the exponent is
+// expanded, so that huge exponents can't make it allocate huge strings.
+func integerDigits(intPart, frac, exp string) (digits string, isInt bool, fits bool) {
+	digits = strings.TrimLeft(intPart+frac, "0")
+	if digits == "" {
+		return "0", true, true
+	}
+
+	e := 0
+	if exp != "" {
+		var err error
+		if e, err = strconv.Atoi(exp); err != nil {
+			// the exponent alone doesn't fit an int
+			return "", !strings.HasPrefix(exp, "-"), false
+		}
+	}
+	e -= len(frac)
+
+	trimmed := strings.TrimRight(digits, "0")
+	e += len(digits) - len(trimmed)
+	digits = trimmed
+
+	if e < 0 {
+		return "", false, false
+	}
+	if len(digits)+e > maxIntegerDigits {
+		return "", true, false
+	}
+	return digits + strings.Repeat("0", e), true, true
+}
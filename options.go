@@ -1,11 +1,13 @@
 package jsonrpc
 
 import (
+	"encoding/json"
 	"net/http"
 	"reflect"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"golang.org/x/xerrors"
 )
 
 type ParamEncoder func(reflect.Value) (reflect.Value, error)
@@ -20,14 +22,45 @@ type Config struct {
 	pingInterval     time.Duration
 	timeout          time.Duration
 
-	paramEncoders map[reflect.Type]ParamEncoder
-	errors        *Errors
+	paramEncoders   map[reflect.Type]ParamEncoder
+	namespaceCodecs map[string]Codec
+	errors          *Errors
 
 	reverseHandlers       []clientHandler
 	aliasedHandlerMethods map[string]string
 
 	httpClient *http.Client
 
+	envelopeFields EnvelopeFields
+
+	conflateSubscriptions bool
+
+	protocolVersion string
+
+	bareResultMethods map[string]struct{}
+
+	maxResponseSize int64
+
+	signingSecret []byte
+
+	requestSigner *requestSigner
+
+	onNotificationError func(method string, err *Error)
+
+	lenientResponseIDs bool
+
+	healthCheckInterval time.Duration
+
+	idempotencyKeys bool
+
+	circuitBreaker *CircuitBreakerSettings
+
+	transport Transport
+
+	followMovedMethods bool
+
+	resultTransform func(method string, raw json.RawMessage) (json.RawMessage, error)
+
 	noReconnect      bool
 	proxyConnFactory func(func() (*websocket.Conn, error)) func() (*websocket.Conn, error) // for testing
 }
@@ -42,10 +75,16 @@ func defaultConfig() Config {
 		timeout:      30 * time.Second,
 
 		aliasedHandlerMethods: map[string]string{},
+		bareResultMethods:     map[string]struct{}{},
 
-		paramEncoders: map[reflect.Type]ParamEncoder{},
+		paramEncoders:   map[reflect.Type]ParamEncoder{},
+		namespaceCodecs: map[string]Codec{},
 
 		httpClient: _defaultHTTPClient,
+
+		protocolVersion: defaultProtocolVersion,
+
+		healthCheckInterval: 5 * time.Second,
 	}
 }
 
@@ -85,6 +124,15 @@ func WithParamEncoder(t interface{}, encoder ParamEncoder) func(c *Config) {
 	}
 }
 
+// WithNamespaceCodec makes the client use the given codec for params and
+// results of methods in the namespace. The namespace of a method is the part
+// of the method name before the first '.'. See Codec for details.
+func WithNamespaceCodec(namespace string, codec Codec) func(c *Config) {
+	return func(c *Config) {
+		c.namespaceCodecs[namespace] = codec
+	}
+}
+
 func WithErrors(es Errors) func(c *Config) {
 	return func(c *Config) {
 		c.errors = &es
@@ -110,3 +158,150 @@ func WithHTTPClient(h *http.Client) func(c *Config) {
 		c.httpClient = h
 	}
 }
+
+// WithEnvelopeFields sets custom names for JSON-RPC envelope fields, both in
+// requests and responses. See EnvelopeFields.
+func WithEnvelopeFields(f EnvelopeFields) func(c *Config) {
+	return func(c *Config) {
+		c.envelopeFields = f
+	}
+}
+
+// WithSubscriptionConflation makes client-side channels returned from calls keep
+// only the latest value which wasn't received yet, instead of buffering all
+// values. When the consumer can't keep up with a fast stream, intermediate values
+// are dropped, which bounds memory use at the cost of being lossy - only use this
+// for streams where only the latest value matters (e.g. state updates).
+// Errors on paired error channels are never dropped.
+func WithSubscriptionConflation() func(c *Config) {
+	return func(c *Config) {
+		c.conflateSubscriptions = true
+	}
+}
+
+// WithProtocolVersion sets the "jsonrpc" version sent in requests. The default
+// is "2.0", this option is meant for interop with legacy / non-compliant servers.
+func WithProtocolVersion(version string) func(c *Config) {
+	return func(c *Config) {
+		c.protocolVersion = version
+	}
+}
+
+// WithBareResult makes the http client accept responses to calls of the given
+// method (full wire name, e.g. "Namespace.Method") which are the bare result
+// value, without the JSON-RPC response envelope. This is an escape hatch for
+// non-compliant servers. Responses which are a JSON-RPC envelope (an object with
+// the "jsonrpc" field and a "result" or "error" field) are still handled as such,
+// so errors returned by the server are surfaced normally.
+func WithBareResult(method string) func(c *Config) {
+	return func(c *Config) {
+		c.bareResultMethods[method] = struct{}{}
+	}
+}
+
+// WithMaxResponseSize limits the size of responses the client accepts, in bytes.
+// Over http, calls with responses over the limit fail with ErrResponseTooLarge.
+// Over websocket, the limit applies to each incoming message; as oversized
+// messages can't be correlated with a call, all in-flight calls fail and the
+// connection is reset.
+func WithMaxResponseSize(n int64) func(c *Config) {
+	return func(c *Config) {
+		c.maxResponseSize = n
+	}
+}
+
+// WithRequestSigning makes the client sign http requests for servers with
+// WithRequestSignatureAuth, with signatures valid for ttl. The key is a []byte
+// HMAC secret (HS256), an ed25519.PrivateKey (EdDSA), a P-256
+// *ecdsa.PrivateKey (ES256) or an *rsa.PrivateKey (RS256), and kid is its key
+// id on the server. Each signature has a unique id, so that it can only be
+// used once. Websocket connections can't be signed.
+func WithRequestSigning(kid string, key interface{}, ttl time.Duration) func(c *Config) {
+	return func(c *Config) {
+		if _, err := jwsAlg(key); err != nil {
+			panic(xerrors.Errorf("request signing key: %w", err))
+		}
+		c.requestSigner = &requestSigner{kid: kid, key: key, ttl: ttl}
+	}
+}
+
+// WithNotificationErrorCallback sets a function called with the errors of
+// notifications the client sent over websocket, reported by servers with
+// WithNotificationErrorFrames. Without it, they're logged.
+func WithNotificationErrorCallback(cb func(method string, err *Error)) func(c *Config) {
+	return func(c *Config) {
+		c.onNotificationError = cb
+	}
+}
+
+// WithLenientResponseIDs makes the client accept responses whose id doesn't
+// match the id of the request, for servers which don't echo ids correctly. By
+// default such calls fail with ErrResponseIDMismatch, as a wrong id may be a
+// server bug, or a response to another request. With lenient ids, the response
+// to an http call is taken as its response whatever its id, and batch
+// responses with unknown ids are paired in order with calls without a
+// response. Over websocket, responses are always paired with calls by id, and
+// responses with unknown ids are dropped.
+func WithLenientResponseIDs() func(c *Config) {
+	return func(c *Config) {
+		c.lenientResponseIDs = true
+	}
+}
+
+// WithResponseSigning makes the client verify signatures of http responses
+// signed by servers with the same secret (see WithServerResponseSigning). Calls
+// with responses which are unsigned, or have an invalid signature, fail with
+// ErrInvalidSignature. Each request carries a random nonce covered by the
+// signature, so that responses to other requests don't verify. Websocket
+// responses aren't signed.
+func WithResponseSigning(secret []byte) func(c *Config) {
+	return func(c *Config) {
+		c.signingSecret = secret
+	}
+}
+
+// WithHealthCheckInterval sets how often ejected endpoints of a client created
+// with NewClientWithEndpoints are checked
+func WithHealthCheckInterval(d time.Duration) func(c *Config) {
+	return func(c *Config) {
+		c.healthCheckInterval = d
+	}
+}
+
+// WithIdempotencyKeys makes the client attach a random idempotency key to each
+// call (unless one is set with WithIdempotencyKey), which is kept when the call
+// is retried. See WithIdempotencyCache for the server side.
+func WithIdempotencyKeys() func(c *Config) {
+	return func(c *Config) {
+		c.idempotencyKeys = true
+	}
+}
+
+// WithFollowMovedMethods makes the client repeat calls which fail with a method
+// moved error (see RPCServer.RegisterMovedMethod) with the new method name, up
+// to 5 times per call.
+func WithFollowMovedMethods() func(c *Config) {
+	return func(c *Config) {
+		c.followMovedMethods = true
+	}
+}
+
+// WithResultTransform sets a function which transforms the result of each
+// successful call before it's decoded, e.g. to adapt to quirks of a server by
+// renaming fields or converting units. Returning an error fails the call.
+func WithResultTransform(f func(method string, raw json.RawMessage) (json.RawMessage, error)) func(c *Config) {
+	return func(c *Config) {
+		c.resultTransform = f
+	}
+}
+
+// WithCircuitBreaker enables a client circuit breaker. After the configured
+// number of consecutive transport failures (connection errors, not JSON-RPC error
+// responses) the circuit opens, and calls fail immediately with ErrCircuitOpen
+// for the cooldown period. After that a single trial call is let through; if it
+// succeeds the circuit closes again, otherwise it stays open for another cooldown.
+func WithCircuitBreaker(settings CircuitBreakerSettings) func(c *Config) {
+	return func(c *Config) {
+		c.circuitBreaker = &settings
+	}
+}
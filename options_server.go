@@ -5,6 +5,7 @@ import (
 	"reflect"
 	"time"
 
+	"go.uber.org/zap"
 	"golang.org/x/xerrors"
 )
 
@@ -14,23 +15,123 @@ type jsonrpcReverseClient struct{ reflect.Type }
 type ParamDecoder func(ctx context.Context, json []byte) (reflect.Value, error)
 
 type ServerConfig struct {
-	maxRequestSize int64
-	pingInterval   time.Duration
+	maxRequestSize     int64
+	pingInterval       time.Duration
+	maxInflightPerConn int
 
-	paramDecoders map[reflect.Type]ParamDecoder
-	errors        *Errors
+	priorityConcurrency int
+	priorityAging       time.Duration
+	priorityMin         int
+	priorityMax         int
+
+	workerPoolSize   int
+	workerQueueLimit int
+
+	paramDecoders   map[reflect.Type]ParamDecoder
+	namespaceCodecs map[string]Codec
+	errors          *Errors
 
 	reverseClientBuilder func(context.Context, *wsConn) (context.Context, error)
+	reverseIDScheme      IDScheme
+
+	responseTiming bool
+	responseMeta   bool
+	traceIDs       bool
+
+	envelopeFields EnvelopeFields
+
+	lenientParams   bool
+	structParams    bool
+	paramDefaults   bool
+	numericCoercion bool
+
+	streamingArrays bool
+
+	largeResponseThreshold int
+	largeResponseMode      LargeResponseMode
+
+	adaptiveTimeoutFactor float64
+
+	invokeFunc InvokeFunc
+
+	baseLogger *zap.SugaredLogger
+
+	notificationErrorHandler NotificationErrorHandler
+	notificationErrorFrames  bool
+
+	backpressure Backpressure
+
+	methodRewrite func(method string) string
+
+	paramInterceptor ParamInterceptor
+
+	maxJSONDepth int
+	maxParams    int
+
+	paramSchemas map[string]*paramSchema
+
+	strictBody bool
+
+	connContext func(context.Context, ConnInfo) context.Context
+	connClose   func(context.Context, ConnInfo, error)
+
+	protocolVersion string
+
+	streamingBatch   bool
+	orderedResponses bool
+
+	notificationBatchDelay time.Duration
+	notificationBatchCount int
+
+	idempotencyTTL   time.Duration
+	idempotencyStore IdempotencyStore
+	callerIdentity   CallerIdentity
+
+	methodCacheTTL map[string]time.Duration
+	cacheStore     CacheStore
+
+	notificationDedupTTL time.Duration
+
+	indent *jsonIndent
+
+	wsSubprotocols []string
+
+	requestTimeout time.Duration
+
+	allowGET map[string]bool
+
+	signingSecret []byte
+	requestKeys   SignatureKeys
+
+	contentCodecs contentCodecs
+
+	wireLogger    WireLogger
+	wireLogFormat WireLogFormat
+	redaction     redactionRules
+
+	methodAllowlist MethodAllowlistFunc
+
+	protocolErrorHandler ProtocolErrorHandler
 }
 
 type ServerOption func(c *ServerConfig)
 
 func defaultServerConfig() ServerConfig {
 	return ServerConfig{
-		paramDecoders:  map[reflect.Type]ParamDecoder{},
-		maxRequestSize: DEFAULT_MAX_REQUEST_SIZE,
+		paramDecoders:   map[reflect.Type]ParamDecoder{},
+		namespaceCodecs: map[string]Codec{},
+		contentCodecs:   contentCodecs{},
+		redaction:       redactionRules{},
+		methodCacheTTL:  map[string]time.Duration{},
+		paramSchemas:    map[string]*paramSchema{},
+		maxRequestSize:  DEFAULT_MAX_REQUEST_SIZE,
 
 		pingInterval: 5 * time.Second,
+
+		priorityMin: defaultMinPriority,
+		priorityMax: defaultMaxPriority,
+
+		protocolVersion: defaultProtocolVersion,
 	}
 }
 
@@ -40,6 +141,25 @@ func WithParamDecoder(t interface{}, decoder ParamDecoder) ServerOption {
 	}
 }
 
+// WithTimeFormat sets how time.Time params are decoded, e.g. TimeUnix for
+// clients sending Unix timestamps, or TimeLayout for custom layouts. It only
+// applies to params, not to time.Time fields of struct params. See Duration
+// for durations.
+func WithTimeFormat(format TimeFormat) ServerOption {
+	return func(c *ServerConfig) {
+		c.paramDecoders[timeType] = timeDecoder(format)
+	}
+}
+
+// WithServerNamespaceCodec makes the server use the given codec for params and
+// results of methods registered in the namespace. See Codec for details on how
+// the encoded values are represented on the wire.
+func WithServerNamespaceCodec(namespace string, codec Codec) ServerOption {
+	return func(c *ServerConfig) {
+		c.namespaceCodecs[namespace] = codec
+	}
+}
+
 func WithMaxRequestSize(max int64) ServerOption {
 	return func(c *ServerConfig) {
 		c.maxRequestSize = max
@@ -58,14 +178,688 @@ func WithServerPingInterval(d time.Duration) ServerOption {
 	}
 }
 
+// WithMaxInflightPerConn limits the number of calls which can be handled at the
+// same time on a single websocket connection. Calls over the limit are rejected
+// with a server busy error (code -32001), notifications over the limit are dropped.
+// This protects against feedback loops (e.g. a client calling back into the server
+// each time it gets a notification) saturating a connection.
+//
+// Calls returning channels only count towards the limit until the channel is
+// set up, active subscriptions are not counted.
+func WithMaxInflightPerConn(n int) ServerOption {
+	return func(c *ServerConfig) {
+		c.maxInflightPerConn = n
+	}
+}
+
+// WithPriorityDispatch makes websocket connections execute at most concurrency
+// calls at the same time, with calls over that queued by priority (see
+// WithCallPriority). To make sure that low priority calls don't starve, queued
+// calls gain one priority level for each aging period they spend waiting. Aging
+// of 0 disables this.
+//
+// Queued calls cancelled by the client before they're executed are answered
+// with a cancelled error (code -32800), and calls still queued when the
+// connection closes with an internal error.
+func WithPriorityDispatch(concurrency int, aging time.Duration) ServerOption {
+	return func(c *ServerConfig) {
+		c.priorityConcurrency = concurrency
+		c.priorityAging = aging
+	}
+}
+
+// WithPriorityRange sets the range call priorities are clamped to with priority
+// dispatch (see WithPriorityDispatch), as priorities are set by clients.
+// Defaults to -100 to 100.
+func WithPriorityRange(min, max int) ServerOption {
+	return func(c *ServerConfig) {
+		c.priorityMin = min
+		c.priorityMax = max
+	}
+}
+
+// WithWorkerPool makes the server execute websocket calls from all connections
+// on a pool of size goroutines, instead of a goroutine per call, to bound the
+// number of goroutines under heavy load. Calls wait in a queue of up to
+// queueLimit calls when all workers are busy; calls over that are rejected with
+// a server busy error (code -32001), and notifications are dropped.
+//
+// Handlers blocking for a long time (e.g. waiting on other calls) hold a worker
+// the whole time, so the pool should be sized accordingly. Http requests and
+// connections with priority dispatch (see WithPriorityDispatch) don't use the
+// pool. The workers exit when the server is shut down, see RPCServer.Shutdown.
+func WithWorkerPool(size, queueLimit int) ServerOption {
+	return func(c *ServerConfig) {
+		c.workerPoolSize = size
+		c.workerQueueLimit = queueLimit
+	}
+}
+
+// WithServerEnvelopeFields sets custom names for JSON-RPC envelope fields, both
+// in requests and responses, over http and websocket. See EnvelopeFields.
+func WithServerEnvelopeFields(f EnvelopeFields) ServerOption {
+	return func(c *ServerConfig) {
+		c.envelopeFields = f
+	}
+}
+
+// WithLenientParams makes the server accept a bare object as params of methods
+// taking a single param, as if it was wrapped in a single-element array. Some
+// clients send `"params": {...}` instead of `"params": [{...}]`.
+//
+// Note that this is ambiguous for methods taking a single object array param,
+// which is why it's not enabled by default.
+func WithLenientParams() ServerOption {
+	return func(c *ServerConfig) {
+		c.lenientParams = true
+	}
+}
+
+// WithStructParams makes methods taking a single struct param accept named
+// params (a bare object, like with WithLenientParams), and positional params
+// mapping to the struct fields in declaration order, e.g. `["a", 1]` for
+// `struct{Name string; Count int}`. Trailing fields may be omitted, but at least
+// one param is required.
+//
+// Struct types implementing json.Unmarshaler or encoding.TextUnmarshaler, and
+// structs with embedded fields, are decoded as usual.
+func WithStructParams() ServerOption {
+	return func(c *ServerConfig) {
+		c.structParams = true
+	}
+}
+
+// WithNumericCoercion makes the server accept params of numeric types (including
+// named types like `type Height int64`) sent as strings holding numbers, e.g.
+// "42", and integer params in any notation which decodes to an integer exactly,
+// e.g. 1e3 or 2.0. Values which don't fit the param type without loss, like 300
+// for an int8 or 1.5 for an int, are still rejected. Types implementing
+// json.Unmarshaler or encoding.TextUnmarshaler, and numbers nested in other
+// params, are decoded as usual.
+func WithNumericCoercion() ServerOption {
+	return func(c *ServerConfig) {
+		c.numericCoercion = true
+	}
+}
+
+// WithParamDefaults makes the server set default values of struct param fields
+// tagged with `default:"..."` (e.g. `json:"limit" default:"100"`), for fields
+// omitted by the client. Fields sent explicitly keep the sent value, even if
+// it's a zero value. Defaults of nested struct fields apply too, but not those
+// of structs behind pointers (other than the param itself), in slices or maps.
+//
+// Supported field types are strings, bools, numbers, time.Duration and types
+// implementing encoding.TextUnmarshaler. Params of namespaces with a codec (see
+// WithServerNamespaceCodec) don't get defaults.
+func WithParamDefaults() ServerOption {
+	return func(c *ServerConfig) {
+		c.paramDefaults = true
+	}
+}
+
+// WithStreamingArrays makes the server write slice and array results one
+// element at a time, instead of marshaling the entire result in memory before
+// writing it, which saves memory for methods returning huge slices.
+//
+// Elements are encoded twice, once to check that they can be encoded and to
+// get the response size for WithLargeResponsePolicy, and once while writing,
+// trading CPU time for memory. Results of methods with caching
+// (WithMethodCache), idempotent calls and indented responses (WithIndent) are
+// never streamed.
+func WithStreamingArrays() ServerOption {
+	return func(c *ServerConfig) {
+		c.streamingArrays = true
+	}
+}
+
+// WithSubscriptionBackpressure sets the default policy for subscriptions
+// (channels returned by methods) whose client reads slower than values are
+// produced, see Backpressure. Methods can override it for the channel they
+// return with SetSubscriptionBackpressure. The default is BackpressureBlock.
+func WithSubscriptionBackpressure(policy Backpressure) ServerOption {
+	return func(c *ServerConfig) {
+		c.backpressure = policy
+	}
+}
+
+// WithMethodRewrite sets a function which rewrites method names of incoming
+// calls before the method is looked up, e.g. to route a legacy "Foo.BarV1" to
+// the registered "Foo.Bar". Returning the name unchanged keeps the default
+// lookup, returning an empty string rejects the call with a method not found
+// error. Everything configured per method (e.g. aliases, see
+// RPCServer.AliasMethod, allowlists, caches and schemas) applies to the
+// rewritten name.
+func WithMethodRewrite(rewrite func(method string) string) ServerOption {
+	return func(c *ServerConfig) {
+		c.methodRewrite = rewrite
+	}
+}
+
+// WithLargeResponsePolicy sets what happens to responses of calls which are
+// larger than threshold bytes when encoded (without indentation, see
+// WithIndent), see LargeResponseMode. Responses are measured when they're
+// encoded before writing; array results streamed element by element (see
+// WithStreamingArrays) are measured by encoding their elements without keeping
+// the output. Output of io.Writer params isn't measured.
+func WithLargeResponsePolicy(threshold int, mode LargeResponseMode) ServerOption {
+	return func(c *ServerConfig) {
+		c.largeResponseThreshold = threshold
+		c.largeResponseMode = mode
+	}
+}
+
+// WithAdaptiveTimeout makes the server bound calls by the recent latency of
+// their method: once a method was called enough times, the context of its
+// calls gets a timeout of the 99th percentile of its recent call durations
+// multiplied by factor (with a floor of 10ms), so that calls much slower than
+// usual are cut off without a static timeout. The timeout follows the method
+// latency as it changes. Only methods taking a context can be cut off, and
+// channel methods aren't.
+//
+// Current timeouts are returned by RPCServer.AdaptiveTimeouts, and calls which
+// timed out are counted by metrics.RPCAdaptiveTimeout. Calls which timed out
+// are taken into account as lasting the timeout, so that when over 1% of
+// recent calls are cut off the timeout grows by factor, until it catches up
+// with a method which got slower. The factor must be greater than 1, as with
+// lower factors calls as slow as the p99 would be cut off.
+func WithAdaptiveTimeout(factor float64) ServerOption {
+	if !(factor > 1) {
+		panic(xerrors.Errorf("adaptive timeout factor must be greater than 1, got %v", factor))
+	}
+	return func(c *ServerConfig) {
+		c.adaptiveTimeoutFactor = factor
+	}
+}
+
+// WithBaseLogger makes the server give each call a logger derived from base,
+// tagged with the method, request id and peer of the call, which handlers get
+// with Logger.
+func WithBaseLogger(base *zap.SugaredLogger) ServerOption {
+	return func(c *ServerConfig) {
+		c.baseLogger = base
+	}
+}
+
+// WithNotificationErrorHandler sets a function called with the errors of
+// notifications (calls without an id), which would otherwise only be logged as
+// notifications get no response: errors returned by their handler, and
+// failures to call it (e.g. unknown methods, invalid params).
+func WithNotificationErrorHandler(h NotificationErrorHandler) ServerOption {
+	return func(c *ServerConfig) {
+		c.notificationErrorHandler = h
+	}
+}
+
+// WithNotificationErrorFrames makes the server tell websocket clients about
+// errors returned by the handlers of their notifications, with an out-of-band
+// notification carrying the method and the JSON-RPC error object. Clients of
+// this package pass them to the WithNotificationErrorCallback callback, older
+// clients may answer them with an error. Over http, errors aren't sent.
+func WithNotificationErrorFrames() ServerOption {
+	return func(c *ServerConfig) {
+		c.notificationErrorFrames = true
+	}
+}
+
+// WithInvokeFunc sets a function which invokes methods in place of the server
+// calling them directly, see InvokeFunc. It's meant for tests of the dispatch
+// machinery, e.g. spies capturing the decoded params of calls.
+func WithInvokeFunc(invoke InvokeFunc) ServerOption {
+	return func(c *ServerConfig) {
+		c.invokeFunc = invoke
+	}
+}
+
+// WithParamInterceptor sets a function which can inspect and modify the params
+// of each call before they are decoded, see ParamInterceptor.
+func WithParamInterceptor(i ParamInterceptor) ServerOption {
+	return func(c *ServerConfig) {
+		c.paramInterceptor = i
+	}
+}
+
+// WithMaxJSONDepth makes the server reject calls with params in which arrays
+// and objects are nested deeper than n levels (counting the params array itself,
+// so [1, [2]] has a depth of 2) with an invalid params error, before the params
+// are decoded. This protects handlers from deeply nested payloads, which are
+// expensive to decode.
+func WithMaxJSONDepth(n int) ServerOption {
+	return func(c *ServerConfig) {
+		c.maxJSONDepth = n
+	}
+}
+
+// WithMaxParams makes the server reject calls with more than n params with an
+// invalid params error, before the params are decoded. Calls with a wrong
+// number of params are rejected anyway, so this mostly bounds the params of
+// methods taking RawParams.
+func WithMaxParams(n int) ServerOption {
+	return func(c *ServerConfig) {
+		c.maxParams = n
+	}
+}
+
+// WithParamSchema makes the server validate the params of calls to method
+// against a JSON Schema before they are decoded, which is mostly useful for
+// methods taking RawParams. The params are validated as sent by
+// the client, so the schema of positional params is an array schema. Calls with
+// params not matching the schema are rejected with an invalid params error,
+// with the violations listed in the error data.
+//
+// Positional params can get a schema each with the tuple form of items, e.g.
+// `{"type": "array", "items": [{"type": "string"}, {"type": "integer"}],
+// "additionalItems": false}`.
+//
+// Supported keywords are type, enum, properties, required,
+// additionalProperties, items, additionalItems, minItems, maxItems,
+// minLength, maxLength, pattern, minimum and maximum, along with annotations
+// such as title and description. Enum values are compared as JSON values, so 1 matches 1.0.
+// Panics if the schema can't be parsed or uses other keywords.
+func WithParamSchema(method string, schema []byte) ServerOption {
+	ps, err := compileSchema(schema)
+	if err != nil {
+		panic(xerrors.Errorf("invalid param schema for '%s': %w", method, err))
+	}
+	return func(c *ServerConfig) {
+		c.paramSchemas[method] = ps
+	}
+}
+
+// WithStrictBody makes the server reject http requests with anything but
+// whitespace after the JSON request (e.g. `{...}{...}` or `{...}garbage`) with
+// a parse error. By default such trailing data is ignored, which can hide
+// request smuggling bugs in proxies.
+func WithStrictBody() ServerOption {
+	return func(c *ServerConfig) {
+		c.strictBody = true
+	}
+}
+
+// WithWSSubprotocols makes the server negotiate a websocket subprotocol from
+// the given list (in preference order) during the handshake. Connections which
+// don't offer any of the subprotocols in the Sec-WebSocket-Protocol header are
+// rejected. The negotiated subprotocol is echoed in the handshake response, and
+// available in ConnInfo (see WithConnContext).
+//
+// Go clients can offer subprotocols by setting the Sec-WebSocket-Protocol
+// request header.
+func WithWSSubprotocols(protocols []string) ServerOption {
+	return func(c *ServerConfig) {
+		c.wsSubprotocols = protocols
+	}
+}
+
+// WithProtocolErrorHandler sets a function called with requests rejected for
+// version or format reasons: unparseable or oversized requests, unsupported
+// jsonrpc versions, invalid ids and malformed batch elements (reported once
+// per element). This helps spotting misconfigured clients. The handler is
+// called synchronously, so it shouldn't block.
+func WithProtocolErrorHandler(h ProtocolErrorHandler) ServerOption {
+	return func(c *ServerConfig) {
+		c.protocolErrorHandler = h
+	}
+}
+
+// WithMethodAllowlistFunc makes the server only allow calls to the methods (by
+// wire name) in the set returned by allowed. The set is computed once per
+// websocket connection, or per http request, on the first call, with the
+// context of that call; it can e.g. depend on the identity authenticated by an
+// http middleware, for tenant-specific APIs.
+//
+// Calls to other methods, and all calls if allowed returns an error, are
+// rejected with an access denied error (code -32002) before the method is
+// looked up, so callers can't tell which methods exist.
+func WithMethodAllowlistFunc(allowed MethodAllowlistFunc) ServerOption {
+	return func(c *ServerConfig) {
+		c.methodAllowlist = allowed
+	}
+}
+
+// WithRequestTimeout sets the maximum time the server spends handling an http
+// request, as the deadline of the handler context. Clients can ask for a
+// shorter deadline with the TimeoutHeader header; header values longer than
+// the maximum are capped to it. Without this option, only the header bounds
+// requests.
+//
+// Websocket connections aren't affected, their calls are bounded by the
+// client cancelling them.
+func WithRequestTimeout(max time.Duration) ServerOption {
+	return func(c *ServerConfig) {
+		c.requestTimeout = max
+	}
+}
+
+// WithAllowGET makes the server accept GET requests calling the given methods,
+// for simple clients which can't send POST requests. The method, params (a JSON
+// array, defaults to no params) and id (defaults to 0) are read from the query
+// string, e.g. `?method=Foo.Bar&params=[1,"a"]&id=1`, and the response is a
+// normal JSON-RPC response.
+//
+// Calls to other methods are rejected with an invalid request error. As GET
+// requests can be triggered e.g. by links, only read-only methods should be
+// allowed.
+func WithAllowGET(allowedMethods []string) ServerOption {
+	return func(c *ServerConfig) {
+		c.allowGET = map[string]bool{}
+		for _, m := range allowedMethods {
+			c.allowGET[m] = true
+		}
+	}
+}
+
+// WithCodecForContentType makes the server accept http request bodies encoded
+// with the codec when sent with the given Content-Type (e.g. "application/cbor"),
+// and encode responses with it for requests which accept it (Accept header), or
+// which were sent with it and don't accept another registered type. The same
+// handlers serve JSON and codec clients.
+//
+// Bodies are transcoded to and from JSON through generic values, so the codec
+// must decode into interface{} values which encoding/json can marshal (maps with
+// string keys), and must encode float64 numbers and map[string]interface{}.
+// Websocket connections always use JSON.
+func WithCodecForContentType(contentType string, codec Codec) ServerOption {
+	return func(c *ServerConfig) {
+		c.contentCodecs[mediaType(contentType)] = codec
+	}
+}
+
+// WithServerResponseSigning makes the server sign http responses with an
+// HMAC-SHA256 of the request nonce (the SignatureNonceHeader header) and the
+// response body, keyed with the shared secret, sent hex encoded in the
+// SignatureHeader header. Clients with the same secret (see
+// WithResponseSigning) send a new nonce with each request, and reject
+// responses with invalid signatures.
+//
+// Responses are buffered to be signed, so streamed responses (writer params,
+// see WithStreamingArrays) aren't flushed progressively and only reach the
+// client once complete. Only http responses are signed, websocket connections
+// should rely on TLS.
+func WithServerResponseSigning(secret []byte) ServerOption {
+	return func(c *ServerConfig) {
+		c.signingSecret = secret
+	}
+}
+
+// WithRequestSignatureAuth makes the server require http requests to be signed
+// with one of the keys, as done by clients with WithRequestSigning. The
+// signature is a compact JWS sent in the RequestSignatureHeader header, with
+// the key id as the "kid" header, and claims with the base64url encoded
+// SHA-256 of the request body as "bodyHash", the http method as "method", the
+// request URI (path and query) as "uri", and the expiry as "exp".
+// Requests with a missing, invalid or expired signature, or a signature of
+// another request, are rejected with an access denied error (code -32002).
+// Handlers can get the claims of the request with RequestClaims.
+//
+// Signatures with a "jti" claim (unique id) are rejected when used again
+// before they expire, clients with WithRequestSigning always set one.
+// Signatures without it can be replayed until they expire, so they should
+// be short-lived.
+//
+// Websocket connections and streamed requests (see StreamContentType) are
+// rejected, as their messages can't be verified before calls are made.
+func WithRequestSignatureAuth(keys SignatureKeys) ServerOption {
+	return func(c *ServerConfig) {
+		c.requestKeys = keys
+	}
+}
+
+// WithWireLogger sets a function which is called with each request handled by
+// the server, and each message sent in response, e.g. for audit logs. See
+// WithLogRedaction for masking sensitive fields.
+func WithWireLogger(l WireLogger) ServerOption {
+	return func(c *ServerConfig) {
+		c.wireLogger = l
+	}
+}
+
+// WithWireLogFormat sets the formatting of messages passed to the wire logger
+// (see WithWireLogger), e.g. WireLogCompact for single-line logs of
+// pretty-printed messages. Messages on the wire are sent unchanged. The default
+// is WireLogAsIs.
+func WithWireLogFormat(format WireLogFormat) ServerOption {
+	return func(c *ServerConfig) {
+		c.wireLogFormat = format
+	}
+}
+
+// WithLogRedaction makes messages of the method passed to the wire logger (see
+// WithWireLogger) have values of the given fields replaced with "***". Fields
+// are object keys matched at any depth inside the params and the result, so
+// e.g. "password" masks {"user": {"password": ...}} in any param. An empty
+// method applies the rules to all methods. Messages which can't be parsed are
+// masked entirely. See WithLogParamRedaction for params which aren't objects.
+//
+// Redaction only applies to the wire logger, messages on the wire are sent
+// unchanged.
+func WithLogRedaction(method string, fields ...string) ServerOption {
+	return func(c *ServerConfig) {
+		r := c.redaction.add(method)
+		for _, f := range fields {
+			r.fields[f] = struct{}{}
+		}
+	}
+}
+
+// WithLogParamRedaction makes requests to the method passed to the wire logger
+// (see WithWireLogger) have the params at the given positions (starting at 0)
+// replaced with "***", e.g. position 1 masks the password of
+// Login(user, password string). It applies to positional params, params sent
+// by name are masked by their name with WithLogRedaction. An empty method
+// applies the rules to all methods.
+func WithLogParamRedaction(method string, positions ...int) ServerOption {
+	return func(c *ServerConfig) {
+		r := c.redaction.add(method)
+		for _, p := range positions {
+			r.params[p] = struct{}{}
+		}
+	}
+}
+
+// WithConnContext sets a function which is called once for each new websocket
+// connection, before any calls on it are handled. The returned context is used
+// for all calls on the connection, which makes it possible to set up
+// connection-scoped state, e.g. a logger with the connection ID. The context
+// passed to the function carries values set by http middleware wrapping the
+// server (like auth.Handler), so it runs after auth.
+func WithConnContext(f func(ctx context.Context, conn ConnInfo) context.Context) ServerOption {
+	return func(c *ServerConfig) {
+		c.connContext = f
+	}
+}
+
+// WithConnClose sets a function which is called after a websocket connection
+// is closed, with the context returned from the WithConnContext function.
+// Together with WithConnContext it can e.g. track active sessions. err is why
+// the connection was closed (e.g. a read error or a ping timeout), nil if the
+// client closed it normally.
+func WithConnClose(f func(ctx context.Context, conn ConnInfo, err error)) ServerOption {
+	return func(c *ServerConfig) {
+		c.connClose = f
+	}
+}
+
+// WithServerProtocolVersion sets the "jsonrpc" version emitted by the server,
+// and the only version it accepts in requests. Requests with other versions are
+// rejected with an invalid request error. The default is "2.0", this option is
+// meant for interop with legacy / non-compliant clients.
+func WithServerProtocolVersion(version string) ServerOption {
+	return func(c *ServerConfig) {
+		c.protocolVersion = version
+	}
+}
+
+// WithStreamingBatch enables JSON-RPC batches over websocket. Each call in a
+// batch frame is handled concurrently, and its response is sent as a separate
+// message as soon as the call completes, instead of waiting for the whole batch.
+// Responses are correlated with calls by id only, there is no ordering guarantee.
+//
+// Batches over http are not affected, and are always answered with a single
+// response array.
+func WithStreamingBatch() ServerOption {
+	return func(c *ServerConfig) {
+		c.streamingBatch = true
+	}
+}
+
+// WithNotificationBatching makes websocket connections coalesce notifications
+// sent to the client (channel values, see Connection.Notify) into batch frames,
+// JSON arrays of notification objects, reducing the per-frame overhead of
+// bursts of notifications. Queued notifications are sent once maxDelay passed
+// since the first of them was queued, or once maxCount are queued (0 for no
+// limit), and before any other message, so that messages keep their order.
+// A lone notification is sent as a regular frame. Clients of this package
+// accept batches of notifications.
+//
+// As notifications are queued, BackpressureDisconnect timeouts of channels
+// don't apply to sending the batch.
+func WithNotificationBatching(maxDelay time.Duration, maxCount int) ServerOption {
+	return func(c *ServerConfig) {
+		c.notificationBatchDelay = maxDelay
+		c.notificationBatchCount = maxCount
+	}
+}
+
+// WithOrderedResponses makes websocket connections write responses in the order
+// the calls arrived, even if handlers complete out of order. Responses of calls
+// which complete early are buffered until all earlier calls are answered, so
+// this trades latency (and memory) for ordering, and a single slow call delays
+// all responses after it. Progress notifications are ordered with responses.
+//
+// Responses of calls returning channels are sent when the channel is set up,
+// and are not ordered. Http batches are always answered in order.
+func WithOrderedResponses() ServerOption {
+	return func(c *ServerConfig) {
+		c.orderedResponses = true
+	}
+}
+
+// WithIdempotencyCache makes the server deduplicate calls carrying an
+// idempotency key (see WithIdempotencyKey and WithIdempotencyKeys). The response
+// of the first call to a method with a given key is stored for ttl, and repeated
+// calls with the key get the stored response (with their own id) instead of
+// executing the method again. Calls with a key which is still being executed
+// wait for the first call to finish.
+//
+// Keys are scoped to the caller (see WithCallerIdentity), and repeated calls
+// must have the same params as the first call, otherwise they fail with an
+// invalid request error.
+//
+// If store is nil, responses are stored in memory. Methods returning channels
+// are never deduplicated.
+func WithIdempotencyCache(ttl time.Duration, store IdempotencyStore) ServerOption {
+	return func(c *ServerConfig) {
+		c.idempotencyTTL = ttl
+		c.idempotencyStore = store
+	}
+}
+
+// WithCallerIdentity sets how the server identifies callers, for scoping
+// idempotency keys (see WithIdempotencyCache) and cached results (see
+// WithMethodCache), so that callers can't get the responses of others. An
+// identity function returning the same identity (e.g. "") for all callers
+// makes cached results shared.
+//
+// By default callers are identified by the "sub" claim of signed requests
+// (see WithRequestSignatureAuth), or their TLS client certificate. Results
+// aren't cached for callers with neither, as callers behind the same NAT or
+// proxy can't be told apart (e.g. with header-based auth); idempotency keys
+// of such callers are scoped to their IP address.
+func WithCallerIdentity(f CallerIdentity) ServerOption {
+	return func(c *ServerConfig) {
+		c.callerIdentity = f
+	}
+}
+
+// WithMethodCache makes the server cache successful results of the method (by
+// its wire name) for ttl. Repeated calls with identical params within the ttl
+// get the cached result (with their own id) without calling the handler, and
+// concurrent identical calls wait for the first one to finish. Errors and
+// response meta (e.g. trace ids) are never cached. Results are cached per
+// caller, and only for callers with an identity, see WithCallerIdentity.
+//
+// This is meant for expensive read-only methods. Methods returning channels are
+// never cached. See WithMethodCacheStore for where results are stored.
+func WithMethodCache(method string, ttl time.Duration) ServerOption {
+	return func(c *ServerConfig) {
+		c.methodCacheTTL[method] = ttl
+	}
+}
+
+// WithMethodCacheStore sets the store of results cached with WithMethodCache,
+// by default results are stored in memory
+func WithMethodCacheStore(store CacheStore) ServerOption {
+	return func(c *ServerConfig) {
+		c.cacheStore = store
+	}
+}
+
+// WithNotificationDedup makes the server skip notifications (calls without an
+// id) identical to one handled within ttl, i.e. with the same method and params,
+// ignoring whitespace differences. This is meant for idempotent event
+// notifications from at-least-once delivery systems, which may re-deliver
+// them. Calls with ids are never deduplicated, see WithIdempotencyCache.
+func WithNotificationDedup(ttl time.Duration) ServerOption {
+	return func(c *ServerConfig) {
+		c.notificationDedupTTL = ttl
+	}
+}
+
+// WithIndent makes the server pretty-print responses (including errors and
+// batch responses) with the given prefix and indent, see json.Indent. This is
+// meant for debugging, and wastes bandwidth in production.
+func WithIndent(prefix, indent string) ServerOption {
+	return func(c *ServerConfig) {
+		c.indent = &jsonIndent{prefix: prefix, indent: indent}
+	}
+}
+
+// WithResponseTiming enables the non-standard response timing extension. When
+// enabled, requests which set the "ResponseTiming" key in their meta will get
+// a "meta" object in the response with the "ServerDuration" key set to the time
+// the server spent processing the request (in time.Duration string format).
+//
+// This deviates from the JSON-RPC 2.0 spec, so it's off by default, and even when
+// enabled, only requests which explicitly ask for it will get the extra field.
+func WithResponseTiming() ServerOption {
+	return func(c *ServerConfig) {
+		c.responseTiming = true
+	}
+}
+
+// WithResponseMeta enables the non-standard response meta extension. When
+// enabled, handlers can set keys in a "meta" object of the response with
+// SetResponseMeta. Responses without meta set don't have the "meta" field.
+func WithResponseMeta() ServerOption {
+	return func(c *ServerConfig) {
+		c.responseMeta = true
+	}
+}
+
+// WithTraceIDPropagation makes the server echo a trace id in the "TraceID" key
+// of the "meta" object of each response, to tie client and server logs
+// together. The trace id is taken from the "TraceID" key of the request meta
+// (set by clients for calls made with a WithTraceID context), or for http
+// requests from the X-Trace-Id header, or from the request context (see
+// WithTraceID), and generated if there is none. Handlers get it with TraceID.
+//
+// Responses to http requests also carry the trace id of the request in the
+// X-Trace-Id header. Like WithResponseMeta, this deviates from the JSON-RPC 2.0
+// spec.
+func WithTraceIDPropagation() ServerOption {
+	return func(c *ServerConfig) {
+		c.traceIDs = true
+	}
+}
+
 // WithReverseClient will allow extracting reverse client on **WEBSOCKET** calls.
 // RP is a proxy-struct type, much like the one passed to NewClient.
 func WithReverseClient[RP any](namespace string) ServerOption {
 	return func(c *ServerConfig) {
 		c.reverseClientBuilder = func(ctx context.Context, conn *wsConn) (context.Context, error) {
 			cl := client{
-				namespace:     namespace,
-				paramEncoders: map[reflect.Type]ParamEncoder{},
+				paramEncoders:   map[reflect.Type]ParamEncoder{},
+				protocolVersion: c.protocolVersion,
+				idScheme:        c.reverseIDScheme,
 			}
 
 			// todo test that everything is closing correctly
@@ -76,8 +870,8 @@ func WithReverseClient[RP any](namespace string) ServerOption {
 
 			calls := new(RP)
 
-			err := cl.provide([]interface{}{
-				calls,
+			err := cl.provide([]clientHandler{
+				{namespace, calls},
 			})
 			if err != nil {
 				return nil, xerrors.Errorf("provide reverse client calls: %w", err)
@@ -88,6 +882,17 @@ func WithReverseClient[RP any](namespace string) ServerOption {
 	}
 }
 
+// WithReverseCallIDs sets the scheme of request ids of calls made with reverse
+// clients (see WithReverseClient), e.g. NegativeIDs or PrefixedIDs. Ids of calls
+// in each direction are tracked separately by this package, but peers using
+// other implementations may need server-initiated ids to be distinguishable
+// from their own.
+func WithReverseCallIDs(scheme IDScheme) ServerOption {
+	return func(c *ServerConfig) {
+		c.reverseIDScheme = scheme
+	}
+}
+
 // ExtractReverseClient will extract reverse client from context. Reverse client for the type
 // will only be present if the server was constructed with a matching WithReverseClient option
 // and the connection was a websocket connection.
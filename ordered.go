@@ -0,0 +1,93 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// responseOrder makes responses on a connection be written in the order the
+// calls arrived, see WithOrderedResponses
+type responseOrder struct {
+	// write writes a message to the connection
+	write func(func(io.Writer))
+
+	lk sync.Mutex
+	// slots of calls which didn't get their responses written yet, in arrival
+	// order; messages of the first call are written directly
+	slots []*responseSlot
+}
+
+type responseSlot struct {
+	msgs [][]byte
+	done bool
+}
+
+func newResponseOrder(write func(func(io.Writer))) *responseOrder {
+	return &responseOrder{
+		write: write,
+	}
+}
+
+// reserve reserves a position for the messages of a call, it must be called in
+// call arrival order. Messages written with the returned writer are buffered
+// until all calls which arrived earlier are done. done must be called after
+// the call has written all its messages.
+func (o *responseOrder) reserve() (w func(func(io.Writer)), done func()) {
+	slot := &responseSlot{}
+
+	o.lk.Lock()
+	o.slots = append(o.slots, slot)
+	o.lk.Unlock()
+
+	w = func(cb func(io.Writer)) {
+		o.lk.Lock()
+		defer o.lk.Unlock()
+
+		if o.slots[0] == slot {
+			o.write(cb)
+			return
+		}
+
+		var buf bytes.Buffer
+		cb(&buf)
+		slot.msgs = append(slot.msgs, buf.Bytes())
+	}
+
+	var doneOnce sync.Once
+	done = func() {
+		doneOnce.Do(func() {
+			o.lk.Lock()
+			defer o.lk.Unlock()
+
+			slot.done = true
+			o.flush()
+		})
+	}
+
+	return w, done
+}
+
+// flush writes buffered messages of calls which are now first, must be called
+// with lk held
+func (o *responseOrder) flush() {
+	for len(o.slots) > 0 && o.slots[0].done {
+		o.slots[0] = nil
+		o.slots = o.slots[1:]
+
+		if len(o.slots) == 0 {
+			return
+		}
+
+		next := o.slots[0]
+		for _, msg := range next.msgs {
+			msg := msg
+			o.write(func(w io.Writer) {
+				if _, err := w.Write(msg); err != nil {
+					log.Warnf("writing ordered response: %s", err)
+				}
+			})
+		}
+		next.msgs = nil
+	}
+}
@@ -0,0 +1,151 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/base64"
+	"strconv"
+
+	"golang.org/x/xerrors"
+)
+
+// Page is a page of results of a paginated method. Paginated methods take a
+// cursor param, and return the first page when called with an empty cursor.
+type Page[T any] struct {
+	Items []T `json:"items"`
+
+	// Cursor is an opaque cursor for fetching the next page, empty if there are
+	// no more pages
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// Paginator splits results of a paginated method into pages, handlers can use
+// it to implement the method:
+//
+//	func (h *Handler) List(ctx context.Context, cursor string) (jsonrpc.Page[Item], error) {
+//		return h.paginator.Page(ctx, cursor)
+//	}
+type Paginator[T any] struct {
+	// PageSize is the maximum number of items in a page
+	PageSize int
+
+	// Fetch returns up to limit items, starting at offset. Returning less than
+	// limit items means that there are no more items.
+	Fetch func(ctx context.Context, offset, limit int) ([]T, error)
+}
+
+// Page returns the page at the cursor, the first page if cursor is empty.
+//
+// Pages with PageSize items always have a cursor, as the paginator can't tell
+// if there are more items, so the last page may be empty.
+func (p *Paginator[T]) Page(ctx context.Context, cursor string) (Page[T], error) {
+	if p.PageSize < 1 {
+		return Page[T]{}, xerrors.Errorf("invalid page size %d", p.PageSize)
+	}
+
+	offset, err := decodeCursor(cursor)
+	if err != nil {
+		return Page[T]{}, err
+	}
+
+	items, err := p.Fetch(ctx, offset, p.PageSize)
+	if err != nil {
+		return Page[T]{}, err
+	}
+	if len(items) > p.PageSize {
+		items = items[:p.PageSize]
+	}
+
+	page := Page[T]{Items: items}
+	if page.Items == nil {
+		page.Items = []T{}
+	}
+	if len(items) == p.PageSize {
+		page.Cursor = encodeCursor(offset + len(items))
+	}
+	return page, nil
+}
+
+func encodeCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, xerrors.Errorf("invalid cursor: %w", err)
+	}
+	offset, err := strconv.Atoi(string(b))
+	if err != nil || offset < 0 {
+		return 0, xerrors.Errorf("invalid cursor '%s'", cursor)
+	}
+	return offset, nil
+}
+
+// PageIterator iterates over items of a paginated method, fetching pages as
+// needed:
+//
+//	it := jsonrpc.NewPageIterator(ctx, client.List)
+//	for it.Next() {
+//		item := it.Item()
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type PageIterator[T any] struct {
+	ctx   context.Context
+	fetch func(ctx context.Context, cursor string) (Page[T], error)
+
+	items  []T
+	cursor string
+	last   bool // the page without a cursor was fetched
+
+	item T
+	err  error
+}
+
+// NewPageIterator creates an iterator over items returned by fetch, which is
+// usually a proxy func of a paginated method
+func NewPageIterator[T any](ctx context.Context, fetch func(ctx context.Context, cursor string) (Page[T], error)) *PageIterator[T] {
+	return &PageIterator[T]{
+		ctx:   ctx,
+		fetch: fetch,
+	}
+}
+
+// Next advances the iterator to the next item, it returns false when there are
+// no more items, or fetching a page failed (see Err)
+func (it *PageIterator[T]) Next() bool {
+	for len(it.items) == 0 {
+		if it.last || it.err != nil {
+			return false
+		}
+
+		page, err := it.fetch(it.ctx, it.cursor)
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		it.items = page.Items
+		it.cursor = page.Cursor
+		it.last = page.Cursor == ""
+	}
+
+	it.item = it.items[0]
+	it.items = it.items[1:]
+	return true
+}
+
+// Item returns the current item
+func (it *PageIterator[T]) Item() T {
+	return it.item
+}
+
+// Err returns the error which stopped the iteration, if any
+func (it *PageIterator[T]) Err() error {
+	return it.err
+}
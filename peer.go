@@ -0,0 +1,90 @@
+package jsonrpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"net/http"
+)
+
+// Peer describes the network peer a call was received from
+type Peer struct {
+	// RemoteAddr is the network address of the peer, as reported by net/http
+	RemoteAddr string
+
+	// TLS is the TLS connection state, nil for connections without TLS
+	TLS *tls.ConnectionState
+}
+
+type peerKey struct{}
+
+// PeerFromContext returns the peer of the connection a call was received on.
+// The context passed to handlers has the peer set both for http requests and
+// websocket connections. If there is no network peer (e.g. for calls made on
+// the client side through WithClientHandler handlers), ok is false.
+func PeerFromContext(ctx context.Context) (peer Peer, ok bool) {
+	peer, ok = ctx.Value(peerKey{}).(Peer)
+	return peer, ok
+}
+
+func withPeer(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, peerKey{}, Peer{
+		RemoteAddr: r.RemoteAddr,
+		TLS:        r.TLS,
+	})
+}
+
+// CallerIdentity returns an identity of the caller of a call, from the context
+// passed to handlers, see WithCallerIdentity
+type CallerIdentity func(ctx context.Context) string
+
+// verifiedCallerIdentity identifies callers by the subject of signed requests
+// or their TLS client certificate, false for callers without either
+func verifiedCallerIdentity(ctx context.Context) (string, bool) {
+	if claims, ok := RequestClaims(ctx); ok {
+		if sub, ok := claims["sub"].(string); ok && sub != "" {
+			return "sub:" + sub, true
+		}
+	}
+
+	peer, ok := PeerFromContext(ctx)
+	if ok && peer.TLS != nil && len(peer.TLS.PeerCertificates) > 0 {
+		h := sha256.Sum256(peer.TLS.PeerCertificates[0].Raw)
+		return "cert:" + hex.EncodeToString(h[:]), true
+	}
+	return "", false
+}
+
+// idempotencyCaller returns the identity idempotency keys are scoped to. With
+// no verified identity the IP address is used; keys are picked by clients,
+// so it only keeps keys of callers behind other addresses apart.
+func (s *handler) idempotencyCaller(ctx context.Context) string {
+	if s.callerIdentity != nil {
+		return s.callerIdentity(ctx)
+	}
+	if id, ok := verifiedCallerIdentity(ctx); ok {
+		return id
+	}
+
+	peer, ok := PeerFromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(peer.RemoteAddr)
+	if err != nil {
+		host = peer.RemoteAddr
+	}
+	return "addr:" + host
+}
+
+// cacheCaller returns the identity cached results are scoped to, false if the
+// caller can't be told apart from others, in which case nothing is cached.
+// Addresses aren't used, as callers behind the same NAT or proxy share them.
+func (s *handler) cacheCaller(ctx context.Context) (string, bool) {
+	if s.callerIdentity != nil {
+		return s.callerIdentity(ctx), true
+	}
+	return verifiedCallerIdentity(ctx)
+}
@@ -0,0 +1,207 @@
+package jsonrpc
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// metaPriority is the request meta key carrying call priority
+const metaPriority = "Priority"
+
+// default range priorities are clamped to, see WithPriorityRange
+const (
+	defaultMinPriority = -100
+	defaultMaxPriority = 100
+)
+
+type callPriorityKey struct{}
+
+// WithCallPriority returns a context which makes calls made with it carry the
+// given priority. On servers with priority dispatch enabled (see
+// WithPriorityDispatch) queued calls with higher priority are executed first.
+// The default priority is 0, negative priorities are allowed; servers clamp
+// priorities to a range, see WithPriorityRange.
+func WithCallPriority(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, callPriorityKey{}, priority)
+}
+
+func callPriority(ctx context.Context) (int, bool) {
+	if ctx == nil {
+		return 0, false
+	}
+	p, ok := ctx.Value(callPriorityKey{}).(int)
+	return p, ok
+}
+
+// requestPriority returns the priority of a request, 0 if not set or invalid
+func requestPriority(req *request) int {
+	p, err := strconv.Atoi(req.Meta[metaPriority])
+	if err != nil {
+		return 0
+	}
+	return p
+}
+
+type queuedCall struct {
+	priority int
+	enqueued time.Time
+
+	// ctx is the context of the call, calls cancelled while queued aren't
+	// executed
+	ctx context.Context
+	run func()
+
+	// drop answers the call with an error instead of executing it
+	drop func(code ErrorCode, err error)
+}
+
+// callQueue is a per-connection priority queue of calls, executed by a fixed
+// number of dispatcher goroutines
+type callQueue struct {
+	aging time.Duration
+
+	minPriority int
+	maxPriority int
+
+	// wake signals dispatchers that calls were queued
+	wake    chan struct{}
+	exiting <-chan struct{}
+
+	lk     sync.Mutex
+	calls  []queuedCall
+	closed bool
+}
+
+// newCallQueue starts concurrency dispatchers, which exit along with the
+// connection once exiting is closed
+func newCallQueue(concurrency int, aging time.Duration, minPriority, maxPriority int, exiting <-chan struct{}) *callQueue {
+	q := &callQueue{
+		aging:       aging,
+		minPriority: minPriority,
+		maxPriority: maxPriority,
+		wake:        make(chan struct{}, concurrency),
+		exiting:     exiting,
+	}
+	for i := 0; i < concurrency; i++ {
+		go q.dispatch()
+	}
+	return q
+}
+
+// schedule queues the call, to be executed once a dispatcher is free and it's
+// the highest priority queued call. Priorities are clamped to the configured
+// range, so that clients can't jump ahead of everything (or overflow aging).
+func (q *callQueue) schedule(ctx context.Context, priority int, run func(), drop func(code ErrorCode, err error)) {
+	if priority < q.minPriority {
+		priority = q.minPriority
+	}
+	if priority > q.maxPriority {
+		priority = q.maxPriority
+	}
+
+	q.lk.Lock()
+	if q.closed {
+		q.lk.Unlock()
+		drop(InternalError, xerrors.New("connection closing, call not executed"))
+		return
+	}
+	q.calls = append(q.calls, queuedCall{
+		priority: priority,
+		enqueued: time.Now(),
+		ctx:      ctx,
+		run:      run,
+		drop:     drop,
+	})
+	q.lk.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+		// all dispatchers were already woken up, and execute queued calls
+		// until there are none left
+	}
+}
+
+func (q *callQueue) dispatch() {
+	for {
+		select {
+		case <-q.wake:
+		case <-q.exiting:
+			q.close()
+			return
+		}
+
+		for {
+			select {
+			case <-q.exiting:
+				q.close()
+				return
+			default:
+			}
+
+			call, ok := q.pop(time.Now())
+			if !ok {
+				break
+			}
+			if call.ctx != nil && call.ctx.Err() != nil {
+				if cancelledByClient(call.ctx) {
+					call.drop(RequestCancelled, xerrors.New("call cancelled while queued"))
+				} else {
+					call.drop(InternalError, xerrors.Errorf("call not executed: %w", call.ctx.Err()))
+				}
+				continue
+			}
+			call.run()
+		}
+	}
+}
+
+// close answers all queued calls with an error, and makes the queue reject
+// calls scheduled later
+func (q *callQueue) close() {
+	q.lk.Lock()
+	calls := q.calls
+	q.calls = nil
+	q.closed = true
+	q.lk.Unlock()
+
+	for _, call := range calls {
+		call.drop(InternalError, xerrors.New("connection closing, call not executed"))
+	}
+}
+
+// pop removes and returns the call with the highest effective priority, false
+// if there are no queued calls. Calls gain one priority level for each aging
+// period spent in the queue, so that low priority calls don't starve. Ties are
+// broken in FIFO order.
+func (q *callQueue) pop(now time.Time) (queuedCall, bool) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	if len(q.calls) == 0 {
+		return queuedCall{}, false
+	}
+
+	best := 0
+	bestPrio := q.effectivePriority(q.calls[0], now)
+	for i := 1; i < len(q.calls); i++ {
+		if p := q.effectivePriority(q.calls[i], now); p > bestPrio {
+			best, bestPrio = i, p
+		}
+	}
+
+	call := q.calls[best]
+	q.calls = append(q.calls[:best], q.calls[best+1:]...)
+	return call, true
+}
+
+func (q *callQueue) effectivePriority(c queuedCall, now time.Time) int {
+	if q.aging <= 0 {
+		return c.priority
+	}
+	return c.priority + int(now.Sub(c.enqueued)/q.aging)
+}
@@ -0,0 +1,39 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"golang.org/x/xerrors"
+)
+
+// ResultMarshaler encodes a method result to JSON, see
+// RPCServer.RegisterResultMarshaler
+type ResultMarshaler func(v interface{}) ([]byte, error)
+
+// RegisterResultMarshaler makes the server encode method results of type t
+// with marshal instead of encoding/json, e.g. for a type which should be sent
+// differently than its MarshalJSON method encodes it. It applies to results of
+// exactly type t (so a marshaler for T doesn't apply to *T results), and not to
+// values nested in results, or sent over channels.
+func (s *RPCServer) RegisterResultMarshaler(t reflect.Type, marshal ResultMarshaler) {
+	s.resultMarshalers[t] = marshal
+}
+
+// marshalResult encodes a result with the marshaler registered for its type,
+// returning false if there is none
+func (s *handler) marshalResult(res interface{}) (json.RawMessage, bool, error) {
+	marshal, ok := s.resultMarshalers[reflect.TypeOf(res)]
+	if !ok {
+		return nil, false, nil
+	}
+
+	b, err := marshal(res)
+	if err != nil {
+		return nil, true, xerrors.Errorf("marshaling result: %w", err)
+	}
+	if !json.Valid(b) {
+		return nil, true, xerrors.Errorf("result marshaler for %s returned invalid JSON", reflect.TypeOf(res))
+	}
+	return b, true, nil
+}
@@ -1,17 +1,35 @@
 package jsonrpc
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/big"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -23,6 +41,9 @@ import (
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 	"golang.org/x/xerrors"
 )
 
@@ -115,29 +136,6621 @@ func TestRawRequests(t *testing.T) {
 			b, err := ioutil.ReadAll(res.Body)
 			require.NoError(t, err)
 
+			if resp == "" {
+				// no response expected (e.g. batch of notifications)
+				require.Empty(t, b)
+				require.Equal(t, n, rpcHandler.n)
+				require.Equal(t, statusCode, res.StatusCode)
+				return
+			}
+
 			expectedResp, err := removeSpaces(resp)
 			require.NoError(t, err)
 
-			responseBody, err := removeSpaces(string(b))
+			responseBody, err := removeSpaces(string(b))
+			require.NoError(t, err)
+
+			assert.Equal(t, expectedResp, responseBody)
+			require.Equal(t, n, rpcHandler.n)
+			require.Equal(t, statusCode, res.StatusCode)
+		}
+	}
+
+	t.Run("inc", tc(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.Inc", "params": [], "id": 1}`, `{"jsonrpc":"2.0","id":1,"result":null}`, 1, 200))
+	t.Run("inc-null", tc(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.Inc", "params": null, "id": 1}`, `{"jsonrpc":"2.0","id":1,"result":null}`, 1, 200))
+	t.Run("inc-noparam", tc(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.Inc", "id": 2}`, `{"jsonrpc":"2.0","id":2,"result":null}`, 1, 200))
+	t.Run("add", tc(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [10], "id": 4}`, `{"jsonrpc":"2.0","id":4,"result":null}`, 10, 200))
+	// Batch requests
+	t.Run("add", tc(`[{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [123], "id": 5}`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"Parse error"}}`, 0, 500))
+	t.Run("add", tc(`[{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [123], "id": 6}]`, `[{"jsonrpc":"2.0","id":6,"result":null}]`, 123, 200))
+	t.Run("add", tc(`[{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [123], "id": 7},{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [-122], "id": 8}]`, `[{"jsonrpc":"2.0","id":7,"result":null},{"jsonrpc":"2.0","id":8,"result":null}]`, 1, 200))
+	t.Run("add", tc(`[{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [123], "id": 9},{"jsonrpc": "2.0", "params": [-122], "id": 10}]`, `[{"jsonrpc":"2.0","id":9,"result":null},{"error":{"code":-32601,"message":"method '' not found","data":{"namespace":"","namespaceExists":false}},"id":10,"jsonrpc":"2.0"}]`, 123, 200))
+	t.Run("add", tc(`     [{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [-1], "id": 11}]   `, `[{"jsonrpc":"2.0","id":11,"result":null}]`, -1, 200))
+	t.Run("add", tc(``, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"Invalid request"}}`, 0, 400))
+	// Batch id echoing
+	t.Run("batch-dup-ids", tc(`[{"jsonrpc": "2.0", "method": "SimpleServerHandler.AddGet", "params": [1], "id": 1},{"jsonrpc": "2.0", "method": "SimpleServerHandler.AddGet", "params": [2], "id": 1}]`, `[{"jsonrpc":"2.0","id":1,"result":1},{"jsonrpc":"2.0","id":1,"result":3}]`, 3, 200))
+	t.Run("batch-interleaved-notifs", tc(`[{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [1]},{"jsonrpc": "2.0", "method": "SimpleServerHandler.AddGet", "params": [2], "id": "a"},{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [3]},{"jsonrpc": "2.0", "method": "SimpleServerHandler.AddGet", "params": [4], "id": 2}]`, `[{"jsonrpc":"2.0","id":"a","result":3},{"jsonrpc":"2.0","id":2,"result":10}]`, 10, 200))
+	t.Run("batch-notif-errors", tc(`[{"jsonrpc": "2.0", "method": "SimpleServerHandler.Missing"},{"jsonrpc": "2.0", "method": "SimpleServerHandler.AddGet", "params": [2], "id": 3}]`, `[{"jsonrpc":"2.0","id":3,"result":2}]`, 2, 200))
+	t.Run("batch-only-notifs", tc(`[{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [1]},{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [2]}]`, ``, 3, 200))
+	t.Run("batch-bad-id", tc(`[{"jsonrpc": "2.0", "method": "SimpleServerHandler.AddGet", "params": [1], "id": [1]},{"jsonrpc": "2.0", "method": "SimpleServerHandler.AddGet", "params": [2], "id": 4}]`, `[{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"failed to parse ID: invalid id type: []interface {}"}},{"jsonrpc":"2.0","id":4,"result":2}]`, 2, 200))
+}
+
+func TestResponseTiming(t *testing.T) {
+	tc := func(opts []ServerOption, req string, expectTiming bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			rpcServer := NewServer(opts...)
+			rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+			testServ := httptest.NewServer(rpcServer)
+			defer testServ.Close()
+
+			res, err := http.Post(testServ.URL, "application/json", strings.NewReader(req))
+			require.NoError(t, err)
+			defer res.Body.Close()
+
+			var resp struct {
+				Result int               `json:"result"`
+				Meta   map[string]string `json:"meta"`
+			}
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+			require.Equal(t, 3, resp.Result)
+
+			if !expectTiming {
+				require.Nil(t, resp.Meta)
+				return
+			}
+
+			d, err := time.ParseDuration(resp.Meta["ServerDuration"])
+			require.NoError(t, err)
+			require.True(t, d > 0)
+		}
+	}
+
+	withMeta := `{"jsonrpc": "2.0", "method": "SimpleServerHandler.AddGet", "params": [3], "id": 1, "meta": {"ResponseTiming": "1"}}`
+	noMeta := `{"jsonrpc": "2.0", "method": "SimpleServerHandler.AddGet", "params": [3], "id": 1}`
+
+	t.Run("enabled-requested", tc([]ServerOption{WithResponseTiming()}, withMeta, true))
+	t.Run("enabled-not-requested", tc([]ServerOption{WithResponseTiming()}, noMeta, false))
+	t.Run("disabled-requested", tc(nil, withMeta, false))
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func TestNamespaceCodec(t *testing.T) {
+	rpcServer := NewServer(WithServerNamespaceCodec("Bin", gobCodec{}), WithServerNamespaceCodec("Bin.V1", gobCodec{}))
+	rpcServer.Register("Bin", &SimpleServerHandler{})
+	rpcServer.Register("Bin.V1", &SimpleServerHandler{})
+	rpcServer.Register("Json", &SimpleServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	// raw requests - the Bin namespace expects base64 gob data, Json plain values
+	param, err := gobCodec{}.Marshal(TestType{S: "5", I: 5})
+	require.NoError(t, err)
+	eparam, err := json.Marshal(param)
+	require.NoError(t, err)
+	param, err = gobCodec{}.Marshal(int64(5))
+	require.NoError(t, err)
+	eparam2, err := json.Marshal(param)
+	require.NoError(t, err)
+
+	res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Bin.StringMatch", "params": [`+string(eparam)+`, `+string(eparam2)+`], "id": 1}`))
+	require.NoError(t, err)
+	var rawResp struct {
+		Result []byte
+	}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&rawResp))
+	require.NoError(t, res.Body.Close())
+
+	var out TestOut
+	require.NoError(t, gobCodec{}.Unmarshal(rawResp.Result, &out))
+	require.Equal(t, TestOut{TestType: TestType{S: "5", I: 5}, Ok: true}, out)
+
+	res, err = http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Json.AddGet", "params": [3], "id": 2}`))
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Contains(t, string(b), `"result":3`)
+
+	// go clients, namespaces with dots are matched as on the server
+	for _, ns := range []string{"Bin", "Bin.V1"} {
+		for _, proto := range []string{"ws", "http"} {
+			var binClient struct {
+				AddGet      func(int) int
+				StringMatch func(t TestType, i2 int64) (out TestOut, err error)
+			}
+			closer, err := NewMergeClient(context.Background(), proto+"://"+testServ.Listener.Addr().String(), ns, []interface{}{&binClient}, nil, WithNamespaceCodec(ns, gobCodec{}))
+			require.NoError(t, err)
+
+			o, err := binClient.StringMatch(TestType{S: "8", I: 8}, 8)
+			require.NoError(t, err)
+			require.Equal(t, TestOut{TestType: TestType{S: "8", I: 8}, Ok: true}, o)
+
+			_, err = binClient.StringMatch(TestType{S: "5"}, 5)
+			require.EqualError(t, err, ":(")
+
+			closer()
+		}
+
+		client, err := Dial(context.Background(), "http://"+testServ.Listener.Addr().String(), nil, WithNamespaceCodec(ns, gobCodec{}))
+		require.NoError(t, err)
+		var n int
+		require.NoError(t, client.Call(context.Background(), ns+".AddGet", &n, 2))
+		require.True(t, n > 0)
+		client.Close()
+	}
+}
+
+type BlockingHandler struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (h *BlockingHandler) Block(ctx context.Context) error {
+	h.entered <- struct{}{}
+	select {
+	case <-h.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestMaxInflightPerConn(t *testing.T) {
+	serverHandler := &BlockingHandler{
+		entered: make(chan struct{}, 3),
+		release: make(chan struct{}),
+	}
+
+	rpcServer := NewServer(WithMaxInflightPerConn(2))
+	rpcServer.Register("BlockingHandler", serverHandler)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var client struct {
+		Block func(ctx context.Context) error
+	}
+	closer, err := NewClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "BlockingHandler", &client, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- client.Block(context.Background())
+		}()
+	}
+	<-serverHandler.entered
+	<-serverHandler.entered
+
+	// third call goes over the limit
+	err = client.Block(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "RPC error (-32001)")
+	require.Contains(t, err.Error(), "server busy")
+
+	close(serverHandler.release)
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+
+	// slots are released after calls complete
+	require.NoError(t, client.Block(context.Background()))
+	<-serverHandler.entered
+}
+
+type ProgressHandler struct{}
+
+func (h *ProgressHandler) Import(ctx context.Context, n int, progress ProgressFunc) (int, error) {
+	for i := 1; i <= n; i++ {
+		progress(float64(i) / float64(n))
+	}
+	return n, nil
+}
+
+func TestProgress(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("ProgressHandler", &ProgressHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	tc := func(proto string, expectProgress bool) func(t *testing.T) {
+		return func(t *testing.T) {
+			var client struct {
+				Import func(ctx context.Context, n int, progress ProgressFunc) (int, error)
+			}
+			closer, err := NewClient(context.Background(), proto+"://"+testServ.Listener.Addr().String(), "ProgressHandler", &client, nil)
+			require.NoError(t, err)
+			defer closer()
+
+			var reports []float64
+			n, err := client.Import(context.Background(), 4, func(p float64) {
+				reports = append(reports, p)
+			})
+			require.NoError(t, err)
+			require.Equal(t, 4, n)
+
+			if !expectProgress {
+				require.Empty(t, reports)
+				return
+			}
+			require.Equal(t, []float64{0.25, 0.5, 0.75, 1}, reports)
+
+			// nil progress callback
+			n, err = client.Import(context.Background(), 2, nil)
+			require.NoError(t, err)
+			require.Equal(t, 2, n)
+		}
+	}
+
+	t.Run("ws", tc("ws", true))
+	t.Run("http", tc("http", false))
+}
+
+type PriorityHandler struct {
+	entered chan struct{}
+	release chan struct{}
+
+	lk    sync.Mutex
+	order []string
+}
+
+func (h *PriorityHandler) Block() {
+	h.entered <- struct{}{}
+	<-h.release
+}
+
+func (h *PriorityHandler) Record(name string) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	h.order = append(h.order, name)
+}
+
+func TestPriorityDispatch(t *testing.T) {
+	serverHandler := &PriorityHandler{
+		entered: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+
+	rpcServer := NewServer(WithPriorityDispatch(1, 0))
+	rpcServer.Register("PriorityHandler", serverHandler)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var client struct {
+		Block  func(ctx context.Context)
+		Record func(ctx context.Context, name string)
+	}
+	closer, err := NewClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "PriorityHandler", &client, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	// occupy the only execution slot
+	go client.Block(context.Background())
+	<-serverHandler.entered
+
+	var wg sync.WaitGroup
+	call := func(name string, priority int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.Record(WithCallPriority(context.Background(), priority), name)
+		}()
+		// make sure calls are queued in order
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	call("low1", 0)
+	call("low2", 0)
+	call("high", 10)
+	call("mid", 5)
+
+	close(serverHandler.release)
+	wg.Wait()
+
+	require.Equal(t, []string{"high", "mid", "low1", "low2"}, serverHandler.order)
+}
+
+func TestPriorityDispatchQueued(t *testing.T) {
+	serverHandler := &PriorityHandler{
+		entered: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+
+	rpcServer := NewServer(WithPriorityDispatch(1, 0), WithPriorityRange(0, 10))
+	rpcServer.Register("PriorityHandler", serverHandler)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var client struct {
+		Block  func(ctx context.Context)
+		Record func(ctx context.Context, name string) error
+	}
+	closer, err := NewClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "PriorityHandler", &client, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	go client.Block(context.Background())
+	<-serverHandler.entered
+
+	var wg sync.WaitGroup
+	call := func(ctx context.Context, name string, priority int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = client.Record(WithCallPriority(ctx, priority), name)
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// priorities over the range don't jump ahead of calls at its top
+	call(context.Background(), "max", 10)
+	call(context.Background(), "over", 1000000)
+
+	// calls cancelled while queued aren't executed
+	ctx, cancel := context.WithCancel(context.Background())
+	call(ctx, "cancelled", 10)
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+
+	close(serverHandler.release)
+	wg.Wait()
+
+	require.Equal(t, []string{"max", "over"}, serverHandler.order)
+}
+
+func TestCallQueueClose(t *testing.T) {
+	exiting := make(chan struct{})
+	q := newCallQueue(1, 0, defaultMinPriority, defaultMaxPriority, exiting)
+
+	running, unblock := make(chan struct{}), make(chan struct{})
+	dropped := make(chan ErrorCode, 2)
+	drop := func(code ErrorCode, err error) {
+		dropped <- code
+	}
+
+	q.schedule(context.Background(), 0, func() {
+		close(running)
+		<-unblock
+	}, drop)
+	<-running
+
+	ran := false
+	q.schedule(context.Background(), 0, func() { ran = true }, drop)
+
+	// calls queued when the connection closes are answered, not executed
+	close(exiting)
+	close(unblock)
+	require.Equal(t, InternalError, <-dropped)
+
+	q.schedule(context.Background(), 0, func() { ran = true }, drop)
+	require.Equal(t, InternalError, <-dropped)
+	require.False(t, ran)
+}
+
+func TestCallQueueAging(t *testing.T) {
+	q := &callQueue{aging: time.Second}
+
+	now := time.Now()
+	var order []string
+	q.calls = []queuedCall{
+		{priority: 0, enqueued: now.Add(-10 * time.Second), run: func() { order = append(order, "old-low") }},
+		{priority: 5, enqueued: now, run: func() { order = append(order, "new-high") }},
+		{priority: 20, enqueued: now, run: func() { order = append(order, "new-higher") }},
+	}
+
+	for {
+		call, ok := q.pop(now)
+		if !ok {
+			break
+		}
+		call.run()
+	}
+
+	// old-low aged to priority 10
+	require.Equal(t, []string{"new-higher", "old-low", "new-high"}, order)
+}
+
+func TestEnvelopeFields(t *testing.T) {
+	fields := EnvelopeFields{
+		Method: "func",
+		Params: "args",
+		Result: "out",
+		Error:  "fault",
+	}
+
+	rpcServer := NewServer(WithServerEnvelopeFields(fields))
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	// raw request in the dialect
+	res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "func": "SimpleServerHandler.AddGet", "args": [2], "id": 1}`))
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"out":2}`, string(b))
+
+	res, err = http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "func": "SimpleServerHandler.Nope", "args": [], "id": 2}`))
+	require.NoError(t, err)
+	b, err = ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, 500, res.StatusCode)
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":2,"fault":{"code":-32601,"message":"method 'SimpleServerHandler.Nope' not found","data":{"namespace":"SimpleServerHandler","namespaceExists":true}}}`, string(b))
+
+	tc := func(proto string) func(t *testing.T) {
+		return func(t *testing.T) {
+			var client struct {
+				AddGet func(int) (int, error)
+			}
+			closer, err := NewMergeClient(context.Background(), proto+"://"+testServ.Listener.Addr().String(), "SimpleServerHandler", []interface{}{&client}, nil, WithEnvelopeFields(fields))
+			require.NoError(t, err)
+			defer closer()
+
+			n, err := client.AddGet(0)
+			require.NoError(t, err)
+			require.Equal(t, 2, n)
+		}
+	}
+
+	t.Run("ws", tc("ws"))
+	t.Run("http", tc("http"))
+}
+
+func TestProtocolVersion(t *testing.T) {
+	post := func(t *testing.T, url, body string) (int, string) {
+		res, err := http.Post(url, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return res.StatusCode, string(b)
+	}
+
+	legacy := `{"jsonrpc": "1.0", "method": "SimpleServerHandler.Inc", "params": [], "id": 1}`
+
+	defServer := NewServer()
+	defServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+	defServ := httptest.NewServer(defServer)
+	defer defServ.Close()
+
+	code, body := post(t, defServ.URL, legacy)
+	require.Equal(t, 400, code)
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"error":{"code":-32600,"message":"unsupported jsonrpc version '1.0', expected '2.0'"}}`, body)
+
+	rpcServer := NewServer(WithServerProtocolVersion("1.0"))
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	code, body = post(t, testServ.URL, legacy)
+	require.Equal(t, 200, code)
+	require.JSONEq(t, `{"jsonrpc":"1.0","id":1,"result":null}`, body)
+
+	code, _ = post(t, testServ.URL, `{"jsonrpc": "2.0", "method": "SimpleServerHandler.Inc", "params": [], "id": 2}`)
+	require.Equal(t, 400, code)
+
+	tc := func(proto string) func(t *testing.T) {
+		return func(t *testing.T) {
+			var client struct {
+				AddGet func(int) (int, error)
+			}
+			closer, err := NewMergeClient(context.Background(), proto+"://"+testServ.Listener.Addr().String(), "SimpleServerHandler", []interface{}{&client}, nil, WithProtocolVersion("1.0"))
+			require.NoError(t, err)
+			defer closer()
+
+			_, err = client.AddGet(3)
+			require.NoError(t, err)
+		}
+	}
+
+	t.Run("ws", tc("ws"))
+	t.Run("http", tc("http"))
+}
+
+func TestBareResult(t *testing.T) {
+	testServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+
+		switch req.Method {
+		case "Bare.Get":
+			_, _ = w.Write([]byte(`{"S": "bare", "I": 3}`))
+		case "Bare.Fail":
+			w.WriteHeader(500)
+			_, _ = fmt.Fprintf(w, `{"jsonrpc": "2.0", "id": %v, "error": {"code": 1, "message": "oops"}}`, req.ID)
+		case "Bare.Proxy":
+			// JSON error bodies which aren't JSON-RPC responses, e.g. from proxies
+			w.WriteHeader(502)
+			_, _ = w.Write([]byte(`{"error": "bad gateway"}`))
+		}
+	}))
+	defer testServ.Close()
+
+	var client struct {
+		Get   func() (TestType, error)
+		Fail  func() (TestType, error)
+		Proxy func() (TestType, error)
+	}
+	closer, err := NewMergeClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "Bare", []interface{}{&client}, nil, WithBareResult("Bare.Get"), WithBareResult("Bare.Fail"))
+	require.NoError(t, err)
+	defer closer()
+
+	res, err := client.Get()
+	require.NoError(t, err)
+	require.Equal(t, TestType{S: "bare", I: 3}, res)
+
+	_, err = client.Fail()
+	require.EqualError(t, err, "oops")
+
+	_, err = client.Proxy()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "http status 502")
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	tc := func(proto string) func(t *testing.T) {
+		return func(t *testing.T) {
+			var client struct {
+				StringMatch func(t TestType, i2 int64) (out TestOut, err error)
+			}
+			closer, err := NewMergeClient(context.Background(), proto+"://"+testServ.Listener.Addr().String(), "SimpleServerHandler", []interface{}{&client}, nil, WithMaxResponseSize(512))
+			require.NoError(t, err)
+			defer closer()
+
+			_, err = client.StringMatch(TestType{S: "0"}, 0)
+			require.NoError(t, err)
+
+			_, err = client.StringMatch(TestType{S: strings.Repeat("x", 1024), I: 1024}, 1024)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), ErrResponseTooLarge.Error())
+			if proto == "http" {
+				require.True(t, errors.Is(err, ErrResponseTooLarge))
+			}
+
+			// the client is usable after an oversized response (over websocket
+			// after it reconnects)
+			require.Eventually(t, func() bool {
+				_, err := client.StringMatch(TestType{S: "0"}, 0)
+				return err == nil
+			}, 5*time.Second, 10*time.Millisecond)
+		}
+	}
+
+	t.Run("ws", tc("ws"))
+	t.Run("http", tc("http"))
+}
+
+type StreamingBatchHandler struct {
+	release chan struct{}
+}
+
+func (h *StreamingBatchHandler) Slow(ctx context.Context) (string, error) {
+	select {
+	case <-h.release:
+		return "slow", nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (h *StreamingBatchHandler) Fast() string {
+	return "fast"
+}
+
+func TestStreamingBatch(t *testing.T) {
+	hnd := &StreamingBatchHandler{release: make(chan struct{})}
+
+	rpcServer := NewServer(WithStreamingBatch())
+	rpcServer.Register("Batch", hnd)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+testServ.Listener.Addr().String(), nil)
+	require.NoError(t, err)
+	defer conn.Close() // nolint:errcheck
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`[
+		{"jsonrpc": "2.0", "method": "Batch.Slow", "params": [], "id": 1},
+		{"jsonrpc": "2.0", "method": "Batch.Fast", "params": [], "id": 2},
+		{"jsonrpc": "2.0", "method": "Batch.Fast", "params": []},
+		{"jsonrpc": "2.0", "method": "Batch.Fast", "params": [], "id": 3}
+	]`)))
+
+	read := func() (id float64, result string) {
+		var resp struct {
+			ID     float64
+			Result string
+		}
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		require.NoError(t, conn.ReadJSON(&resp))
+		return resp.ID, resp.Result
+	}
+
+	// fast calls are answered while the slow call is still running
+	fast := map[float64]string{}
+	for i := 0; i < 2; i++ {
+		id, res := read()
+		fast[id] = res
+	}
+	require.Equal(t, map[float64]string{2: "fast", 3: "fast"}, fast)
+
+	close(hnd.release)
+
+	id, res := read()
+	require.Equal(t, float64(1), id)
+	require.Equal(t, "slow", res)
+}
+
+type OrderedHandler struct {
+	fastDone chan struct{}
+	release  chan struct{}
+}
+
+func (h *OrderedHandler) Slow() string {
+	<-h.release
+	return "slow"
+}
+
+func (h *OrderedHandler) Fast() string {
+	defer close(h.fastDone)
+	return "fast"
+}
+
+func TestOrderedResponses(t *testing.T) {
+	hnd := &OrderedHandler{fastDone: make(chan struct{}), release: make(chan struct{})}
+
+	rpcServer := NewServer(WithOrderedResponses())
+	rpcServer.Register("Ordered", hnd)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+testServ.Listener.Addr().String(), nil)
+	require.NoError(t, err)
+	defer conn.Close() // nolint:errcheck
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "method": "Ordered.Slow", "params": [], "id": 1}`)))
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "method": "Ordered.Fast", "params": [], "id": 2}`)))
+
+	// the fast call completes first, but its response waits for the slow one
+	select {
+	case <-hnd.fastDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("fast call didn't complete")
+	}
+	close(hnd.release)
+
+	read := func() (id float64, result string) {
+		var resp struct {
+			ID     float64
+			Result string
+		}
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		require.NoError(t, conn.ReadJSON(&resp))
+		return resp.ID, resp.Result
+	}
+
+	id, res := read()
+	require.Equal(t, float64(1), id)
+	require.Equal(t, "slow", res)
+
+	id, res = read()
+	require.Equal(t, float64(2), id)
+	require.Equal(t, "fast", res)
+}
+
+type NotificationHandler struct {
+	notif chan bool
+}
+
+func (h *NotificationHandler) Call(ctx context.Context) error {
+	h.notif <- IsNotification(ctx)
+	return nil
+}
+
+func TestIsNotification(t *testing.T) {
+	hnd := &NotificationHandler{notif: make(chan bool, 1)}
+
+	rpcServer := NewServer()
+	rpcServer.Register("Notif", hnd)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	tc := func(proto string) func(t *testing.T) {
+		return func(t *testing.T) {
+			var client struct {
+				Call   func() error
+				Notify func() error `notify:"true" rpc_method:"Notif.Call"`
+			}
+			closer, err := NewMergeClient(context.Background(), proto+"://"+testServ.Listener.Addr().String(), "Notif", []interface{}{&client}, nil)
+			require.NoError(t, err)
+			defer closer()
+
+			require.NoError(t, client.Call())
+			require.False(t, <-hnd.notif)
+
+			require.NoError(t, client.Notify())
+			require.True(t, <-hnd.notif)
+		}
+	}
+
+	t.Run("ws", tc("ws"))
+	t.Run("http", tc("http"))
+}
+
+func TestRegisterWithMethodNames(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.RegisterWithMethodNames("ns", &SimpleServerHandler{}, func(namespace, method string) string {
+		return namespace + "_" + strings.ToLower(method[:1]) + method[1:]
+	})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "ns_addGet", "params": [3], "id": 1}`))
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":3}`, string(b))
+
+	var client struct {
+		AddGet func(int) int          `rpc_method:"ns_addGet"`
+		Orig   func(int) (int, error) `rpc_method:"SimpleServerHandler.AddGet"`
+	}
+	closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "ns", []interface{}{&client}, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	require.Equal(t, 5, client.AddGet(2))
+
+	// default names aren't registered
+	_, err = client.Orig(1)
+	require.Error(t, err)
+}
+
+type NoResponseHandler struct{}
+
+func (h *NoResponseHandler) Sink(ev string) error {
+	return xerrors.Errorf("sinking %s: %w", ev, ErrNoResponse)
+}
+
+func TestErrNoResponse(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("Events", &NoResponseHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Events.Sink", "params": ["x"], "id": 1}`))
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, 200, res.StatusCode)
+	require.Empty(t, b)
+
+	// in batches there's no element for the call
+	res, err = http.Post(testServ.URL, "application/json", strings.NewReader(`[{"jsonrpc": "2.0", "method": "Events.Sink", "params": ["x"], "id": 1}, {"jsonrpc": "2.0", "method": "Events.Nope", "params": [], "id": 2}]`))
+	require.NoError(t, err)
+	b, err = ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.JSONEq(t, `[{"jsonrpc":"2.0","id":2,"error":{"code":-32601,"message":"method 'Events.Nope' not found","data":{"namespace":"Events","namespaceExists":true}}}]`, string(b))
+}
+
+func TestWSConcurrentResponsesIntact(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+testServ.Listener.Addr().String(), nil)
+	require.NoError(t, err)
+	defer conn.Close() // nolint:errcheck
+
+	const calls = 200
+	payload := func(i int) string {
+		return strings.Repeat(string(rune('a'+i%26)), 16<<10)
+	}
+
+	for i := 0; i < calls; i++ {
+		req := request{
+			Jsonrpc: "2.0",
+			ID:      i,
+			Method:  "SimpleServerHandler.StringMatch",
+			Params:  json.RawMessage(fmt.Sprintf(`[{"S": "%s", "I": %d}, %d]`, payload(i), i, i)),
+		}
+		require.NoError(t, conn.WriteJSON(req))
+	}
+
+	seen := map[int]bool{}
+	for len(seen) < calls {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Second)))
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+
+		// each message must be exactly one complete response
+		var resp struct {
+			ID     int
+			Result TestOut
+			Error  *respError
+		}
+		require.NoError(t, json.Unmarshal(msg, &resp), "malformed frame")
+		require.Nil(t, resp.Error)
+		require.Equal(t, resp.ID, resp.Result.I)
+		require.Equal(t, payload(resp.ID), resp.Result.S)
+		require.False(t, seen[resp.ID])
+
+		seen[resp.ID] = true
+	}
+}
+
+type NilResultHandler struct{}
+
+func (h *NilResultHandler) Get() (*TestType, error) {
+	return nil, nil
+}
+
+// The server always emits "result" on success, as required by the spec, even
+// when the result is nil (see response.MarshalJSON)
+func TestNilResultEmitted(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("Nil", &NilResultHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	req := `{"jsonrpc": "2.0", "method": "Nil.Get", "params": [], "id": 1}`
+	expect := `{"jsonrpc":"2.0","id":1,"result":null}`
+
+	res, err := http.Post(testServ.URL, "application/json", strings.NewReader(req))
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.JSONEq(t, expect, string(b))
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+testServ.Listener.Addr().String(), nil)
+	require.NoError(t, err)
+	defer conn.Close() // nolint:errcheck
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(req)))
+	_, b, err = conn.ReadMessage()
+	require.NoError(t, err)
+	require.JSONEq(t, expect, string(b))
+}
+
+type EndpointNameHandler struct {
+	name string
+}
+
+func (h *EndpointNameHandler) Name() string {
+	return h.name
+}
+
+func TestClientWithEndpoints(t *testing.T) {
+	newServer := func(name string, l net.Listener) *httptest.Server {
+		rpcServer := NewServer()
+		rpcServer.Register("Endpoint", &EndpointNameHandler{name: name})
+
+		testServ := httptest.NewUnstartedServer(rpcServer)
+		if l != nil {
+			testServ.Listener = l
+		}
+		testServ.Start()
+		return testServ
+	}
+
+	servA := newServer("a", nil)
+	defer servA.Close()
+
+	// reserve an address for the websocket endpoint, which starts down
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addrB := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	client, err := NewClientWithEndpoints(context.Background(), []string{
+		"http://" + servA.Listener.Addr().String(),
+		"ws://" + addrB,
+	}, RoundRobin, nil, WithHealthCheckInterval(20*time.Millisecond))
+	require.NoError(t, err)
+	defer client.Close()
+
+	name := func() string {
+		var n string
+		require.NoError(t, client.Call(context.Background(), "Endpoint.Name", &n))
+		return n
+	}
+
+	// the down endpoint isn't used
+	for i := 0; i < 4; i++ {
+		require.Equal(t, "a", name())
+	}
+
+	// the endpoint is used once it's up
+	l, err = net.Listen("tcp", addrB)
+	require.NoError(t, err)
+	servB := newServer("b", l)
+	defer servB.Close()
+
+	require.Eventually(t, func() bool {
+		return name() == "b"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// round-robin across both endpoints
+	require.ElementsMatch(t, []string{"a", "b"}, []string{name(), name()})
+
+	// failover when an endpoint goes down
+	servA.Close()
+	for i := 0; i < 4; i++ {
+		require.Equal(t, "b", name())
+	}
+}
+
+type IdempotentHandler struct {
+	calls int32
+}
+
+func (h *IdempotentHandler) Next() int32 {
+	return atomic.AddInt32(&h.calls, 1)
+}
+
+func (h *IdempotentHandler) Other() int32 {
+	return atomic.AddInt32(&h.calls, 1)
+}
+
+func (h *IdempotentHandler) Add(n int32) int32 {
+	return atomic.AddInt32(&h.calls, n)
+}
+
+func TestIdempotencyCache(t *testing.T) {
+	hnd := &IdempotentHandler{}
+
+	rpcServer := NewServer(WithIdempotencyCache(200*time.Millisecond, nil))
+	rpcServer.Register("Idem", hnd)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	post := func(body string) string {
+		res, err := http.Post(testServ.URL, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return string(b)
+	}
+
+	// repeated keys get the cached response, with their own id
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":1}`, post(`{"jsonrpc": "2.0", "method": "Idem.Next", "params": [], "id": 1, "meta": {"IdempotencyKey": "k1"}}`))
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":2,"result":1}`, post(`{"jsonrpc": "2.0", "method": "Idem.Next", "params": [], "id": 2, "meta": {"IdempotencyKey": "k1"}}`))
+
+	// keys are scoped to the method, calls without keys aren't cached
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":3,"result":2}`, post(`{"jsonrpc": "2.0", "method": "Idem.Other", "params": [], "id": 3, "meta": {"IdempotencyKey": "k1"}}`))
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":4,"result":3}`, post(`{"jsonrpc": "2.0", "method": "Idem.Next", "params": [], "id": 4}`))
+
+	// entries expire after the ttl
+	time.Sleep(250 * time.Millisecond)
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":5,"result":4}`, post(`{"jsonrpc": "2.0", "method": "Idem.Next", "params": [], "id": 5, "meta": {"IdempotencyKey": "k1"}}`))
+
+	tc := func(proto string) func(t *testing.T) {
+		return func(t *testing.T) {
+			var client struct {
+				Next func(context.Context) (int32, error)
+			}
+			closer, err := NewMergeClient(context.Background(), proto+"://"+testServ.Listener.Addr().String(), "Idem", []interface{}{&client}, nil, WithIdempotencyKeys())
+			require.NoError(t, err)
+			defer closer()
+
+			// random keys for each call
+			a, err := client.Next(context.Background())
+			require.NoError(t, err)
+			b, err := client.Next(context.Background())
+			require.NoError(t, err)
+			require.NotEqual(t, a, b)
+
+			// explicit keys
+			ctx := WithIdempotencyKey(context.Background(), proto+"-retry")
+			a, err = client.Next(ctx)
+			require.NoError(t, err)
+			b, err = client.Next(ctx)
+			require.NoError(t, err)
+			require.Equal(t, a, b)
+		}
+	}
+
+	t.Run("ws", tc("ws"))
+	t.Run("http", tc("http"))
+
+	// keys can't be reused with other params
+	first := post(`{"jsonrpc": "2.0", "method": "Idem.Add", "params": [2], "id": 6, "meta": {"IdempotencyKey": "k2"}}`)
+	require.JSONEq(t, first, post(`{"jsonrpc": "2.0", "method": "Idem.Add", "params": [ 2 ], "id": 6, "meta": {"IdempotencyKey": "k2"}}`))
+	var mismatch response
+	require.NoError(t, json.Unmarshal([]byte(post(`{"jsonrpc": "2.0", "method": "Idem.Add", "params": [3], "id": 7, "meta": {"IdempotencyKey": "k2"}}`)), &mismatch))
+	require.NotNil(t, mismatch.Error)
+	require.Equal(t, InvalidRequest, mismatch.Error.Code)
+	require.Contains(t, mismatch.Error.Message, "different params")
+
+	// keys are scoped to callers, here each connection
+	scoped := NewServer(WithIdempotencyCache(time.Minute, nil), WithCallerIdentity(func(ctx context.Context) string {
+		p, _ := PeerFromContext(ctx)
+		return p.RemoteAddr
+	}))
+	scoped.Register("Idem", &IdempotentHandler{})
+	scopedServ := httptest.NewServer(scoped)
+	defer scopedServ.Close()
+
+	postNewConn := func(body string) string {
+		hc := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		res, err := hc.Post(scopedServ.URL, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return string(b)
+	}
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":1}`, postNewConn(`{"jsonrpc": "2.0", "method": "Idem.Next", "params": [], "id": 1, "meta": {"IdempotencyKey": "k1"}}`))
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":2,"result":2}`, postNewConn(`{"jsonrpc": "2.0", "method": "Idem.Next", "params": [], "id": 2, "meta": {"IdempotencyKey": "k1"}}`))
+
+	// replayed responses carry the trace id of the retry, not the meta of
+	// the first call
+	traced := NewServer(WithIdempotencyCache(time.Minute, nil), WithTraceIDPropagation(), WithResponseTiming())
+	traced.Register("Idem", &IdempotentHandler{})
+	tracedServ := httptest.NewServer(traced)
+	defer tracedServ.Close()
+
+	postTraced := func(traceID string) response {
+		req, err := http.NewRequest("POST", tracedServ.URL, strings.NewReader(`{"jsonrpc": "2.0", "method": "Idem.Next", "params": [], "id": 1, "meta": {"IdempotencyKey": "k1", "ResponseTiming": "1"}}`))
+		require.NoError(t, err)
+		req.Header.Set(TraceIDHeader, traceID)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close() // nolint:errcheck
+		var resp response
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+		return resp
+	}
+	firstTraced := postTraced("trace-1")
+	require.Equal(t, "trace-1", firstTraced.Meta[metaTraceID])
+	require.NotEmpty(t, firstTraced.Meta[metaServerDuration])
+
+	retry := postTraced("trace-2")
+	require.Equal(t, firstTraced.Result, retry.Result)
+	require.Equal(t, map[string]string{metaTraceID: "trace-2"}, retry.Meta)
+}
+
+func TestIdempotencyCacheWait(t *testing.T) {
+	c := newIdempotencyCache(time.Minute, nil)
+
+	_, ok, err := c.begin(context.Background(), "k", "")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// waiting for the running call stops when the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, _, err = c.begin(ctx, "k", "")
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	c.finish("k", "", []byte(`{"result": 1}`))
+	cached, ok, err := c.begin(context.Background(), "k", "")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.JSONEq(t, `{"result": 1}`, string(cached))
+
+	// expired entries are removed when new entries are stored
+	store := NewMemoryIdempotencyStore().(*memIdempotencyStore)
+	store.Put("a", []byte("1"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	store.Put("b", []byte("2"), time.Minute)
+	require.Len(t, store.entries, 1)
+	require.Len(t, store.expiry, 1)
+}
+
+func TestServerMethods(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("Lenient", &LenientHandler{})
+	rpcServer.Register("Progress", &ProgressHandler{})
+
+	methods := rpcServer.Methods()
+
+	var names []string
+	for _, m := range methods {
+		names = append(names, m.Name)
+	}
+	require.Equal(t, []string{"Lenient.Map", "Lenient.One", "Lenient.Slice", "Lenient.Two", "Progress.Import"}, names)
+
+	two := methods[3]
+	require.Equal(t, 2, two.NumParams)
+	require.Equal(t, []reflect.Type{reflect.TypeOf(TestType{}), reflect.TypeOf(0)}, two.ParamTypes)
+	require.Equal(t, []reflect.Type{reflect.TypeOf(0)}, two.ReturnTypes)
+
+	// context and progress callback aren't params
+	imp := methods[4]
+	require.Equal(t, 1, imp.NumParams)
+	require.Equal(t, reflect.TypeOf((*error)(nil)).Elem(), imp.ReturnTypes[1])
+
+	// returned values are copies
+	two.ParamTypes[0] = reflect.TypeOf("")
+	require.Equal(t, reflect.TypeOf(TestType{}), rpcServer.Methods()[3].ParamTypes[0])
+}
+
+func TestCallHeader(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+	var lk sync.Mutex
+	var headers []http.Header
+	testServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lk.Lock()
+		headers = append(headers, r.Header.Clone())
+		lk.Unlock()
+		rpcServer.ServeHTTP(w, r)
+	}))
+	defer testServ.Close()
+
+	var client struct {
+		Inc func(context.Context) error
+	}
+	closer, err := NewMergeClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "SimpleServerHandler", []interface{}{&client}, http.Header{
+		"X-Client": []string{"c"},
+		"X-Tenant": []string{"default"},
+	})
+	require.NoError(t, err)
+	defer closer()
+
+	ctx := WithCallHeader(context.Background(), http.Header{
+		"X-Trace":  []string{"t1"},
+		"X-Tenant": []string{"tenant1"},
+	})
+	require.NoError(t, client.Inc(ctx))
+	require.NoError(t, client.Inc(context.Background()))
+
+	require.Len(t, headers, 2)
+	require.Equal(t, "c", headers[0].Get("X-Client"))
+	require.Equal(t, "t1", headers[0].Get("X-Trace"))
+	require.Equal(t, "tenant1", headers[0].Get("X-Tenant"))
+
+	// per-call headers don't leak into other calls
+	require.Equal(t, "c", headers[1].Get("X-Client"))
+	require.Equal(t, "", headers[1].Get("X-Trace"))
+	require.Equal(t, "default", headers[1].Get("X-Tenant"))
+}
+
+type StructParamHandler struct{}
+
+type StructParams struct {
+	Name  string `json:"name"`
+	Count int
+	Skip  string `json:"-"`
+}
+
+type TextStructParams struct {
+	Name string
+}
+
+func (p *TextStructParams) UnmarshalText(b []byte) error {
+	p.Name = "text:" + string(b)
+	return nil
+}
+
+type EmbeddedStructParams struct {
+	StructParams
+	Extra string
+}
+
+func (h *StructParamHandler) Do(p StructParams) string {
+	return fmt.Sprintf("%s:%d", p.Name, p.Count)
+}
+
+func (h *StructParamHandler) Text(p TextStructParams) string {
+	return p.Name
+}
+
+func (h *StructParamHandler) Embedded(p EmbeddedStructParams) string {
+	return fmt.Sprintf("%s:%d:%s", p.Name, p.Count, p.Extra)
+}
+
+func TestStructParam(t *testing.T) {
+	rpcServer := NewServer(WithStructParams())
+	rpcServer.Register("Struct", &StructParamHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	strictServer := NewServer()
+	strictServer.Register("Struct", &StructParamHandler{})
+
+	strictServ := httptest.NewServer(strictServer)
+	defer strictServ.Close()
+
+	call := func(url, method, params, resp string) func(t *testing.T) {
+		return func(t *testing.T) {
+			res, err := http.Post(url, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Struct.`+method+`", "params": `+params+`, "id": 1}`))
+			require.NoError(t, err)
+			defer res.Body.Close()
+
+			var out struct {
+				Result json.RawMessage
+				Error  *respError
+			}
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+
+			if resp == "" {
+				require.NotNil(t, out.Error)
+				return
+			}
+			require.Nil(t, out.Error)
+			require.JSONEq(t, resp, string(out.Result))
+		}
+	}
+	tc := func(params, resp string) func(t *testing.T) {
+		return call(testServ.URL, "Do", params, resp)
+	}
+
+	t.Run("wrapped", tc(`[{"name": "a", "Count": 1}]`, `"a:1"`))
+	t.Run("named", tc(`{"name": "a", "Count": 1}`, `"a:1"`))
+	t.Run("positional", tc(`["a", 1]`, `"a:1"`))
+	t.Run("positional-partial", tc(`["a"]`, `"a:0"`))
+	t.Run("positional-empty", tc(`[]`, ""))
+	t.Run("positional-too-many", tc(`["a", 1, "x"]`, ""))
+	t.Run("positional-bad-type", tc(`[1, "a"]`, ""))
+
+	// types decoding themselves aren't remapped
+	t.Run("text-unmarshaler", call(testServ.URL, "Text", `["a"]`, `"text:a"`))
+
+	// embedded fields are flattened by encoding/json, so positions would be ambiguous
+	t.Run("embedded-wrapped", call(testServ.URL, "Embedded", `[{"name": "a", "Count": 1, "Extra": "x"}]`, `"a:1:x"`))
+	t.Run("embedded-positional", call(testServ.URL, "Embedded", `["a", 1, "x"]`, ""))
+
+	// opt-in
+	t.Run("strict-named", call(strictServ.URL, "Do", `{"name": "a", "Count": 1}`, ""))
+	t.Run("strict-positional", call(strictServ.URL, "Do", `["a", 1]`, ""))
+	t.Run("strict-wrapped", call(strictServ.URL, "Do", `[{"name": "a", "Count": 1}]`, `"a:1"`))
+}
+
+type UnencodableHandler struct{}
+
+func (h *UnencodableHandler) Get() (struct{ F func() }, error) {
+	return struct{ F func() }{F: func() {}}, nil
+}
+
+func TestUnencodableResult(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("Bad", &UnencodableHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Bad.Get", "params": [], "id": 1}`))
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, 500, res.StatusCode)
+
+	var resp struct {
+		ID    int
+		Error *respError
+	}
+	require.NoError(t, json.Unmarshal(b, &resp), "malformed response: %s", string(b))
+	require.Equal(t, 1, resp.ID)
+	require.Equal(t, ErrorCode(-32603), resp.Error.Code)
+	require.Contains(t, resp.Error.Message, "failed to serialize result of 'Bad.Get'")
+
+	var client struct {
+		Get func() (struct{}, error)
+	}
+	closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "Bad", []interface{}{&client}, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	_, err = client.Get()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to serialize result")
+}
+
+func TestIndent(t *testing.T) {
+	rpcServer := NewServer(WithIndent("", "  "))
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	post := func(body string) string {
+		res, err := http.Post(testServ.URL, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return strings.TrimSpace(string(b))
+	}
+
+	require.Equal(t, `{
+  "id": 1,
+  "jsonrpc": "2.0",
+  "result": 2
+}`, post(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.AddGet", "params": [2], "id": 1}`))
+
+	require.Equal(t, `{
+  "error": {
+    "code": -32601,
+    "message": "method 'SimpleServerHandler.Nope' not found",
+    "data": {
+      "namespace": "SimpleServerHandler",
+      "namespaceExists": true
+    }
+  },
+  "id": 2,
+  "jsonrpc": "2.0"
+}`, post(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.Nope", "params": [], "id": 2}`))
+
+	require.Equal(t, `[
+  {
+    "id": 3,
+    "jsonrpc": "2.0",
+    "result": 3
+  },
+  {
+    "id": 4,
+    "jsonrpc": "2.0",
+    "result": 4
+  }
+]`, post(`[{"jsonrpc": "2.0", "method": "SimpleServerHandler.AddGet", "params": [1], "id": 3}, {"jsonrpc": "2.0", "method": "SimpleServerHandler.AddGet", "params": [1], "id": 4}]`))
+}
+
+type ResponseMetaHandler struct{}
+
+func (h *ResponseMetaHandler) List(ctx context.Context, page int) ([]int, error) {
+	SetResponseMeta(ctx, "cursor", strconv.Itoa(page+1))
+	return []int{page}, nil
+}
+
+func (h *ResponseMetaHandler) Plain() int {
+	return 1
+}
+
+func TestResponseMeta(t *testing.T) {
+	tc := func(opts []ServerOption, req, resp string) func(t *testing.T) {
+		return func(t *testing.T) {
+			rpcServer := NewServer(opts...)
+			rpcServer.Register("Meta", &ResponseMetaHandler{})
+
+			testServ := httptest.NewServer(rpcServer)
+			defer testServ.Close()
+
+			res, err := http.Post(testServ.URL, "application/json", strings.NewReader(req))
+			require.NoError(t, err)
+			b, err := ioutil.ReadAll(res.Body)
+			require.NoError(t, err)
+			require.NoError(t, res.Body.Close())
+			require.JSONEq(t, resp, string(b))
+		}
+	}
+
+	enabled := []ServerOption{WithResponseMeta()}
+	list := `{"jsonrpc": "2.0", "method": "Meta.List", "params": [1], "id": 1}`
+
+	t.Run("disabled", tc(nil, list, `{"jsonrpc":"2.0","id":1,"result":[1]}`))
+	t.Run("enabled", tc(enabled, list, `{"jsonrpc":"2.0","id":1,"result":[1],"meta":{"cursor":"2"}}`))
+	t.Run("enabled-empty", tc(enabled, `{"jsonrpc": "2.0", "method": "Meta.Plain", "params": [], "id": 1}`, `{"jsonrpc":"2.0","id":1,"result":1}`))
+}
+
+func TestWSSubprotocols(t *testing.T) {
+	var lk sync.Mutex
+	var negotiated []string
+
+	rpcServer := NewServer(WithWSSubprotocols([]string{"jsonrpc-2.0", "jsonrpc-legacy"}), WithConnContext(func(ctx context.Context, conn ConnInfo) context.Context {
+		lk.Lock()
+		negotiated = append(negotiated, conn.Subprotocol)
+		lk.Unlock()
+		return ctx
+	}))
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	addr := "ws://" + testServ.Listener.Addr().String()
+
+	dial := func(protocols ...string) (*websocket.Conn, *http.Response, error) {
+		d := websocket.Dialer{Subprotocols: protocols}
+		return d.Dial(addr, nil)
+	}
+
+	// server preference order wins
+	conn, _, err := dial("jsonrpc-legacy", "jsonrpc-2.0")
+	require.NoError(t, err)
+	require.Equal(t, "jsonrpc-2.0", conn.Subprotocol())
+	require.NoError(t, conn.Close())
+
+	conn, _, err = dial("other", "jsonrpc-legacy")
+	require.NoError(t, err)
+	require.Equal(t, "jsonrpc-legacy", conn.Subprotocol())
+	require.NoError(t, conn.Close())
+
+	// connections without a supported subprotocol are rejected
+	_, res, err := dial("other")
+	require.Error(t, err)
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	_, res, err = dial()
+	require.Error(t, err)
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// the Go client can offer subprotocols with the request header
+	var client struct {
+		AddGet func(int) int
+	}
+	closer, err := NewMergeClient(context.Background(), addr, "SimpleServerHandler", []interface{}{&client}, http.Header{
+		"Sec-WebSocket-Protocol": []string{"jsonrpc-2.0"},
+	})
+	require.NoError(t, err)
+	defer closer()
+	require.Equal(t, 1, client.AddGet(1))
+
+	lk.Lock()
+	defer lk.Unlock()
+	require.Equal(t, []string{"jsonrpc-2.0", "jsonrpc-legacy", "jsonrpc-2.0"}, negotiated)
+}
+
+func TestCircuitBreakerTrial(t *testing.T) {
+	cb := newCircuitBreaker(CircuitBreakerSettings{FailureThreshold: 1})
+
+	// allowed while closed, finishes after the circuit opened
+	slow, err := cb.allow()
+	require.NoError(t, err)
+	require.False(t, slow)
+
+	trial, err := cb.allow()
+	require.NoError(t, err)
+	cb.done(trial, true, false)
+	require.Equal(t, CircuitOpen, cb.State())
+
+	trial, err = cb.allow()
+	require.NoError(t, err)
+	require.True(t, trial)
+	require.Equal(t, CircuitHalfOpen, cb.State())
+
+	// the earlier call neither ends the trial nor changes the state
+	cb.done(slow, true, false)
+	require.Equal(t, CircuitHalfOpen, cb.State())
+	_, err = cb.allow()
+	require.True(t, errors.Is(err, ErrCircuitOpen))
+
+	cb.done(trial, false, false)
+	require.Equal(t, CircuitClosed, cb.State())
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	newServer := func(l net.Listener) *httptest.Server {
+		rpcServer := NewServer()
+		rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+		testServ := httptest.NewUnstartedServer(rpcServer)
+		if l != nil {
+			testServ.Listener = l
+		}
+		testServ.Start()
+		return testServ
+	}
+
+	testServ := newServer(nil)
+	addr := testServ.Listener.Addr().String()
+
+	var lk sync.Mutex
+	var changes []string
+
+	var client *Client
+	client, err := Dial(context.Background(), "http://"+addr, nil, WithCircuitBreaker(CircuitBreakerSettings{
+		FailureThreshold: 2,
+		Cooldown:         100 * time.Millisecond,
+		OnStateChange: func(from, to CircuitState) {
+			// callbacks can query the breaker
+			require.Equal(t, to, client.CircuitState())
+
+			lk.Lock()
+			defer lk.Unlock()
+			changes = append(changes, from.String()+"->"+to.String())
+		},
+	}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	// JSON-RPC errors aren't transport failures
+	for i := 0; i < 3; i++ {
+		err := client.Call(context.Background(), "SimpleServerHandler.Nope", nil)
+		require.Error(t, err)
+		require.False(t, errors.Is(err, ErrCircuitOpen))
+	}
+	require.Equal(t, CircuitClosed, client.CircuitState())
+
+	// transport failures open the circuit
+	testServ.Close()
+	for i := 0; i < 2; i++ {
+		err := client.Call(context.Background(), "SimpleServerHandler.Inc", nil)
+		require.Error(t, err)
+		require.False(t, errors.Is(err, ErrCircuitOpen))
+	}
+	require.Equal(t, CircuitOpen, client.CircuitState())
+
+	err = client.Call(context.Background(), "SimpleServerHandler.Inc", nil)
+	require.True(t, errors.Is(err, ErrCircuitOpen))
+
+	// a failed trial call after the cooldown keeps the circuit open
+	time.Sleep(150 * time.Millisecond)
+	err = client.Call(context.Background(), "SimpleServerHandler.Inc", nil)
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrCircuitOpen))
+	require.Equal(t, CircuitOpen, client.CircuitState())
+
+	// a successful trial call closes the circuit
+	l, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	testServ = newServer(l)
+	defer testServ.Close()
+
+	time.Sleep(150 * time.Millisecond)
+	require.NoError(t, client.Call(context.Background(), "SimpleServerHandler.Inc", nil))
+	require.Equal(t, CircuitClosed, client.CircuitState())
+
+	lk.Lock()
+	defer lk.Unlock()
+	require.Equal(t, []string{"closed->open", "open->half-open", "half-open->open", "open->half-open", "half-open->closed"}, changes)
+}
+
+type UnmarshalerParam struct {
+	v string
+}
+
+func (p *UnmarshalerParam) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	p.v = "custom:" + s
+	return nil
+}
+
+type UnmarshalerHandler struct{}
+
+func (h *UnmarshalerHandler) BigPtr(i *big.Int) string {
+	return i.String()
+}
+
+func (h *UnmarshalerHandler) BigVal(i big.Int) string {
+	return i.String()
+}
+
+func (h *UnmarshalerHandler) Custom(p UnmarshalerParam, pp *UnmarshalerParam) string {
+	return p.v + "," + pp.v
+}
+
+func TestUnmarshalerParams(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("U", &UnmarshalerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	tc := func(method, params, resp string) func(t *testing.T) {
+		return func(t *testing.T) {
+			res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "U.`+method+`", "params": `+params+`, "id": 1}`))
+			require.NoError(t, err)
+			defer res.Body.Close()
+
+			var out struct {
+				Result json.RawMessage
+				Error  *respError
+			}
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+
+			if resp == "" {
+				require.NotNil(t, out.Error)
+				return
+			}
+			require.Nil(t, out.Error)
+			require.JSONEq(t, resp, string(out.Result))
+		}
+	}
+
+	t.Run("big-ptr-number", tc("BigPtr", `[123456789012345678901234567890]`, `"123456789012345678901234567890"`))
+	t.Run("big-ptr-string", tc("BigPtr", `["123456789012345678901234567890"]`, `"123456789012345678901234567890"`))
+	t.Run("big-ptr-hex-string", tc("BigPtr", `["0x10"]`, `"16"`))
+	t.Run("big-val-string", tc("BigVal", `["42"]`, `"42"`))
+	t.Run("big-bad-string", tc("BigPtr", `["nope"]`, ""))
+	t.Run("custom", tc("Custom", `["a", "b"]`, `"custom:a,custom:b"`))
+
+	// the client sends *big.Int as a number
+	var client struct {
+		BigPtr func(*big.Int) (string, error)
+	}
+	closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "U", []interface{}{&client}, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	n, _ := new(big.Int).SetString("98765432109876543210", 10)
+	s, err := client.BigPtr(n)
+	require.NoError(t, err)
+	require.Equal(t, n.String(), s)
+}
+
+func TestValidate(t *testing.T) {
+	serverHandler := &SimpleServerHandler{}
+
+	rpcServer := NewServer()
+	rpcServer.Register("SimpleServerHandler", serverHandler)
+
+	ctx := context.Background()
+
+	require.Nil(t, rpcServer.Validate(ctx, []byte(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [2], "id": 1}`)))
+	require.Nil(t, rpcServer.Validate(ctx, []byte(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [2]}`)))
+
+	tc := func(req string, code ErrorCode) func(t *testing.T) {
+		return func(t *testing.T) {
+			errs := rpcServer.Validate(ctx, []byte(req))
+			require.Len(t, errs, 1)
+			require.Equal(t, code, errs[0].Code)
+		}
+	}
+
+	t.Run("parse", tc(`{"jsonrpc": "2.0",`, ParseError))
+	t.Run("version", tc(`{"jsonrpc": "1.0", "method": "SimpleServerHandler.Add", "params": [2], "id": 1}`, InvalidRequest))
+	t.Run("not-found", tc(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.Nope", "params": [], "id": 1}`, MethodNotFound))
+	t.Run("param-count", tc(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [2, 3], "id": 1}`, InvalidParams))
+	t.Run("param-type", tc(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": ["x"], "id": 1}`, ParseError))
+
+	errs := rpcServer.Validate(ctx, []byte(`[
+		{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [2], "id": 1},
+		{"jsonrpc": "2.0", "method": "SimpleServerHandler.Nope", "params": [], "id": 2},
+		{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": ["x"], "id": 3}
+	]`))
+	require.Len(t, errs, 2)
+	require.Equal(t, 1, errs[0].Index)
+	require.Equal(t, float64(2), errs[0].ID)
+	require.Equal(t, MethodNotFound, errs[0].Code)
+	require.Equal(t, 2, errs[1].Index)
+	require.Equal(t, ParseError, errs[1].Code)
+
+	// nothing was executed
+	require.Equal(t, int32(0), serverHandler.n)
+}
+
+func TestMethodRewrite(t *testing.T) {
+	rpcServer := NewServer(WithMethodRewrite(func(method string) string {
+		switch method {
+		case "SimpleServerHandler.AddGetV1":
+			return "SimpleServerHandler.AddGet"
+		case "SimpleServerHandler.Inc":
+			return ""
+		}
+		return method
+	}))
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var client struct {
+		AddGetV1 func(int) int
+		AddGet   func(int) int
+		Inc      func() error
+	}
+	closer, err := NewMergeClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "SimpleServerHandler", []interface{}{&client}, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	require.Equal(t, 2, client.AddGetV1(2))
+	require.Equal(t, 5, client.AddGet(3))
+
+	err = client.Inc()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "method 'SimpleServerHandler.Inc' not found")
+
+	// per-method settings apply to the rewritten name
+	hnd := &CachedHandler{}
+	cached := NewServer(WithMethodRewrite(func(method string) string {
+		return strings.TrimSuffix(method, "V1")
+	}), WithMethodCache("Cached.Square", time.Minute), WithCallerIdentity(sharedCallerIdentity), WithMethodAllowlistFunc(func(ctx context.Context) (map[string]bool, error) {
+		return map[string]bool{"Cached.Square": true}, nil
+	}))
+	cached.Register("Cached", hnd)
+
+	cachedServ := httptest.NewServer(cached)
+	defer cachedServ.Close()
+
+	var cachedClient struct {
+		Square   func(int) (int, error)
+		SquareV1 func(int) (int, error)
+	}
+	closer, err = NewMergeClient(context.Background(), "http://"+cachedServ.Listener.Addr().String(), "Cached", []interface{}{&cachedClient}, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	n, err := cachedClient.Square(3)
+	require.NoError(t, err)
+	require.Equal(t, 9, n)
+	n, err = cachedClient.SquareV1(3)
+	require.NoError(t, err)
+	require.Equal(t, 9, n)
+	require.Equal(t, int32(1), atomic.LoadInt32(&hnd.calls))
+}
+
+type PaginatedHandler struct {
+	items []int
+	pages int32
+}
+
+func (h *PaginatedHandler) List(ctx context.Context, cursor string) (Page[int], error) {
+	atomic.AddInt32(&h.pages, 1)
+
+	p := Paginator[int]{
+		PageSize: 3,
+		Fetch: func(ctx context.Context, offset, limit int) ([]int, error) {
+			if offset >= len(h.items) {
+				return nil, nil
+			}
+			end := offset + limit
+			if end > len(h.items) {
+				end = len(h.items)
+			}
+			return h.items[offset:end], nil
+		},
+	}
+	return p.Page(ctx, cursor)
+}
+
+func TestPagination(t *testing.T) {
+	hnd := &PaginatedHandler{}
+
+	rpcServer := NewServer()
+	rpcServer.Register("Pages", hnd)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var client struct {
+		List func(ctx context.Context, cursor string) (Page[int], error)
+	}
+	closer, err := NewMergeClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "Pages", []interface{}{&client}, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	collect := func() []int {
+		out := []int{}
+		it := NewPageIterator(context.Background(), client.List)
+		for it.Next() {
+			out = append(out, it.Item())
+		}
+		require.NoError(t, it.Err())
+		return out
+	}
+
+	tc := func(n int, pages int32) func(t *testing.T) {
+		return func(t *testing.T) {
+			hnd.items = nil
+			for i := 0; i < n; i++ {
+				hnd.items = append(hnd.items, i)
+			}
+			atomic.StoreInt32(&hnd.pages, 0)
+
+			require.Equal(t, append([]int{}, hnd.items...), collect())
+			require.Equal(t, pages, atomic.LoadInt32(&hnd.pages))
+		}
+	}
+
+	t.Run("empty", tc(0, 1))
+	t.Run("partial-last-page", tc(5, 2))
+	// the last full page has a cursor, the final page is empty
+	t.Run("empty-final-page", tc(6, 3))
+
+	page, err := client.List(context.Background(), "")
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1, 2}, page.Items)
+	require.NotEmpty(t, page.Cursor)
+
+	_, err = client.List(context.Background(), "not a cursor")
+	require.Error(t, err)
+}
+
+func TestAllowGET(t *testing.T) {
+	rpcServer := NewServer(WithAllowGET([]string{"SimpleServerHandler.StringMatch", "SimpleServerHandler.AddGet"}))
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	get := func(q url.Values) (int, string) {
+		res, err := http.Get(testServ.URL + "?" + q.Encode())
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		b, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(b)
+	}
+
+	code, body := get(url.Values{
+		"method": {"SimpleServerHandler.StringMatch"},
+		"params": {`[{"S":"7","I":7}, 7]`},
+		"id":     {"3"},
+	})
+	require.Equal(t, http.StatusOK, code)
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":3,"result":{"S":"7","I":7,"Ok":true}}`, body)
+
+	// string ids don't need to be quoted
+	_, body = get(url.Values{
+		"method": {"SimpleServerHandler.AddGet"},
+		"params": {`[2]`},
+		"id":     {"abc"},
+	})
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":"abc","result":2}`, body)
+
+	// missing params and id
+	_, body = get(url.Values{"method": {"SimpleServerHandler.StringMatch"}})
+	require.Contains(t, body, `"id":0`)
+	require.Contains(t, body, "wrong param count")
+
+	_, body = get(url.Values{"method": {"SimpleServerHandler.AddGet"}, "params": {`[2`}})
+	require.Contains(t, body, "Parse error")
+
+	code, body = get(url.Values{"method": {"SimpleServerHandler.Add"}, "params": {`[2]`}})
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Contains(t, body, "can't be called with GET")
+}
+
+func TestResponseSigning(t *testing.T) {
+	secret := []byte("shared secret")
+
+	signed := NewServer(WithServerResponseSigning(secret))
+	signed.Register("SimpleServerHandler", &SimpleServerHandler{})
+	signedServ := httptest.NewServer(signed)
+	defer signedServ.Close()
+
+	unsigned := NewServer()
+	unsigned.Register("SimpleServerHandler", &SimpleServerHandler{})
+	unsignedServ := httptest.NewServer(unsigned)
+	defer unsignedServ.Close()
+
+	type client struct {
+		AddGet      func(int) int
+		StringMatch func(t TestType, i2 int64) (out TestOut, err error)
+	}
+	connect := func(serv *httptest.Server, opts ...Option) (*client, ClientCloser) {
+		var c client
+		closer, err := NewMergeClient(context.Background(), "http://"+serv.Listener.Addr().String(), "SimpleServerHandler", []interface{}{&c}, nil, opts...)
+		require.NoError(t, err)
+		return &c, closer
+	}
+
+	c, closer := connect(signedServ, WithResponseSigning(secret))
+	defer closer()
+
+	_, err := c.StringMatch(TestType{S: "0", I: 0}, 0)
+	require.NoError(t, err)
+
+	// error responses are signed too
+	_, err = c.StringMatch(TestType{S: "0", I: 1}, 0)
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrInvalidSignature))
+
+	// unsigned and wrongly signed responses are rejected
+	for _, tc := range []struct {
+		name string
+		serv *httptest.Server
+		opts []Option
+	}{
+		{"wrong-secret", signedServ, []Option{WithResponseSigning([]byte("other secret"))}},
+		{"unsigned", unsignedServ, []Option{WithResponseSigning(secret)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, closer := connect(tc.serv, tc.opts...)
+			defer closer()
+
+			_, err := c.StringMatch(TestType{S: "0", I: 0}, 0)
+			require.True(t, errors.Is(err, ErrInvalidSignature), err)
+		})
+	}
+
+	// clients without signing ignore the signature
+	c, closer = connect(signedServ)
+	defer closer()
+	require.Equal(t, 2, c.AddGet(2))
+
+	// signatures are bound to the request nonce, replayed responses don't
+	// verify for other requests
+	post := func(nonce string) ([]byte, string) {
+		req, err := http.NewRequest("POST", signedServ.URL, strings.NewReader(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.AddGet", "params": [1], "id": 1}`))
+		require.NoError(t, err)
+		req.Header.Set(SignatureNonceHeader, nonce)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close() // nolint:errcheck
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return body, resp.Header.Get(SignatureHeader)
+	}
+	body, sig := post("nonce-a")
+	require.True(t, verifyBody(secret, "nonce-a", body, sig))
+	require.False(t, verifyBody(secret, "nonce-b", body, sig))
+}
+
+type TrailerHandler struct {
+	release chan struct{}
+}
+
+func (h *TrailerHandler) Count(ctx context.Context, n int) (<-chan int, error) {
+	out := make(chan int)
+	go func() {
+		defer close(out)
+
+		for i := 0; i < n; i++ {
+			out <- i
+		}
+
+		<-h.release
+		SetStreamTrailer(ctx, "count", strconv.Itoa(n))
+	}()
+	return out, nil
+}
+
+func TestStreamTrailer(t *testing.T) {
+	hnd := &TrailerHandler{release: make(chan struct{})}
+
+	rpcServer := NewServer()
+	rpcServer.Register("Trailer", hnd)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var client struct {
+		Count func(ctx context.Context, n int) (<-chan int, error)
+	}
+	closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "Trailer", []interface{}{&client}, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	var trailer StreamTrailer
+	ch, err := client.Count(WithStreamTrailer(context.Background(), &trailer), 3)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, i, <-ch)
+	}
+	require.Empty(t, trailer.Get())
+
+	close(hnd.release)
+
+	_, ok := <-ch
+	require.False(t, ok)
+	require.Equal(t, map[string]string{"count": "3"}, trailer.Get())
+
+	// calls without WithStreamTrailer ignore the trailer
+	ch, err = client.Count(context.Background(), 1)
+	require.NoError(t, err)
+	require.Equal(t, 0, <-ch)
+	_, ok = <-ch
+	require.False(t, ok)
+}
+
+type WorkerPoolHandler struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (h *WorkerPoolHandler) Block() string {
+	h.started <- struct{}{}
+	<-h.release
+	return "done"
+}
+
+func TestWorkerPool(t *testing.T) {
+	hnd := &WorkerPoolHandler{started: make(chan struct{}, 2), release: make(chan struct{})}
+
+	rpcServer := NewServer(WithWorkerPool(1, 1))
+	rpcServer.Register("Pool", hnd)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+testServ.Listener.Addr().String(), nil)
+	require.NoError(t, err)
+	defer conn.Close() // nolint:errcheck
+
+	call := func(id int) {
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"jsonrpc": "2.0", "method": "Pool.Block", "params": [], "id": %d}`, id))))
+	}
+
+	type resp struct {
+		ID     float64
+		Result string
+		Error  *respError
+	}
+	read := func() resp {
+		var r resp
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		require.NoError(t, conn.ReadJSON(&r))
+		return r
+	}
+
+	// the first call takes the only worker, the second one is queued
+	call(1)
+	<-hnd.started
+	call(2)
+	call(3)
+
+	r := read()
+	require.Equal(t, float64(3), r.ID)
+	require.NotNil(t, r.Error)
+	require.Equal(t, ServerBusy, r.Error.Code)
+
+	close(hnd.release)
+
+	ids := map[float64]string{}
+	for i := 0; i < 2; i++ {
+		r := read()
+		require.Nil(t, r.Error)
+		ids[r.ID] = r.Result
+	}
+	require.Equal(t, map[float64]string{1: "done", 2: "done"}, ids)
+
+	// workers exit after shutdown, later calls are rejected as draining
+	require.NoError(t, rpcServer.Shutdown(context.Background()))
+	exited := make(chan struct{})
+	go func() {
+		rpcServer.workers.workers.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("workers didn't exit")
+	}
+
+	call(4)
+	r = read()
+	require.Equal(t, float64(4), r.ID)
+	require.NotNil(t, r.Error)
+	require.Equal(t, ServerDraining, r.Error.Code)
+}
+
+func BenchmarkHandleNoParams(b *testing.B) {
+	rpcServer := NewServer()
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+	bench := func(method, params string) func(b *testing.B) {
+		return func(b *testing.B) {
+			req := request{
+				Jsonrpc: "2.0",
+				ID:      float64(1),
+				Method:  method,
+				Params:  json.RawMessage(params),
+			}
+			w := func(cb func(io.Writer)) {
+				cb(ioutil.Discard)
+			}
+			done := func(bool) {}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					rpcServer.handle(context.Background(), req, w, rpcServer.rpcError, done, nil)
+				}
+			})
+		}
+	}
+
+	b.Run("no-params", bench("SimpleServerHandler.Inc", `[]`))
+	b.Run("one-param", bench("SimpleServerHandler.AddGet", `[1]`))
+}
+
+type maxWriter struct {
+	max int
+}
+
+func (w *maxWriter) Write(p []byte) (int, error) {
+	if len(p) > w.max {
+		w.max = len(p)
+	}
+	return len(p), nil
+}
+
+func BenchmarkStreamingArrays(b *testing.B) {
+	bench := func(opts ...ServerOption) func(b *testing.B) {
+		return func(b *testing.B) {
+			rpcServer := NewServer(opts...)
+			rpcServer.Register("Array", &ArrayHandler{})
+
+			req := request{
+				Jsonrpc: "2.0",
+				ID:      float64(1),
+				Method:  "Array.Items",
+				Params:  json.RawMessage(`[100000, -1]`),
+			}
+			// the largest write is roughly the largest encoded buffer held
+			mw := &maxWriter{}
+			w := func(cb func(io.Writer)) {
+				cb(mw)
+			}
+			done := func(bool) {}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rpcServer.handle(context.Background(), req, w, rpcServer.rpcError, done, nil)
+			}
+			b.ReportMetric(float64(mw.max), "max-write-B")
+		}
+	}
+
+	b.Run("buffered", bench())
+	b.Run("streaming", bench(WithStreamingArrays()))
+}
+
+func BenchmarkWorkerPool(b *testing.B) {
+	bench := func(opts ...ServerOption) func(b *testing.B) {
+		return func(b *testing.B) {
+			rpcServer := NewServer(opts...)
+			rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+			testServ := httptest.NewServer(rpcServer)
+			defer testServ.Close()
+
+			var client struct {
+				AddGet func(int) int
+			}
+			closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "SimpleServerHandler", []interface{}{&client}, nil)
+			require.NoError(b, err)
+			defer closer()
+
+			// sample the peak goroutine count while calls are running
+			var peak int64
+			stop := make(chan struct{})
+			sampled := make(chan struct{})
+			go func() {
+				defer close(sampled)
+				for {
+					if n := int64(runtime.NumGoroutine()); n > atomic.LoadInt64(&peak) {
+						atomic.StoreInt64(&peak, n)
+					}
+					select {
+					case <-stop:
+						return
+					case <-time.After(time.Millisecond):
+					}
+				}
+			}()
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					client.AddGet(1)
+				}
+			})
+			b.StopTimer()
+
+			close(stop)
+			<-sampled
+			b.ReportMetric(float64(atomic.LoadInt64(&peak)), "peak-goroutines")
+		}
+	}
+
+	b.Run("goroutine-per-call", bench())
+	b.Run("pool", bench(WithWorkerPool(4, 1024)))
+}
+
+func TestMethodNotFoundData(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	tc := func(method, msg, data string) func(t *testing.T) {
+		return func(t *testing.T) {
+			res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "`+method+`", "params": [], "id": 1}`))
+			require.NoError(t, err)
+			defer res.Body.Close()
+
+			var out struct {
+				Error *respError
+			}
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+			require.NotNil(t, out.Error)
+			require.Equal(t, MethodNotFound, out.Error.Code)
+			require.Equal(t, msg, out.Error.Message)
+			require.JSONEq(t, data, string(out.Error.Data))
+		}
+	}
+
+	t.Run("unknown-method", tc("SimpleServerHandler.Nope",
+		"method 'SimpleServerHandler.Nope' not found",
+		`{"namespace": "SimpleServerHandler", "namespaceExists": true}`))
+	t.Run("unknown-namespace", tc("SimpleServerHandlr.Add",
+		"method 'SimpleServerHandlr.Add' not found (namespace 'SimpleServerHandlr' not registered)",
+		`{"namespace": "SimpleServerHandlr", "namespaceExists": false}`))
+}
+
+// testCBOR is a minimal CBOR codec for generic values (RFC 8949 subset: ints,
+// float64, strings, arrays, maps with string keys, bools and null)
+type testCBOR struct{}
+
+func (testCBOR) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := cborEncode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (testCBOR) Unmarshal(data []byte, v interface{}) error {
+	r := bytes.NewReader(data)
+	val, err := cborDecode(r)
+	if err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return errors.New("trailing cbor data")
+	}
+	reflect.ValueOf(v).Elem().Set(reflect.ValueOf(&val).Elem())
+	return nil
+}
+
+func cborHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major<<5 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major<<5 | 25)
+		_ = binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major<<5 | 26)
+		_ = binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major<<5 | 27)
+		_ = binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func cborEncode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if v {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			if v >= 0 {
+				cborHead(buf, 0, uint64(v))
+			} else {
+				cborHead(buf, 1, uint64(-v-1))
+			}
+			return nil
+		}
+		buf.WriteByte(0xfb)
+		_ = binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case int64:
+		if v >= 0 {
+			cborHead(buf, 0, uint64(v))
+		} else {
+			cborHead(buf, 1, uint64(-(v + 1)))
+		}
+	case uint64:
+		cborHead(buf, 0, v)
+	case string:
+		cborHead(buf, 3, uint64(len(v)))
+		buf.WriteString(v)
+	case []interface{}:
+		cborHead(buf, 4, uint64(len(v)))
+		for _, e := range v {
+			if err := cborEncode(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		cborHead(buf, 5, uint64(len(v)))
+		for _, k := range keys {
+			_ = cborEncode(buf, k)
+			if err := cborEncode(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cbor: unsupported type %T", v)
+	}
+	return nil
+}
+
+func cborDecode(r *bytes.Reader) (interface{}, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	major, info := b>>5, b&0x1f
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22:
+			return nil, nil
+		case 27:
+			var bits uint64
+			if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+				return nil, err
+			}
+			return math.Float64frombits(bits), nil
+		}
+		return nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+
+	n := uint64(info)
+	switch info {
+	case 24:
+		var v uint8
+		err = binary.Read(r, binary.BigEndian, &v)
+		n = uint64(v)
+	case 25:
+		var v uint16
+		err = binary.Read(r, binary.BigEndian, &v)
+		n = uint64(v)
+	case 26:
+		var v uint32
+		err = binary.Read(r, binary.BigEndian, &v)
+		n = uint64(v)
+	case 27:
+		err = binary.Read(r, binary.BigEndian, &n)
+	default:
+		if info > 27 {
+			return nil, fmt.Errorf("cbor: unsupported length %d", info)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case 0:
+		// integers which float64 can't represent exactly are kept as integers
+		if n > 1<<53 {
+			return n, nil
+		}
+		return float64(n), nil
+	case 1:
+		if n > 1<<53 {
+			return -int64(n) - 1, nil
+		}
+		return -float64(n) - 1, nil
+	case 3:
+		s := make([]byte, n)
+		if _, err := io.ReadFull(r, s); err != nil {
+			return nil, err
+		}
+		return string(s), nil
+	case 4:
+		out := []interface{}{}
+		for i := uint64(0); i < n; i++ {
+			e, err := cborDecode(r)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, e)
+		}
+		return out, nil
+	case 5:
+		out := map[string]interface{}{}
+		for i := uint64(0); i < n; i++ {
+			k, err := cborDecode(r)
+			if err != nil {
+				return nil, err
+			}
+			ks, ok := k.(string)
+			if !ok {
+				return nil, errors.New("cbor: non-string map key")
+			}
+			if out[ks], err = cborDecode(r); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("cbor: unsupported major type %d", major)
+}
+
+func TestCodecForContentType(t *testing.T) {
+	rpcServer := NewServer(WithCodecForContentType("application/cbor", testCBOR{}))
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	post := func(contentType, accept string, body []byte) (string, []byte) {
+		req, err := http.NewRequest("POST", testServ.URL, bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", contentType)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		b, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.Header.Get("Content-Type"), b
+	}
+
+	reqBody, err := testCBOR{}.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      float64(1),
+		"method":  "SimpleServerHandler.StringMatch",
+		"params":  []interface{}{map[string]interface{}{"S": "7", "I": float64(7)}, float64(7)},
+	})
+	require.NoError(t, err)
+
+	expected := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      float64(1),
+		"result":  map[string]interface{}{"S": "7", "I": float64(7), "Ok": true},
+	}
+
+	// cbor request, cbor response
+	ct, body := post("application/cbor", "", reqBody)
+	require.Equal(t, "application/cbor", ct)
+	var resp interface{}
+	require.NoError(t, testCBOR{}.Unmarshal(body, &resp))
+	require.Equal(t, expected, resp)
+
+	// cbor request, json response
+	_, body = post("application/cbor", "application/json", reqBody)
+	var jresp interface{}
+	require.NoError(t, json.Unmarshal(body, &jresp))
+	require.Equal(t, expected, jresp)
+
+	// json request, cbor response
+	ct, body = post("application/json", "application/cbor", []byte(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.StringMatch", "params": [{"S":"7","I":7}, 7], "id": 1}`))
+	require.Equal(t, "application/cbor", ct)
+	require.NoError(t, testCBOR{}.Unmarshal(body, &resp))
+	require.Equal(t, expected, resp)
+
+	// errors are encoded too
+	nope, err := testCBOR{}.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": float64(2), "method": "SimpleServerHandler.Nope", "params": []interface{}{}})
+	require.NoError(t, err)
+	_, body = post("application/cbor", "", nope)
+	require.NoError(t, testCBOR{}.Unmarshal(body, &resp))
+	require.Equal(t, float64(MethodNotFound), resp.(map[string]interface{})["error"].(map[string]interface{})["code"])
+
+	// invalid cbor
+	_, body = post("application/cbor", "application/json", []byte{0xff})
+	require.Contains(t, string(body), "decoding request body")
+
+	// integers over 2^53 keep their precision
+	require.NoError(t, rpcServer.RegisterMap("Big", map[string]interface{}{
+		"Echo": func(n int64) int64 { return n },
+	}))
+	_, body = post("application/json", "application/cbor", []byte(`{"jsonrpc": "2.0", "method": "Big.Echo", "params": [9007199254740993], "id": 1}`))
+	require.NoError(t, testCBOR{}.Unmarshal(body, &resp))
+	require.Equal(t, uint64(9007199254740993), resp.(map[string]interface{})["result"])
+
+	bigReq, err := testCBOR{}.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": float64(1), "method": "Big.Echo", "params": []interface{}{int64(-9007199254740993)}})
+	require.NoError(t, err)
+	_, body = post("application/cbor", "application/json", bigReq)
+	require.JSONEq(t, `{"jsonrpc": "2.0", "id": 1, "result": -9007199254740993}`, string(body))
+
+	// output of io.Writer params isn't encoded
+	proceed := make(chan struct{})
+	close(proceed)
+	rpcServer.Register("Tail", &TailHandler{proceed: proceed, cancelled: make(chan struct{})})
+	ct, body = post("application/json", "application/cbor", []byte(`{"jsonrpc": "2.0", "method": "Tail.Tail", "params": [1, null], "id": 1}`))
+	require.Equal(t, "text/plain; charset=utf-8", ct)
+	require.Equal(t, "line 1\n", string(body))
+}
+
+func TestMockServer(t *testing.T) {
+	for _, proto := range []string{"http", "ws"} {
+		t.Run(proto, func(t *testing.T) {
+			mock := NewMockServer()
+			mock.Expect("SimpleServerHandler.AddGet").WithParams(2).Return(5).Times(2)
+			mock.Expect("SimpleServerHandler.AddGet").Return(-1)
+			mock.Expect("SimpleServerHandler.StringMatch").ReturnError(12, "mocked")
+			mock.Expect("SimpleServerHandler.Inc")
+
+			testServ := httptest.NewServer(mock)
+			defer testServ.Close()
+
+			var client struct {
+				AddGet      func(int) int
+				StringMatch func(t TestType, i2 int64) (out TestOut, err error)
+				Add         func(int) error
+			}
+			closer, err := NewMergeClient(context.Background(), proto+"://"+testServ.Listener.Addr().String(), "SimpleServerHandler", []interface{}{&client}, nil)
+			require.NoError(t, err)
+			defer closer()
+
+			require.Equal(t, 5, client.AddGet(2))
+			require.Equal(t, 5, client.AddGet(2))
+			// the first expectation is exhausted
+			require.Equal(t, -1, client.AddGet(2))
+			require.Equal(t, -1, client.AddGet(3))
+
+			_, err = client.StringMatch(TestType{S: "1"}, 1)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "mocked")
+
+			err = client.Add(1)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "unexpected call to 'SimpleServerHandler.Add'")
+
+			calls := mock.Calls()
+			require.Len(t, calls, 6)
+			require.Equal(t, "SimpleServerHandler.AddGet", calls[3].Method)
+			require.JSONEq(t, `[3]`, string(calls[3].Params))
+
+			err = mock.Verify()
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "expected call to 'SimpleServerHandler.Inc' not made")
+			require.Contains(t, err.Error(), "unexpected call to 'SimpleServerHandler.Add' with params [1]")
+		})
+	}
+
+	mock := NewMockServer()
+	mock.Expect("Ns.Call").WithParams("a", 1).Times(1)
+
+	testServ := httptest.NewServer(mock)
+	defer testServ.Close()
+
+	var client struct {
+		Call func(string, int) error
+	}
+	closer, err := NewMergeClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "Ns", []interface{}{&client}, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	require.NoError(t, client.Call("a", 1))
+	require.NoError(t, mock.Verify())
+
+	// expectations can be changed while clients are calling the mock
+	e := mock.Expect("Ns.Call")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			_ = client.Call("b", i)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		e.WithParams("b", i).Return(i).Times(1)
+	}
+	e.ReturnError(1, "done")
+	<-done
+}
+
+func TestParamErrorIndex(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.StringMatch", "params": [{"S":"1","I":1}, "x"], "id": 1}`))
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	var out struct {
+		Error *respError
+	}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+	require.NotNil(t, out.Error)
+	require.Equal(t, ParseError, out.Error.Code)
+	require.Contains(t, out.Error.Message, "unmarshaling params for 'SimpleServerHandler.StringMatch' (param 1: *int64)")
+	require.JSONEq(t, `{"param": 1}`, string(out.Error.Data))
+
+	errs := rpcServer.Validate(context.Background(), []byte(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.StringMatch", "params": [7, 1], "id": 1}`))
+	require.Len(t, errs, 1)
+	require.Contains(t, errs[0].Error(), "(param 0: *jsonrpc.TestType)")
+}
+
+type RedactUser struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type RedactCreds struct {
+	User   RedactUser        `json:"user"`
+	APIKey string            `json:"apiKey"`
+	Extra  []json.RawMessage `json:"extra"`
+}
+
+type RedactHandler struct{}
+
+func (h *RedactHandler) Login(creds RedactCreds, note string) (map[string]string, error) {
+	return map[string]string{"user": creds.User.Name, "token": "t-" + creds.User.Password}, nil
+}
+
+func (h *RedactHandler) LoginPlain(user, password string) (string, error) {
+	return "ok " + user, nil
+}
+
+func TestLogRedaction(t *testing.T) {
+	var lk sync.Mutex
+	var entries []WireLogEntry
+
+	rpcServer := NewServer(
+		WithWireLogger(func(ctx context.Context, e WireLogEntry) {
+			lk.Lock()
+			defer lk.Unlock()
+			entries = append(entries, e)
+		}),
+		WithLogRedaction("Redact.Login", "password", "token"),
+		WithLogRedaction("", "apiKey"),
+	)
+	rpcServer.Register("Redact", &RedactHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var client struct {
+		Login func(RedactCreds, string) (map[string]string, error)
+	}
+	closer, err := NewMergeClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "Redact", []interface{}{&client}, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	creds := RedactCreds{
+		User:   RedactUser{Name: "alice", Password: "hunter2"},
+		APIKey: "secret-key",
+		Extra:  []json.RawMessage{json.RawMessage(`{"deep": {"password": "nested"}}`)},
+	}
+	res, err := client.Login(creds, "password")
+	require.NoError(t, err)
+	// the wire isn't affected
+	require.Equal(t, map[string]string{"user": "alice", "token": "t-hunter2"}, res)
+
+	lk.Lock()
+	defer lk.Unlock()
+	require.Len(t, entries, 2)
+
+	require.False(t, entries[0].Response)
+	require.Equal(t, "Redact.Login", entries[0].Method)
+	var req struct {
+		Params []json.RawMessage
+	}
+	require.NoError(t, json.Unmarshal(entries[0].Data, &req))
+	require.JSONEq(t, `{"user": {"name": "alice", "password": "***"}, "apiKey": "***", "extra": [{"deep": {"password": "***"}}]}`, string(req.Params[0]))
+	// only object fields are redacted, not values
+	require.JSONEq(t, `"password"`, string(req.Params[1]))
+	require.NotContains(t, string(entries[0].Data), "hunter2")
+
+	require.True(t, entries[1].Response)
+	require.JSONEq(t, `{"jsonrpc": "2.0", "id": 1, "result": {"user": "alice", "token": "***"}}`, string(entries[1].Data))
+}
+
+func TestLogParamRedaction(t *testing.T) {
+	var lk sync.Mutex
+	var entries []WireLogEntry
+
+	rpcServer := NewServer(
+		WithWireLogger(func(ctx context.Context, e WireLogEntry) {
+			lk.Lock()
+			defer lk.Unlock()
+			entries = append(entries, e)
+		}),
+		WithLogParamRedaction("Redact.LoginPlain", 1),
+	)
+	rpcServer.Register("Redact", &RedactHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var client struct {
+		LoginPlain func(string, string) (string, error)
+	}
+	closer, err := NewMergeClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "Redact", []interface{}{&client}, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	res, err := client.LoginPlain("alice", "hunter2")
+	require.NoError(t, err)
+	require.Equal(t, "ok alice", res)
+
+	lk.Lock()
+	defer lk.Unlock()
+	require.Len(t, entries, 2)
+
+	var req struct {
+		Params []json.RawMessage
+	}
+	require.NoError(t, json.Unmarshal(entries[0].Data, &req))
+	require.Len(t, req.Params, 2)
+	require.JSONEq(t, `"alice"`, string(req.Params[0]))
+	require.JSONEq(t, `"***"`, string(req.Params[1]))
+	require.NotContains(t, string(entries[0].Data), "hunter2")
+
+	// positions only apply to request params
+	require.JSONEq(t, `{"jsonrpc": "2.0", "id": 1, "result": "ok alice"}`, string(entries[1].Data))
+}
+
+type SlowCallHandler struct {
+	started   chan struct{}
+	cancelled chan struct{}
+}
+
+func (h *SlowCallHandler) Wait(ctx context.Context) (string, error) {
+	close(h.started)
+	select {
+	case <-ctx.Done():
+		close(h.cancelled)
+		return "", ctx.Err()
+	case <-time.After(10 * time.Second):
+		return "done", nil
+	}
+}
+
+func TestCancelByID(t *testing.T) {
+	hnd := &SlowCallHandler{started: make(chan struct{}), cancelled: make(chan struct{})}
+
+	rpcServer := NewServer()
+	rpcServer.Register("Slow", hnd)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+testServ.Listener.Addr().String(), nil)
+	require.NoError(t, err)
+	defer conn.Close() // nolint:errcheck
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "method": "Slow.Wait", "params": [], "id": 1}`)))
+
+	select {
+	case <-hnd.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("call didn't start")
+	}
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "method": "rpc.cancel", "params": [1]}`)))
+
+	select {
+	case <-hnd.cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("call wasn't cancelled")
+	}
+
+	var resp struct {
+		ID    float64
+		Error *struct {
+			Code    ErrorCode
+			Message string
+		}
+	}
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	require.NoError(t, conn.ReadJSON(&resp))
+	require.Equal(t, float64(1), resp.ID)
+	require.NotNil(t, resp.Error)
+	require.Equal(t, RequestCancelled, resp.Error.Code)
+	require.Equal(t, "call to 'Slow.Wait' cancelled", resp.Error.Message)
+}
+
+type CachedHandler struct {
+	calls   int32
+	release chan struct{}
+}
+
+func (h *CachedHandler) Square(n int) (int, error) {
+	atomic.AddInt32(&h.calls, 1)
+	if h.release != nil {
+		<-h.release
+	}
+	if n < 0 {
+		return 0, errors.New("negative")
+	}
+	return n * n, nil
+}
+
+// sharedCallerIdentity makes all callers share cached results
+func sharedCallerIdentity(ctx context.Context) string {
+	return ""
+}
+
+func TestMethodCache(t *testing.T) {
+	hnd := &CachedHandler{}
+
+	rpcServer := NewServer(WithMethodCache("Cached.Square", 200*time.Millisecond), WithCallerIdentity(sharedCallerIdentity))
+	rpcServer.Register("Cached", hnd)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	post := func(body string) string {
+		res, err := http.Post(testServ.URL, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return string(b)
+	}
+
+	// identical params get the cached result, with their own id
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":4}`, post(`{"jsonrpc": "2.0", "method": "Cached.Square", "params": [2], "id": 1}`))
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":2,"result":4}`, post(`{"jsonrpc": "2.0", "method": "Cached.Square", "params": [ 2 ], "id": 2}`))
+	require.Equal(t, int32(1), atomic.LoadInt32(&hnd.calls))
+
+	// different params aren't
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":3,"result":9}`, post(`{"jsonrpc": "2.0", "method": "Cached.Square", "params": [3], "id": 3}`))
+	require.Equal(t, int32(2), atomic.LoadInt32(&hnd.calls))
+
+	// errors aren't cached
+	post(`{"jsonrpc": "2.0", "method": "Cached.Square", "params": [-1], "id": 4}`)
+	post(`{"jsonrpc": "2.0", "method": "Cached.Square", "params": [-1], "id": 5}`)
+	require.Equal(t, int32(4), atomic.LoadInt32(&hnd.calls))
+
+	// entries expire after the ttl
+	time.Sleep(250 * time.Millisecond)
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":6,"result":4}`, post(`{"jsonrpc": "2.0", "method": "Cached.Square", "params": [2], "id": 6}`))
+	require.Equal(t, int32(5), atomic.LoadInt32(&hnd.calls))
+
+	// concurrent identical calls execute once
+	atomic.StoreInt32(&hnd.calls, 0)
+	hnd.release = make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([]string, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = post(fmt.Sprintf(`{"jsonrpc": "2.0", "method": "Cached.Square", "params": [7], "id": %d}`, i))
+		}(i)
+	}
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&hnd.calls) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	close(hnd.release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&hnd.calls))
+	for i, res := range results {
+		require.JSONEq(t, fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"result":49}`, i), res)
+	}
+}
+
+func TestMethodCacheScope(t *testing.T) {
+	hnd := &CachedHandler{}
+
+	// callers are identified by the prefix of their trace id here
+	rpcServer := NewServer(WithMethodCache("Cached.Square", time.Minute), WithTraceIDPropagation(), WithCallerIdentity(func(ctx context.Context) string {
+		id, _ := TraceID(ctx)
+		return strings.Split(id, "-")[0]
+	}))
+	rpcServer.Register("Cached", hnd)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	post := func(traceID string) string {
+		req, err := http.NewRequest("POST", testServ.URL, strings.NewReader(`{"jsonrpc": "2.0", "method": "Cached.Square", "params": [2], "id": 1}`))
+		require.NoError(t, err)
+		req.Header.Set(TraceIDHeader, traceID)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return string(b)
+	}
+
+	// cached responses carry the trace id of the call, not the cached one
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":4,"meta":{"TraceID":"alice-1"}}`, post("alice-1"))
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":4,"meta":{"TraceID":"alice-2"}}`, post("alice-2"))
+	require.Equal(t, int32(1), atomic.LoadInt32(&hnd.calls))
+
+	// results are cached per caller
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":4,"meta":{"TraceID":"bob-1"}}`, post("bob-1"))
+	require.Equal(t, int32(2), atomic.LoadInt32(&hnd.calls))
+
+	// by default callers without a verified identity (here plain http from
+	// one address) don't get cached results
+	unidentified := NewServer(WithMethodCache("Cached.Square", time.Minute))
+	unidentified.Register("Cached", hnd)
+	unidentifiedServ := httptest.NewServer(unidentified)
+	defer unidentifiedServ.Close()
+
+	atomic.StoreInt32(&hnd.calls, 0)
+	for i := 0; i < 2; i++ {
+		res, err := http.Post(unidentifiedServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Cached.Square", "params": [2], "id": 1}`))
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+	}
+	require.Equal(t, int32(2), atomic.LoadInt32(&hnd.calls))
+}
+
+func TestRegisterMap(t *testing.T) {
+	rpcServer := NewServer()
+
+	err := rpcServer.RegisterMap("Dyn", map[string]interface{}{
+		"Add": func(a, b int) int { return a + b },
+		"Bad": "not a func",
+		"Err": func(ctx context.Context) (int, int) { return 0, 0 },
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "'Bad': expected a func")
+	require.Contains(t, err.Error(), "'Err': expected error as second return value")
+	require.NotContains(t, err.Error(), "'Add'")
+
+	// nothing is registered if any entry is invalid
+	require.Empty(t, rpcServer.Methods())
+
+	err = rpcServer.RegisterMap("Dyn", map[string]interface{}{
+		"Add": func(a, b int) int { return a + b },
+		"Hello": func(ctx context.Context, name string) (string, error) {
+			if name == "" {
+				return "", errors.New("no name")
+			}
+			return "hello " + name, nil
+		},
+	})
+	require.NoError(t, err)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var client struct {
+		Add   func(int, int) int
+		Hello func(context.Context, string) (string, error)
+	}
+	closer, err := NewClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "Dyn", &client, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	require.Equal(t, 5, client.Add(2, 3))
+
+	res, err := client.Hello(context.Background(), "world")
+	require.NoError(t, err)
+	require.Equal(t, "hello world", res)
+
+	_, err = client.Hello(context.Background(), "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no name")
+}
+
+type DeadlineHandler struct{}
+
+// Remaining returns the time until the deadline in ms, -1 if there is none
+func (h *DeadlineHandler) Remaining(ctx context.Context) int64 {
+	dl, ok := ctx.Deadline()
+	if !ok {
+		return -1
+	}
+	return time.Until(dl).Milliseconds()
+}
+
+func TestTimeoutHeader(t *testing.T) {
+	call := func(t *testing.T, opts []ServerOption, timeout string) int64 {
+		rpcServer := NewServer(opts...)
+		rpcServer.Register("Deadline", &DeadlineHandler{})
+
+		testServ := httptest.NewServer(rpcServer)
+		defer testServ.Close()
+
+		req, err := http.NewRequest("POST", testServ.URL, strings.NewReader(`{"jsonrpc": "2.0", "method": "Deadline.Remaining", "params": [], "id": 1}`))
+		require.NoError(t, err)
+		if timeout != "" {
+			req.Header.Set(TimeoutHeader, timeout)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close() // nolint:errcheck
+
+		var resp struct {
+			Result int64
+		}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+		return resp.Result
+	}
+
+	within := func(t *testing.T, expect time.Duration, got int64) {
+		require.LessOrEqual(t, got, expect.Milliseconds())
+		require.Greater(t, got, expect.Milliseconds()-1000)
+	}
+
+	t.Run("none", func(t *testing.T) {
+		require.Equal(t, int64(-1), call(t, nil, ""))
+	})
+	t.Run("header", func(t *testing.T) {
+		within(t, 5*time.Second, call(t, nil, "5s"))
+		within(t, 3*time.Second, call(t, nil, "3"))
+	})
+	t.Run("invalid", func(t *testing.T) {
+		require.Equal(t, int64(-1), call(t, nil, "soon"))
+		require.Equal(t, int64(-1), call(t, nil, "-1s"))
+	})
+	t.Run("max", func(t *testing.T) {
+		opts := []ServerOption{WithRequestTimeout(10 * time.Second)}
+		within(t, 10*time.Second, call(t, opts, ""))
+		within(t, 10*time.Second, call(t, opts, "1m"))
+		within(t, 2*time.Second, call(t, opts, "2s"))
+	})
+}
+
+func TestNoParamsFastPath(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	for params, ok := range map[string]bool{
+		`, "params": []`:   true,
+		`, "params": [  ]`: true,
+		`, "params": null`: true,
+		``:                 true,
+		`, "params": [1]`:  false,
+	} {
+		res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.Inc", "id": 1`+params+`}`))
+		require.NoError(t, err)
+
+		var resp struct {
+			Error *respError
+		}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+		require.NoError(t, res.Body.Close())
+
+		if ok {
+			require.Nil(t, resp.Error, params)
+		} else {
+			require.NotNil(t, resp.Error, params)
+			require.Equal(t, InvalidParams, resp.Error.Code)
+		}
+	}
+}
+
+func TestBatchMalformedElement(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`[
+		{"jsonrpc": "2.0", "method": "SimpleServerHandler.AddGet", "params": [2], "id": 1},
+		"garbage",
+		{"jsonrpc": "2.0", "method": 7, "id": 2},
+		{"jsonrpc": "2.0", "method": "SimpleServerHandler.AddGet", "params": [3], "id": 3}
+	]`))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	var resps []struct {
+		ID     interface{}
+		Result *int
+		Error  *respError
+	}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&resps))
+	require.NoError(t, res.Body.Close())
+	require.Len(t, resps, 4)
+
+	require.Equal(t, float64(1), resps[0].ID)
+	require.Equal(t, 2, *resps[0].Result)
+
+	for _, r := range resps[1:3] {
+		require.Nil(t, r.ID)
+		require.NotNil(t, r.Error)
+		require.Equal(t, InvalidRequest, r.Error.Code)
+	}
+	require.Contains(t, resps[1].Error.Message, "batch element 1 is not an object")
+
+	require.Equal(t, float64(3), resps[3].ID)
+	require.Equal(t, 5, *resps[3].Result)
+
+	// the whole body is still rejected if it isn't valid JSON
+	res, err = http.Post(testServ.URL, "application/json", strings.NewReader(`[{"jsonrpc": "2.0", "method": "SimpleServerHandler.AddGet", "params": [2], "id": 1},]`))
+	require.NoError(t, err)
+	var resp struct {
+		Error *respError
+	}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, ParseError, resp.Error.Code)
+
+	// and validation reports the malformed elements
+	verrs := rpcServer.Validate(context.Background(), []byte(`[{"jsonrpc": "2.0", "method": "SimpleServerHandler.AddGet", "params": [2], "id": 1}, 42]`))
+	require.Len(t, verrs, 1)
+	require.Equal(t, 1, verrs[0].Index)
+	require.Equal(t, InvalidRequest, verrs[0].Code)
+}
+
+type FundsErr struct{}
+
+func (e *FundsErr) Error() string {
+	return "insufficient funds"
+}
+
+type FundsData struct {
+	Need, Have int
+}
+
+type LimitData struct {
+	Limit int
+}
+
+func (d *LimitData) Error() string {
+	return fmt.Sprintf("limit %d exceeded", d.Limit)
+}
+
+type ErrorDataHandler struct{}
+
+func (h *ErrorDataHandler) Pay(amount int) error {
+	return ErrorWithData(&FundsErr{}, FundsData{Need: amount, Have: 3})
+}
+
+func (h *ErrorDataHandler) Limited() error {
+	return ErrorWithData(errors.New("over the limit"), &LimitData{Limit: 5})
+}
+
+func TestErrorData(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("Data", &ErrorDataHandler{})
+	rpcServer.RegisterErrorType(&FundsErr{}, 100)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	errs := NewErrors()
+	errs.RegisterErrorData(100, FundsData{})
+	errs.RegisterErrorData(1, &LimitData{})
+
+	var client struct {
+		Pay     func(int) error
+		Limited func() error
+	}
+	closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "Data", []interface{}{&client}, nil, WithErrors(errs))
+	require.NoError(t, err)
+	defer closer()
+
+	err = client.Pay(10)
+	require.Error(t, err)
+	require.Equal(t, "insufficient funds", err.Error())
+
+	data, ok := ErrorDataAs[FundsData](err)
+	require.True(t, ok)
+	require.Equal(t, FundsData{Need: 10, Have: 3}, data)
+
+	_, ok = ErrorDataAs[*LimitData](err)
+	require.False(t, ok)
+
+	// data types implementing error work with errors.As
+	err = client.Limited()
+	require.Error(t, err)
+
+	var ld *LimitData
+	require.True(t, errors.As(err, &ld))
+	require.Equal(t, 5, ld.Limit)
+}
+
+type UploadHandler struct{}
+
+func (h *UploadHandler) Upload(name string, r io.Reader) (string, error) {
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d", name, n), nil
+}
+
+func (h *UploadHandler) Two(a, b io.Reader) error {
+	return nil
+}
+
+func TestStreamedParam(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("Upload", &UploadHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	post := func(body io.Reader) (result string, rerr *respError) {
+		res, err := http.Post(testServ.URL, StreamContentType, body)
+		require.NoError(t, err)
+		defer res.Body.Close() // nolint:errcheck
+
+		var resp struct {
+			Result string
+			Error  *respError
+		}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+		return resp.Result, resp.Error
+	}
+
+	const size = 8 << 20
+	stream := io.LimitReader(rand.New(rand.NewSource(1)), size)
+	body, err := StreamRequestBody("Upload.Upload", 1, []interface{}{"file", stream}, stream)
+	require.NoError(t, err)
+
+	res, rerr := post(body)
+	require.Nil(t, rerr)
+	require.Equal(t, fmt.Sprintf("file:%d", size), res)
+
+	// the header must be terminated with a newline
+	_, rerr = post(strings.NewReader(`{"jsonrpc": "2.0", "method": "Upload.Upload", "params": ["file", null], "id": 1}`))
+	require.NotNil(t, rerr)
+	require.Equal(t, ParseError, rerr.Code)
+
+	// only one param can be streamed
+	_, rerr = post(strings.NewReader(`{"jsonrpc": "2.0", "method": "Upload.Two", "params": [null, null], "id": 1}` + "\nabc"))
+	require.NotNil(t, rerr)
+	require.Equal(t, InvalidParams, rerr.Code)
+	require.Contains(t, rerr.Message, "only one stream param")
+}
+
+func TestDo(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	for i, proto := range []string{"http", "ws"} {
+		addr := proto + "://" + testServ.Listener.Addr().String()
+
+		// AddGet returns the running sum
+		var res int
+		require.NoError(t, Do(context.Background(), addr, "SimpleServerHandler.AddGet", &res, 3), proto)
+		require.Equal(t, 3*(i+1), res, proto)
+
+		err := Do(context.Background(), addr, "SimpleServerHandler.Missing", nil)
+		require.Error(t, err, proto)
+		require.Contains(t, err.Error(), "method 'SimpleServerHandler.Missing' not found", proto)
+	}
+}
+
+type identityKey struct{}
+
+func TestMethodAllowlist(t *testing.T) {
+	var computed int32
+	allowlists := map[string]map[string]bool{
+		"alice": {"SimpleServerHandler.AddGet": true, "SimpleServerHandler.Inc": true},
+		"bob":   {"SimpleServerHandler.Inc": true},
+	}
+
+	rpcServer := NewServer(WithMethodAllowlistFunc(func(ctx context.Context) (map[string]bool, error) {
+		atomic.AddInt32(&computed, 1)
+		id, _ := ctx.Value(identityKey{}).(string)
+		al, ok := allowlists[id]
+		if !ok {
+			return nil, fmt.Errorf("unknown identity '%s'", id)
+		}
+		return al, nil
+	}))
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+	// auth middleware
+	testServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), identityKey{}, r.Header.Get("X-User"))
+		rpcServer.ServeHTTP(w, r.WithContext(ctx))
+	}))
+	defer testServ.Close()
+
+	connect := func(t *testing.T, proto, user string) (*Client, func()) {
+		c, err := Dial(context.Background(), proto+"://"+testServ.Listener.Addr().String(), http.Header{"X-User": []string{user}})
+		require.NoError(t, err)
+		return c, c.Close
+	}
+
+	accessDenied := func(t *testing.T, err error) {
+		var re *respError
+		require.True(t, errors.As(err, &re), err)
+		require.Equal(t, AccessDenied, re.Code)
+	}
+
+	tc := func(proto string) func(t *testing.T) {
+		return func(t *testing.T) {
+			atomic.StoreInt32(&computed, 0)
+
+			alice, closeAlice := connect(t, proto, "alice")
+			defer closeAlice()
+			bob, closeBob := connect(t, proto, "bob")
+			defer closeBob()
+
+			var res int
+			require.NoError(t, alice.Call(context.Background(), "SimpleServerHandler.AddGet", &res, 1))
+			require.NoError(t, alice.Call(context.Background(), "SimpleServerHandler.Inc", nil))
+			require.NoError(t, bob.Call(context.Background(), "SimpleServerHandler.Inc", nil))
+
+			accessDenied(t, bob.Call(context.Background(), "SimpleServerHandler.AddGet", &res, 1))
+			// unknown methods are denied too, not reported as missing
+			accessDenied(t, bob.Call(context.Background(), "SimpleServerHandler.Missing", nil))
+
+			eve, closeEve := connect(t, proto, "eve")
+			defer closeEve()
+			err := eve.Call(context.Background(), "SimpleServerHandler.Inc", nil)
+			accessDenied(t, err)
+			require.Contains(t, err.Error(), "unknown identity 'eve'")
+
+			if proto == "ws" {
+				// once per connection
+				require.Equal(t, int32(3), atomic.LoadInt32(&computed))
+			}
+		}
+	}
+
+	t.Run("ws", tc("ws"))
+	t.Run("http", tc("http"))
+}
+
+func TestProtocolErrorHandler(t *testing.T) {
+	var lk sync.Mutex
+	var perrs []ProtocolError
+
+	rpcServer := NewServer(WithProtocolErrorHandler(func(ctx context.Context, perr ProtocolError) {
+		lk.Lock()
+		defer lk.Unlock()
+		perrs = append(perrs, perr)
+	}))
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	reported := func() []ProtocolError {
+		lk.Lock()
+		defer lk.Unlock()
+		out := perrs
+		perrs = nil
+		return out
+	}
+
+	post := func(body string) {
+		res, err := http.Post(testServ.URL, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+	}
+
+	// valid requests aren't reported
+	post(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.Inc", "params": [], "id": 1}`)
+	require.Empty(t, reported())
+
+	post(`{"jsonrpc": "1.0", "method": "SimpleServerHandler.Inc", "params": [], "id": 1}`)
+	pe := reported()
+	require.Len(t, pe, 1)
+	require.Contains(t, pe[0].Reason.Error(), "unsupported jsonrpc version '1.0'")
+	require.Contains(t, string(pe[0].Raw), `"SimpleServerHandler.Inc"`)
+
+	post(`{"jsonrpc": "2.0", "method"`)
+	pe = reported()
+	require.Len(t, pe, 1)
+	require.Equal(t, `{"jsonrpc": "2.0", "method"`, string(pe[0].Raw))
+
+	// batch elements are reported individually
+	post(`[{"jsonrpc": "2.0", "method": "SimpleServerHandler.Inc", "params": [], "id": 1}, 5, {"jsonrpc": "3.0", "method": "SimpleServerHandler.Inc", "params": [], "id": 2}]`)
+	pe = reported()
+	require.Len(t, pe, 2)
+	require.Equal(t, "5", string(pe[0].Raw))
+	require.Contains(t, pe[1].Reason.Error(), "unsupported jsonrpc version '3.0'")
+
+	// and so are websocket frames
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+testServ.Listener.Addr().String(), nil)
+	require.NoError(t, err)
+	defer conn.Close() // nolint:errcheck
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "id": [1]}`)))
+	require.Eventually(t, func() bool {
+		lk.Lock()
+		defer lk.Unlock()
+		return len(perrs) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	pe = reported()
+	require.Equal(t, `{"jsonrpc": "2.0", "id": [1]}`, string(pe[0].Raw))
+}
+
+type PageOpts struct {
+	Limit   int           `json:"limit" default:"100"`
+	Sort    string        `json:"sort" default:"asc"`
+	Timeout time.Duration `json:"timeout" default:"5s"`
+	Filter  FilterOpts    `json:"filter"`
+}
+
+type FilterOpts struct {
+	Active bool    `json:"active" default:"true"`
+	Min    float64 `json:"min" default:"0.5"`
+}
+
+type DefaultsHandler struct{}
+
+func (h *DefaultsHandler) List(opts PageOpts) PageOpts {
+	return opts
+}
+
+func (h *DefaultsHandler) ListPtr(opts *PageOpts) *PageOpts {
+	return opts
+}
+
+func TestParamDefaults(t *testing.T) {
+	rpcServer := NewServer(WithParamDefaults(), WithStructParams())
+	rpcServer.Register("Defaults", &DefaultsHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	call := func(method, params string) PageOpts {
+		res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Defaults.`+method+`", "params": `+params+`, "id": 1}`))
+		require.NoError(t, err)
+		defer res.Body.Close() // nolint:errcheck
+
+		var resp struct {
+			Result PageOpts
+			Error  *respError
+		}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+		require.Nil(t, resp.Error)
+		return resp.Result
+	}
+
+	defaults := PageOpts{Limit: 100, Sort: "asc", Timeout: 5 * time.Second, Filter: FilterOpts{Active: true, Min: 0.5}}
+
+	require.Equal(t, defaults, call("List", `[{}]`))
+	require.Equal(t, defaults, call("ListPtr", `[{}]`))
+
+	// explicit values, including zero values, override the defaults
+	require.Equal(t, PageOpts{Limit: 0, Sort: "desc", Timeout: 5 * time.Second, Filter: FilterOpts{Active: false, Min: 0.5}},
+		call("List", `[{"limit": 0, "sort": "desc", "filter": {"active": false}}]`))
+
+	// positional params too, see WithStructParams
+	require.Equal(t, PageOpts{Limit: 10, Sort: "asc", Timeout: 5 * time.Second, Filter: FilterOpts{Active: true, Min: 0.5}},
+		call("List", `[10]`))
+
+	// without the option, there are no defaults
+	plain := NewServer()
+	plain.Register("Defaults", &DefaultsHandler{})
+	plainServ := httptest.NewServer(plain)
+	defer plainServ.Close()
+
+	var client struct {
+		List func(PageOpts) PageOpts
+	}
+	closer, err := NewClient(context.Background(), "http://"+plainServ.Listener.Addr().String(), "Defaults", &client, nil)
+	require.NoError(t, err)
+	defer closer()
+	require.Equal(t, PageOpts{}, client.List(PageOpts{}))
+}
+
+// TestReverseCallIDs checks that server-initiated calls use the configured id
+// scheme, and that calls in both directions sharing ids are routed correctly
+func TestReverseCallIDs(t *testing.T) {
+	rpcServer := NewServer(WithReverseClient[RevCallTestClientProxy]("Client"), WithReverseCallIDs(PrefixedIDs("srv-")))
+	rpcServer.Register("Server", &RevCallConcurrentServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+testServ.Listener.Addr().String(), nil)
+	require.NoError(t, err)
+	defer conn.Close() // nolint:errcheck
+
+	// the server makes two calls on the client while handling ours
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "method": "Server.Sum", "params": [2], "id": "srv-1"}`)))
+
+	type msg struct {
+		ID     interface{}     `json:"id"`
+		Method string          `json:"method"`
+		Params []int           `json:"params"`
+		Result json.RawMessage `json:"result"`
+	}
+
+	ids := map[interface{}]bool{}
+	for len(ids) < 2 {
+		var m msg
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		require.NoError(t, conn.ReadJSON(&m))
+		require.Equal(t, "Client.CallOnClient", m.Method)
+		ids[m.ID] = true
+
+		require.NoError(t, conn.WriteJSON(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      m.ID,
+			"result":  m.Params[0] * 2,
+		}))
+	}
+	require.Equal(t, map[interface{}]bool{"srv-1": true, "srv-2": true}, ids)
+
+	// our call with a colliding id gets its own response
+	var m msg
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	require.NoError(t, conn.ReadJSON(&m))
+	require.Equal(t, "srv-1", m.ID)
+	require.Equal(t, "", m.Method)
+	require.Equal(t, "2", string(m.Result))
+}
+
+type MarketFeeds struct {
+	Prices <-chan int
+	Trades <-chan string
+	Unused <-chan int
+}
+
+type MultiStreamHandler struct {
+	tradeReady chan struct{}
+	done       chan struct{}
+}
+
+func (h *MultiStreamHandler) Subscribe(ctx context.Context) (MarketFeeds, error) {
+	prices := make(chan int)
+	trades := make(chan string)
+
+	go func() {
+		defer close(prices)
+		for i := 1; i <= 2; i++ {
+			select {
+			case prices <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(h.done)
+		defer close(trades)
+		for {
+			select {
+			case <-h.tradeReady:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case trades <- "trade":
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return MarketFeeds{Prices: prices, Trades: trades}, nil
+}
+
+func TestMultipleStreams(t *testing.T) {
+	hnd := &MultiStreamHandler{tradeReady: make(chan struct{}), done: make(chan struct{})}
+
+	rpcServer := NewServer()
+	rpcServer.Register("Market", hnd)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var client struct {
+		Subscribe func(context.Context) (MarketFeeds, error)
+	}
+	closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "Market", []interface{}{&client}, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	feeds, err := client.Subscribe(ctx)
+	require.NoError(t, err)
+
+	recv := func(ch interface{}) (interface{}, bool) {
+		chosen, v, ok := reflect.Select([]reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(time.After(5 * time.Second))},
+		})
+		require.Equal(t, 0, chosen, "timed out")
+		if !ok {
+			return nil, false
+		}
+		return v.Interface(), true
+	}
+
+	// nil channels are closed right away
+	_, ok := recv(feeds.Unused)
+	require.False(t, ok)
+
+	// the price feed closes independently of the trade feed
+	for i := 1; i <= 2; i++ {
+		v, ok := recv(feeds.Prices)
+		require.True(t, ok)
+		require.Equal(t, i, v)
+	}
+	_, ok = recv(feeds.Prices)
+	require.False(t, ok)
+
+	hnd.tradeReady <- struct{}{}
+	v, ok := recv(feeds.Trades)
+	require.True(t, ok)
+	require.Equal(t, "trade", v)
+
+	// cancelling the call closes the remaining feeds on both sides
+	cancel()
+	_, ok = recv(feeds.Trades)
+	require.False(t, ok)
+
+	select {
+	case <-hnd.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server context wasn't cancelled")
+	}
+}
+
+type FeedItem struct {
+	Seq int
+	Pad string
+}
+
+type BackpressureHandler struct {
+	n        int
+	finished chan struct{}
+	aborted  chan struct{}
+}
+
+func (h *BackpressureHandler) Feed(ctx context.Context, conflate bool) (<-chan FeedItem, error) {
+	if conflate {
+		SetSubscriptionBackpressure(ctx, Backpressure{Mode: BackpressureConflate})
+	}
+
+	pad := strings.Repeat("x", 64<<10)
+	ch := make(chan FeedItem)
+	go func() {
+		defer close(ch)
+		for i := 1; i <= h.n; i++ {
+			select {
+			case ch <- FeedItem{Seq: i, Pad: pad}:
+			case <-ctx.Done():
+				close(h.aborted)
+				return
+			}
+		}
+		close(h.finished)
+	}()
+	return ch, nil
+}
+
+// TestSubscriptionBackpressure checks that a client which stops reading a
+// subscription gets disconnected after the timeout, and that conflated
+// subscriptions don't block the producer and deliver the latest value
+func TestSubscriptionBackpressure(t *testing.T) {
+	hnd := &BackpressureHandler{n: 500}
+
+	rpcServer := NewServer(WithSubscriptionBackpressure(Backpressure{Mode: BackpressureDisconnect, Timeout: 200 * time.Millisecond}))
+	rpcServer.Register("Feed", hnd)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	subscribe := func(conflate bool) *websocket.Conn {
+		hnd.finished, hnd.aborted = make(chan struct{}), make(chan struct{})
+
+		conn, _, err := websocket.DefaultDialer.Dial("ws://"+testServ.Listener.Addr().String(), nil)
+		require.NoError(t, err)
+
+		require.NoError(t, conn.WriteJSON(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"method":  "Feed.Feed",
+			"params":  []bool{conflate},
+			"id":      1,
+		}))
+		return conn
+	}
+
+	t.Run("disconnect", func(t *testing.T) {
+		conn := subscribe(false)
+		defer conn.Close() // nolint:errcheck
+
+		// never read, the server can't send more than the socket buffers hold
+		select {
+		case <-hnd.aborted:
+		case <-hnd.finished:
+			t.Fatal("producer wasn't blocked")
+		case <-time.After(5 * time.Second):
+			t.Fatal("slow client wasn't disconnected")
+		}
+	})
+
+	t.Run("conflate", func(t *testing.T) {
+		conn := subscribe(true)
+		defer conn.Close() // nolint:errcheck
+
+		select {
+		case <-hnd.finished:
+		case <-hnd.aborted:
+			t.Fatal("conflated subscription was disconnected")
+		case <-time.After(5 * time.Second):
+			t.Fatal("producer was blocked by the slow client")
+		}
+
+		var values []int
+		for {
+			var m struct {
+				Method string            `json:"method"`
+				Params []json.RawMessage `json:"params"`
+			}
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+			require.NoError(t, conn.ReadJSON(&m))
+			if m.Method == chClose {
+				break
+			}
+			if m.Method != chValue {
+				continue // the call response
+			}
+
+			var item FeedItem
+			require.NoError(t, json.Unmarshal(m.Params[1], &item))
+			values = append(values, item.Seq)
+		}
+
+		require.NotEmpty(t, values)
+		require.Equal(t, hnd.n, values[len(values)-1])
+		require.Less(t, len(values), hnd.n)
+	})
+}
+
+type DedupHandler struct {
+	events chan int
+}
+
+func (h *DedupHandler) Event(ctx context.Context, id int) {
+	h.events <- id
+}
+
+// TestNotificationDedup checks that a notification repeated within the window
+// is skipped, while different notifications are still handled
+func TestNotificationDedup(t *testing.T) {
+	hnd := &DedupHandler{events: make(chan int, 10)}
+
+	rpcServer := NewServer(WithNotificationDedup(time.Minute))
+	rpcServer.Register("Dedup", hnd)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+testServ.Listener.Addr().String(), nil)
+	require.NoError(t, err)
+	defer conn.Close() // nolint:errcheck
+
+	for _, n := range []string{
+		`{"jsonrpc": "2.0", "method": "Dedup.Event", "params": [1]}`,
+		`{"jsonrpc": "2.0", "method": "Dedup.Event", "params": [ 1 ]}`,
+		`{"jsonrpc": "2.0", "method": "Dedup.Event", "params": [2]}`,
+	} {
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(n)))
+	}
+
+	got := map[int]int{}
+	timeout := time.After(500 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case id := <-hnd.events:
+			got[id]++
+		case <-timeout:
+			done = true
+		}
+	}
+	require.Equal(t, map[int]int{1: 1, 2: 1}, got)
+}
+
+type PredefinedErrHandler struct{}
+
+func (h *PredefinedErrHandler) Fail(ctx context.Context, kind string) error {
+	switch kind {
+	case "request":
+		return ErrInvalidRequest("bad request")
+	case "method":
+		return ErrMethodNotFound("Foo.Bar")
+	case "params":
+		return ErrInvalidParams("limit must be positive")
+	case "internal":
+		return xerrors.Errorf("wrapped: %w", ErrInternal("database unavailable"))
+	}
+	return nil
+}
+
+// TestPredefinedErrors checks that the predefined error constructors are sent
+// with the spec codes
+func TestPredefinedErrors(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("Errs", &PredefinedErrHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	tc := []struct {
+		kind    string
+		code    ErrorCode
+		message string
+	}{
+		{"request", -32600, "bad request"},
+		{"method", -32601, "method 'Foo.Bar' not found"},
+		{"params", -32602, "limit must be positive"},
+		{"internal", -32603, "wrapped: database unavailable"},
+	}
+	for _, c := range tc {
+		t.Run(c.kind, func(t *testing.T) {
+			req := fmt.Sprintf(`{"jsonrpc": "2.0", "method": "Errs.Fail", "params": [%q], "id": 1}`, c.kind)
+			res, err := http.Post(testServ.URL, "application/json", strings.NewReader(req))
+			require.NoError(t, err)
+			defer res.Body.Close() // nolint:errcheck
+
+			var resp struct {
+				Error struct {
+					Code    ErrorCode `json:"code"`
+					Message string    `json:"message"`
+				} `json:"error"`
+			}
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+			require.Equal(t, c.code, resp.Error.Code)
+			require.Equal(t, c.message, resp.Error.Message)
+		})
+	}
+}
+
+// TestWireLogFormat checks that logged messages are formatted as configured,
+// independently of the formatting on the wire
+func TestWireLogFormat(t *testing.T) {
+	logged := func(format WireLogFormat) []WireLogEntry {
+		var lk sync.Mutex
+		var entries []WireLogEntry
+
+		// pretty-printed responses on the wire
+		rpcServer := NewServer(
+			WithIndent("", "    "),
+			WithWireLogger(func(ctx context.Context, e WireLogEntry) {
+				lk.Lock()
+				defer lk.Unlock()
+				entries = append(entries, e)
+			}),
+			WithWireLogFormat(format),
+		)
+		rpcServer.Register("Redact", &RedactHandler{})
+
+		testServ := httptest.NewServer(rpcServer)
+		defer testServ.Close()
+
+		res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Redact.Login", "params": [{"user": {"name": "alice"}}, ""], "id": 1}`))
+		require.NoError(t, err)
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.Contains(t, string(body), "\n    ")
+
+		lk.Lock()
+		defer lk.Unlock()
+		require.Len(t, entries, 2)
+		return entries
+	}
+
+	for _, e := range logged(WireLogAsIs) {
+		if e.Response {
+			require.Contains(t, string(e.Data), "\n    ")
+		}
+	}
+
+	for _, e := range logged(WireLogCompact) {
+		var buf bytes.Buffer
+		require.NoError(t, json.Compact(&buf, e.Data))
+		require.Equal(t, buf.String(), string(e.Data))
+		require.NotContains(t, string(e.Data), "\n")
+	}
+
+	for _, e := range logged(WireLogIndent) {
+		var buf bytes.Buffer
+		require.NoError(t, json.Indent(&buf, e.Data, "", "  "))
+		require.Equal(t, buf.String(), string(e.Data))
+		require.Contains(t, string(e.Data), "\n  \"")
+		require.NotContains(t, string(e.Data), "\n    \"jsonrpc\"")
+	}
+}
+
+type ArrayItem struct {
+	N    int
+	Fail bool `json:"-"`
+}
+
+func (i ArrayItem) MarshalJSON() ([]byte, error) {
+	if i.Fail {
+		return nil, errors.New("item can't be encoded")
+	}
+	return []byte(fmt.Sprintf(`{"N":%d}`, i.N)), nil
+}
+
+type ArrayHandler struct{}
+
+func (h *ArrayHandler) Items(ctx context.Context, n, failAt int) []ArrayItem {
+	out := make([]ArrayItem, n)
+	for i := range out {
+		out[i] = ArrayItem{N: i, Fail: i == failAt}
+	}
+	return out
+}
+
+// TestStreamingArrays checks that streamed array results decode like buffered
+// ones, and that an element failing to encode mid-stream still produces a
+// valid response, which the client reports as an error
+func TestStreamingArrays(t *testing.T) {
+	rpcServer := NewServer(WithStreamingArrays())
+	rpcServer.Register("Array", &ArrayHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var client struct {
+		Items func(ctx context.Context, n, failAt int) ([]ArrayItem, error)
+	}
+	closer, err := NewMergeClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "Array", []interface{}{&client}, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	for _, n := range []int{0, 1, 1000} {
+		items, err := client.Items(context.Background(), n, -1)
+		require.NoError(t, err)
+		require.Len(t, items, n)
+		for i, item := range items {
+			require.Equal(t, i, item.N)
+		}
+	}
+
+	res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Array.Items", "params": [5, 3], "id": 1}`))
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+
+	// elements failing to encode get a regular error response
+	var resp map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(body, &resp))
+	require.NotContains(t, resp, "result")
+	var rerr respError
+	require.NoError(t, json.Unmarshal(resp["error"], &rerr))
+	require.Equal(t, ErrorCode(-32603), rerr.Code)
+	require.Contains(t, rerr.Message, "item can't be encoded")
+
+	_, err = client.Items(context.Background(), 5, 3)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "item can't be encoded")
+
+	// the response meta doesn't depend on the encoding order of members
+	traced := NewServer(WithStreamingArrays(), WithTraceIDPropagation())
+	traced.Register("Array", &ArrayHandler{})
+	rec := httptest.NewRecorder()
+	traced.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(`{"jsonrpc": "2.0", "method": "Array.Items", "params": [2, -1], "id": 1, "meta": {"TraceID": "t"}}`)))
+	require.JSONEq(t, `{"jsonrpc": "2.0", "id": 1, "meta": {"TraceID": "t"}, "result": [{"N": 0}, {"N": 1}]}`, rec.Body.String())
+
+	// the large response policy applies to streamed results
+	limited := NewServer(WithStreamingArrays(), WithLargeResponsePolicy(1000, LargeResponseReject))
+	limited.Register("Array", &ArrayHandler{})
+	rec = httptest.NewRecorder()
+	limited.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(`{"jsonrpc": "2.0", "method": "Array.Items", "params": [1000, -1], "id": 1}`)))
+	require.Contains(t, rec.Body.String(), "over the limit of 1000 bytes")
+	rec = httptest.NewRecorder()
+	limited.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(`{"jsonrpc": "2.0", "method": "Array.Items", "params": [3, -1], "id": 1}`)))
+	require.JSONEq(t, `{"jsonrpc": "2.0", "id": 1, "result": [{"N": 0}, {"N": 1}, {"N": 2}]}`, rec.Body.String())
+}
+
+// inProcTransport calls the server in-process, without a network
+type inProcTransport struct {
+	server *RPCServer
+	calls  int32
+}
+
+func (t *inProcTransport) RoundTrip(ctx context.Context, req json.RawMessage) (json.RawMessage, error) {
+	atomic.AddInt32(&t.calls, 1)
+
+	rec := httptest.NewRecorder()
+	t.server.ServeHTTP(rec, httptest.NewRequest("POST", "/", bytes.NewReader(req)).WithContext(ctx))
+	if rec.Body.Len() == 0 {
+		return nil, nil
+	}
+	return rec.Body.Bytes(), nil
+}
+
+// TestTransport checks that clients work over a custom transport, and over the
+// http and websocket transports
+func TestTransport(t *testing.T) {
+	serverHandler := &SimpleServerHandler{}
+
+	rpcServer := NewServer()
+	rpcServer.Register("SimpleServerHandler", serverHandler)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var client struct {
+		AddGet func(int) int
+		Add    func(int) error
+		Notify func(int) error `notify:"true" rpc_method:"SimpleServerHandler.Add"`
+
+		ErrChanSub func(context.Context) (<-chan int, error)
+	}
+
+	inProc := &inProcTransport{server: rpcServer}
+	httpTransport, httpCloser, err := NewHTTPTransport(context.Background(), "http://"+testServ.Listener.Addr().String(), nil)
+	require.NoError(t, err)
+	defer httpCloser()
+	wsTransport, wsCloser, err := NewWebsocketTransport(context.Background(), "ws://"+testServ.Listener.Addr().String(), nil)
+	require.NoError(t, err)
+	defer wsCloser()
+
+	var n int32
+	for name, transport := range map[string]Transport{"inproc": inProc, "http": httpTransport, "ws": wsTransport} {
+		t.Run(name, func(t *testing.T) {
+			// the address is ignored
+			closer, err := NewMergeClient(context.Background(), "", "SimpleServerHandler", []interface{}{&client}, nil, WithTransport(transport))
+			require.NoError(t, err)
+			defer closer()
+
+			n += 2
+			require.Equal(t, int(n), client.AddGet(2))
+
+			err = client.Add(-3546)
+			var respErr *respError
+			require.True(t, errors.As(err, &respErr))
+			require.Equal(t, "test", respErr.Message)
+
+			require.NoError(t, client.Notify(1))
+			require.Eventually(t, func() bool {
+				return atomic.LoadInt32(&serverHandler.n) == n+1
+			}, 5*time.Second, 10*time.Millisecond)
+			n++
+
+			_, err = client.ErrChanSub(context.Background())
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "channels")
+		})
+	}
+	require.Equal(t, int32(3), atomic.LoadInt32(&inProc.calls))
+}
+
+// TestRegisterAll checks that a handler registered under multiple namespaces
+// is reachable through each of them, with per-namespace codecs
+func TestRegisterAll(t *testing.T) {
+	rpcServer := NewServer(WithServerNamespaceCodec("TenantB", gobCodec{}))
+	rpcServer.RegisterAll([]string{"TenantA", "TenantB"}, &SimpleServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "TenantA.AddGet", "params": [2], "id": 1}`))
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Contains(t, string(b), `"result":2`)
+
+	var client struct {
+		AddGet func(int) int
+	}
+	closer, err := NewMergeClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "TenantB", []interface{}{&client}, nil, WithNamespaceCodec("TenantB", gobCodec{}))
+	require.NoError(t, err)
+	defer closer()
+
+	// same handler value, so the state is shared
+	require.Equal(t, 5, client.AddGet(3))
+}
+
+type TailHandler struct {
+	proceed   chan struct{}
+	cancelled chan struct{}
+}
+
+func (h *TailHandler) Tail(ctx context.Context, lines int, out io.Writer) error {
+	if lines < 0 {
+		return errors.New("negative line count")
+	}
+
+	for i := 1; i <= lines; i++ {
+		if _, err := fmt.Fprintf(out, "line %d\n", i); err != nil {
+			return err
+		}
+
+		select {
+		case <-h.proceed:
+		case <-ctx.Done():
+			close(h.cancelled)
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// TestWriterParam checks that output written to a writer param is flushed to
+// http clients as it's written, and that disconnecting cancels the handler
+func TestWriterParam(t *testing.T) {
+	hnd := &TailHandler{proceed: make(chan struct{}), cancelled: make(chan struct{})}
+
+	rpcServer := NewServer()
+	rpcServer.Register("Logs", hnd)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	post := func(ctx context.Context, body string) *http.Response {
+		req, err := http.NewRequestWithContext(ctx, "POST", testServ.URL, strings.NewReader(body))
+		require.NoError(t, err)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+
+	res := post(context.Background(), `{"jsonrpc": "2.0", "method": "Logs.Tail", "params": [2, null], "id": 1}`)
+	require.Equal(t, "text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+	br := bufio.NewReader(res.Body)
+
+	// each line arrives before the handler writes the next one
+	for i := 1; i <= 2; i++ {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("line %d\n", i), line)
+		hnd.proceed <- struct{}{}
+	}
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	require.Empty(t, rest)
+	require.NoError(t, res.Body.Close())
+
+	// errors before any output are regular responses
+	res = post(context.Background(), `{"jsonrpc": "2.0", "method": "Logs.Tail", "params": [-1, null], "id": 2}`)
+	var resp struct {
+		Error *respError `json:"error"`
+	}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+	require.NoError(t, res.Body.Close())
+	require.NotNil(t, resp.Error)
+	require.Equal(t, "negative line count", resp.Error.Message)
+
+	// disconnecting cancels the handler
+	ctx, cancel := context.WithCancel(context.Background())
+	res = post(ctx, `{"jsonrpc": "2.0", "method": "Logs.Tail", "params": [2, null], "id": 3}`)
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "line 1\n", line)
+	cancel()
+	_ = res.Body.Close()
+
+	select {
+	case <-hnd.cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler context wasn't cancelled")
+	}
+}
+
+type NormalizeHandler struct{}
+
+func (h *NormalizeHandler) Balance(addr string, limit int) string {
+	return fmt.Sprintf("%s:%d", addr, limit)
+}
+
+// TestParamInterceptor checks that the interceptor can rewrite and inject
+// params before decoding, and reject calls
+func TestParamInterceptor(t *testing.T) {
+	rpcServer := NewServer(WithParamInterceptor(func(method string, params []json.RawMessage) ([]json.RawMessage, error) {
+		if method != "Norm.Balance" || len(params) == 0 {
+			return params, nil
+		}
+
+		var addr string
+		if err := json.Unmarshal(params[0], &addr); err != nil {
+			return nil, err
+		}
+		if addr == "" {
+			return nil, errors.New("empty address")
+		}
+		params[0], _ = json.Marshal(strings.ToLower(addr))
+
+		if len(params) == 1 {
+			params = append(params, json.RawMessage(`10`)) // default limit
+		}
+		return params, nil
+	}))
+	rpcServer.Register("Norm", &NormalizeHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	call := func(params string) (string, *respError) {
+		res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Norm.Balance", "params": `+params+`, "id": 1}`))
+		require.NoError(t, err)
+		defer res.Body.Close() // nolint:errcheck
+
+		var resp struct {
+			Result string     `json:"result"`
+			Error  *respError `json:"error"`
+		}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+		return resp.Result, resp.Error
+	}
+
+	res, rerr := call(`["0xABC", 5]`)
+	require.Nil(t, rerr)
+	require.Equal(t, "0xabc:5", res)
+
+	res, rerr = call(`["0xABC"]`)
+	require.Nil(t, rerr)
+	require.Equal(t, "0xabc:10", res)
+
+	_, rerr = call(`["", 5]`)
+	require.NotNil(t, rerr)
+	require.Equal(t, ErrorCode(-32602), rerr.Code)
+	require.Contains(t, rerr.Message, "empty address")
+}
+
+type DepthHandler struct{}
+
+func (h *DepthHandler) Take(v interface{}) bool {
+	return true
+}
+
+// TestMaxJSONDepth checks that deeply nested params are rejected before they
+// are decoded, while brackets in strings don't count
+func TestMaxJSONDepth(t *testing.T) {
+	rpcServer := NewServer(WithMaxJSONDepth(32))
+	rpcServer.Register("Depth", &DepthHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	call := func(params string) *respError {
+		res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Depth.Take", "params": `+params+`, "id": 1}`))
+		require.NoError(t, err)
+		defer res.Body.Close() // nolint:errcheck
+
+		var resp struct {
+			Error *respError `json:"error"`
+		}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+		return resp.Error
+	}
+
+	nested := func(depth int) string {
+		return "[" + strings.Repeat("[", depth-1) + strings.Repeat("]", depth-1) + "]"
+	}
+
+	require.Nil(t, call(nested(32)))
+	require.Nil(t, call(`["`+strings.Repeat(`[{\"`, 100)+`"]`))
+
+	rerr := call(nested(1000))
+	require.NotNil(t, rerr)
+	require.Equal(t, ErrorCode(-32602), rerr.Code)
+	require.Contains(t, rerr.Message, "maximum depth of 32")
+}
+
+type QuorumHandler struct {
+	value     int
+	fail      bool
+	block     bool
+	cancelled chan struct{}
+}
+
+func (h *QuorumHandler) Read(ctx context.Context) (int, error) {
+	if h.fail {
+		return 0, errors.New("replica unavailable")
+	}
+	if h.block {
+		<-ctx.Done()
+		close(h.cancelled)
+		return 0, ctx.Err()
+	}
+	return h.value, nil
+}
+
+// TestFanOut checks that fan-out calls gather per-client results, and that
+// FirstSuccess cancels the calls still in flight
+func TestFanOut(t *testing.T) {
+	dial := func(hnd *QuorumHandler) *Client {
+		rpcServer := NewServer()
+		rpcServer.Register("Replica", hnd)
+
+		testServ := httptest.NewServer(rpcServer)
+		t.Cleanup(testServ.Close)
+
+		c, err := Dial(context.Background(), "ws://"+testServ.Listener.Addr().String(), nil)
+		require.NoError(t, err)
+		t.Cleanup(c.Close)
+		return c
+	}
+
+	slow := &QuorumHandler{block: true, cancelled: make(chan struct{})}
+	ok1, failing, ok2 := dial(&QuorumHandler{value: 1}), dial(&QuorumHandler{fail: true}), dial(&QuorumHandler{value: 2})
+
+	results := FanOut[int](context.Background(), []*Client{ok1, failing, ok2}, "Replica.Read")
+	require.Len(t, results, 3)
+	require.NoError(t, results[0].Err)
+	require.Equal(t, 1, results[0].Result)
+	require.Error(t, results[1].Err)
+	require.Contains(t, results[1].Err.Error(), "replica unavailable")
+	require.NoError(t, results[2].Err)
+	require.Equal(t, 2, results[2].Result)
+
+	res, err := FirstSuccess[int](context.Background(), []*Client{dial(slow), failing, ok2}, "Replica.Read")
+	require.NoError(t, err)
+	require.Equal(t, 2, res)
+	select {
+	case <-slow.cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight call wasn't cancelled")
+	}
+
+	_, err = FirstSuccess[int](context.Background(), []*Client{failing, failing}, "Replica.Read")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "all 2 calls")
+}
+
+type TimeParamHandler struct{}
+
+func (h *TimeParamHandler) At(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func (h *TimeParamHandler) Wait(d Duration) string {
+	return time.Duration(d).String()
+}
+
+// TestTimeFormat checks decoding of time.Time params with the configured
+// format, and of Duration params from strings and nanoseconds
+func TestTimeFormat(t *testing.T) {
+	call := func(opts []ServerOption, method, param string) (string, *respError) {
+		rpcServer := NewServer(opts...)
+		rpcServer.Register("Time", &TimeParamHandler{})
+
+		testServ := httptest.NewServer(rpcServer)
+		defer testServ.Close()
+
+		res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Time.`+method+`", "params": [`+param+`], "id": 1}`))
+		require.NoError(t, err)
+		defer res.Body.Close() // nolint:errcheck
+
+		var resp struct {
+			Result string     `json:"result"`
+			Error  *respError `json:"error"`
+		}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+		return resp.Result, resp.Error
+	}
+
+	tc := []struct {
+		name  string
+		opts  []ServerOption
+		param string
+		out   string
+	}{
+		{"rfc3339", nil, `"2023-11-14T22:13:20Z"`, "2023-11-14T22:13:20Z"},
+		{"rfc3339-explicit", []ServerOption{WithTimeFormat(TimeRFC3339)}, `"2023-11-14T23:13:20+01:00"`, "2023-11-14T22:13:20Z"},
+		{"unix", []ServerOption{WithTimeFormat(TimeUnix)}, `1700000000`, "2023-11-14T22:13:20Z"},
+		{"unix-fractional", []ServerOption{WithTimeFormat(TimeUnix)}, `1700000000.5`, "2023-11-14T22:13:20.5Z"},
+		{"layout", []ServerOption{WithTimeFormat(TimeLayout("2006-01-02"))}, `"2023-11-14"`, "2023-11-14T00:00:00Z"},
+	}
+	for _, c := range tc {
+		t.Run(c.name, func(t *testing.T) {
+			out, rerr := call(c.opts, "At", c.param)
+			require.Nil(t, rerr)
+			require.Equal(t, c.out, out)
+		})
+	}
+
+	// unix timestamps aren't accepted by default
+	_, rerr := call(nil, "At", `1700000000`)
+	require.NotNil(t, rerr)
+	_, rerr = call([]ServerOption{WithTimeFormat(TimeUnix)}, "At", `"2023-11-14T22:13:20Z"`)
+	require.NotNil(t, rerr)
+
+	out, rerr := call(nil, "Wait", `"1m30s"`)
+	require.Nil(t, rerr)
+	require.Equal(t, "1m30s", out)
+	out, rerr = call(nil, "Wait", `1500000000`)
+	require.Nil(t, rerr)
+	require.Equal(t, "1.5s", out)
+	_, rerr = call(nil, "Wait", `"soon"`)
+	require.NotNil(t, rerr)
+
+	b, err := json.Marshal(Duration(5 * time.Second))
+	require.NoError(t, err)
+	require.Equal(t, `"5s"`, string(b))
+}
+
+// TestStrictBody checks that trailing data after the request is ignored by
+// default, and rejected as a parse error in strict mode
+func TestStrictBody(t *testing.T) {
+	call := func(opts []ServerOption, body string) string {
+		rpcServer := NewServer(opts...)
+		rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+		testServ := httptest.NewServer(rpcServer)
+		defer testServ.Close()
+
+		res, err := http.Post(testServ.URL, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return string(b)
+	}
+
+	req := `{"jsonrpc": "2.0", "method": "SimpleServerHandler.AddGet", "params": [2], "id": 1}`
+	strict := []ServerOption{WithStrictBody()}
+
+	for _, trailing := range []string{`garbage`, `{"jsonrpc": "2.0", "method": "SimpleServerHandler.AddGet", "params": [5], "id": 2}`, `]`} {
+		require.Contains(t, call(nil, req+trailing), `"result":2`)
+
+		resp := call(strict, req+trailing)
+		require.Contains(t, resp, `"code":-32700`)
+		require.Contains(t, resp, `"id":null`)
+	}
+
+	// trailing whitespace is fine
+	require.Contains(t, call(strict, req+" \n\t\n"), `"result":2`)
+}
+
+// TestMovedMethod checks the shape of method moved errors, and that clients
+// can follow them to the new method
+func TestMovedMethod(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+	rpcServer.RegisterMovedMethod("Legacy.AddGet", "SimpleServerHandler.AddGet")
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Legacy.AddGet", "params": [1], "id": 1}`))
+	require.NoError(t, err)
+	var resp struct {
+		Error struct {
+			Code    ErrorCode       `json:"code"`
+			Message string          `json:"message"`
+			Data    json.RawMessage `json:"data"`
+		} `json:"error"`
+	}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, ErrorCode(-32003), resp.Error.Code)
+	require.Equal(t, "method 'Legacy.AddGet' moved to 'SimpleServerHandler.AddGet'", resp.Error.Message)
+	require.JSONEq(t, `{"movedTo": "SimpleServerHandler.AddGet"}`, string(resp.Error.Data))
+
+	var n int
+	for _, proto := range []string{"http", "ws"} {
+		t.Run(proto, func(t *testing.T) {
+			var client struct {
+				AddGet func(int) (int, error) `rpc_method:"Legacy.AddGet"`
+			}
+
+			closer, err := NewMergeClient(context.Background(), proto+"://"+testServ.Listener.Addr().String(), "Legacy", []interface{}{&client}, nil)
+			require.NoError(t, err)
+			_, err = client.AddGet(2)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "moved to")
+			closer()
+
+			closer, err = NewMergeClient(context.Background(), proto+"://"+testServ.Listener.Addr().String(), "Legacy", []interface{}{&client}, nil, WithFollowMovedMethods())
+			require.NoError(t, err)
+			defer closer()
+
+			n += 2
+			res, err := client.AddGet(2)
+			require.NoError(t, err)
+			require.Equal(t, n, res)
+		})
+	}
+}
+
+type BatchCtxHandler struct{}
+
+func (h *BatchCtxHandler) Info(ctx context.Context) string {
+	return fmt.Sprintf("%v/%d", InBatch(ctx), BatchSize(ctx))
+}
+
+// TestBatchContext checks the batch context helpers inside batched and single
+// calls, over http and websockets
+func TestBatchContext(t *testing.T) {
+	rpcServer := NewServer(WithStreamingBatch())
+	rpcServer.Register("Batch", &BatchCtxHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	single := `{"jsonrpc": "2.0", "method": "Batch.Info", "params": [], "id": 1}`
+	batch := `[{"jsonrpc": "2.0", "method": "Batch.Info", "params": [], "id": 1}, {"jsonrpc": "2.0", "method": "Batch.Info", "params": [], "id": 2}, {"jsonrpc": "2.0", "method": "Batch.Info", "params": []}]`
+
+	type resp struct {
+		ID     int    `json:"id"`
+		Result string `json:"result"`
+	}
+
+	t.Run("http", func(t *testing.T) {
+		post := func(body string, out interface{}) {
+			res, err := http.Post(testServ.URL, "application/json", strings.NewReader(body))
+			require.NoError(t, err)
+			defer res.Body.Close() // nolint:errcheck
+			require.NoError(t, json.NewDecoder(res.Body).Decode(out))
+		}
+
+		var sr resp
+		post(single, &sr)
+		require.Equal(t, "false/0", sr.Result)
+
+		var br []resp
+		post(batch, &br)
+		require.Equal(t, []resp{{1, "true/3"}, {2, "true/3"}}, br)
+	})
+
+	t.Run("ws", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial("ws://"+testServ.Listener.Addr().String(), nil)
+		require.NoError(t, err)
+		defer conn.Close() // nolint:errcheck
+
+		read := func() resp {
+			var r resp
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+			require.NoError(t, conn.ReadJSON(&r))
+			return r
+		}
+
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(single)))
+		require.Equal(t, resp{1, "false/0"}, read())
+
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(batch)))
+		got := map[int]string{}
+		for i := 0; i < 2; i++ {
+			r := read()
+			got[r.ID] = r.Result
+		}
+		require.Equal(t, map[int]string{1: "true/3", 2: "true/3"}, got)
+	})
+}
+
+type SchemaHandler struct{}
+
+func (h *SchemaHandler) Create(ctx context.Context, params RawParams) (string, error) {
+	return string(params), nil
+}
+
+func TestParamSchema(t *testing.T) {
+	rpcServer := NewServer(WithParamSchema("Schema.Create", []byte(`{
+		"type": "array",
+		"minItems": 1,
+		"maxItems": 1,
+		"items": {
+			"type": "object",
+			"required": ["name", "count"],
+			"additionalProperties": false,
+			"properties": {
+				"name": {"type": "string", "minLength": 1, "pattern": "^[a-z]+$"},
+				"count": {"type": "integer", "minimum": 1, "maximum": 10},
+				"kind": {"enum": ["a", "b"]},
+				"level": {"enum": [1, 2.5, {"x": [1]}]}
+			}
+		},
+		"description": "annotations are allowed"
+	}`)))
+	rpcServer.Register("Schema", &SchemaHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	call := func(params string) (string, *respError) {
+		res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Schema.Create", "params": `+params+`, "id": 1}`))
+		require.NoError(t, err)
+		defer res.Body.Close() // nolint:errcheck
+
+		var resp struct {
+			Result string     `json:"result"`
+			Error  *respError `json:"error"`
+		}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+		return resp.Result, resp.Error
+	}
+
+	res, rerr := call(`[{"name": "foo", "count": 3, "kind": "a"}]`)
+	require.Nil(t, rerr)
+	require.Equal(t, `[{"name": "foo", "count": 3, "kind": "a"}]`, res)
+
+	_, rerr = call(`[{"name": "Foo", "count": 2.5, "kind": "c", "extra": true}]`)
+	require.NotNil(t, rerr)
+	require.Equal(t, ErrorCode(-32602), rerr.Code)
+
+	var data struct {
+		Violations []string `json:"violations"`
+	}
+	require.NoError(t, json.Unmarshal(rerr.Data, &data))
+	require.Equal(t, []string{
+		"/0/count: expected integer, got number",
+		"/0: unexpected property 'extra'",
+		"/0/kind: value \"c\" is not one of the allowed values",
+		"/0/name: string doesn't match the pattern \"^[a-z]+$\"",
+	}, data.Violations)
+	require.Contains(t, rerr.Message, "don't match the schema")
+
+	_, rerr = call(`[{"name": "foo"}, 1]`)
+	require.NotNil(t, rerr)
+	require.NoError(t, json.Unmarshal(rerr.Data, &data))
+	require.Equal(t, []string{
+		"/: expected at most 1 items, got 2",
+		"/0: missing required property 'count'",
+		"/1: expected object, got number",
+	}, data.Violations)
+
+	// enum numbers are compared by value
+	for _, level := range []string{`1.0`, `1e0`, `2.50`, `{"x": [1.0]}`} {
+		_, rerr = call(`[{"name": "foo", "count": 3, "level": ` + level + `}]`)
+		require.Nil(t, rerr, level)
+	}
+	_, rerr = call(`[{"name": "foo", "count": 3, "level": 1.0000001}]`)
+	require.NotNil(t, rerr)
+
+	require.Panics(t, func() {
+		WithParamSchema("Schema.Create", []byte(`{"pattern": "("}`))
+	})
+
+	// positional params get a schema each with tuple items
+	tuple, err := compileSchema([]byte(`{
+		"type": "array",
+		"items": [{"type": "string"}, {"type": "integer", "minimum": 0}],
+		"additionalItems": false
+	}`))
+	require.NoError(t, err)
+	require.NoError(t, tuple.validate("m", json.RawMessage(`["a", 1]`)))
+	require.NoError(t, tuple.validate("m", json.RawMessage(`["a"]`)))
+
+	err = tuple.validate("m", json.RawMessage(`[1, -1, true]`))
+	require.Error(t, err)
+	var de *dataError
+	require.True(t, errors.As(err, &de))
+	require.Equal(t, []string{
+		"/: expected at most 2 items, got 3",
+		"/0: expected string, got number",
+		"/1: -1 is less than the minimum of 0",
+	}, de.data.(schemaErrorData).Violations)
+
+	rest, err := compileSchema([]byte(`{"items": [{"type": "string"}], "additionalItems": {"type": "boolean"}}`))
+	require.NoError(t, err)
+	require.NoError(t, rest.validate("m", json.RawMessage(`["a", true, false]`)))
+	require.Error(t, rest.validate("m", json.RawMessage(`["a", true, 1]`)))
+
+	// unsupported keywords would silently accept anything
+	require.Panics(t, func() {
+		WithParamSchema("Schema.Create", []byte(`{"type": "array", "items": {"oneOf": [{"type": "string"}]}}`))
+	})
+	require.Panics(t, func() {
+		WithParamSchema("Schema.Create", []byte(`{"$ref": "#/definitions/a"}`))
+	})
+}
+
+type QuirkyHandler struct{}
+
+type QuirkyOut struct {
+	Name string `json:"name"`
+}
+
+func (h *QuirkyHandler) Get(ctx context.Context) (map[string]string, error) {
+	return map[string]string{"legacy_name": "quirk"}, nil
+}
+
+func TestResultTransform(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("Quirky", &QuirkyHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var methods []string
+	transform := WithResultTransform(func(method string, raw json.RawMessage) (json.RawMessage, error) {
+		methods = append(methods, method)
+
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return nil, err
+		}
+		if _, ok := m["legacy_name"]; !ok {
+			return nil, errors.New("unexpected result")
+		}
+		m["name"] = m["legacy_name"]
+		delete(m, "legacy_name")
+		return json.Marshal(m)
+	})
+
+	var client struct {
+		Get func(ctx context.Context) (QuirkyOut, error)
+	}
+	closer, err := NewMergeClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "Quirky", []interface{}{&client}, nil, transform)
+	require.NoError(t, err)
+	defer closer()
+
+	out, err := client.Get(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "quirk", out.Name)
+
+	c, err := Dial(context.Background(), "http://"+testServ.Listener.Addr().String(), nil, transform)
+	require.NoError(t, err)
+	defer c.Close()
+
+	out = QuirkyOut{}
+	require.NoError(t, c.Call(context.Background(), "Quirky.Get", &out))
+	require.Equal(t, "quirk", out.Name)
+
+	require.Equal(t, []string{"Quirky.Get", "Quirky.Get"}, methods)
+
+	// transform errors fail the call
+	rpcServer.Register("Quirky2", &SimpleServerHandler{})
+	var n int
+	err = c.Call(context.Background(), "Quirky2.AddGet", &n, 1)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "transforming result of 'Quirky2.AddGet'")
+}
+
+func TestMaxParams(t *testing.T) {
+	rpcServer := NewServer(WithMaxParams(3))
+	rpcServer.Register("Schema", &SchemaHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	call := func(params string) *respError {
+		res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Schema.Create", "params": `+params+`, "id": 1}`))
+		require.NoError(t, err)
+		defer res.Body.Close() // nolint:errcheck
+
+		var resp struct {
+			Error *respError `json:"error"`
+		}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+		return resp.Error
+	}
+
+	require.Nil(t, call(`[]`))
+	require.Nil(t, call(`[1, 2, 3]`))
+	require.Nil(t, call(`["a,b,c,d", [1, 2, 3, 4], {"a": 1, "b": 2, "c": 3, "d": 4}]`))
+	require.Nil(t, call(`{"a": 1, "b": 2, "c": 3, "d": 4}`))
+
+	rerr := call(`[1, 2, 3, 4]`)
+	require.NotNil(t, rerr)
+	require.Equal(t, ErrorCode(-32602), rerr.Code)
+	require.Contains(t, rerr.Message, "too many params for 'Schema.Create': got 4, the maximum is 3")
+
+	rerr = call(`[` + strings.Repeat(`"x",`, 10000) + `"x"]`)
+	require.NotNil(t, rerr)
+	require.Contains(t, rerr.Message, "got 10001")
+}
+
+type DrainHandler struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (h *DrainHandler) Slow(ctx context.Context) (string, error) {
+	close(h.started)
+	<-h.release
+	return "done", nil
+}
+
+func (h *DrainHandler) Fast(ctx context.Context) (string, error) {
+	return "fast", nil
+}
+
+func TestShutdownDraining(t *testing.T) {
+	handler := &DrainHandler{started: make(chan struct{}), release: make(chan struct{})}
+	rpcServer := NewServer()
+	rpcServer.Register("Drain", handler)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var client struct {
+		Slow func(ctx context.Context) (string, error)
+		Fast func(ctx context.Context) (string, error)
+	}
+	closer, err := NewClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "Drain", &client, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	slowRes := make(chan string, 1)
+	go func() {
+		res, err := client.Slow(context.Background())
+		require.NoError(t, err)
+		slowRes <- res
+	}()
+	<-handler.started
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- rpcServer.Shutdown(context.Background())
+	}()
+
+	// new calls are rejected once draining
+	require.Eventually(t, func() bool {
+		_, err := client.Fast(context.Background())
+		var rerr *respError
+		return errors.As(err, &rerr) && rerr.Code == -32004
+	}, time.Second, 5*time.Millisecond)
+
+	// the call being handled completes
+	select {
+	case <-shutdownDone:
+		t.Fatal("shutdown returned with a call in flight")
+	default:
+	}
+	close(handler.release)
+	require.Equal(t, "done", <-slowRes)
+	require.NoError(t, <-shutdownDone)
+
+	// http calls are rejected too
+	res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Drain.Fast", "params": [], "id": 1}`))
+	require.NoError(t, err)
+	defer res.Body.Close() // nolint:errcheck
+	var resp struct {
+		Error *respError `json:"error"`
+	}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+	require.NotNil(t, resp.Error)
+	require.Equal(t, ErrorCode(-32004), resp.Error.Code)
+	require.Equal(t, "server draining", resp.Error.Message)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	handler := &DrainHandler{started: make(chan struct{}), release: make(chan struct{})}
+	rpcServer := NewServer()
+	rpcServer.Register("Drain", handler)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	go func() {
+		res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Drain.Slow", "params": [], "id": 1}`))
+		if err == nil {
+			res.Body.Close() // nolint:errcheck
+		}
+	}()
+	<-handler.started
+	defer close(handler.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, rpcServer.Shutdown(ctx))
+}
+
+func TestClientWithEndpointsDraining(t *testing.T) {
+	newServer := func(name string) (*RPCServer, *httptest.Server) {
+		rpcServer := NewServer()
+		rpcServer.Register("Endpoint", &EndpointNameHandler{name: name})
+		return rpcServer, httptest.NewServer(rpcServer)
+	}
+
+	rpcServerA, servA := newServer("a")
+	defer servA.Close()
+	_, servB := newServer("b")
+	defer servB.Close()
+
+	client, err := NewClientWithEndpoints(context.Background(), []string{
+		"http://" + servA.Listener.Addr().String(),
+		"http://" + servB.Listener.Addr().String(),
+	}, RoundRobin, nil)
+	require.NoError(t, err)
+	defer client.Close()
+
+	require.NoError(t, rpcServerA.Shutdown(context.Background()))
+
+	// calls rejected by the draining server are retried on the other one
+	for i := 0; i < 4; i++ {
+		var n string
+		require.NoError(t, client.Call(context.Background(), "Endpoint.Name", &n))
+		require.Equal(t, "b", n)
+	}
+}
+
+type Address []byte
+
+type AddressHandler struct{}
+
+func (h *AddressHandler) Get(ctx context.Context) (Address, error) {
+	return Address{0xde, 0xad, 0xbe, 0xef}, nil
+}
+
+func (h *AddressHandler) GetNested(ctx context.Context) (map[string]Address, error) {
+	return map[string]Address{"addr": {0xde, 0xad, 0xbe, 0xef}}, nil
+}
+
+func (h *AddressHandler) GetBad(ctx context.Context) (*Address, error) {
+	return &Address{}, nil
+}
+
+func TestResultMarshaler(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("Address", &AddressHandler{})
+	rpcServer.RegisterResultMarshaler(reflect.TypeOf(Address{}), func(v interface{}) ([]byte, error) {
+		return json.Marshal("0x" + hex.EncodeToString(v.(Address)))
+	})
+	rpcServer.RegisterResultMarshaler(reflect.TypeOf(&Address{}), func(v interface{}) ([]byte, error) {
+		return nil, errors.New("can't marshal")
+	})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	call := func(method string) (json.RawMessage, *respError) {
+		res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Address.`+method+`", "params": [], "id": 1}`))
+		require.NoError(t, err)
+		defer res.Body.Close() // nolint:errcheck
+
+		var resp struct {
+			Result json.RawMessage `json:"result"`
+			Error  *respError      `json:"error"`
+		}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+		return resp.Result, resp.Error
+	}
+
+	res, rerr := call("Get")
+	require.Nil(t, rerr)
+	require.Equal(t, `"0xdeadbeef"`, string(res))
+
+	// nested values use the default encoding
+	res, rerr = call("GetNested")
+	require.Nil(t, rerr)
+	require.JSONEq(t, `{"addr": "3q2+7w=="}`, string(res))
+
+	_, rerr = call("GetBad")
+	require.NotNil(t, rerr)
+	require.Contains(t, rerr.Message, "can't marshal")
+}
+
+type TraceHandler struct{}
+
+func (h *TraceHandler) ID(ctx context.Context) (string, error) {
+	id, _ := TraceID(ctx)
+	return id, nil
+}
+
+func TestTraceIDPropagation(t *testing.T) {
+	rpcServer := NewServer(WithTraceIDPropagation())
+	rpcServer.Register("Trace", &TraceHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	type response struct {
+		Result string            `json:"result"`
+		Meta   map[string]string `json:"meta"`
+	}
+
+	post := func(header, meta string) (response, string) {
+		req, err := http.NewRequest("POST", testServ.URL, strings.NewReader(`{"jsonrpc": "2.0", "method": "Trace.ID", "params": [], "id": 1`+meta+`}`))
+		require.NoError(t, err)
+		if header != "" {
+			req.Header.Set(TraceIDHeader, header)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close() // nolint:errcheck
+
+		var resp response
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+		return resp, res.Header.Get(TraceIDHeader)
+	}
+
+	// from the header
+	resp, header := post("trace-1", "")
+	require.Equal(t, "trace-1", header)
+	require.Equal(t, "trace-1", resp.Result)
+	require.Equal(t, "trace-1", resp.Meta["TraceID"])
+
+	// from the request meta
+	resp, _ = post("", `, "meta": {"TraceID": "trace-2"}`)
+	require.Equal(t, "trace-2", resp.Result)
+	require.Equal(t, "trace-2", resp.Meta["TraceID"])
+
+	// generated
+	resp, header = post("", "")
+	require.NotEmpty(t, header)
+	require.Equal(t, header, resp.Result)
+	require.Equal(t, header, resp.Meta["TraceID"])
+
+	// client calls made with a trace id context
+	for _, proto := range []string{"http", "ws"} {
+		var client struct {
+			ID func(ctx context.Context) (string, error)
+		}
+		closer, err := NewClient(context.Background(), proto+"://"+testServ.Listener.Addr().String(), "Trace", &client, nil)
+		require.NoError(t, err)
+
+		id, err := client.ID(WithTraceID(context.Background(), "trace-"+proto))
+		require.NoError(t, err)
+		require.Equal(t, "trace-"+proto, id)
+
+		// calls without one get a new trace id each
+		id1, err := client.ID(context.Background())
+		require.NoError(t, err)
+		id2, err := client.ID(context.Background())
+		require.NoError(t, err)
+		require.NotEmpty(t, id1)
+		require.NotEqual(t, id1, id2)
+
+		closer()
+	}
+
+	// websocket responses carry the trace id in meta
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+testServ.Listener.Addr().String(), nil)
+	require.NoError(t, err)
+	defer conn.Close() // nolint:errcheck
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "method": "Trace.ID", "params": [], "id": 1, "meta": {"TraceID": "trace-3"}}`)))
+	var wsResp response
+	require.NoError(t, conn.ReadJSON(&wsResp))
+	require.Equal(t, "trace-3", wsResp.Result)
+	require.Equal(t, "trace-3", wsResp.Meta["TraceID"])
+}
+
+type SubsHandler struct{}
+
+func (h *SubsHandler) Sub(ctx context.Context) (<-chan int, error) {
+	ch := make(chan int)
+	go func() {
+		defer close(ch)
+		ch <- 1
+		<-ctx.Done()
+	}()
+	return ch, nil
+}
+
+func (h *SubsHandler) List(ctx context.Context) ([]Subscription, error) {
+	conn, ok := ConnectionFromContext(ctx)
+	if !ok {
+		return nil, errors.New("not a websocket call")
+	}
+	return conn.Subscriptions(), nil
+}
+
+func (h *SubsHandler) CancelAll(ctx context.Context) error {
+	conn, ok := ConnectionFromContext(ctx)
+	if !ok {
+		return errors.New("not a websocket call")
+	}
+	conn.CancelAllSubscriptions()
+	return nil
+}
+
+func TestConnectionSubscriptions(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("Subs", &SubsHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var client struct {
+		Sub       func(ctx context.Context) (<-chan int, error)
+		List      func(ctx context.Context) ([]Subscription, error)
+		CancelAll func(ctx context.Context) error
+	}
+	closer, err := NewClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "Subs", &client, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	var chs []<-chan int
+	for i := 0; i < 3; i++ {
+		ch, err := client.Sub(context.Background())
+		require.NoError(t, err)
+		<-ch
+		chs = append(chs, ch)
+	}
+
+	subs, err := client.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, subs, 3)
+	for _, s := range subs {
+		require.Equal(t, "Subs.Sub", s.Method)
+	}
+	require.NotEqual(t, subs[0].ID, subs[1].ID)
+
+	require.NoError(t, client.CancelAll(context.Background()))
+
+	for _, ch := range chs {
+		for range ch {
+			// drain until closed
+		}
+	}
+
+	require.Eventually(t, func() bool {
+		subs, err := client.List(context.Background())
+		return err == nil && len(subs) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// http calls have no connection handle
+	var httpClient struct {
+		List func(ctx context.Context) ([]Subscription, error)
+	}
+	httpCloser, err := NewClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "Subs", &httpClient, nil)
+	require.NoError(t, err)
+	defer httpCloser()
+
+	_, err = httpClient.List(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not a websocket call")
+}
+
+type LargeHandler struct{}
+
+func (h *LargeHandler) Get(ctx context.Context, n int) (string, error) {
+	return strings.Repeat("x", n), nil
+}
+
+func (h *LargeHandler) List(ctx context.Context, n int) ([]string, error) {
+	out := make([]string, n)
+	for i := range out {
+		out[i] = "xxxxxxxxxx"
+	}
+	return out, nil
+}
+
+func TestLargeResponsePolicy(t *testing.T) {
+	call := func(url string, n int) (*http.Response, string, *respError) {
+		res, err := http.Post(url, "application/json", strings.NewReader(fmt.Sprintf(`{"jsonrpc": "2.0", "method": "Large.Get", "params": [%d], "id": 1}`, n)))
+		require.NoError(t, err)
+		defer res.Body.Close() // nolint:errcheck
+
+		var resp struct {
+			Result string     `json:"result"`
+			Error  *respError `json:"error"`
+		}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+		return res, resp.Result, resp.Error
+	}
+	list := func(url string, n int) (*http.Response, []string) {
+		res, err := http.Post(url, "application/json", strings.NewReader(fmt.Sprintf(`{"jsonrpc": "2.0", "method": "Large.List", "params": [%d], "id": 1}`, n)))
+		require.NoError(t, err)
+		defer res.Body.Close() // nolint:errcheck
+
+		var resp struct {
+			Result []string   `json:"result"`
+			Error  *respError `json:"error"`
+		}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+		require.Nil(t, resp.Error)
+		return res, resp.Result
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		rpcServer := NewServer(WithLargeResponsePolicy(100, LargeResponseReject))
+		rpcServer.Register("Large", &LargeHandler{})
+		testServ := httptest.NewServer(rpcServer)
+		defer testServ.Close()
+
+		_, res, rerr := call(testServ.URL, 10)
+		require.Nil(t, rerr)
+		require.Equal(t, strings.Repeat("x", 10), res)
+
+		_, _, rerr = call(testServ.URL, 1000)
+		require.NotNil(t, rerr)
+		require.Equal(t, ErrorCode(-32603), rerr.Code)
+		require.Contains(t, rerr.Message, "over the limit of 100 bytes")
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		rpcServer := NewServer(WithLargeResponsePolicy(100, LargeResponseStream))
+		rpcServer.Register("Large", &LargeHandler{})
+		testServ := httptest.NewServer(rpcServer)
+		defer testServ.Close()
+
+		// small array results are buffered, and sent with a content length
+		httpRes, items := list(testServ.URL, 2)
+		require.Len(t, items, 2)
+		require.Greater(t, httpRes.ContentLength, int64(0))
+
+		// large ones are encoded element by element, and flushed as written
+		httpRes, items = list(testServ.URL, 100)
+		require.Len(t, items, 100)
+		require.Equal(t, "xxxxxxxxxx", items[99])
+		require.Equal(t, int64(-1), httpRes.ContentLength)
+		require.Equal(t, []string{"chunked"}, httpRes.TransferEncoding)
+
+		// other results can't be encoded in parts, and are written as usual
+		_, res, rerr := call(testServ.URL, 1000)
+		require.Nil(t, rerr)
+		require.Equal(t, strings.Repeat("x", 1000), res)
+
+		// websocket responses are the same
+		var client struct {
+			Get func(ctx context.Context, n int) (string, error)
+		}
+		closer, err := NewClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "Large", &client, nil)
+		require.NoError(t, err)
+		defer closer()
+
+		res, err = client.Get(context.Background(), 1000)
+		require.NoError(t, err)
+		require.Equal(t, strings.Repeat("x", 1000), res)
+	})
+}
+
+func TestErrorCodes(t *testing.T) {
+	// values from the JSON-RPC 2.0 spec
+	require.Equal(t, ErrorCode(-32700), ParseError)
+	require.Equal(t, ErrorCode(-32600), InvalidRequest)
+	require.Equal(t, ErrorCode(-32601), MethodNotFound)
+	require.Equal(t, ErrorCode(-32602), InvalidParams)
+	require.Equal(t, ErrorCode(-32603), InternalError)
+	require.Equal(t, ErrorCode(-32099), ServerErrorMin)
+	require.Equal(t, ErrorCode(-32000), ServerErrorMax)
+
+	for _, c := range []ErrorCode{ServerBusy, AccessDenied, MethodMoved, ServerDraining} {
+		require.True(t, c.IsServerError(), c)
+		require.True(t, c.IsReserved(), c)
+	}
+	for _, c := range []ErrorCode{ParseError, InvalidRequest, MethodNotFound, InvalidParams, InternalError} {
+		require.False(t, c.IsServerError(), c)
+		require.True(t, c.IsReserved(), c)
+	}
+	// the LSP code is outside of the reserved range
+	require.False(t, RequestCancelled.IsReserved())
+	require.False(t, ErrorCode(1).IsReserved())
+	require.False(t, ErrorCode(-31999).IsServerError())
+
+	// client errors can be compared with errors.As
+	rpcServer := NewServer()
+	rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var client struct {
+		Missing func() error
+		Add     func(int) error
+	}
+	closer, err := NewClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "SimpleServerHandler", &client, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	var rerr *Error
+	require.True(t, errors.As(client.Missing(), &rerr))
+	require.Equal(t, MethodNotFound, rerr.Code)
+	require.Contains(t, rerr.Message, "SimpleServerHandler.Missing")
+
+	require.True(t, errors.As(client.Add(-3546), &rerr))
+	require.Equal(t, ErrorCode(1), rerr.Code)
+	require.Equal(t, "test", rerr.Message)
+}
+
+type Height int64
+
+type NumericHandler struct{}
+
+func (h *NumericHandler) Height(ctx context.Context, height Height) (Height, error) {
+	return height, nil
+}
+
+func (h *NumericHandler) Small(ctx context.Context, a int8, b uint16) (int, error) {
+	return int(a) + int(b), nil
+}
+
+func (h *NumericHandler) Ratio(ctx context.Context, r float32) (float32, error) {
+	return r, nil
+}
+
+func TestNumericCoercion(t *testing.T) {
+	rpcServer := NewServer(WithNumericCoercion())
+	rpcServer.Register("Num", &NumericHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	call := func(method, params string) (json.RawMessage, *respError) {
+		res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Num.`+method+`", "params": `+params+`, "id": 1}`))
+		require.NoError(t, err)
+		defer res.Body.Close() // nolint:errcheck
+
+		var resp struct {
+			Result json.RawMessage `json:"result"`
+			Error  *respError      `json:"error"`
+		}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+		return resp.Result, resp.Error
+	}
+
+	for params, expect := range map[string]string{
+		`[42]`:                 `42`,
+		`["42"]`:               `42`,
+		`["-7"]`:               `-7`,
+		`[1e3]`:                `1000`,
+		`["2.0"]`:              `2`,
+		`[null]`:               `0`,
+		`["9007199254740993"]`: `9007199254740993`,
+		`["-0"]`:               `0`,
+		`["0e5"]`:              `0`,
+		`[1.50e1]`:             `15`,
+		`[120e-1]`:             `12`,
+	} {
+		res, rerr := call("Height", params)
+		require.Nil(t, rerr, params)
+		require.Equal(t, expect, string(res), params)
+	}
+
+	res, rerr := call("Small", `["127", 65535]`)
+	require.Nil(t, rerr)
+	require.Equal(t, `65662`, string(res))
+
+	res, rerr = call("Ratio", `["0.5"]`)
+	require.Nil(t, rerr)
+	require.Equal(t, `0.5`, string(res))
+
+	// lossy conversions are rejected
+	for _, tc := range []struct{ method, params, msg string }{
+		{"Small", `[128, 1]`, "128 overflows int8"},
+		{"Small", `["-129", 1]`, "-129 overflows int8"},
+		{"Small", `[1, -1]`, "-1 overflows uint16"},
+		{"Small", `[1, "65536"]`, "65536 overflows uint16"},
+		{"Height", `[1.5]`, "1.5 isn't an integer"},
+		{"Height", `["9223372036854775808"]`, "overflows jsonrpc.Height"},
+		{"Height", `["abc"]`, "'abc' isn't a number"},
+		{"Height", `["1/2"]`, "'1/2' isn't a number"},
+		{"Height", `["0x10"]`, "'0x10' isn't a number"},
+		{"Height", `["+1"]`, "'+1' isn't a number"},
+		{"Ratio", `["Inf"]`, "'Inf' isn't a number"},
+		{"Height", `["1e1000000000"]`, "overflows jsonrpc.Height"},
+		{"Height", `["1e99999999999999999999"]`, "overflows jsonrpc.Height"},
+		{"Height", `["1e-99999999999999999999"]`, "isn't an integer"},
+		{"Height", `["1e-1000000000"]`, "isn't an integer"},
+		{"Ratio", `["1e39"]`, "isn't a valid float32"},
+	} {
+		_, rerr := call(tc.method, tc.params)
+		require.NotNil(t, rerr, tc.params)
+		require.Equal(t, InvalidParams, rerr.Code, tc.params)
+		require.Contains(t, rerr.Message, tc.msg, tc.params)
+	}
+
+	// without coercion string numbers are rejected
+	plainServer := NewServer()
+	plainServer.Register("Num", &NumericHandler{})
+	plainServ := httptest.NewServer(plainServer)
+	defer plainServ.Close()
+
+	res2, err := http.Post(plainServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Num.Height", "params": ["42"], "id": 1}`))
+	require.NoError(t, err)
+	defer res2.Body.Close() // nolint:errcheck
+	var resp struct {
+		Error *respError `json:"error"`
+	}
+	require.NoError(t, json.NewDecoder(res2.Body).Decode(&resp))
+	require.NotNil(t, resp.Error)
+	require.Equal(t, ParseError, resp.Error.Code)
+}
+
+type NotifyHandler struct{}
+
+func (h *NotifyHandler) Work(ctx context.Context, steps int) (string, error) {
+	for i := 1; i <= steps; i++ {
+		if err := Notify(ctx, "Progress.Step", i, steps); err != nil {
+			return "", err
+		}
+	}
+	return "done", nil
+}
+
+type NotifyClientHandler struct {
+	lk    sync.Mutex
+	steps []int
+}
+
+func (h *NotifyClientHandler) Step(ctx context.Context, i, total int) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	h.steps = append(h.steps, i)
+}
+
+func TestNotify(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("Notify", &NotifyHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	// notifications are sent before the response
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+testServ.Listener.Addr().String(), nil)
+	require.NoError(t, err)
+	defer conn.Close() // nolint:errcheck
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "method": "Notify.Work", "params": [3], "id": 1}`)))
+	for i := 1; i <= 3; i++ {
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		require.JSONEq(t, fmt.Sprintf(`{"jsonrpc": "2.0", "method": "Progress.Step", "params": [%d, 3]}`, i), string(msg))
+	}
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.JSONEq(t, `{"jsonrpc": "2.0", "result": "done", "id": 1}`, string(msg))
+
+	// clients handle them with client handlers
+	progress := &NotifyClientHandler{}
+	var client struct {
+		Work func(ctx context.Context, steps int) (string, error)
+	}
+	closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "Notify", []interface{}{&client}, nil, WithClientHandler("Progress", progress))
+	require.NoError(t, err)
+	defer closer()
+
+	res, err := client.Work(context.Background(), 5)
+	require.NoError(t, err)
+	require.Equal(t, "done", res)
+	require.Eventually(t, func() bool {
+		progress.lk.Lock()
+		defer progress.lk.Unlock()
+		return len(progress.steps) == 5
+	}, time.Second, 10*time.Millisecond)
+
+	// http calls can't notify
+	var httpClient struct {
+		Work func(ctx context.Context, steps int) (string, error)
+	}
+	httpCloser, err := NewClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "Notify", &httpClient, nil)
+	require.NoError(t, err)
+	defer httpCloser()
+
+	_, err = httpClient.Work(context.Background(), 1)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), ErrNoConnection.Error())
+}
+
+type ClaimsHandler struct{}
+
+func (h *ClaimsHandler) Signed(ctx context.Context) (bool, error) {
+	claims, ok := RequestClaims(ctx)
+	if !ok {
+		return false, nil
+	}
+	_, ok = claims["bodyHash"]
+	return ok, nil
+}
+
+func TestRequestSignatureAuth(t *testing.T) {
+	secret := []byte("shared secret")
+	edPub, edPriv, err := ed25519.GenerateKey(crand.Reader)
+	require.NoError(t, err)
+	ecPriv, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	require.NoError(t, err)
+	rsaPriv, err := rsa.GenerateKey(crand.Reader, 2048)
+	require.NoError(t, err)
+
+	rpcServer := NewServer(WithRequestSignatureAuth(SignatureKeys{
+		"hmac":  secret,
+		"ed":    edPub,
+		"ecdsa": &ecPriv.PublicKey,
+		"rsa":   &rsaPriv.PublicKey,
+	}))
+	rpcServer.Register("ClaimsHandler", &ClaimsHandler{})
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	// signed clients
+	for _, tc := range []struct {
+		kid string
+		key interface{}
+	}{
+		{"hmac", secret},
+		{"ed", edPriv},
+		{"ecdsa", ecPriv},
+		{"rsa", rsaPriv},
+	} {
+		t.Run(tc.kid, func(t *testing.T) {
+			var client struct {
+				Signed func(ctx context.Context) (bool, error)
+			}
+			closer, err := NewMergeClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "ClaimsHandler", []interface{}{&client}, nil, WithRequestSigning(tc.kid, tc.key, time.Minute))
+			require.NoError(t, err)
+			defer closer()
+
+			signed, err := client.Signed(context.Background())
+			require.NoError(t, err)
+			require.True(t, signed)
+		})
+	}
+
+	body := []byte(`{"jsonrpc": "2.0", "method": "ClaimsHandler.Signed", "params": [], "id": 1}`)
+	signClaims := func(kid string, key interface{}, body []byte, claims map[string]interface{}) string {
+		hash := sha256.Sum256(body)
+		payload := map[string]interface{}{
+			"bodyHash": base64.RawURLEncoding.EncodeToString(hash[:]),
+			"method":   "POST",
+			"uri":      "/",
+			"exp":      time.Now().Add(time.Minute).Unix(),
+		}
+		for k, v := range claims {
+			payload[k] = v
+		}
+		b, err := json.Marshal(payload)
+		require.NoError(t, err)
+		sig, err := signJWS(kid, key, b)
+		require.NoError(t, err)
+		return sig
+	}
+	sign := func(kid string, key interface{}, body []byte, exp time.Time) string {
+		return signClaims(kid, key, body, map[string]interface{}{"exp": exp.Unix()})
+	}
+	callURL := func(t *testing.T, method, url, contentType string, body []byte, sig string) (int, *respError) {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		require.NoError(t, err)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if sig != "" {
+			req.Header.Set(RequestSignatureHeader, sig)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var res response
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		return resp.StatusCode, res.Error
+	}
+	call := func(t *testing.T, body []byte, sig string) (int, *respError) {
+		return callURL(t, "POST", testServ.URL, "", body, sig)
+	}
+
+	code, rerr := call(t, body, sign("hmac", secret, body, time.Now().Add(time.Minute)))
+	require.Equal(t, http.StatusOK, code)
+	require.Nil(t, rerr)
+
+	validSig := sign("ed", edPriv, body, time.Now().Add(time.Minute))
+	parts := strings.Split(validSig, ".")
+
+	for _, tc := range []struct {
+		name string
+		body []byte
+		sig  string
+		msg  string
+	}{
+		{"missing", body, "", "missing request signature"},
+		{"expired", body, sign("hmac", secret, body, time.Now().Add(-time.Minute)), "signature expired"},
+		{"tampered-body", []byte(`{"jsonrpc": "2.0", "method": "ClaimsHandler.Signed", "params": [], "id": 2}`), validSig, "doesn't match the request body"},
+		{"tampered-claims", body, parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"bodyHash":"x","exp":99999999999}`)) + "." + parts[2], "invalid JWS signature"},
+		{"wrong-key", body, sign("hmac", []byte("other secret"), body, time.Now().Add(time.Minute)), "invalid JWS signature"},
+		{"unknown-kid", body, sign("other", secret, body, time.Now().Add(time.Minute)), "unknown key id"},
+		// an HMAC signature with the public key as the secret
+		{"wrong-alg", body, sign("ed", []byte(edPub), body, time.Now().Add(time.Minute)), "doesn't match the key algorithm"},
+		{"wrong-uri", body, signClaims("hmac", secret, body, map[string]interface{}{"uri": "/other"}), "doesn't match the request method and URI"},
+		{"wrong-method", body, signClaims("hmac", secret, body, map[string]interface{}{"method": "GET"}), "doesn't match the request method and URI"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, rerr := call(t, tc.body, tc.sig)
+			require.NotNil(t, rerr)
+			require.Equal(t, AccessDenied, rerr.Code)
+			require.Contains(t, rerr.Message, tc.msg)
+		})
+	}
+
+	// signatures are bound to the query of GET requests
+	getSig := signClaims("hmac", secret, nil, map[string]interface{}{"method": "GET", "uri": "/?method=ClaimsHandler.Signed&id=1"})
+	_, rerr = callURL(t, "GET", testServ.URL+"/?method=ClaimsHandler.Signed&id=2", "", nil, getSig)
+	require.NotNil(t, rerr)
+	require.Contains(t, rerr.Message, "doesn't match the request method and URI")
+
+	// signatures with an id can't be replayed
+	jtiSig := signClaims("hmac", secret, body, map[string]interface{}{"jti": "once"})
+	_, rerr = call(t, body, jtiSig)
+	require.Nil(t, rerr)
+	_, rerr = call(t, body, jtiSig)
+	require.NotNil(t, rerr)
+	require.Equal(t, AccessDenied, rerr.Code)
+	require.Contains(t, rerr.Message, "signature already used")
+
+	// streamed bodies can't be verified up front
+	_, rerr = callURL(t, "POST", testServ.URL, StreamContentType, append(body, '\n'), sign("hmac", secret, append(body, '\n'), time.Now().Add(time.Minute)))
+	require.NotNil(t, rerr)
+	require.Equal(t, AccessDenied, rerr.Code)
+	require.Contains(t, rerr.Message, "streamed requests")
+
+	// only P-256 ecdsa keys are supported, for signing too
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), crand.Reader)
+	require.NoError(t, err)
+	require.Panics(t, func() { WithRequestSigning("ecdsa", p384, time.Minute)(&Config{}) })
+
+	// websocket connections can't be signed
+	_, resp, err := websocket.DefaultDialer.Dial("ws://"+testServ.Listener.Addr().String(), nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+type LatencyHandler struct{}
+
+func (h *LatencyHandler) Sleep(ctx context.Context, ms int) error {
+	select {
+	case <-time.After(time.Duration(ms) * time.Millisecond):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestAdaptiveTimeout(t *testing.T) {
+	rpcServer := NewServer(WithAdaptiveTimeout(4))
+	rpcServer.Register("LatencyHandler", &LatencyHandler{})
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var client struct {
+		Sleep func(ctx context.Context, ms int) error
+	}
+	closer, err := NewMergeClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "LatencyHandler", []interface{}{&client}, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	// no timeout before the method latency is known
+	require.NoError(t, client.Sleep(context.Background(), 50))
+	require.Empty(t, rpcServer.AdaptiveTimeouts())
+
+	for i := 0; i < adaptiveMinSamples; i++ {
+		require.NoError(t, client.Sleep(context.Background(), 1+i%5))
+	}
+
+	timeouts := rpcServer.AdaptiveTimeouts()
+	timeout, ok := timeouts["LatencyHandler.Sleep"]
+	require.True(t, ok, timeouts)
+	require.True(t, timeout >= 200*time.Millisecond, timeout) // p99 is the first 50ms call
+	require.True(t, timeout < time.Second, timeout)
+
+	// calls within the timeout succeed, outliers are cut off
+	require.NoError(t, client.Sleep(context.Background(), 5))
+
+	start := time.Now()
+	err = client.Sleep(context.Background(), 3000)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), context.DeadlineExceeded.Error())
+	require.True(t, time.Since(start) < 2*time.Second)
+
+	// the timed out call counts as lasting the timeout, so the timeout grows
+	// by the factor, following a method which got slower
+	for i := 0; i < adaptiveRecompute; i++ {
+		require.NoError(t, client.Sleep(context.Background(), 1))
+	}
+	require.Equal(t, 4*timeout, rpcServer.AdaptiveTimeouts()["LatencyHandler.Sleep"])
+
+	require.Panics(t, func() { WithAdaptiveTimeout(1) })
+	require.Panics(t, func() { WithAdaptiveTimeout(0.5) })
+}
+
+type SingleResultHandler struct{}
+
+func (h *SingleResultHandler) Struct() TestOut {
+	return TestOut{TestType: TestType{S: "s", I: 1}, Ok: true}
+}
+
+func (h *SingleResultHandler) Slice() []TestOut {
+	return []TestOut{{Ok: true}}
+}
+
+func (h *SingleResultHandler) Map() map[string]int {
+	return map[string]int{"a": 1}
+}
+
+func TestSingleResult(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []ServerOption
+	}{
+		{"default", nil},
+		{"streaming-arrays", []ServerOption{WithStreamingArrays()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rpcServer := NewServer(tc.opts...)
+			rpcServer.Register("SingleResultHandler", &SingleResultHandler{})
+			testServ := httptest.NewServer(rpcServer)
+			defer testServ.Close()
+
+			// single results are the value itself on the wire
+			for method, expect := range map[string]string{
+				"Struct": `{"S":"s","I":1,"Ok":true}`,
+				"Slice":  `[{"S":"","I":0,"Ok":true}]`,
+				"Map":    `{"a":1}`,
+			} {
+				body := fmt.Sprintf(`{"jsonrpc": "2.0", "method": "SingleResultHandler.%s", "params": [], "id": 1}`, method)
+				resp, err := http.Post(testServ.URL, "application/json", strings.NewReader(body))
+				require.NoError(t, err)
+
+				var res struct {
+					Result json.RawMessage
+				}
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+				resp.Body.Close()
+				require.JSONEq(t, expect, string(res.Result), method)
+			}
+
+			for _, addr := range []string{"http://", "ws://"} {
+				c, err := Dial(context.Background(), addr+testServ.Listener.Addr().String(), nil)
+				require.NoError(t, err)
+
+				var s TestOut
+				require.NoError(t, c.Call(context.Background(), "SingleResultHandler.Struct", &s))
+				require.Equal(t, TestOut{TestType: TestType{S: "s", I: 1}, Ok: true}, s)
+
+				var sl []TestOut
+				require.NoError(t, c.Call(context.Background(), "SingleResultHandler.Slice", &sl))
+				require.Equal(t, []TestOut{{Ok: true}}, sl)
+
+				var m map[string]int
+				require.NoError(t, c.Call(context.Background(), "SingleResultHandler.Map", &m))
+				require.Equal(t, map[string]int{"a": 1}, m)
+
+				// results can't be decoded into non-pointers
+				err = c.Call(context.Background(), "SingleResultHandler.Struct", s)
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "non-nil pointer")
+
+				if addr == "http://" {
+					b := c.NewBatch()
+					structCall := b.Add("SingleResultHandler.Struct")
+					mapCall := b.Add("SingleResultHandler.Map")
+					br, err := b.Send(context.Background())
+					require.NoError(t, err)
+
+					var bs TestOut
+					require.NoError(t, br.Decode(structCall, &bs))
+					require.Equal(t, s, bs)
+					var bm map[string]int
+					require.NoError(t, br.Decode(mapCall, &bm))
+					require.Equal(t, m, bm)
+				}
+
+				c.Close()
+			}
+
+			var client struct {
+				Struct func() TestOut
+				Slice  func() []TestOut
+				Map    func() map[string]int
+			}
+			closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "SingleResultHandler", []interface{}{&client}, nil)
+			require.NoError(t, err)
+			defer closer()
+
+			require.True(t, client.Struct().Ok)
+			require.Len(t, client.Slice(), 1)
+			require.Equal(t, 1, client.Map()["a"])
+		})
+	}
+}
+
+func TestInvokeFunc(t *testing.T) {
+	type call struct {
+		method string
+		params []interface{}
+	}
+	var calls []call
+
+	rpcServer := NewServer(WithInvokeFunc(func(method MethodInfo, fn reflect.Value, params []reflect.Value) []reflect.Value {
+		c := call{method: method.Name}
+		for _, p := range params[1:] { // skip the receiver
+			c.params = append(c.params, p.Interface())
+		}
+		calls = append(calls, c)
+
+		switch method.Name {
+		case "SimpleServerHandler.Add":
+			// don't call the handler
+			return []reflect.Value{reflect.ValueOf(errors.New("spied"))}
+		case "SimpleServerHandler.AddGet":
+			return fn.Call(params)
+		default:
+			return nil
+		}
+	}))
+	serverHandler := &SimpleServerHandler{}
+	rpcServer.Register("SimpleServerHandler", serverHandler)
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var client struct {
+		Add         func(int) error
+		AddGet      func(int) int
+		StringMatch func(t TestType, i2 int64) (out TestOut, err error)
+	}
+	closer, err := NewMergeClient(context.Background(), "http://"+testServ.Listener.Addr().String(), "SimpleServerHandler", []interface{}{&client}, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	err = client.Add(2)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "spied")
+	require.Equal(t, int32(0), serverHandler.n)
+
+	require.Equal(t, 3, client.AddGet(3))
+	require.Equal(t, int32(3), serverHandler.n)
+
+	// invoke funcs must return values of the method return types
+	_, err = client.StringMatch(TestType{S: "0"}, 0)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invoke func returned 0 values")
+
+	require.Equal(t, []call{
+		{"SimpleServerHandler.Add", []interface{}{2}},
+		{"SimpleServerHandler.AddGet", []interface{}{3}},
+		{"SimpleServerHandler.StringMatch", []interface{}{TestType{S: "0"}, int64(0)}},
+	}, calls)
+}
+
+type BurstHandler struct{}
+
+func (h *BurstHandler) Burst(ctx context.Context, n int) (<-chan int, error) {
+	ch := make(chan int)
+	go func() {
+		defer close(ch)
+		for i := 0; i < n; i++ {
+			select {
+			case ch <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+		<-ctx.Done()
+	}()
+	return ch, nil
+}
+
+func TestNotificationBatching(t *testing.T) {
+	rpcServer := NewServer(WithNotificationBatching(50*time.Millisecond, 10))
+	rpcServer.Register("Notify", &NotifyHandler{})
+	rpcServer.Register("BurstHandler", &BurstHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+testServ.Listener.Addr().String(), nil)
+	require.NoError(t, err)
+	defer conn.Close() // nolint:errcheck
+
+	readBatch := func() []json.RawMessage {
+		_, msg, err := conn.ReadMessage()
+		require.NoError(t, err)
+		require.True(t, isJSONArray(msg), string(msg))
+
+		var batch []json.RawMessage
+		require.NoError(t, json.Unmarshal(msg, &batch))
+		return batch
+	}
+
+	// full batches are sent right away, and queued notifications are sent
+	// before the response
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "method": "Notify.Work", "params": [25], "id": 1}`)))
+	step := 1
+	for _, size := range []int{10, 10, 5} {
+		batch := readBatch()
+		require.Len(t, batch, size)
+		for _, n := range batch {
+			require.JSONEq(t, fmt.Sprintf(`{"jsonrpc": "2.0", "method": "Progress.Step", "params": [%d, 25]}`, step), string(n))
+			step++
+		}
+	}
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.JSONEq(t, `{"jsonrpc": "2.0", "result": "done", "id": 1}`, string(msg))
+
+	// bursts of channel values are sent in one frame after the delay
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "method": "BurstHandler.Burst", "params": [3], "id": 2}`)))
+	_, msg, err = conn.ReadMessage()
+	require.NoError(t, err)
+	require.JSONEq(t, `{"jsonrpc": "2.0", "result": 1, "id": 2}`, string(msg))
+
+	batch := readBatch()
+	require.Len(t, batch, 3)
+	for i, n := range batch {
+		require.JSONEq(t, fmt.Sprintf(`{"jsonrpc": "2.0", "method": "xrpc.ch.val", "params": [1, %d]}`, i), string(n))
+	}
+
+	// clients handle batches of notifications
+	progress := &NotifyClientHandler{}
+	var client struct {
+		Work  func(ctx context.Context, steps int) (string, error)
+		Burst func(ctx context.Context, n int) (<-chan int, error) `rpc_method:"BurstHandler.Burst"`
+	}
+	closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "Notify", []interface{}{&client}, nil, WithClientHandler("Progress", progress))
+	require.NoError(t, err)
+	defer closer()
+
+	res, err := client.Work(context.Background(), 25)
+	require.NoError(t, err)
+	require.Equal(t, "done", res)
+	require.Eventually(t, func() bool {
+		progress.lk.Lock()
+		defer progress.lk.Unlock()
+		return len(progress.steps) == 25
+	}, time.Second, 10*time.Millisecond)
+	// batched notifications are handled concurrently, so only the set of
+	// steps is known
+	progress.lk.Lock()
+	steps := append([]int(nil), progress.steps...)
+	progress.lk.Unlock()
+	sort.Ints(steps)
+	for i, s := range steps {
+		require.Equal(t, i+1, s)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := client.Burst(ctx, 15)
+	require.NoError(t, err)
+	for i := 0; i < 15; i++ {
+		require.Equal(t, i, <-ch)
+	}
+}
+
+type LogHandler struct{}
+
+func (h *LogHandler) Log(ctx context.Context, msg string) error {
+	Logger(ctx).Infow(msg, "extra", 1)
+	return nil
+}
+
+func TestBaseLogger(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+
+	rpcServer := NewServer(WithBaseLogger(zap.New(core).Sugar()))
+	rpcServer.Register("LogHandler", &LogHandler{})
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	for _, addr := range []string{"http://", "ws://"} {
+		var client struct {
+			Log    func(ctx context.Context, msg string) error
+			Notify func(ctx context.Context, msg string) error `notify:"true" rpc_method:"LogHandler.Log"`
+		}
+		closer, err := NewMergeClient(context.Background(), addr+testServ.Listener.Addr().String(), "LogHandler", []interface{}{&client}, nil)
+		require.NoError(t, err)
+
+		require.NoError(t, client.Log(context.Background(), addr))
+
+		entries := logs.TakeAll()
+		require.Len(t, entries, 1)
+		fields := entries[0].ContextMap()
+		require.Equal(t, addr, entries[0].Message)
+		require.Equal(t, "LogHandler.Log", fields["method"])
+		require.NotNil(t, fields["id"])
+		require.Contains(t, fields["peer"], "127.0.0.1:")
+		require.Equal(t, int64(1), fields["extra"])
+
+		// notifications have no id
+		require.NoError(t, client.Notify(context.Background(), "notification"))
+		require.Eventually(t, func() bool {
+			return logs.FilterMessage("notification").Len() == 1
+		}, time.Second, 10*time.Millisecond)
+		fields = logs.TakeAll()[0].ContextMap()
+		require.Equal(t, "LogHandler.Log", fields["method"])
+		require.NotContains(t, fields, "id")
+
+		closer()
+	}
+
+	// without a base logger, handlers get the package logger
+	require.NotNil(t, Logger(context.Background()))
+}
+
+type FailingNotifyHandler struct{}
+
+func (h *FailingNotifyHandler) Fail(ctx context.Context, msg string) error {
+	return &Error{Code: ServerErrorMin, Message: msg}
+}
+
+func TestNotificationErrorHandler(t *testing.T) {
+	type notifErr struct {
+		method string
+		params string
+		err    string
+		peer   bool
+	}
+	errs := make(chan notifErr, 10)
+
+	rpcServer := NewServer(WithNotificationErrorHandler(func(ctx context.Context, method string, params json.RawMessage, err error) {
+		_, peer := PeerFromContext(ctx)
+		errs <- notifErr{method: method, params: string(params), err: err.Error(), peer: peer}
+	}), WithNotificationErrorFrames())
+	rpcServer.Register("FailingNotifyHandler", &FailingNotifyHandler{})
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	clientErrs := make(chan *Error, 10)
+	var client struct {
+		Fail func(ctx context.Context, msg string) error `notify:"true"`
+	}
+	closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "FailingNotifyHandler", []interface{}{&client}, nil, WithNotificationErrorCallback(func(method string, err *Error) {
+		require.Equal(t, "FailingNotifyHandler.Fail", method)
+		clientErrs <- err
+	}))
+	require.NoError(t, err)
+	defer closer()
+
+	require.NoError(t, client.Fail(context.Background(), "ws failure"))
+	select {
+	case e := <-errs:
+		require.Equal(t, notifErr{method: "FailingNotifyHandler.Fail", params: `["ws failure"]`, err: "ws failure", peer: true}, e)
+	case <-time.After(time.Second):
+		t.Fatal("notification error handler wasn't called")
+	}
+	// errors are sent to websocket clients
+	select {
+	case e := <-clientErrs:
+		require.Equal(t, &Error{Code: ServerErrorMin, Message: "ws failure"}, e)
+	case <-time.After(time.Second):
+		t.Fatal("notification error wasn't sent to the client")
+	}
+
+	// over http, and for calls which fail before the handler
+	for _, tc := range []struct {
+		body string
+		err  notifErr
+	}{
+		{`{"jsonrpc": "2.0", "method": "FailingNotifyHandler.Fail", "params": ["http failure"]}`, notifErr{method: "FailingNotifyHandler.Fail", params: `["http failure"]`, err: "http failure", peer: true}},
+		{`{"jsonrpc": "2.0", "method": "FailingNotifyHandler.Unknown", "params": []}`, notifErr{method: "FailingNotifyHandler.Unknown", params: `[]`, err: "method 'FailingNotifyHandler.Unknown' not found", peer: true}},
+	} {
+		resp, err := http.Post(testServ.URL, "application/json", strings.NewReader(tc.body))
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		select {
+		case e := <-errs:
+			require.Equal(t, tc.err, e)
+		case <-time.After(time.Second):
+			t.Fatal("notification error handler wasn't called")
+		}
+	}
+	require.Empty(t, clientErrs)
+}
+
+func TestResponseIDMismatch(t *testing.T) {
+	// answers with the result 7, and ids off by 100
+	testServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		wrongID := func(req map[string]interface{}) map[string]interface{} {
+			return map[string]interface{}{"jsonrpc": "2.0", "result": 7, "id": req["id"].(float64) + 100}
+		}
+		var out interface{}
+		if isJSONArray(body) {
+			var reqs []map[string]interface{}
+			require.NoError(t, json.Unmarshal(body, &reqs))
+			var resps []interface{}
+			for _, req := range reqs {
+				resps = append(resps, wrongID(req))
+			}
+			out = resps
+		} else {
+			var req map[string]interface{}
+			require.NoError(t, json.Unmarshal(body, &req))
+			out = wrongID(req)
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(out))
+	}))
+	defer testServ.Close()
+
+	addr := "http://" + testServ.Listener.Addr().String()
+
+	// ids are checked by default
+	c, err := Dial(context.Background(), addr, nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	var res int
+	err = c.Call(context.Background(), "Test.Get", &res)
+	require.True(t, errors.Is(err, ErrResponseIDMismatch), err)
+
+	var proxy struct {
+		Get func() (int, error)
+	}
+	closer, err := NewMergeClient(context.Background(), addr, "Test", []interface{}{&proxy}, nil)
+	require.NoError(t, err)
+	defer closer()
+	_, err = proxy.Get()
+	require.True(t, errors.Is(err, ErrResponseIDMismatch), err)
+
+	b := c.NewBatch()
+	b.Add("Test.Get")
+	_, err = b.Send(context.Background())
+	require.True(t, errors.Is(err, ErrResponseIDMismatch), err)
+
+	// lenient clients take the responses
+	lc, err := Dial(context.Background(), addr, nil, WithLenientResponseIDs())
+	require.NoError(t, err)
+	defer lc.Close()
+
+	require.NoError(t, lc.Call(context.Background(), "Test.Get", &res))
+	require.Equal(t, 7, res)
+
+	b = lc.NewBatch()
+	first := b.Add("Test.Get")
+	second := b.Add("Test.Get")
+	br, err := b.Send(context.Background())
+	require.NoError(t, err)
+	for _, call := range []*BatchCall{first, second} {
+		res = 0
+		require.NoError(t, br.Decode(call, &res))
+		require.Equal(t, 7, res)
+	}
+}
+
+type SnapshotHandler struct {
+	lk     sync.Mutex
+	value  int
+	closed bool
+	subs   []chan int
+}
+
+func (h *SnapshotHandler) publish(v int) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	h.value = v
+	for _, sub := range h.subs {
+		sub <- v
+	}
+}
+
+func (h *SnapshotHandler) close() {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	h.closed = true
+	for _, sub := range h.subs {
+		close(sub)
+	}
+}
+
+// Subscribe takes the snapshot and subscribes under the lock, so that no
+// update is missed or duplicated
+func (h *SnapshotHandler) Subscribe(ctx context.Context) (int, <-chan int, error) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	ch := make(chan int, 1000)
+	if h.closed {
+		close(ch)
+	} else {
+		h.subs = append(h.subs, ch)
+	}
+	return h.value, ch, nil
+}
+
+func (h *SnapshotHandler) SubscribeInf(ctx context.Context) (float64, <-chan int, error) {
+	return math.Inf(1), make(chan int), nil
+}
+
+func TestSnapshotStream(t *testing.T) {
+	const updates = 500
+
+	serverHandler := &SnapshotHandler{}
+	rpcServer := NewServer()
+	rpcServer.Register("SnapshotHandler", serverHandler)
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 1; i <= updates; i++ {
+			serverHandler.publish(i)
+			if i%10 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		serverHandler.close()
+	}()
+
+	// subscribe while updates are published
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			time.Sleep(time.Duration(i*5) * time.Millisecond)
+
+			var client struct {
+				Subscribe func(ctx context.Context) (int, <-chan int, error)
+			}
+			closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "SnapshotHandler", []interface{}{&client}, nil)
+			require.NoError(t, err)
+			defer closer()
+
+			snapshot, ch, err := client.Subscribe(context.Background())
+			require.NoError(t, err)
+
+			// updates continue from the snapshot, without gaps or overlaps
+			next := snapshot + 1
+			for v := range ch {
+				require.Equal(t, next, v)
+				next++
+			}
+			require.Equal(t, updates+1, next)
+		}(i)
+	}
+	wg.Wait()
+	<-published
+
+	// the snapshot is sent with the channel id
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+testServ.Listener.Addr().String(), nil)
+	require.NoError(t, err)
+	defer conn.Close() // nolint:errcheck
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "method": "SnapshotHandler.Subscribe", "params": [], "id": 1}`)))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.JSONEq(t, fmt.Sprintf(`{"jsonrpc": "2.0", "result": {"snapshot": %d, "updates": 1}, "id": 1}`, updates), string(msg))
+	_, msg, err = conn.ReadMessage()
+	require.NoError(t, err)
+	require.JSONEq(t, `{"jsonrpc": "2.0", "method": "xrpc.ch.close", "params": [1]}`, string(msg))
+
+	// snapshots which can't be serialized fail the call
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "method": "SnapshotHandler.SubscribeInf", "params": [], "id": 2}`)))
+	_, msg, err = conn.ReadMessage()
+	require.NoError(t, err)
+	var resp struct {
+		Error *respError `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal(msg, &resp))
+	require.NotNil(t, resp.Error, string(msg))
+	require.Equal(t, InternalError, resp.Error.Code)
+	require.Contains(t, resp.Error.Message, "failed to serialize snapshot")
+}
+
+type LenientHandler struct{}
+
+func (h *LenientHandler) One(t TestType) string {
+	return fmt.Sprintf("%s:%d", t.S, t.I)
+}
+
+func (h *LenientHandler) Slice(ts []TestType) int {
+	return len(ts)
+}
+
+func (h *LenientHandler) Map(m map[string]int) int {
+	return len(m)
+}
+
+func (h *LenientHandler) Two(t TestType, i int) int {
+	return t.I + i
+}
+
+func TestLenientParams(t *testing.T) {
+	tc := func(opts []ServerOption, req, resp string) func(t *testing.T) {
+		return func(t *testing.T) {
+			rpcServer := NewServer(opts...)
+			rpcServer.Register("Lenient", &LenientHandler{})
+
+			testServ := httptest.NewServer(rpcServer)
+			defer testServ.Close()
+
+			res, err := http.Post(testServ.URL, "application/json", strings.NewReader(req))
+			require.NoError(t, err)
+			defer res.Body.Close()
+
+			var out struct {
+				Result json.RawMessage
+				Error  *respError
+			}
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+
+			if resp == "" {
+				require.NotNil(t, out.Error)
+				return
+			}
+			require.Nil(t, out.Error)
+			require.JSONEq(t, resp, string(out.Result))
+		}
+	}
+
+	lenient := []ServerOption{WithLenientParams()}
+	bare := `{"jsonrpc": "2.0", "method": "Lenient.One", "params": {"S": "a", "I": 1}, "id": 1}`
+	wrapped := `{"jsonrpc": "2.0", "method": "Lenient.One", "params": [{"S": "a", "I": 1}], "id": 1}`
+
+	t.Run("strict-bare", tc(nil, bare, ""))
+	t.Run("strict-bare-map", tc(nil, `{"jsonrpc": "2.0", "method": "Lenient.Map", "params": {"a": 1}, "id": 1}`, ""))
+	t.Run("lenient-bare-map", tc(lenient, `{"jsonrpc": "2.0", "method": "Lenient.Map", "params": {"a": 1}, "id": 1}`, `1`))
+	t.Run("strict-wrapped", tc(nil, wrapped, `"a:1"`))
+	t.Run("lenient-bare", tc(lenient, bare, `"a:1"`))
+	t.Run("lenient-wrapped", tc(lenient, wrapped, `"a:1"`))
+	t.Run("lenient-slice", tc(lenient, `{"jsonrpc": "2.0", "method": "Lenient.Slice", "params": [[{"S": "a"}, {"S": "b"}]], "id": 1}`, `2`))
+	t.Run("lenient-two-params", tc(lenient, `{"jsonrpc": "2.0", "method": "Lenient.Two", "params": {"S": "a", "I": 1}, "id": 1}`, ""))
+}
+
+type PeerHandler struct{}
+
+func (h *PeerHandler) RemoteAddr(ctx context.Context) (string, error) {
+	p, ok := PeerFromContext(ctx)
+	if !ok {
+		return "", errors.New("no peer")
+	}
+	if p.TLS != nil {
+		return "tls:" + p.RemoteAddr, nil
+	}
+	return p.RemoteAddr, nil
+}
+
+func TestPeerFromContext(t *testing.T) {
+	_, ok := PeerFromContext(context.Background())
+	require.False(t, ok)
+
+	rpcServer := NewServer()
+	rpcServer.Register("Peer", &PeerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	tc := func(proto string) func(t *testing.T) {
+		return func(t *testing.T) {
+			var client struct {
+				RemoteAddr func(ctx context.Context) (string, error)
+			}
+			closer, err := NewClient(context.Background(), proto+"://"+testServ.Listener.Addr().String(), "Peer", &client, nil)
+			require.NoError(t, err)
+			defer closer()
+
+			addr, err := client.RemoteAddr(context.Background())
 			require.NoError(t, err)
 
-			assert.Equal(t, expectedResp, responseBody)
-			require.Equal(t, n, rpcHandler.n)
-			require.Equal(t, statusCode, res.StatusCode)
+			host, _, err := net.SplitHostPort(addr)
+			require.NoError(t, err)
+			require.Equal(t, "127.0.0.1", host)
 		}
 	}
 
-	t.Run("inc", tc(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.Inc", "params": [], "id": 1}`, `{"jsonrpc":"2.0","id":1,"result":null}`, 1, 200))
-	t.Run("inc-null", tc(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.Inc", "params": null, "id": 1}`, `{"jsonrpc":"2.0","id":1,"result":null}`, 1, 200))
-	t.Run("inc-noparam", tc(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.Inc", "id": 2}`, `{"jsonrpc":"2.0","id":2,"result":null}`, 1, 200))
-	t.Run("add", tc(`{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [10], "id": 4}`, `{"jsonrpc":"2.0","id":4,"result":null}`, 10, 200))
-	// Batch requests
-	t.Run("add", tc(`[{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [123], "id": 5}`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"Parse error"}}`, 0, 500))
-	t.Run("add", tc(`[{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [123], "id": 6}]`, `[{"jsonrpc":"2.0","id":6,"result":null}]`, 123, 200))
-	t.Run("add", tc(`[{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [123], "id": 7},{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [-122], "id": 8}]`, `[{"jsonrpc":"2.0","id":7,"result":null},{"jsonrpc":"2.0","id":8,"result":null}]`, 1, 200))
-	t.Run("add", tc(`[{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [123], "id": 9},{"jsonrpc": "2.0", "params": [-122], "id": 10}]`, `[{"jsonrpc":"2.0","id":9,"result":null},{"error":{"code":-32601,"message":"method '' not found"},"id":10,"jsonrpc":"2.0"}]`, 123, 200))
-	t.Run("add", tc(`     [{"jsonrpc": "2.0", "method": "SimpleServerHandler.Add", "params": [-1], "id": 11}]   `, `[{"jsonrpc":"2.0","id":11,"result":null}]`, -1, 200))
-	t.Run("add", tc(``, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"Invalid request"}}`, 0, 400))
+	t.Run("ws", tc("ws"))
+	t.Run("http", tc("http"))
+}
+
+type RawResultHandler struct{}
+
+func (h *RawResultHandler) Get() (json.RawMessage, error) {
+	return json.RawMessage(`{"a": [1, 2], "b": "c"}`), nil
+}
+
+func TestRawMessageResult(t *testing.T) {
+	rpcServer := NewServer()
+	rpcServer.Register("Raw", &RawResultHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	// the raw JSON is embedded as the result, not re-encoded as a string
+	res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "Raw.Get", "params": [], "id": 1}`))
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":{"a":[1,2],"b":"c"}}`, string(b))
+
+	tc := func(proto string) func(t *testing.T) {
+		return func(t *testing.T) {
+			var client struct {
+				Get func() (json.RawMessage, error)
+			}
+			closer, err := NewClient(context.Background(), proto+"://"+testServ.Listener.Addr().String(), "Raw", &client, nil)
+			require.NoError(t, err)
+			defer closer()
+
+			raw, err := client.Get()
+			require.NoError(t, err)
+			require.JSONEq(t, `{"a":[1,2],"b":"c"}`, string(raw))
+		}
+	}
+
+	t.Run("ws", tc("ws"))
+	t.Run("http", tc("http"))
+}
+
+type connIDKey struct{}
+
+type ConnCtxHandler struct{}
+
+func (h *ConnCtxHandler) ConnID(ctx context.Context) string {
+	id, _ := ctx.Value(connIDKey{}).(string)
+	return id
+}
+
+func TestConnContext(t *testing.T) {
+	closed := make(chan string, 2)
+
+	rpcServer := NewServer(
+		WithConnContext(func(ctx context.Context, conn ConnInfo) context.Context {
+			return context.WithValue(ctx, connIDKey{}, conn.ID)
+		}),
+		WithConnClose(func(ctx context.Context, conn ConnInfo, err error) {
+			require.Equal(t, conn.ID, ctx.Value(connIDKey{}))
+			closed <- conn.ID
+		}),
+	)
+	rpcServer.Register("ConnCtx", &ConnCtxHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	connect := func() (func() string, ClientCloser) {
+		var client struct {
+			ConnID func(ctx context.Context) string
+		}
+		closer, err := NewClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "ConnCtx", &client, nil)
+		require.NoError(t, err)
+		return func() string { return client.ConnID(context.Background()) }, closer
+	}
+
+	connID1, closer1 := connect()
+	connID2, closer2 := connect()
+
+	id1 := connID1()
+	require.NotEmpty(t, id1)
+	require.Equal(t, id1, connID1())
+
+	id2 := connID2()
+	require.NotEmpty(t, id2)
+	require.NotEqual(t, id1, id2)
+
+	closer1()
+	require.Equal(t, id1, <-closed)
+	closer2()
+	require.Equal(t, id2, <-closed)
+}
+
+func TestConnCloseError(t *testing.T) {
+	type disconnect struct {
+		conn ConnInfo
+		err  error
+	}
+	connected := make(chan ConnInfo, 2)
+	disconnected := make(chan disconnect, 2)
+
+	rpcServer := NewServer(
+		WithConnContext(func(ctx context.Context, conn ConnInfo) context.Context {
+			connected <- conn
+			return ctx
+		}),
+		WithConnClose(func(ctx context.Context, conn ConnInfo, err error) {
+			disconnected <- disconnect{conn: conn, err: err}
+		}),
+	)
+	rpcServer.Register("ConnCtx", &ConnCtxHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	// normal close
+	var client struct {
+		ConnID func(ctx context.Context) string
+	}
+	closer, err := NewClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "ConnCtx", &client, nil)
+	require.NoError(t, err)
+	client.ConnID(context.Background())
+
+	conn := <-connected
+	require.NotEmpty(t, conn.ID)
+	require.NotEmpty(t, conn.RemoteAddr)
+
+	closer()
+	d := <-disconnected
+	require.Equal(t, conn, d.conn)
+	require.NoError(t, d.err)
+
+	// connection dropped without a close message
+	wsConn, _, err := websocket.DefaultDialer.Dial("ws://"+testServ.Listener.Addr().String(), nil)
+	require.NoError(t, err)
+
+	conn = <-connected
+	require.Equal(t, wsConn.LocalAddr().String(), conn.RemoteAddr)
+
+	require.NoError(t, wsConn.UnderlyingConn().Close())
+	d = <-disconnected
+	require.Equal(t, conn.ID, d.conn.ID)
+	require.Error(t, d.err)
+}
+
+func TestClientBatch(t *testing.T) {
+	tc := func(proto string) func(t *testing.T) {
+		return func(t *testing.T) {
+			rpcServer := NewServer()
+			rpcServer.Register("SimpleServerHandler", &SimpleServerHandler{})
+
+			testServ := httptest.NewServer(rpcServer)
+			defer testServ.Close()
+
+			client, err := Dial(context.Background(), proto+"://"+testServ.Listener.Addr().String(), nil)
+			require.NoError(t, err)
+			defer client.Close()
+
+			var n int
+			require.NoError(t, client.Call(context.Background(), "SimpleServerHandler.AddGet", &n, 2))
+			require.Equal(t, 2, n)
+
+			b := client.NewBatch()
+			add := b.Add("SimpleServerHandler.AddGet", 3)
+			missing := b.Add("SimpleServerHandler.Missing")
+			badParams := b.Add("SimpleServerHandler.AddGet")
+			match := b.Add("SimpleServerHandler.StringMatch", TestType{S: "0", I: 0}, int64(0))
+
+			resp, err := b.Send(context.Background())
+			require.NoError(t, err)
+			require.True(t, resp.Failed())
+
+			require.NoError(t, resp.Err(add))
+			require.NoError(t, resp.Decode(add, &n))
+			require.Equal(t, 5, n)
+
+			err = resp.Err(missing)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "RPC error (-32601)")
+			require.Equal(t, err, resp.Decode(missing, &n))
+
+			err = resp.Err(badParams)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "RPC error (-32602)")
+
+			var out TestOut
+			require.NoError(t, resp.Decode(match, &out))
+			require.True(t, out.Ok)
+
+			// calls from other batches are rejected
+			require.Error(t, resp.Err(client.NewBatch().Add("SimpleServerHandler.Inc")))
+
+			b = client.NewBatch()
+			add = b.Add("SimpleServerHandler.AddGet", 1)
+			resp, err = b.Send(context.Background())
+			require.NoError(t, err)
+			require.False(t, resp.Failed())
+			require.NoError(t, resp.Decode(add, &n))
+			require.Equal(t, 6, n)
+
+			// untyped nil params are sent as null
+			require.NoError(t, client.Call(context.Background(), "SimpleServerHandler.AddGet", &n, nil))
+			require.Equal(t, 6, n)
+
+			b = client.NewBatch()
+			add = b.Add("SimpleServerHandler.AddGet", nil)
+			resp, err = b.Send(context.Background())
+			require.NoError(t, err)
+			require.NoError(t, resp.Decode(add, &n))
+			require.Equal(t, 6, n)
+		}
+	}
+
+	t.Run("ws", tc("ws"))
+	t.Run("http", tc("http"))
 }
 
 func TestReconnection(t *testing.T) {
@@ -459,6 +7072,54 @@ func TestRPCHttpClient(t *testing.T) {
 	closer()
 }
 
+func TestNamespacedMergeClient(t *testing.T) {
+	tc := func(proto string) func(t *testing.T) {
+		return func(t *testing.T) {
+			handlerA := &SimpleServerHandler{}
+			handlerB := &SimpleServerHandler{n: 1000}
+
+			rpcServer := NewServer()
+			rpcServer.Register("A", handlerA)
+			rpcServer.Register("B", handlerB)
+
+			testServ := httptest.NewServer(rpcServer)
+			defer testServ.Close()
+
+			var clientA, clientB struct {
+				Add    func(int) error
+				AddGet func(int) int
+			}
+			closer, err := NewNamespacedMergeClient(context.Background(), proto+"://"+testServ.Listener.Addr().String(), map[string]interface{}{
+				"A": &clientA,
+				"B": &clientB,
+			}, nil)
+			require.NoError(t, err)
+			defer closer()
+
+			// interleave calls to both namespaces on the shared connection
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					require.NoError(t, clientA.Add(1))
+				}()
+				go func() {
+					defer wg.Done()
+					require.NoError(t, clientB.Add(2))
+				}()
+			}
+			wg.Wait()
+
+			require.Equal(t, 50, clientA.AddGet(0))
+			require.Equal(t, 1100, clientB.AddGet(0))
+		}
+	}
+
+	t.Run("ws", tc("ws"))
+	t.Run("http", tc("http"))
+}
+
 func TestParallelRPC(t *testing.T) {
 	// setup server
 
@@ -1006,6 +7667,119 @@ func TestChanClientReceiveAll(t *testing.T) {
 
 }
 
+func TestChanWithErrors(t *testing.T) {
+	var client struct {
+		GetData func(context.Context, int) (<-chan int, <-chan error, error)
+		// the server sends ints, which can't be decoded into strings
+		GetStrings func(context.Context, int) (<-chan string, <-chan error, error) `rpc_method:"ChanHandler.GetData"`
+	}
+	var subClient struct {
+		Sub func(context.Context, int, int) (<-chan int, <-chan error, error)
+	}
+
+	rpcServer := NewServer()
+	rpcServer.Register("ChanHandler", &StreamingHandler{})
+
+	subHandler := &ChanHandler{
+		wait: make(chan struct{}, 5),
+	}
+	rpcServer.Register("SubHandler", subHandler)
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	closer, err := NewClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "ChanHandler", &client, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// all values, then both channels closed without errors
+
+	sub, errs, err := client.GetData(ctx, 10)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.Equal(t, i, <-sub)
+	}
+	_, ok := <-sub
+	require.False(t, ok)
+	_, ok = <-errs
+	require.False(t, ok)
+
+	// values which fail to decode are reported on the error channel
+
+	strs, errs, err := client.GetStrings(ctx, 3)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		err := <-errs
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "unmarshaling chan response")
+	}
+	_, ok = <-errs
+	require.False(t, ok)
+	_, ok = <-strs
+	require.False(t, ok)
+
+	// connection loss is reported on the error channel
+
+	subCloser, err := NewClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "SubHandler", &subClient, nil)
+	require.NoError(t, err)
+
+	subHandler.wait <- struct{}{}
+
+	isub, errs, err := subClient.Sub(ctx, 2, -1)
+	require.NoError(t, err)
+	require.Equal(t, 2, <-isub)
+
+	subCloser()
+
+	err = <-errs
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "websocket connection closed")
+	_, ok = <-isub
+	require.False(t, ok)
+}
+
+func TestChanConflation(t *testing.T) {
+	var client struct {
+		GetData func(context.Context, int) (<-chan int, error)
+	}
+
+	rpcServer := NewServer()
+	rpcServer.Register("ChanHandler", &StreamingHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "ChanHandler", []interface{}{&client}, nil, WithSubscriptionConflation())
+	require.NoError(t, err)
+	defer closer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sub, err := client.GetData(ctx, 1000)
+	require.NoError(t, err)
+
+	// slow consumer
+	time.Sleep(200 * time.Millisecond)
+
+	var got []int
+	for v := range sub {
+		got = append(got, v)
+	}
+
+	require.NotEmpty(t, got)
+	require.Less(t, len(got), 1000)
+	require.Equal(t, 999, got[len(got)-1])
+	for i := 1; i < len(got); i++ {
+		require.Greater(t, got[i], got[i-1])
+	}
+}
+
 func TestControlChanDeadlock(t *testing.T) {
 	_ = logging.SetLogLevel("rpc", "error")
 	defer func() {
@@ -1220,6 +7994,51 @@ func TestUserError(t *testing.T) {
 	closer()
 }
 
+type ErrNotFound struct{ What string }
+
+func (e *ErrNotFound) Error() string {
+	return e.What + " not found"
+}
+
+type ErrTypeHandler struct{}
+
+func (h *ErrTypeHandler) Get(what string) error {
+	return xerrors.Errorf("getting: %w", &ErrNotFound{What: what})
+}
+
+func (h *ErrTypeHandler) Other() error {
+	return errors.New("other")
+}
+
+func TestRegisterErrorType(t *testing.T) {
+	const ENotFound = FirstUserCode + 10
+
+	rpcServer := NewServer()
+	rpcServer.RegisterErrorType(&ErrNotFound{}, ENotFound)
+	rpcServer.Register("ErrTypeHandler", &ErrTypeHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	tc := func(method, params string, code ErrorCode) func(t *testing.T) {
+		return func(t *testing.T) {
+			res, err := http.Post(testServ.URL, "application/json", strings.NewReader(`{"jsonrpc": "2.0", "method": "ErrTypeHandler.`+method+`", "params": `+params+`, "id": 1}`))
+			require.NoError(t, err)
+			defer res.Body.Close()
+
+			var resp struct {
+				Error *respError
+			}
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&resp))
+			require.NotNil(t, resp.Error)
+			require.Equal(t, code, resp.Error.Code)
+		}
+	}
+
+	t.Run("wrapped", tc("Get", `["thing"]`, ENotFound))
+	t.Run("unregistered", tc("Other", `[]`, 1))
+}
+
 // Unit test for request/response ID translation.
 func TestIDHandling(t *testing.T) {
 	var decoded request
@@ -1434,6 +8253,68 @@ func TestReverseCall(t *testing.T) {
 	closer()
 }
 
+type RevCallConcurrentServerHandler struct{}
+
+// Sum makes n concurrent calls on the client, and sums the results
+func (h *RevCallConcurrentServerHandler) Sum(ctx context.Context, n int) (int, error) {
+	revClient, ok := ExtractReverseClient[RevCallTestClientProxy](ctx)
+	if !ok {
+		return 0, fmt.Errorf("no reverse client")
+	}
+
+	var wg sync.WaitGroup
+	res := make([]int, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res[i], errs[i] = revClient.CallOnClient(i)
+		}(i)
+	}
+	wg.Wait()
+
+	var sum int
+	for i := range res {
+		if errs[i] != nil {
+			return 0, errs[i]
+		}
+		sum += res[i]
+	}
+	return sum, nil
+}
+
+// TestReverseCallConcurrent checks that both ends of a connection can make calls
+// at the same time, with request ids tracked independently on each side
+func TestReverseCallConcurrent(t *testing.T) {
+	rpcServer := NewServer(WithReverseClient[RevCallTestClientProxy]("Client"))
+	rpcServer.Register("Server", &RevCallConcurrentServerHandler{})
+
+	testServ := httptest.NewServer(rpcServer)
+	defer testServ.Close()
+
+	var client struct {
+		Sum func(ctx context.Context, n int) (int, error)
+	}
+	closer, err := NewMergeClient(context.Background(), "ws://"+testServ.Listener.Addr().String(), "Server", []interface{}{
+		&client,
+	}, nil, WithClientHandler("Client", &RevCallTestClientHandler{}))
+	require.NoError(t, err)
+	defer closer()
+
+	var wg sync.WaitGroup
+	for c := 1; c <= 10; c++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			sum, err := client.Sum(context.Background(), n)
+			require.NoError(t, err)
+			require.Equal(t, n*(n-1), sum) // 2 * (0 + 1 + ... + n-1)
+		}(c * 5)
+	}
+	wg.Wait()
+}
+
 type RevCallTestServerHandlerAliased struct {
 }
 
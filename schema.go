@@ -0,0 +1,446 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/xerrors"
+)
+
+// paramSchema is a compiled JSON Schema, see WithParamSchema. Only the
+// validation keywords below are supported, schemas with other keywords
+// (including $ref) are rejected, see schemaKeywords.
+type paramSchema struct {
+	types []string
+	// enum holds the allowed values decoded with UseNumber
+	enum      []interface{}
+	minimum   *float64
+	maximum   *float64
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+	minItems  *int
+	maxItems  *int
+
+	// items is the schema of all items, or tupleItems the schemas of items by
+	// position (`"items": [...]`), with additionalItems the schema of items
+	// past them, nil if any are allowed. noAdditionalItems is set for
+	// `"additionalItems": false`.
+	items             *paramSchema
+	tupleItems        []*paramSchema
+	additionalItems   *paramSchema
+	noAdditionalItems bool
+
+	properties map[string]*paramSchema
+	required   []string
+
+	// additional is the schema of properties not in properties, nil if any
+	// are allowed. noAdditional is set for `"additionalProperties": false`.
+	additional   *paramSchema
+	noAdditional bool
+}
+
+type rawSchema struct {
+	Type                 json.RawMessage            `json:"type"`
+	Enum                 []json.RawMessage          `json:"enum"`
+	Minimum              *float64                   `json:"minimum"`
+	Maximum              *float64                   `json:"maximum"`
+	MinLength            *int                       `json:"minLength"`
+	MaxLength            *int                       `json:"maxLength"`
+	Pattern              *string                    `json:"pattern"`
+	Items                json.RawMessage            `json:"items"`
+	AdditionalItems      json.RawMessage            `json:"additionalItems"`
+	MinItems             *int                       `json:"minItems"`
+	MaxItems             *int                       `json:"maxItems"`
+	Properties           map[string]json.RawMessage `json:"properties"`
+	Required             []string                   `json:"required"`
+	AdditionalProperties json.RawMessage            `json:"additionalProperties"`
+}
+
+// schemaKeywords are the keywords compileSchema accepts; true for validation
+// keywords, false for annotations which don't affect validation
+var schemaKeywords = map[string]bool{
+	"type":                 true,
+	"enum":                 true,
+	"minimum":              true,
+	"maximum":              true,
+	"minLength":            true,
+	"maxLength":            true,
+	"pattern":              true,
+	"items":                true,
+	"additionalItems":      true,
+	"minItems":             true,
+	"maxItems":             true,
+	"properties":           true,
+	"required":             true,
+	"additionalProperties": true,
+
+	"$schema":     false,
+	"$id":         false,
+	"$comment":    false,
+	"title":       false,
+	"description": false,
+	"default":     false,
+	"examples":    false,
+}
+
+// compileSchema parses a JSON Schema
+func compileSchema(data []byte) (*paramSchema, error) {
+	// a schema with a keyword which isn't supported would silently accept
+	// params it was meant to reject
+	var keywords map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keywords); err != nil {
+		return nil, xerrors.Errorf("parsing schema: %w", err)
+	}
+	var unsupported []string
+	for k := range keywords {
+		if _, ok := schemaKeywords[k]; !ok {
+			unsupported = append(unsupported, k)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return nil, xerrors.Errorf("unsupported schema keywords: %s", strings.Join(unsupported, ", "))
+	}
+
+	var raw rawSchema
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, xerrors.Errorf("parsing schema: %w", err)
+	}
+
+	s := &paramSchema{
+		minimum:   raw.Minimum,
+		maximum:   raw.Maximum,
+		minLength: raw.MinLength,
+		maxLength: raw.MaxLength,
+		minItems:  raw.MinItems,
+		maxItems:  raw.MaxItems,
+		required:  raw.Required,
+	}
+
+	if len(raw.Type) > 0 {
+		if raw.Type[0] == '[' {
+			if err := json.Unmarshal(raw.Type, &s.types); err != nil {
+				return nil, xerrors.Errorf("parsing schema type: %w", err)
+			}
+		} else {
+			var t string
+			if err := json.Unmarshal(raw.Type, &t); err != nil {
+				return nil, xerrors.Errorf("parsing schema type: %w", err)
+			}
+			s.types = []string{t}
+		}
+	}
+
+	for _, e := range raw.Enum {
+		dec := json.NewDecoder(bytes.NewReader(e))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return nil, xerrors.Errorf("parsing schema enum: %w", err)
+		}
+		s.enum = append(s.enum, v)
+	}
+
+	if raw.Pattern != nil {
+		re, err := regexp.Compile(*raw.Pattern)
+		if err != nil {
+			return nil, xerrors.Errorf("compiling schema pattern: %w", err)
+		}
+		s.pattern = re
+	}
+
+	if items := bytes.TrimSpace(raw.Items); len(items) > 0 && items[0] == '[' {
+		var tuple []json.RawMessage
+		if err := json.Unmarshal(items, &tuple); err != nil {
+			return nil, xerrors.Errorf("parsing schema items: %w", err)
+		}
+		for i, item := range tuple {
+			is, err := compileSchema(item)
+			if err != nil {
+				return nil, xerrors.Errorf("items %d: %w", i, err)
+			}
+			s.tupleItems = append(s.tupleItems, is)
+		}
+		if s.tupleItems == nil {
+			s.tupleItems = []*paramSchema{}
+		}
+	} else if len(items) > 0 {
+		is, err := compileSchema(items)
+		if err != nil {
+			return nil, xerrors.Errorf("items: %w", err)
+		}
+		s.items = is
+	}
+
+	// additionalItems only applies to tuple items
+	switch a := bytes.TrimSpace(raw.AdditionalItems); {
+	case len(a) == 0 || string(a) == "true" || s.tupleItems == nil:
+	case string(a) == "false":
+		s.noAdditionalItems = true
+	default:
+		additional, err := compileSchema(a)
+		if err != nil {
+			return nil, xerrors.Errorf("additionalItems: %w", err)
+		}
+		s.additionalItems = additional
+	}
+
+	if len(raw.Properties) > 0 {
+		s.properties = map[string]*paramSchema{}
+		for name, p := range raw.Properties {
+			ps, err := compileSchema(p)
+			if err != nil {
+				return nil, xerrors.Errorf("property '%s': %w", name, err)
+			}
+			s.properties[name] = ps
+		}
+	}
+
+	switch a := bytes.TrimSpace(raw.AdditionalProperties); string(a) {
+	case "", "true":
+	case "false":
+		s.noAdditional = true
+	default:
+		additional, err := compileSchema(a)
+		if err != nil {
+			return nil, xerrors.Errorf("additionalProperties: %w", err)
+		}
+		s.additional = additional
+	}
+
+	return s, nil
+}
+
+// jsonEqual compares values decoded with UseNumber, with numbers compared by
+// value, so that e.g. 1 and 1.0 are equal as JSON Schema requires
+func jsonEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		return ok && numbersEqual(a, b)
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, av := range a {
+			bv, ok := b[k]
+			if !ok || !jsonEqual(av, bv) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+// numbersEqual compares JSON numbers by value. They are parsed as big floats
+// rather than float64, so that large integers differing by one aren't equal.
+func numbersEqual(a, b json.Number) bool {
+	if a == b {
+		return true
+	}
+	af, _, err := big.ParseFloat(string(a), 10, 256, big.ToNearestEven)
+	if err != nil {
+		return false
+	}
+	bf, _, err := big.ParseFloat(string(b), 10, 256, big.ToNearestEven)
+	if err != nil {
+		return false
+	}
+	return af.Cmp(bf) == 0
+}
+
+// schemaErrorData is the error data of params rejected by a param schema
+type schemaErrorData struct {
+	// Violations describe each place the params don't match the schema, as
+	// "<JSON pointer>: <problem>"
+	Violations []string `json:"violations"`
+}
+
+// validate checks params against the schema, returning an invalid params
+// error listing all violations
+func (s *paramSchema) validate(method string, params json.RawMessage) error {
+	if len(bytes.TrimSpace(params)) == 0 {
+		params = json.RawMessage("null")
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(params))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return xerrors.Errorf("unmarshaling params for '%s': %w", method, err)
+	}
+
+	var violations []string
+	s.check(v, "", &violations)
+	if len(violations) == 0 {
+		return nil
+	}
+
+	return &dataError{
+		err:  xerrors.Errorf("params for '%s' don't match the schema: %s", method, strings.Join(violations, "; ")),
+		data: schemaErrorData{Violations: violations},
+	}
+}
+
+func (s *paramSchema) check(v interface{}, path string, violations *[]string) {
+	fail := func(format string, args ...interface{}) {
+		p := path
+		if p == "" {
+			p = "/"
+		}
+		*violations = append(*violations, p+": "+fmt.Sprintf(format, args...))
+	}
+
+	if len(s.types) > 0 && !s.hasType(v) {
+		fail("expected %s, got %s", strings.Join(s.types, " or "), jsonTypeName(v))
+		return
+	}
+
+	if len(s.enum) > 0 {
+		found := false
+		for _, e := range s.enum {
+			if jsonEqual(v, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			c, _ := json.Marshal(v)
+			fail("value %s is not one of the allowed values", c)
+		}
+	}
+
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		if s.minimum != nil && f < *s.minimum {
+			fail("%s is less than the minimum of %v", v, *s.minimum)
+		}
+		if s.maximum != nil && f > *s.maximum {
+			fail("%s is greater than the maximum of %v", v, *s.maximum)
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.minLength != nil && n < *s.minLength {
+			fail("string shorter than the minimum length of %d", *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			fail("string longer than the maximum length of %d", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("string doesn't match the pattern %q", s.pattern.String())
+		}
+	case []interface{}:
+		if s.minItems != nil && len(v) < *s.minItems {
+			fail("expected at least %d items, got %d", *s.minItems, len(v))
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			fail("expected at most %d items, got %d", *s.maxItems, len(v))
+		}
+		if s.noAdditionalItems && len(v) > len(s.tupleItems) {
+			fail("expected at most %d items, got %d", len(s.tupleItems), len(v))
+		}
+		for i, item := range v {
+			p := fmt.Sprintf("%s/%d", path, i)
+			switch {
+			case s.items != nil:
+				s.items.check(item, p, violations)
+			case i < len(s.tupleItems):
+				s.tupleItems[i].check(item, p, violations)
+			case s.additionalItems != nil:
+				s.additionalItems.check(item, p, violations)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				fail("missing required property '%s'", name)
+			}
+		}
+
+		// sorted for stable error messages
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			p := path + "/" + escapePointer(name)
+			if ps, ok := s.properties[name]; ok {
+				ps.check(v[name], p, violations)
+				continue
+			}
+			switch {
+			case s.noAdditional:
+				fail("unexpected property '%s'", name)
+			case s.additional != nil:
+				s.additional.check(v[name], p, violations)
+			}
+		}
+	}
+}
+
+func (s *paramSchema) hasType(v interface{}) bool {
+	for _, t := range s.types {
+		switch t {
+		case "integer":
+			if n, ok := v.(json.Number); ok {
+				f, err := n.Float64()
+				if err == nil && f == math.Trunc(f) {
+					return true
+				}
+			}
+		default:
+			if jsonTypeName(v) == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jsonTypeName returns the JSON Schema type name of a decoded value
+func jsonTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// escapePointer escapes a JSON pointer token (RFC 6901)
+func escapePointer(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
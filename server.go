@@ -1,31 +1,83 @@
 package jsonrpc
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"io"
 	"net/http"
+	"reflect"
 	"runtime/pprof"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"golang.org/x/xerrors"
 )
 
-const (
-	rpcParseError     = -32700
-	rpcInvalidRequest = -32600
-	rpcMethodNotFound = -32601
-	rpcInvalidParams  = -32602
-)
+const defaultProtocolVersion = "2.0"
 
 // RPCServer provides a jsonrpc 2.0 http server handler
 type RPCServer struct {
 	*handler
 	reverseClientBuilder func(context.Context, *wsConn) (context.Context, error)
 
-	pingInterval time.Duration
+	pingInterval       time.Duration
+	maxInflightPerConn int
+
+	priorityConcurrency int
+	priorityAging       time.Duration
+	priorityMin         int
+	priorityMax         int
+
+	// workers is shared by all connections, nil if disabled
+	workers *workerPool
+
+	connContext func(context.Context, ConnInfo) context.Context
+	connClose   func(context.Context, ConnInfo, error)
+
+	streamingBatch   bool
+	orderedResponses bool
+
+	// notificationBatchDelay and notificationBatchCount bound notification
+	// batches, see WithNotificationBatching; 0 delay if batching is disabled
+	notificationBatchDelay time.Duration
+	notificationBatchCount int
+
+	wsSubprotocols []string
+
+	// requestTimeout bounds the handling of http requests, 0 for no limit
+	requestTimeout time.Duration
+
+	// allowGET is the set of methods which can be called with GET requests, nil
+	// if GET requests aren't allowed
+	allowGET map[string]bool
+
+	// signingSecret is the response signing HMAC secret, nil if responses
+	// aren't signed
+	signingSecret []byte
+
+	// requestKeys verify request signatures, nil if requests don't need to be
+	// signed
+	requestKeys SignatureKeys
+	// seenSignatures are the ids of used request signatures
+	seenSignatures *seenSignatures
+
+	contentCodecs contentCodecs
+}
+
+// ConnInfo describes a websocket connection, see WithConnContext
+type ConnInfo struct {
+	// ID is a unique connection identifier
+	ID string
+
+	RemoteAddr string
+
+	// Subprotocol is the negotiated websocket subprotocol, empty if the server
+	// doesn't negotiate subprotocols (see WithWSSubprotocols)
+	Subprotocol string
 }
 
 // NewServer creates new RPCServer instance
@@ -35,11 +87,44 @@ func NewServer(opts ...ServerOption) *RPCServer {
 		o(&config)
 	}
 
+	var workers *workerPool
+	if config.workerPoolSize > 0 {
+		workers = newWorkerPool(config.workerPoolSize, config.workerQueueLimit)
+	}
+
 	return &RPCServer{
 		handler:              makeHandler(config),
 		reverseClientBuilder: config.reverseClientBuilder,
 
-		pingInterval: config.pingInterval,
+		pingInterval:       config.pingInterval,
+		maxInflightPerConn: config.maxInflightPerConn,
+
+		priorityConcurrency: config.priorityConcurrency,
+		priorityAging:       config.priorityAging,
+		priorityMin:         config.priorityMin,
+		priorityMax:         config.priorityMax,
+
+		workers: workers,
+
+		connContext: config.connContext,
+		connClose:   config.connClose,
+
+		streamingBatch:   config.streamingBatch,
+		orderedResponses: config.orderedResponses,
+
+		notificationBatchDelay: config.notificationBatchDelay,
+		notificationBatchCount: config.notificationBatchCount,
+
+		wsSubprotocols: config.wsSubprotocols,
+
+		requestTimeout: config.requestTimeout,
+
+		allowGET: config.allowGET,
+
+		signingSecret:  config.signingSecret,
+		requestKeys:    config.requestKeys,
+		seenSignatures: newSeenSignatures(),
+		contentCodecs:  config.contentCodecs,
 	}
 }
 
@@ -53,11 +138,23 @@ func (s *RPCServer) handleWS(ctx context.Context, w http.ResponseWriter, r *http
 	// TODO: allow setting
 	// (note that we still are mostly covered by jwt tokens)
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	if r.Header.Get("Sec-WebSocket-Protocol") != "" {
+
+	var subprotocol string
+	var upgradeHeader http.Header
+	if len(s.wsSubprotocols) > 0 {
+		subprotocol = selectSubprotocol(websocket.Subprotocols(r), s.wsSubprotocols)
+		if subprotocol == "" {
+			log.Warnw("rejecting websocket connection without a supported subprotocol", "offered", r.Header.Get("Sec-WebSocket-Protocol"), "remote", r.RemoteAddr)
+			http.Error(w, "no supported websocket subprotocol offered", http.StatusBadRequest)
+			return
+		}
+		// the upgrader only sends the subprotocol from the upgrade header
+		upgradeHeader = http.Header{"Sec-Websocket-Protocol": []string{subprotocol}}
+	} else if r.Header.Get("Sec-WebSocket-Protocol") != "" {
 		w.Header().Set("Sec-WebSocket-Protocol", r.Header.Get("Sec-WebSocket-Protocol"))
 	}
 
-	c, err := upgrader.Upgrade(w, r, nil)
+	c, err := upgrader.Upgrade(w, r, upgradeHeader)
 	if err != nil {
 		log.Errorw("upgrading connection", "error", err)
 		// note that upgrader.Upgrade will set http error if there is an error
@@ -68,8 +165,23 @@ func (s *RPCServer) handleWS(ctx context.Context, w http.ResponseWriter, r *http
 		conn:         c,
 		handler:      s,
 		pingInterval: s.pingInterval,
+		maxInflight:  s.maxInflightPerConn,
+		envelope:     s.envelope,
+		version:      s.protocolVersion,
+		batches:      s.streamingBatch,
+		indent:       s.indent,
 		exiting:      make(chan struct{}),
 	}
+	if s.notificationBatchDelay > 0 {
+		wc.notifications = &notificationBatch{
+			maxDelay: s.notificationBatchDelay,
+			maxCount: s.notificationBatchCount,
+		}
+	}
+	if s.orderedResponses {
+		wc.ordered = newResponseOrder(wc.nextWriter)
+	}
+	wc.workers = s.workers
 
 	if s.reverseClientBuilder != nil {
 		ctx, err = s.reverseClientBuilder(ctx, wc)
@@ -80,7 +192,32 @@ func (s *RPCServer) handleWS(ctx context.Context, w http.ResponseWriter, r *http
 		}
 	}
 
-	lbl := pprof.Labels("jrpc-mode", "wsserver", "jrpc-remote", r.RemoteAddr, "jrpc-uuid", uuid.New().String())
+	// dispatchers exit when handleWsConn closes exiting, so they're only
+	// started once nothing returns before it runs
+	if s.priorityConcurrency > 0 {
+		wc.callQueue = newCallQueue(s.priorityConcurrency, s.priorityAging, s.priorityMin, s.priorityMax, wc.exiting)
+	}
+
+	connInfo := ConnInfo{
+		ID:          uuid.New().String(),
+		RemoteAddr:  r.RemoteAddr,
+		Subprotocol: subprotocol,
+	}
+
+	if s.connContext != nil {
+		ctx = s.connContext(ctx, connInfo)
+	}
+	if s.connClose != nil {
+		defer func() {
+			closeErr := wc.closeErr
+			if websocket.IsCloseError(closeErr, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				closeErr = nil
+			}
+			s.connClose(ctx, connInfo, closeErr)
+		}()
+	}
+
+	lbl := pprof.Labels("jrpc-mode", "wsserver", "jrpc-remote", r.RemoteAddr, "jrpc-uuid", connInfo.ID)
 	pprof.Do(ctx, lbl, func(ctx context.Context) {
 		wc.handleWsConn(ctx)
 	})
@@ -91,50 +228,228 @@ func (s *RPCServer) handleWS(ctx context.Context, w http.ResponseWriter, r *http
 	}
 }
 
+// selectSubprotocol returns the first supported subprotocol in server
+// preference order which the client offered, empty if there is none
+func selectSubprotocol(offered, supported []string) string {
+	for _, s := range supported {
+		for _, o := range offered {
+			if o == s {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
 // TODO: return errors to clients per spec
 func (s *RPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+	ctx := withPeer(r.Context(), r)
+	if s.methodAllowlist != nil {
+		ctx = withMethodAllowlist(ctx)
+	}
 
 	h := strings.ToLower(r.Header.Get("Connection"))
 	if strings.Contains(h, "upgrade") {
+		if s.requestKeys != nil {
+			http.Error(w, errUnsignedWebsocket.Error(), http.StatusForbidden)
+			return
+		}
 		s.handleWS(ctx, w, r)
 		return
 	}
 
-	s.handleReader(ctx, r.Body, w, rpcError)
-}
+	ctx, cancel := s.httpDeadline(ctx, r)
+	defer cancel()
 
-func rpcError(wf func(func(io.Writer)), req *request, code ErrorCode, err error) {
-	log.Errorf("RPC Error: %s", err)
-	wf(func(w io.Writer) {
-		if hw, ok := w.(http.ResponseWriter); ok {
-			if code == rpcInvalidRequest {
-				hw.WriteHeader(400)
-			} else {
-				hw.WriteHeader(500)
+	if s.signingSecret != nil {
+		sw := &signingResponseWriter{ResponseWriter: w, nonce: r.Header.Get(SignatureNonceHeader)}
+		defer func() {
+			if err := sw.flush(s.signingSecret); err != nil {
+				log.Warnf("writing response failed: %s", err)
 			}
+		}()
+		w = sw
+	}
+
+	if s.traceIDs {
+		ctx = WithTraceID(ctx, httpTraceID(ctx, w, r))
+	}
+
+	if s.requestKeys != nil {
+		if r.Method == http.MethodPost && mediaType(r.Header.Get("Content-Type")) == StreamContentType {
+			s.rpcError(func(cb func(io.Writer)) { cb(w) }, nil, AccessDenied, errUnsignedStream)
+			return
+		}
+
+		// read one byte over the limit so that oversized requests fail as
+		// without signatures
+		body, err := io.ReadAll(io.LimitReader(r.Body, s.maxRequestSize+1))
+		if err != nil {
+			s.rpcError(func(cb func(io.Writer)) { cb(w) }, nil, ParseError, xerrors.Errorf("reading request: %w", err))
+			return
+		}
+		claims, err := verifyRequest(r.Header.Get(RequestSignatureHeader), s.requestKeys, s.seenSignatures, r, body)
+		if err != nil {
+			s.rpcError(func(cb func(io.Writer)) { cb(w) }, nil, AccessDenied, xerrors.Errorf("verifying request signature: %w", err))
+			return
+		}
+		ctx = context.WithValue(ctx, requestClaimsKey{}, claims)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	if len(s.contentCodecs) > 0 {
+		reqCodec, respCodec, respType := s.contentCodecs.negotiate(r)
+		if reqCodec != nil {
+			body, err := decodeBody(r.Body, reqCodec, s.maxRequestSize)
+			if err != nil {
+				s.rpcError(func(cb func(io.Writer)) { cb(w) }, nil, ParseError, err)
+				return
+			}
+			r.Body = io.NopCloser(body)
+		}
+		if respCodec != nil {
+			cw := &codecResponseWriter{ResponseWriter: w}
+			defer func() {
+				if err := cw.flush(respCodec, respType); err != nil {
+					log.Warnf("writing response failed: %s", err)
+				}
+			}()
+			w = cw
 		}
+	}
+
+	if s.envelope != nil {
+		ew := &envelopeResponseWriter{ResponseWriter: w}
+		s.handleHTTP(ctx, r, ew)
+		if err := ew.flush(s.envelope); err != nil {
+			log.Warnf("writing response failed: %s", err)
+		}
+		return
+	}
+
+	s.handleHTTP(ctx, r, w)
+}
+
+func (s *RPCServer) handleHTTP(ctx context.Context, r *http.Request, w http.ResponseWriter) {
+	if r.Method == http.MethodGet && s.allowGET != nil {
+		s.handleGET(ctx, r, w)
+		return
+	}
+	if r.Method == http.MethodPost && mediaType(r.Header.Get("Content-Type")) == StreamContentType {
+		s.handleStream(ctx, r, w)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		ctx = withOutputStream(ctx, w)
+	}
+	s.handleReader(ctx, r.Body, w, s.rpcError)
+}
+
+// handleGET handles a call with the method, params and id in the query string,
+// see WithAllowGET
+func (s *RPCServer) handleGET(ctx context.Context, r *http.Request, w http.ResponseWriter) {
+	wf := func(cb func(io.Writer)) {
+		cb(w)
+	}
 
-		log.Warnf("rpc error: %s", err)
+	q := r.URL.Query()
+	req := request{
+		Jsonrpc: s.protocolVersion,
+		ID:      float64(0),
+		Method:  q.Get("method"),
+		Params:  json.RawMessage("[]"),
+	}
 
-		if req == nil {
-			req = &request{}
+	if id := q.Get("id"); id != "" {
+		// ids which aren't valid JSON are taken as strings
+		var v interface{}
+		if err := json.Unmarshal([]byte(id), &v); err != nil {
+			v = id
 		}
 
-		resp := response{
-			Jsonrpc: "2.0",
-			ID:      req.ID,
-			Error: &respError{
-				Code:    code,
-				Message: err.Error(),
-			},
+		var err error
+		if req.ID, err = normalizeID(v); err != nil {
+			s.rpcError(wf, &request{}, ParseError, xerrors.Errorf("failed to parse ID: %w", err))
+			return
 		}
+	}
 
-		err = json.NewEncoder(w).Encode(resp)
-		if err != nil {
-			log.Warnf("failed to write rpc error: %s", err)
+	if method, _ := s.rewriteMethod(req.Method); !s.allowGET[method] {
+		s.rpcError(wf, &req, InvalidRequest, xerrors.Errorf("method '%s' can't be called with GET", req.Method))
+		return
+	}
+
+	if params := q.Get("params"); params != "" {
+		if !json.Valid([]byte(params)) {
+			s.rpcError(wf, &req, ParseError, xerrors.New("Parse error"))
 			return
 		}
+		req.Params = json.RawMessage(params)
+	}
+
+	s.handle(ctx, req, wf, s.rpcError, func(bool) {}, nil)
+}
+
+// makeRPCError creates an rpcErrFunc writing error responses with the given
+// protocol version
+func makeRPCError(version string, indent *jsonIndent) rpcErrFunc {
+	return func(wf func(func(io.Writer)), req *request, code ErrorCode, err error) {
+		log.Errorf("RPC Error: %s", err)
+		wf(func(w io.Writer) {
+			if hw, ok := w.(http.ResponseWriter); ok {
+				if code == InvalidRequest {
+					hw.WriteHeader(400)
+				} else {
+					hw.WriteHeader(500)
+				}
+			}
+
+			log.Warnf("rpc error: %s", err)
+
+			if req == nil {
+				req = &request{}
+			}
+
+			resp := response{
+				Jsonrpc: version,
+				ID:      req.ID,
+				Error: &respError{
+					Code:    code,
+					Message: err.Error(),
+					Data:    errorData(err),
+				},
+			}
+
+			data, err := json.Marshal(resp)
+			if err != nil {
+				log.Warnf("failed to marshal rpc error: %s", err)
+				return
+			}
+			if _, err := w.Write(append(indent.apply(data), '\n')); err != nil {
+				log.Warnf("failed to write rpc error: %s", err)
+				return
+			}
+		})
+	}
+}
+
+// RegisterErrorType makes errors returned by handlers which match the type of
+// prototype (checked with errors.As, so wrapped errors match too) be sent with
+// the given error code. Types registered first take precedence. Errors with an
+// exact type match in the WithServerErrors registry use that code instead.
+//
+// Note that all errors created with errors.New share a single type, so error
+// types to be mapped must be distinct. Error types should be registered before
+// the server starts handling requests.
+func (s *RPCServer) RegisterErrorType(prototype error, code ErrorCode) {
+	if prototype == nil {
+		panic("can't register nil error prototype")
+	}
+
+	s.errorTypes = append(s.errorTypes, registeredErrorType{
+		typ:  reflect.TypeOf(prototype),
+		code: code,
 	})
 }
 
@@ -142,7 +457,90 @@ func rpcError(wf func(func(io.Writer)), req *request, code ErrorCode, err error)
 //
 // Handler is any value with methods defined
 func (s *RPCServer) Register(namespace string, handler interface{}) {
-	s.register(namespace, handler)
+	s.register(namespace, handler, nil)
+}
+
+// RegisterAll registers the handler under each of the namespaces, e.g. to
+// expose the same methods under per-tenant prefixes. Calls through any of the
+// namespaces are executed on the same handler value, but everything else
+// (namespace codecs, method names) is set up separately for each namespace, as
+// if Register was called for each of them.
+func (s *RPCServer) RegisterAll(namespaces []string, handler interface{}) {
+	for _, ns := range namespaces {
+		s.register(ns, handler, nil)
+	}
+}
+
+// RegisterWithMethodNames registers new RPC handler, with wire names of its
+// methods produced by methodName instead of the default "Namespace.Method".
+// This makes it possible to e.g. expose camelCase names to JavaScript clients:
+//
+//	s.RegisterWithMethodNames("Ns", hnd, func(ns, method string) string {
+//		return ns + "." + strings.ToLower(method[:1]) + method[1:]
+//	})
+//
+// Note that the namespace codec (see WithServerNamespaceCodec) is still picked
+// by the namespace passed here.
+func (s *RPCServer) RegisterWithMethodNames(namespace string, handler interface{}, methodName MethodNameFunc) {
+	s.register(namespace, handler, methodName)
+}
+
+// RegisterMap registers funcs as methods of the namespace, with wire names
+// "namespace.key". The funcs take the same params and return the same values as
+// methods of handlers passed to Register, which is convenient for dynamically
+// assembled APIs.
+//
+// All funcs are validated first; if any is invalid (e.g. isn't a func, or
+// returns too many values), nothing is registered and the returned error names
+// all invalid entries.
+func (s *RPCServer) RegisterMap(namespace string, funcs map[string]interface{}) error {
+	return s.registerFuncs(namespace, funcs)
+}
+
+// MethodInfo describes a registered method, see RPCServer.Methods
+type MethodInfo struct {
+	// Name is the wire name of the method
+	Name string
+
+	// NumParams is the number of JSON-RPC params the method takes
+	NumParams int
+	// ParamTypes are the Go types of the params, not including the context
+	// and progress callback
+	ParamTypes []reflect.Type
+	// ReturnTypes are the Go types of all values returned by the method,
+	// including the error
+	ReturnTypes []reflect.Type
+}
+
+// info describes the method registered under name
+func (m methodHandler) info(name string) MethodInfo {
+	funcType := m.handlerFunc.Type()
+
+	returns := make([]reflect.Type, funcType.NumOut())
+	for i := range returns {
+		returns[i] = funcType.Out(i)
+	}
+
+	return MethodInfo{
+		Name:        name,
+		NumParams:   m.nParams,
+		ParamTypes:  append([]reflect.Type(nil), m.paramReceivers...),
+		ReturnTypes: returns,
+	}
+}
+
+// Methods returns descriptions of all registered methods, sorted by name. The
+// returned values are copies, so they can be freely modified.
+func (s *RPCServer) Methods() []MethodInfo {
+	out := make([]MethodInfo, 0, len(s.methods))
+	for name, m := range s.methods {
+		out = append(out, m.info(name))
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
 }
 
 func (s *RPCServer) AliasMethod(alias, original string) {
@@ -0,0 +1,87 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+)
+
+// SignatureHeader is the http response header carrying the response signature,
+// see WithServerResponseSigning
+const SignatureHeader = "X-Jsonrpc-Signature"
+
+// SignatureNonceHeader is the http request header carrying a random nonce which
+// the response signature covers along with the body, so that signed responses
+// can't be replayed as responses to other requests
+const SignatureNonceHeader = "X-Jsonrpc-Signature-Nonce"
+
+// ErrInvalidSignature is returned by clients with response signing enabled (see
+// WithResponseSigning) for responses with a missing or invalid signature
+var ErrInvalidSignature = errors.New("invalid response signature")
+
+// newSignatureNonce returns a random hex encoded request nonce
+func newSignatureNonce() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// bodyMAC returns the HMAC-SHA256 of the request nonce and the response body.
+// Nonces are hex encoded, so the zero byte separates them from the body.
+func bodyMAC(secret []byte, nonce string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(nonce)) // nolint:errcheck
+	mac.Write([]byte{0})     // nolint:errcheck
+	mac.Write(body)          // nolint:errcheck
+	return mac.Sum(nil)
+}
+
+// signBody returns the hex encoded signature of the response body to the
+// request with the given nonce
+func signBody(secret []byte, nonce string, body []byte) string {
+	return hex.EncodeToString(bodyMAC(secret, nonce, body))
+}
+
+func verifyBody(secret []byte, nonce string, body []byte, signature string) bool {
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(sig, bodyMAC(secret, nonce, body))
+}
+
+// signingResponseWriter buffers the response, so that the signature header can
+// be set before the body is sent. It doesn't implement http.Flusher, so
+// responses meant to be streamed (writer params, streamed arrays) are only sent
+// once complete.
+type signingResponseWriter struct {
+	http.ResponseWriter
+	nonce  string
+	buf    bytes.Buffer
+	status int
+}
+
+func (w *signingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *signingResponseWriter) Write(b []byte) (int, error) {
+	return w.buf.Write(b)
+}
+
+func (w *signingResponseWriter) flush(secret []byte) error {
+	w.ResponseWriter.Header().Set(SignatureHeader, signBody(secret, w.nonce, w.buf.Bytes()))
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	_, err := w.ResponseWriter.Write(w.buf.Bytes())
+	return err
+}
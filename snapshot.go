@@ -0,0 +1,75 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"golang.org/x/xerrors"
+)
+
+// isSnapshotStream checks if the function returns a snapshot with a stream of
+// updates: (T, <-chan U, error), where T isn't a channel.
+//
+// The snapshot and the channel are sent in the response to the call, as
+// snapshotResult, before any value of the channel. Handlers taking the
+// snapshot and subscribing to updates atomically (e.g. under the lock guarding
+// the state) thus guarantee clients get the state and then every update after
+// it, without gaps or overlaps. Methods with this shape must be called over
+// websocket.
+func isSnapshotStream(funcType reflect.Type) bool {
+	if funcType.NumOut() != 3 {
+		return false
+	}
+
+	snap, ch := funcType.Out(0), funcType.Out(1)
+	return snap.Kind() != reflect.Chan && !isChanStruct(snap) &&
+		ch.Kind() == reflect.Chan && ch.ChanDir()&reflect.RecvDir != 0 &&
+		funcType.Out(2) == errorType
+}
+
+// snapshotResult is the result of calls to snapshot stream methods, see
+// isSnapshotStream
+type snapshotResult struct {
+	Snapshot interface{} `json:"snapshot"`
+
+	// Updates is the id of the update channel
+	Updates uint64 `json:"updates"`
+}
+
+// snapshotChanID returns the update channel id of a snapshot stream result,
+// false if the result is a plain channel id
+func snapshotChanID(result json.RawMessage) (uint64, bool, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(result), []byte("{")) {
+		return 0, false, nil
+	}
+
+	var res struct {
+		Updates *uint64 `json:"updates"`
+	}
+	if err := json.Unmarshal(result, &res); err != nil {
+		return 0, true, err
+	}
+	if res.Updates == nil {
+		return 0, true, xerrors.New("snapshot result without an update channel")
+	}
+	return *res.Updates, true, nil
+}
+
+// decodeSnapshot decodes the snapshot of a snapshot stream result
+func decodeSnapshot(result json.RawMessage, typ reflect.Type) (reflect.Value, error) {
+	var res struct {
+		Snapshot json.RawMessage `json:"snapshot"`
+	}
+	if err := json.Unmarshal(result, &res); err != nil {
+		return reflect.Value{}, xerrors.Errorf("unmarshaling snapshot result: %w", err)
+	}
+
+	val := reflect.New(typ)
+	if len(res.Snapshot) > 0 {
+		if err := json.Unmarshal(res.Snapshot, val.Interface()); err != nil {
+			return reflect.Value{}, xerrors.Errorf("unmarshaling snapshot: %w", err)
+		}
+	}
+	return val.Elem(), nil
+}
@@ -0,0 +1,201 @@
+package jsonrpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// StreamContentType is the Content-Type of http requests with a streamed
+// param. The body of such requests is a single JSON-RPC request on the first
+// line, followed by the raw bytes of the stream:
+//
+//	{"jsonrpc":"2.0","method":"Ns.Upload","params":["name",null],"id":1}\n
+//	<raw bytes until the end of the body>
+//
+// The method must have exactly one io.Reader param; in the JSON request it's a
+// null placeholder, and the handler gets a reader of the rest of the body. The
+// stream isn't buffered, so the handler should consume it before returning.
+// Batches aren't supported. See StreamRequestBody for building such bodies.
+const StreamContentType = "application/x-jsonrpc-stream"
+
+var readerType = reflect.TypeOf(new(io.Reader)).Elem()
+
+type streamBodyKey struct{}
+
+// streamBody holds the stream of a request, it can only be taken once
+type streamBody struct {
+	r     io.Reader
+	taken bool
+}
+
+func (sb *streamBody) take() (io.Reader, error) {
+	if sb.taken {
+		return nil, xerrors.New("only one stream param is supported")
+	}
+	sb.taken = true
+	return sb.r, nil
+}
+
+var writerType = reflect.TypeOf(new(io.Writer)).Elem()
+
+type outputStreamKey struct{}
+
+// outputStream is the http response of a call, for methods with an io.Writer
+// param. Methods with such a param write their output directly to the response
+// body, which is flushed after each write:
+//
+//	func (h *Handler) Tail(ctx context.Context, name string, out io.Writer) error
+//
+// In the JSON params the writer is a null placeholder. The response has a
+// text/plain content type, and its body is what the handler wrote. If the
+// handler returns an error before writing anything, a regular JSON-RPC error is
+// sent instead; errors after the output started can only be logged. When the
+// client disconnects, the handler context is cancelled and writes fail.
+//
+// Writer params are only supported for single (non-batch) http POST calls.
+// Responses buffered by the server (e.g. with WithServerResponseSigning or
+// response codecs) are only sent once the handler returns.
+type outputStream struct {
+	w http.ResponseWriter
+
+	lk      sync.Mutex
+	taken   bool
+	started bool
+	closed  bool
+}
+
+func withOutputStream(ctx context.Context, w http.ResponseWriter) context.Context {
+	return context.WithValue(ctx, outputStreamKey{}, &outputStream{w: w})
+}
+
+func (s *outputStream) take() (io.Writer, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if s.taken {
+		return nil, xerrors.New("only one writer param is supported")
+	}
+	s.taken = true
+	return s, nil
+}
+
+func (s *outputStream) Write(b []byte) (int, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if s.closed {
+		return 0, xerrors.New("write after the call returned")
+	}
+	if !s.started {
+		s.started = true
+		s.w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		s.w.WriteHeader(http.StatusOK)
+	}
+
+	n, err := s.w.Write(b)
+	if f, ok := s.w.(http.Flusher); ok && err == nil {
+		f.Flush()
+	}
+	return n, err
+}
+
+// finish is called after the handler returned, it returns true if the handler
+// started writing output, in which case no response should be written
+func (s *outputStream) finish() bool {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.closed = true
+	return s.started
+}
+
+// StreamRequestBody builds the body of a request with a streamed param, see
+// StreamContentType. Params of type io.Reader in params are replaced with the
+// null placeholder, stream is sent after the request.
+func StreamRequestBody(method string, id interface{}, params []interface{}, stream io.Reader) (io.Reader, error) {
+	ps := make([]interface{}, len(params))
+	for i, p := range params {
+		if _, ok := p.(io.Reader); !ok {
+			ps[i] = p
+		}
+	}
+
+	encParams, err := json.Marshal(ps)
+	if err != nil {
+		return nil, xerrors.Errorf("marshaling params: %w", err)
+	}
+
+	header, err := json.Marshal(request{
+		Jsonrpc: defaultProtocolVersion,
+		ID:      id,
+		Method:  method,
+		Params:  encParams,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("marshaling request: %w", err)
+	}
+
+	return io.MultiReader(bytes.NewReader(append(header, '\n')), stream), nil
+}
+
+// handleStream handles an http request with a streamed param
+func (s *RPCServer) handleStream(ctx context.Context, r *http.Request, w http.ResponseWriter) {
+	wf := func(cb func(io.Writer)) {
+		cb(w)
+	}
+
+	br := bufio.NewReader(r.Body)
+	line, err := readLine(br, s.maxRequestSize)
+	if err != nil {
+		s.rpcError(wf, nil, ParseError, xerrors.Errorf("reading stream request: %w", err))
+		return
+	}
+
+	if s.envelope != nil {
+		line = s.envelope.decode(line)
+	}
+
+	var req request
+	if err := json.Unmarshal(line, &req); err != nil {
+		s.rpcError(wf, nil, ParseError, xerrors.New("Parse error"))
+		return
+	}
+	if req.ID, err = normalizeID(req.ID); err != nil {
+		s.rpcError(wf, &req, ParseError, xerrors.Errorf("failed to parse ID: %w", err))
+		return
+	}
+
+	ctx = context.WithValue(ctx, streamBodyKey{}, &streamBody{r: br})
+	s.handle(ctx, req, wf, s.rpcError, func(bool) {}, nil)
+}
+
+// readLine reads up to and excluding the next newline
+func readLine(br *bufio.Reader, maxSize int64) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := br.ReadSlice('\n')
+		line = append(line, chunk...)
+		if int64(len(line)) > maxSize+1 {
+			return nil, xerrors.Errorf("request bigger than maximum %d allowed", maxSize)
+		}
+
+		switch err {
+		case nil:
+			return bytes.TrimSpace(line), nil
+		case bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			return nil, xerrors.New("missing newline after the request")
+		default:
+			return nil, err
+		}
+	}
+}
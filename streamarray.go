@@ -0,0 +1,169 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+
+	"go.opencensus.io/stats"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-jsonrpc/metrics"
+)
+
+// streamableArray returns true if the result should be encoded element by
+// element, see WithStreamingArrays. Byte slices are encoded as base64 strings,
+// not arrays, so they aren't streamed.
+func streamableArray(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.IsNil() {
+			return false
+		}
+	case reflect.Array:
+	default:
+		return false
+	}
+
+	if v.Type().Elem().Kind() == reflect.Uint8 {
+		return false
+	}
+	_, isMarshaler := v.Interface().(json.Marshaler)
+	return !isMarshaler
+}
+
+// writeStreamingArray writes a successful response with an array result,
+// marshaling one element at a time, so that only the largest element is held
+// in memory instead of the entire encoded result.
+//
+// All elements are encoded once before the response is written, discarding
+// the output, so that elements which can't be encoded, and responses over the
+// large response threshold (see WithLargeResponsePolicy), get a regular error
+// response instead of a partially written one.
+func (s *handler) writeStreamingArray(ctx context.Context, w func(func(io.Writer)), rpcError rpcErrFunc, req *request, resp response, arr reflect.Value) {
+	head, err := streamingArrayHead(resp)
+	if err != nil {
+		log.Errorf("marshaling response of '%s' failed: %s", req.Method, err)
+		stats.Record(ctx, metrics.RPCResponseError.M(1))
+		return
+	}
+
+	size := len(head) + len(`]}`)
+	var cw countingWriter
+	enc := json.NewEncoder(&cw)
+	for i := 0; i < arr.Len(); i++ {
+		if err := enc.Encode(arr.Index(i).Interface()); err != nil {
+			stats.Record(ctx, metrics.RPCResponseError.M(1))
+			rpcError(w, req, InternalError, xerrors.Errorf("failed to serialize result of '%s' (element %d): %w", req.Method, i, err))
+			return
+		}
+		if i > 0 {
+			size++ // comma
+		}
+	}
+	size += int(cw.n) - arr.Len() // without the newlines added by Encode
+
+	large := s.largeResponseThreshold > 0 && size > s.largeResponseThreshold
+	if large && s.largeResponseMode == LargeResponseReject {
+		log.Warnf("response of RPC call to '%s' is too large: %d bytes", req.Method, size)
+		stats.Record(ctx, metrics.RPCResponseError.M(1))
+		rpcError(w, req, InternalError, xerrors.Errorf("response of '%s' is %d bytes, over the limit of %d bytes", req.Method, size, s.largeResponseThreshold))
+		return
+	}
+
+	w(func(w io.Writer) {
+		// with LargeResponseStream, flush every threshold bytes
+		var flusher http.Flusher
+		if large {
+			flusher, _ = w.(http.Flusher)
+		}
+		unflushed := 0
+		write := func(b []byte) bool {
+			if _, err := w.Write(b); err != nil {
+				log.Error(err)
+				stats.Record(ctx, metrics.RPCResponseError.M(1))
+				return false
+			}
+			if unflushed += len(b); flusher != nil && unflushed >= s.largeResponseThreshold {
+				flusher.Flush()
+				unflushed = 0
+			}
+			return true
+		}
+
+		if !write(head) {
+			return
+		}
+
+		// the buffer is reused for all elements
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+
+		for i := 0; i < arr.Len(); i++ {
+			buf.Reset()
+			if err := enc.Encode(arr.Index(i).Interface()); err != nil {
+				// elements encoded before; the response is left truncated,
+				// which clients fail to parse
+				log.Errorf("failed to encode element %d of result of RPC call to '%s' after the response started: %s", i, req.Method, err)
+				stats.Record(ctx, metrics.RPCResponseError.M(1))
+				return
+			}
+
+			if i > 0 && !write([]byte{','}) {
+				return
+			}
+			if !write(bytes.TrimSuffix(buf.Bytes(), []byte{'\n'})) {
+				return
+			}
+		}
+
+		write([]byte("]}\n"))
+	})
+}
+
+// streamingArrayHead encodes a response up to the opening bracket of the array
+// result
+func streamingArrayHead(resp response) ([]byte, error) {
+	var head bytes.Buffer
+	field := func(name string, v interface{}) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if head.Len() == 0 {
+			head.WriteByte('{')
+		} else {
+			head.WriteByte(',')
+		}
+		head.WriteString(`"` + name + `":`)
+		head.Write(b)
+		return nil
+	}
+
+	if err := field("jsonrpc", resp.Jsonrpc); err != nil {
+		return nil, err
+	}
+	if err := field("id", resp.ID); err != nil {
+		return nil, err
+	}
+	if len(resp.Meta) > 0 {
+		if err := field("meta", resp.Meta); err != nil {
+			return nil, err
+		}
+	}
+	head.WriteString(`,"result":[`)
+	return head.Bytes(), nil
+}
+
+// countingWriter counts the bytes written to it, discarding them
+type countingWriter struct {
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	cw.n += int64(len(b))
+	return len(b), nil
+}
@@ -0,0 +1,103 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// TimeFormat decodes the JSON value of a time.Time param, see WithTimeFormat
+type TimeFormat func(data []byte) (time.Time, error)
+
+// TimeRFC3339 decodes RFC 3339 strings, which is how time.Time params are
+// decoded by default
+func TimeRFC3339(data []byte) (time.Time, error) {
+	var t time.Time
+	err := json.Unmarshal(data, &t)
+	return t, err
+}
+
+// TimeUnix decodes Unix timestamps in seconds, which may have a fractional
+// part, e.g. 1700000000.5
+func TimeUnix(data []byte) (time.Time, error) {
+	var secs float64
+	if err := json.Unmarshal(data, &secs); err != nil {
+		return time.Time{}, xerrors.Errorf("expected unix timestamp: %w", err)
+	}
+
+	whole, frac := math.Modf(secs)
+	return time.Unix(int64(whole), int64(frac*float64(time.Second))).UTC(), nil
+}
+
+// TimeLayout decodes strings in the given layout, see time.Parse
+func TimeLayout(layout string) TimeFormat {
+	return func(data []byte) (time.Time, error) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return time.Time{}, xerrors.Errorf("expected time string: %w", err)
+		}
+		return time.Parse(layout, s)
+	}
+}
+
+// timeDecoder adapts a TimeFormat to a ParamDecoder
+func timeDecoder(format TimeFormat) ParamDecoder {
+	return func(ctx context.Context, data []byte) (reflect.Value, error) {
+		t, err := format(data)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(t), nil
+	}
+}
+
+// Duration is a time.Duration which is encoded in JSON as a string like "5s"
+// (see time.ParseDuration), and can be decoded from such strings or from
+// numbers of nanoseconds. Use it for params and fields which clients send in
+// either form.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		return d.UnmarshalText([]byte(s))
+	}
+
+	var ns int64
+	if err := json.Unmarshal(data, &ns); err != nil {
+		return xerrors.Errorf("expected duration string or nanoseconds: %w", err)
+	}
+	*d = Duration(ns)
+	return nil
+}
+
+// UnmarshalText decodes duration strings, or integers of nanoseconds, so that
+// Duration fields also work with struct tag defaults (see WithParamDefaults)
+func (d *Duration) UnmarshalText(text []byte) error {
+	if ns, err := strconv.ParseInt(string(text), 10, 64); err == nil {
+		*d = Duration(ns)
+		return nil
+	}
+
+	pd, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(pd)
+	return nil
+}
@@ -0,0 +1,55 @@
+package jsonrpc
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeoutHeader is the http request header with which clients bound the time
+// the server spends handling the request. The value is a duration in Go syntax
+// ("1.5s", "300ms"), or a number of seconds.
+//
+// The timeout becomes the deadline of the handler context, capped by the
+// server maximum set with WithRequestTimeout. Invalid and non-positive values
+// are ignored.
+const TimeoutHeader = "X-Jsonrpc-Timeout"
+
+func parseTimeout(v string) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		secs, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, false
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	return d, d > 0
+}
+
+// httpDeadline applies the request timeout to the context of an http request,
+// either the one from TimeoutHeader, or the server maximum
+func (s *RPCServer) httpDeadline(ctx context.Context, r *http.Request) (context.Context, context.CancelFunc) {
+	timeout := s.requestTimeout
+
+	if hv := r.Header.Get(TimeoutHeader); hv != "" {
+		d, ok := parseTimeout(hv)
+		if !ok {
+			log.Debugf("ignoring invalid %s header: %q", TimeoutHeader, hv)
+		} else if timeout == 0 || d < timeout {
+			timeout = d
+		}
+	}
+
+	if timeout == 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
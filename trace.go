@@ -0,0 +1,75 @@
+package jsonrpc
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// metaTraceID is the request and response meta key carrying the trace id, see
+// WithTraceIDPropagation
+const metaTraceID = "TraceID"
+
+// TraceIDHeader is the http header carrying the trace id of http requests and
+// responses, see WithTraceIDPropagation
+const TraceIDHeader = "X-Trace-Id"
+
+type traceIDKey struct{}
+
+// WithTraceID returns a context which makes calls made with it carry the given
+// trace id. On servers with WithTraceIDPropagation, handlers get the trace id
+// with TraceID, and it's echoed in the response.
+func WithTraceID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, id)
+}
+
+// TraceID returns the trace id of the call handled with ctx (on servers with
+// WithTraceIDPropagation), or the trace id set with WithTraceID
+func TraceID(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	id, ok := ctx.Value(traceIDKey{}).(string)
+	return id, ok
+}
+
+// setTraceID sets the trace id of the request from the context, if it has one
+func (c *client) setTraceID(ctx context.Context, req *request) {
+	id, ok := TraceID(ctx)
+	if !ok {
+		return
+	}
+
+	if req.Meta == nil {
+		req.Meta = map[string]string{}
+	}
+	req.Meta[metaTraceID] = id
+}
+
+// httpTraceID returns the trace id of an http request, from the trace id header
+// or from the request context (e.g. set by middleware), or a new one, and sets
+// it in the response header
+func httpTraceID(ctx context.Context, w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(TraceIDHeader)
+	if id == "" {
+		id, _ = TraceID(ctx)
+	}
+	if id == "" {
+		id = uuid.New().String()
+	}
+	w.Header().Set(TraceIDHeader, id)
+	return id
+}
+
+// callTraceID returns the trace id of a call, from the request meta or from
+// the context (set for http requests), or a new one
+func callTraceID(ctx context.Context, req request) string {
+	if id := req.Meta[metaTraceID]; id != "" {
+		return id
+	}
+	if id, ok := TraceID(ctx); ok && id != "" {
+		return id
+	}
+	return uuid.New().String()
+}
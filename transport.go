@@ -0,0 +1,134 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"golang.org/x/xerrors"
+)
+
+// Transport sends encoded JSON-RPC requests and returns the encoded responses,
+// see WithTransport. It allows using clients over networks other than http and
+// websockets (e.g. message queues), or calling servers in-process in tests.
+//
+// Notification requests (without an id) don't get responses, RoundTrip should
+// return a nil response for them. Transports are only used for calls, so
+// methods returning channels and reverse calls aren't supported.
+type Transport interface {
+	RoundTrip(ctx context.Context, req json.RawMessage) (json.RawMessage, error)
+}
+
+// WithTransport makes the client send calls with the given transport, instead
+// of connecting to the address passed to the client constructor, which is
+// ignored.
+func WithTransport(t Transport) func(c *Config) {
+	return func(c *Config) {
+		c.transport = t
+	}
+}
+
+func transportClient(t Transport, config Config) (*client, ClientCloser) {
+	c := &client{
+		paramEncoders:   config.paramEncoders,
+		namespaceCodecs: config.namespaceCodecs,
+		errors:          config.errors,
+
+		protocolVersion: config.protocolVersion,
+		idempotencyKeys: config.idempotencyKeys,
+		resultTransform: config.resultTransform,
+	}
+
+	stop := make(chan struct{})
+	c.exiting = stop
+
+	c.doRequest = func(ctx context.Context, cr clientRequest) (clientResponse, error) {
+		if cr.retCh != nil || cr.retChs != nil {
+			return clientResponse{}, xerrors.Errorf("method '%s' returns channels, which aren't supported over custom transports", cr.req.Method)
+		}
+
+		b, err := json.Marshal(&cr.req)
+		if err != nil {
+			return clientResponse{}, xerrors.Errorf("marshalling request: %w", err)
+		}
+
+		if ctx == nil { // methods without a context param
+			ctx = context.Background()
+		}
+		rb, err := t.RoundTrip(ctx, b)
+		if err != nil {
+			return clientResponse{}, err
+		}
+
+		if cr.req.ID == nil { // notification
+			return clientResponse{}, nil
+		}
+		return unmarshalResponse(rb, cr.req.ID, config.lenientResponseIDs)
+	}
+
+	return c, func() {
+		close(stop)
+	}
+}
+
+// clientTransport is a Transport using a client created for an address
+type clientTransport struct {
+	c *client
+}
+
+// NewHTTPTransport creates a Transport sending requests over http, with the
+// same behaviour as clients created for http:// addresses.
+func NewHTTPTransport(ctx context.Context, addr string, requestHeader http.Header, opts ...Option) (Transport, ClientCloser, error) {
+	config := defaultConfig()
+	for _, o := range opts {
+		o(&config)
+	}
+
+	c, closer, err := httpClient(ctx, addr, requestHeader, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &clientTransport{c: c}, closer, nil
+}
+
+// NewWebsocketTransport creates a Transport sending requests over a websocket
+// connection, with the same behaviour as clients created for ws:// addresses.
+// The returned closer closes the connection.
+func NewWebsocketTransport(ctx context.Context, addr string, requestHeader http.Header, opts ...Option) (Transport, ClientCloser, error) {
+	config := defaultConfig()
+	for _, o := range opts {
+		o(&config)
+	}
+
+	c, closer, err := websocketClient(ctx, addr, requestHeader, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &clientTransport{c: c}, closer, nil
+}
+
+func (t *clientTransport) RoundTrip(ctx context.Context, msg json.RawMessage) (json.RawMessage, error) {
+	var req request
+	if err := json.Unmarshal(msg, &req); err != nil {
+		return nil, xerrors.Errorf("unmarshaling request: %w", err)
+	}
+
+	id, err := normalizeID(req.ID)
+	if err != nil {
+		return nil, xerrors.Errorf("request id: %w", err)
+	}
+	req.ID = id
+
+	resp, err := t.c.doRequest(ctx, clientRequest{
+		req:   req,
+		ready: make(chan clientResponse, 1),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if req.ID == nil {
+		return nil, nil
+	}
+	return json.Marshal(resp)
+}
@@ -1,11 +1,16 @@
 package jsonrpc
 
 import (
+	"bytes"
+	"container/heap"
+	"encoding"
 	"encoding/json"
 	"fmt"
 	"math"
 	"math/rand"
 	"reflect"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -29,6 +34,145 @@ func (p *param) MarshalJSON() ([]byte, error) {
 	return json.Marshal(p.v.Interface())
 }
 
+// decodeJSONParam decodes a JSON param into v, which must be a pointer. Some
+// types (like *big.Int) implement json.Unmarshaler, but only accept unquoted
+// values, even though clients commonly send them as strings (e.g. to avoid
+// precision loss in JavaScript); for those, if the value is a JSON string, it's
+// decoded with encoding.TextUnmarshaler instead.
+func decodeJSONParam(data []byte, v reflect.Value) error {
+	err := json.NewDecoder(bytes.NewReader(data)).Decode(v.Interface())
+	if err == nil {
+		return nil
+	}
+
+	var s string
+	if json.Unmarshal(data, &s) != nil {
+		return err
+	}
+
+	target := v
+	if t := v.Type().Elem(); t.Kind() == reflect.Ptr {
+		target = reflect.New(t.Elem())
+	}
+	tu, ok := target.Interface().(encoding.TextUnmarshaler)
+	if !ok {
+		return err
+	}
+	if terr := tu.UnmarshalText([]byte(s)); terr != nil {
+		return err
+	}
+
+	if target != v {
+		v.Elem().Set(target)
+	}
+	return nil
+}
+
+// positionalStruct checks if params of the struct type can be sent as named
+// or positional params, see WithStructParams. Types decoding themselves are
+// excluded, as are structs with embedded fields, which encoding/json flattens.
+func positionalStruct(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+
+	pt := reflect.PtrTo(t)
+	if pt.Implements(jsonUnmarshalerType) || pt.Implements(textUnmarshalerType) {
+		return false
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Anonymous {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonFieldNames returns JSON names of exported fields of a struct type, in
+// declaration order
+func jsonFieldNames(t reflect.Type) []string {
+	names := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+
+		name := f.Name
+		if tag := f.Tag.Get("json"); tag != "" {
+			tagName := strings.Split(tag, ",")[0]
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				name = tagName
+			}
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// isRPCResponse checks if data is a JSON-RPC response object, with an id and a
+// result or an error, or a non-empty batch of them
+func isRPCResponse(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var elems []json.RawMessage
+		if err := json.Unmarshal(data, &elems); err != nil || len(elems) == 0 {
+			return false
+		}
+		for _, elem := range elems {
+			if !isRPCResponseObject(elem) {
+				return false
+			}
+		}
+		return true
+	}
+	return isRPCResponseObject(data)
+}
+
+func isRPCResponseObject(data []byte) bool {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return false
+	}
+	_, hasID := obj["id"]
+	_, hasResult := obj["result"]
+	_, hasError := obj["error"]
+	return hasID && (hasResult || hasError)
+}
+
+// isResponseEnvelope checks if data is a JSON-RPC response object, as
+// opposed to a bare result value
+func isResponseEnvelope(data []byte) bool {
+	if !isJSONObject(data) {
+		return false
+	}
+
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return false
+	}
+	_, hasVersion := obj["jsonrpc"]
+	_, hasResult := obj["result"]
+	_, hasError := obj["error"]
+	return hasVersion && (hasResult || hasError)
+}
+
+// isJSONArray checks if the raw JSON value is an array
+func isJSONArray(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] == '['
+}
+
+// isJSONObject checks if the raw JSON value is an object
+func isJSONObject(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] == '{'
+}
+
 // processFuncOut finds value and error Outs in function
 func processFuncOut(funcType reflect.Type) (valOut int, errOut int, n int) {
 	errOut = -1 // -1 if not found
@@ -57,6 +201,19 @@ func processFuncOut(funcType reflect.Type) (valOut int, errOut int, n int) {
 	return
 }
 
+// isStreamWithErrors checks if the function has the client-side streaming
+// shape with a paired error channel: (<-chan T, <-chan error, error)
+func isStreamWithErrors(funcType reflect.Type) bool {
+	if funcType.NumOut() != 3 {
+		return false
+	}
+
+	val, errCh := funcType.Out(0), funcType.Out(1)
+	return val.Kind() == reflect.Chan && val.ChanDir()&reflect.RecvDir != 0 &&
+		errCh.Kind() == reflect.Chan && errCh.ChanDir()&reflect.RecvDir != 0 && errCh.Elem() == errorType &&
+		funcType.Out(2) == errorType
+}
+
 type backoff struct {
 	minDelay time.Duration
 	maxDelay time.Duration
@@ -79,3 +236,69 @@ func (b *backoff) next(attempt int) time.Duration {
 
 	return delay
 }
+
+// IDScheme maps the sequence number of a call (starting at 1) to its request
+// id, which must be a string, a float64 or an int64
+type IDScheme func(seq int64) interface{}
+
+// NegativeIDs is an IDScheme using negative numbers
+func NegativeIDs(seq int64) interface{} {
+	return float64(-seq)
+}
+
+// PrefixedIDs returns an IDScheme using strings with the given prefix, e.g.
+// "srv-1"
+func PrefixedIDs(prefix string) IDScheme {
+	return func(seq int64) interface{} {
+		return prefix + strconv.FormatInt(seq, 10)
+	}
+}
+
+// isChanStruct checks if the type is a struct with only channel fields, all
+// exported; methods returning such structs open a channel subscription for
+// each field
+func isChanStruct(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct || t.NumField() == 0 {
+		return false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Type.Kind() != reflect.Chan {
+			return false
+		}
+	}
+	return true
+}
+
+type expiringKey struct {
+	key     string
+	expires time.Time
+}
+
+// expiryHeap is a min-heap of keys by expiry, for removing expired entries of
+// maps without scanning them
+type expiryHeap []expiringKey
+
+func (e expiryHeap) Len() int            { return len(e) }
+func (e expiryHeap) Less(i, j int) bool  { return e[i].expires.Before(e[j].expires) }
+func (e expiryHeap) Swap(i, j int)       { e[i], e[j] = e[j], e[i] }
+func (e *expiryHeap) Push(x interface{}) { *e = append(*e, x.(expiringKey)) }
+func (e *expiryHeap) Pop() interface{} {
+	old := *e
+	x := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return x
+}
+
+func (e *expiryHeap) push(key string, expires time.Time) {
+	heap.Push(e, expiringKey{key: key, expires: expires})
+}
+
+// popExpired removes and returns the keys which expired before now
+func (e *expiryHeap) popExpired(now time.Time) []string {
+	var keys []string
+	for len(*e) > 0 && now.After((*e)[0].expires) {
+		keys = append(keys, heap.Pop(e).(expiringKey).key)
+	}
+	return keys
+}
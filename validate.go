@@ -0,0 +1,124 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"golang.org/x/xerrors"
+)
+
+// ValidationError describes why a request would be rejected by the server, see
+// RPCServer.Validate
+type ValidationError struct {
+	// Index is the position of the request in a batch, 0 for single requests,
+	// and -1 for errors which apply to the whole request body
+	Index int
+	// ID is the id of the request, nil for notifications
+	ID interface{}
+
+	// Code is the JSON-RPC error code the server would reply with
+	Code ErrorCode
+	Err  error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("request %d: %s", e.Index, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Validate checks a request (or a batch of requests) without executing it. It
+// runs the same checks as the server does before calling the method: request
+// size and parsing, protocol version, method lookup, param count and param
+// decoding (including custom param decoders, which get ctx). This lets e.g.
+// API gateways reject bad requests before forwarding them.
+//
+// Validate returns nil if the request is valid. For batches, it returns an
+// error for each invalid element. Note that methods returning channels pass
+// validation, even though they're only supported over websocket.
+func (s *RPCServer) Validate(ctx context.Context, data []byte) []*ValidationError {
+	bodyErr := func(code ErrorCode, err error) []*ValidationError {
+		return []*ValidationError{{Index: -1, Code: code, Err: err}}
+	}
+
+	if int64(len(data)) > s.maxRequestSize {
+		return bodyErr(ParseError, xerrors.Errorf("request bigger than maximum %d allowed", s.maxRequestSize))
+	}
+
+	if s.envelope != nil {
+		data = s.envelope.decode(data)
+	}
+	data = bytes.TrimSpace(data)
+
+	if len(data) == 0 {
+		return bodyErr(InvalidRequest, xerrors.New("Invalid request"))
+	}
+
+	if !isJSONArray(data) {
+		var req request
+		if err := json.Unmarshal(data, &req); err != nil {
+			return bodyErr(ParseError, xerrors.New("Parse error"))
+		}
+
+		if verr := s.validateRequest(ctx, req); verr != nil {
+			return []*ValidationError{verr}
+		}
+		return nil
+	}
+
+	reqs, err := decodeBatch(data)
+	if err != nil {
+		return bodyErr(ParseError, xerrors.New("Parse error"))
+	}
+	if len(reqs) == 0 {
+		return bodyErr(InvalidRequest, xerrors.New("Invalid request"))
+	}
+
+	var errs []*ValidationError
+	for i, breq := range reqs {
+		if breq.err != nil {
+			errs = append(errs, &ValidationError{Index: i, Code: InvalidRequest, Err: breq.err})
+			continue
+		}
+		if verr := s.validateRequest(ctx, breq.req); verr != nil {
+			verr.Index = i
+			errs = append(errs, verr)
+		}
+	}
+	return errs
+}
+
+func (s *handler) validateRequest(ctx context.Context, req request) *ValidationError {
+	var err error
+	if req.ID, err = normalizeID(req.ID); err != nil {
+		return &ValidationError{Code: ParseError, Err: xerrors.Errorf("failed to parse ID: %w", err)}
+	}
+
+	fail := func(code ErrorCode, err error) *ValidationError {
+		return &ValidationError{ID: req.ID, Code: code, Err: err}
+	}
+
+	if req.Jsonrpc != s.protocolVersion {
+		return fail(InvalidRequest, fmt.Errorf("unsupported jsonrpc version '%s', expected '%s'", req.Jsonrpc, s.protocolVersion))
+	}
+
+	var ok bool
+	req.Method, ok = s.rewriteMethod(req.Method)
+	if !ok {
+		return fail(MethodNotFound, s.methodNotFound(req.Method))
+	}
+
+	handler, ok := s.lookupMethod(req.Method)
+	if !ok {
+		return fail(MethodNotFound, s.methodNotFound(req.Method))
+	}
+
+	if _, code, err := s.decodeParams(ctx, req, handler); err != nil {
+		return fail(code, err)
+	}
+	return nil
+}
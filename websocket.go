@@ -1,6 +1,7 @@
 package jsonrpc
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -18,8 +19,14 @@ import (
 )
 
 const wsCancel = "xrpc.cancel"
+
+// rpcCancel is an alias of wsCancel in the reserved "rpc." namespace, for
+// clients which aren't aware of the xrpc extensions
+const rpcCancel = "rpc.cancel"
 const chValue = "xrpc.ch.val"
 const chClose = "xrpc.ch.close"
+const wsProgress = "xrpc.progress"
+const chTrailer = "xrpc.ch.trailer"
 
 var debugTrace = os.Getenv("JSONRPC_ENABLE_DEBUG_TRACE") == "1"
 
@@ -43,6 +50,26 @@ type outChanReg struct {
 
 	chID uint64
 	ch   reflect.Value
+
+	// fields are the channels of a returned struct of channels, instead of ch
+	fields []outChanField
+
+	// snapshot is sent with the channel id, invalid if the method doesn't
+	// return one
+	snapshot reflect.Value
+
+	// trailer is sent before the channel close notification, if not empty
+	trailer *responseMeta
+
+	// timeout closes the connection when sending a value takes longer, see
+	// BackpressureDisconnect; zero for no timeout
+	timeout time.Duration
+}
+
+type outChanField struct {
+	name string
+	chID uint64
+	ch   reflect.Value
 }
 
 type reqestHandler interface {
@@ -62,6 +89,15 @@ type wsConn struct {
 	stopPings        func()
 	stop             <-chan struct{}
 	exiting          chan struct{}
+	maxInflight      int
+	callQueue        *callQueue  // nil if calls aren't queued by priority
+	workers          *workerPool // nil if calls get their own goroutines
+	envelope         *envelopeMapping
+	version          string // jsonrpc protocol version
+	batches          bool   // accept streaming batches, see WithStreamingBatch
+	notifyBatches    bool   // accept batches of notifications, see WithNotificationBatching
+	indent           *jsonIndent
+	ordered          *responseOrder // nil if responses aren't ordered
 
 	// incoming messages
 	incoming    chan io.Reader
@@ -69,11 +105,24 @@ type wsConn struct {
 
 	readError chan error
 
+	// closeErr is why handleWsConn returned, nil if the connection was closed
+	// normally
+	closeErr error
+
 	frameExecQueue chan []byte
 
-	// outgoing messages
+	// outgoing messages; held for the whole time a message is written, so that
+	// messages from concurrent handlers are never interleaved
 	writeLk sync.Mutex
 
+	// notifications coalesces sent notifications, nil if they're sent as they
+	// come
+	notifications *notificationBatch
+
+	// onNotificationError is called with errors of notifications sent to the
+	// server, see WithNotificationErrorCallback
+	onNotificationError func(method string, err *Error)
+
 	// ////
 	// Client related
 
@@ -92,19 +141,30 @@ type wsConn struct {
 	handling   map[interface{}]context.CancelFunc
 	handlingLk sync.Mutex
 
+	// handlingCalls is the number of calls currently being executed (not
+	// counting active channel subscriptions), take inside handlingLk
+	handlingCalls int
+
 	spawnOutChanHandlerOnce sync.Once
 
 	// chanCtr is a counter used for identifying output channels on the server side
 	chanCtr uint64
 
 	registerCh chan outChanReg
+
+	// subs are the active output channels, by channel id
+	subs   map[uint64]outSub
+	subsLk sync.Mutex
 }
 
 type chanHandler struct {
 	// take inside chanHandlersLk
 	lk sync.Mutex
 
-	cb func(m []byte, ok bool)
+	cb func(m []byte, ok bool, err error)
+
+	// trailer receives the channel trailer, may be nil
+	trailer *StreamTrailer
 }
 
 //                         //
@@ -116,6 +176,9 @@ func (c *wsConn) nextMessage() {
 	c.resetReadDeadline()
 	msgType, r, err := c.conn.NextReader()
 	if err != nil {
+		if errors.Is(err, websocket.ErrReadLimit) {
+			err = ErrResponseTooLarge
+		}
 		c.incomingErr = err
 		close(c.incoming)
 		return
@@ -134,6 +197,20 @@ func (c *wsConn) nextWriter(cb func(io.Writer)) {
 	c.writeLk.Lock()
 	defer c.writeLk.Unlock()
 
+	if err := c.flushNotifications(); err != nil {
+		log.Error("handle me:", err)
+		return
+	}
+
+	if c.envelope != nil {
+		var buf bytes.Buffer
+		cb(&buf)
+		if err := c.conn.WriteMessage(websocket.TextMessage, c.envelope.encode(buf.Bytes())); err != nil {
+			log.Error("handle me:", err)
+		}
+		return
+	}
+
 	wcl, err := c.conn.NextWriter(websocket.TextMessage)
 	if err != nil {
 		log.Error("handle me:", err)
@@ -156,6 +233,23 @@ func (c *wsConn) sendRequest(req request) error {
 		log.Debugw("sendRequest", "req", req.Method, "id", req.ID)
 	}
 
+	if c.notifications != nil {
+		if req.ID == nil {
+			return c.queueNotification(req)
+		}
+		if err := c.flushNotifications(); err != nil {
+			return err
+		}
+	}
+
+	if c.envelope != nil {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		return c.conn.WriteMessage(websocket.TextMessage, c.envelope.encode(b))
+	}
+
 	if err := c.conn.WriteJSON(req); err != nil {
 		return err
 	}
@@ -184,6 +278,8 @@ func (c *wsConn) handleOutChans() {
 	}
 	internal := len(cases)
 	var caseToID []uint64
+	trailers := map[uint64]*responseMeta{}
+	timeouts := map[uint64]time.Duration{}
 
 	for {
 		chosen, val, ok := reflect.Select(cases)
@@ -199,17 +295,48 @@ func (c *wsConn) handleOutChans() {
 
 			registration := val.Interface().(outChanReg)
 
-			caseToID = append(caseToID, registration.chID)
-			cases = append(cases, reflect.SelectCase{
-				Dir:  reflect.SelectRecv,
-				Chan: registration.ch,
-			})
+			var result interface{} = registration.chID
+			if registration.fields != nil {
+				// struct of channels, the result maps field names to channel ids
+				ids := make(map[string]uint64, len(registration.fields))
+				for _, f := range registration.fields {
+					ids[f.name] = f.chID
+					if registration.timeout > 0 {
+						timeouts[f.chID] = registration.timeout
+					}
+					caseToID = append(caseToID, f.chID)
+					cases = append(cases, reflect.SelectCase{
+						Dir:  reflect.SelectRecv,
+						Chan: f.ch,
+					})
+				}
+				result = ids
+			} else {
+				caseToID = append(caseToID, registration.chID)
+				if registration.trailer != nil {
+					trailers[registration.chID] = registration.trailer
+				}
+				if registration.timeout > 0 {
+					timeouts[registration.chID] = registration.timeout
+				}
+				cases = append(cases, reflect.SelectCase{
+					Dir:  reflect.SelectRecv,
+					Chan: registration.ch,
+				})
+				if registration.snapshot.IsValid() {
+					// sent with the channel id, before any channel value
+					result = snapshotResult{
+						Snapshot: registration.snapshot.Interface(),
+						Updates:  registration.chID,
+					}
+				}
+			}
 
 			c.nextWriter(func(w io.Writer) {
 				resp := &response{
-					Jsonrpc: "2.0",
+					Jsonrpc: c.version,
 					ID:      registration.reqID,
-					Result:  registration.chID,
+					Result:  result,
 				}
 
 				if err := json.NewEncoder(w).Encode(resp); err != nil {
@@ -245,6 +372,16 @@ func (c *wsConn) handleOutChans() {
 
 			cases = cases[:n]
 			caseToID = caseToID[:n-internal]
+			delete(timeouts, id)
+
+			c.subsLk.Lock()
+			delete(c.subs, id)
+			c.subsLk.Unlock()
+
+			if trailer := trailers[id]; trailer != nil {
+				delete(trailers, id)
+				c.sendTrailer(id, trailer)
+			}
 
 			rp, err := json.Marshal([]param{{v: reflect.ValueOf(id)}})
 			if err != nil {
@@ -253,7 +390,7 @@ func (c *wsConn) handleOutChans() {
 			}
 
 			if err := c.sendRequest(request{
-				Jsonrpc: "2.0",
+				Jsonrpc: c.version,
 				ID:      nil, // notification
 				Method:  chClose,
 				Params:  rp,
@@ -264,40 +401,126 @@ func (c *wsConn) handleOutChans() {
 		}
 
 		// forward message
-		rp, err := json.Marshal([]param{{v: reflect.ValueOf(caseToID[chosen-internal])}, {v: val}})
+		id := caseToID[chosen-internal]
+		rp, err := json.Marshal([]param{{v: reflect.ValueOf(id)}, {v: val}})
 		if err != nil {
 			log.Errorw("marshaling params for sendRequest failed", "err", err)
 			continue
 		}
 
-		if err := c.sendRequest(request{
-			Jsonrpc: "2.0",
+		var timer *time.Timer
+		if timeout, ok := timeouts[id]; ok {
+			timer = time.AfterFunc(timeout, func() {
+				log.Warnw("subscription client too slow, closing connection", "chID", id, "timeout", timeout)
+				_ = c.conn.Close()
+			})
+		}
+
+		err = c.sendRequest(request{
+			Jsonrpc: c.version,
 			ID:      nil, // notification
 			Method:  chValue,
 			Params:  rp,
-		}); err != nil {
+		})
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
 			log.Warnf("sendRequest failed: %s", err)
 			return
 		}
 	}
 }
 
+// sendTrailer sends the trailer of a closed output channel, if it's not empty
+func (c *wsConn) sendTrailer(chID uint64, trailer *responseMeta) {
+	trailer.lk.Lock()
+	meta := trailer.meta
+	trailer.meta = nil
+	trailer.lk.Unlock()
+
+	if len(meta) == 0 {
+		return
+	}
+
+	rp, err := json.Marshal([]param{{v: reflect.ValueOf(chID)}, {v: reflect.ValueOf(meta)}})
+	if err != nil {
+		log.Errorw("marshaling channel trailer failed", "err", err)
+		return
+	}
+
+	if err := c.sendRequest(request{
+		Jsonrpc: c.version,
+		ID:      nil, // notification
+		Method:  chTrailer,
+		Params:  rp,
+	}); err != nil {
+		log.Warnf("sending channel trailer failed: %s", err)
+	}
+}
+
 // handleChanOut registers output channel for forwarding to client
-func (c *wsConn) handleChanOut(ch reflect.Value, req interface{}) error {
+func (c *wsConn) handleChanOut(ch reflect.Value, snapshot reflect.Value, req interface{}, method string, trailer *responseMeta, backpressure Backpressure) error {
 	c.spawnOutChanHandlerOnce.Do(func() {
 		go c.handleOutChans()
 	})
-	id := atomic.AddUint64(&c.chanCtr, 1)
-
-	select {
-	case c.registerCh <- outChanReg{
+	reg := outChanReg{
 		reqID: req,
 
-		chID: id,
-		ch:   ch,
-	}:
+		snapshot: snapshot,
+		trailer:  trailer,
+	}
+	if backpressure.Mode == BackpressureDisconnect {
+		reg.timeout = backpressure.Timeout
+	}
+	forward := func(ch reflect.Value) reflect.Value {
+		if backpressure.Mode == BackpressureConflate {
+			return conflate(ch, c.exiting)
+		}
+		return ch
+	}
+	if ch.Kind() == reflect.Struct {
+		// struct of channels, see isChanStruct; trailers aren't supported, and
+		// nil channels are closed on the client right away
+		reg.trailer = nil
+		reg.fields = []outChanField{}
+		for i := 0; i < ch.NumField(); i++ {
+			if ch.Field(i).IsNil() {
+				continue
+			}
+			reg.fields = append(reg.fields, outChanField{
+				name: ch.Type().Field(i).Name,
+				chID: atomic.AddUint64(&c.chanCtr, 1),
+				ch:   forward(ch.Field(i)),
+			})
+		}
+	} else {
+		reg.chID = atomic.AddUint64(&c.chanCtr, 1)
+		reg.ch = forward(ch)
+	}
+
+	chIDs := []uint64{reg.chID}
+	if reg.fields != nil {
+		chIDs = chIDs[:0]
+		for _, f := range reg.fields {
+			chIDs = append(chIDs, f.chID)
+		}
+	}
+	c.subsLk.Lock()
+	for _, id := range chIDs {
+		c.subs[id] = outSub{method: method, reqID: req}
+	}
+	c.subsLk.Unlock()
+
+	select {
+	case c.registerCh <- reg:
 		return nil
 	case <-c.exiting:
+		c.subsLk.Lock()
+		for _, id := range chIDs {
+			delete(c.subs, id)
+		}
+		c.subsLk.Unlock()
 		return xerrors.New("connection closing")
 	}
 }
@@ -323,7 +546,7 @@ func (c *wsConn) handleCtxAsync(actx context.Context, id interface{}) {
 	}
 
 	if err := c.sendRequest(request{
-		Jsonrpc: "2.0",
+		Jsonrpc: c.version,
 		Method:  wsCancel,
 		Params:  rp,
 	}); err != nil {
@@ -331,7 +554,18 @@ func (c *wsConn) handleCtxAsync(actx context.Context, id interface{}) {
 	}
 }
 
-// cancelCtx is a built-in rpc which handles context cancellation over rpc
+type remoteCancelKey struct{}
+
+// cancelledByClient checks if the call handled with ctx was cancelled with a
+// cancel message
+func cancelledByClient(ctx context.Context) bool {
+	c, ok := ctx.Value(remoteCancelKey{}).(*int32)
+	return ok && atomic.LoadInt32(c) != 0
+}
+
+// cancelCtx handles cancel messages, which cancel the context of the call with
+// the id in params; the response of the call (if not sent yet) is replaced
+// with a cancellation error
 func (c *wsConn) cancelCtx(req frame) {
 	if req.ID != nil {
 		log.Warnf("%s call with ID set, won't respond", wsCancel)
@@ -343,11 +577,21 @@ func (c *wsConn) cancelCtx(req frame) {
 		return
 	}
 
+	if len(params) == 0 {
+		log.Errorf("%s without the call id", req.Method)
+		return
+	}
+
 	var id interface{}
 	if err := json.Unmarshal(params[0].data, &id); err != nil {
 		log.Error("handle me:", err)
 		return
 	}
+	id, err := normalizeID(id)
+	if err != nil {
+		log.Errorf("invalid call id in %s: %s", req.Method, err)
+		return
+	}
 
 	c.handlingLk.Lock()
 	defer c.handlingLk.Unlock()
@@ -388,7 +632,7 @@ func (c *wsConn) handleChanMessage(frame frame) {
 
 	c.chanHandlersLk.Unlock()
 
-	hnd.cb(params[1].data, true)
+	hnd.cb(params[1].data, true, nil)
 }
 
 func (c *wsConn) handleChanClose(frame frame) {
@@ -419,7 +663,71 @@ func (c *wsConn) handleChanClose(frame frame) {
 
 	c.chanHandlersLk.Unlock()
 
-	hnd.cb(nil, false)
+	hnd.cb(nil, false, nil)
+}
+
+func (c *wsConn) handleChanTrailer(frame frame) {
+	var params []param
+	if err := json.Unmarshal(frame.Params, &params); err != nil || len(params) != 2 {
+		log.Errorf("failed to unmarshal %s params: %v", chTrailer, err)
+		return
+	}
+
+	var chid uint64
+	if err := json.Unmarshal(params[0].data, &chid); err != nil {
+		log.Errorf("failed to unmarshal channel id in %s: %s", chTrailer, err)
+		return
+	}
+
+	var meta map[string]string
+	if err := json.Unmarshal(params[1].data, &meta); err != nil {
+		log.Errorf("failed to unmarshal trailer in %s: %s", chTrailer, err)
+		return
+	}
+
+	c.chanHandlersLk.Lock()
+	hnd, ok := c.chanHandlers[chid]
+	c.chanHandlersLk.Unlock()
+	if !ok {
+		log.Errorf("%s: handler %d not found", chTrailer, chid)
+		return
+	}
+
+	if hnd.trailer != nil {
+		hnd.trailer.set(meta)
+	}
+}
+
+func (c *wsConn) handleProgress(frame frame) {
+	var params []param
+	if err := json.Unmarshal(frame.Params, &params); err != nil || len(params) != 2 {
+		log.Errorf("failed to unmarshal %s params: %v", wsProgress, err)
+		return
+	}
+
+	var id interface{}
+	if err := json.Unmarshal(params[0].data, &id); err != nil {
+		log.Errorf("failed to unmarshal request id in %s: %s", wsProgress, err)
+		return
+	}
+
+	var progress float64
+	if err := json.Unmarshal(params[1].data, &progress); err != nil {
+		log.Errorf("failed to unmarshal progress in %s: %s", wsProgress, err)
+		return
+	}
+
+	c.inflightLk.Lock()
+	req, ok := c.inflight[id]
+	c.inflightLk.Unlock()
+	if !ok {
+		log.Debugw("progress for unknown request", "id", id)
+		return
+	}
+
+	if req.progress != nil {
+		req.progress(progress)
+	}
 }
 
 func (c *wsConn) handleResponse(frame frame) {
@@ -432,17 +740,48 @@ func (c *wsConn) handleResponse(frame frame) {
 	}
 
 	if req.retCh != nil && frame.Result != nil {
-		// output is channel
-		var chid uint64
-		if err := json.Unmarshal(frame.Result, &chid); err != nil {
-			log.Errorf("failed to unmarshal channel id response: %s, data '%s'", err, string(frame.Result))
+		// output is channel, possibly with a snapshot
+		chid, snapshot, err := snapshotChanID(frame.Result)
+		if err != nil {
+			log.Errorf("failed to unmarshal snapshot channel id response: %s, data '%s'", err, string(frame.Result))
 			return
 		}
+		if !snapshot {
+			if err := json.Unmarshal(frame.Result, &chid); err != nil {
+				log.Errorf("failed to unmarshal channel id response: %s, data '%s'", err, string(frame.Result))
+				return
+			}
+		}
 
 		chanCtx, chHnd := req.retCh()
 
 		c.chanHandlersLk.Lock()
-		c.chanHandlers[chid] = &chanHandler{cb: chHnd}
+		c.chanHandlers[chid] = &chanHandler{cb: chHnd, trailer: req.trailer}
+		c.chanHandlersLk.Unlock()
+
+		go c.handleCtxAsync(chanCtx, frame.ID)
+	}
+
+	if req.retChs != nil && frame.Result != nil {
+		// output is a struct of channels
+		var chids map[string]uint64
+		if err := json.Unmarshal(frame.Result, &chids); err != nil {
+			log.Errorf("failed to unmarshal channel ids response: %s, data '%s'", err, string(frame.Result))
+			return
+		}
+
+		chanCtx, sinks := req.retChs()
+
+		c.chanHandlersLk.Lock()
+		for name, sink := range sinks {
+			chid, ok := chids[name]
+			if !ok {
+				// the server didn't open this channel
+				sink(nil, false, nil)
+				continue
+			}
+			c.chanHandlers[chid] = &chanHandler{cb: sink}
+		}
 		c.chanHandlersLk.Unlock()
 
 		go c.handleCtxAsync(chanCtx, frame.ID)
@@ -473,24 +812,53 @@ func (c *wsConn) handleCall(ctx context.Context, frame frame) {
 		Params:  frame.Params,
 	}
 
+	writer, written := c.nextWriter, func() {}
+	if c.ordered != nil && frame.ID != nil {
+		writer, written = c.ordered.reserve()
+	}
+
+	if !c.acquireCallSlot() {
+		if frame.ID == nil {
+			log.Warnw("too many in-flight calls on connection, dropping notification", "method", frame.Method, "limit", c.maxInflight)
+			return
+		}
+
+		makeRPCError(c.version, c.indent)(writer, &req, ServerBusy, xerrors.Errorf("server busy: too many in-flight calls on connection (limit %d)", c.maxInflight))
+		written()
+		return
+	}
+	var releaseOnce sync.Once
+	release := func() {
+		releaseOnce.Do(c.releaseCallSlot)
+	}
+
+	var cancelled int32
+	ctx = context.WithValue(ctx, remoteCancelKey{}, &cancelled)
 	ctx, cancel := context.WithCancel(ctx)
 
 	nextWriter := func(cb func(io.Writer)) {
 		cb(ioutil.Discard)
 	}
 	done := func(keepCtx bool) {
+		release()
 		if !keepCtx {
 			cancel()
 		}
 	}
 	if frame.ID != nil {
-		nextWriter = c.nextWriter
+		nextWriter = writer
 
 		c.handlingLk.Lock()
-		c.handling[frame.ID] = cancel
+		c.handling[frame.ID] = func() {
+			atomic.StoreInt32(&cancelled, 1)
+			cancel()
+		}
 		c.handlingLk.Unlock()
 
 		done = func(keepctx bool) {
+			release()
+			written()
+
 			c.handlingLk.Lock()
 			defer c.handlingLk.Unlock()
 
@@ -501,7 +869,53 @@ func (c *wsConn) handleCall(ctx context.Context, frame frame) {
 		}
 	}
 
-	go c.handler.handle(ctx, req, nextWriter, rpcError, done, c.handleChanOut)
+	if c.callQueue != nil {
+		c.callQueue.schedule(ctx, requestPriority(&req), func() {
+			c.handler.handle(ctx, req, nextWriter, makeRPCError(c.version, c.indent), done, c.handleChanOut)
+		}, func(code ErrorCode, err error) {
+			if frame.ID != nil {
+				makeRPCError(c.version, c.indent)(nextWriter, &req, code, err)
+			}
+			done(false)
+		})
+		return
+	}
+
+	if c.workers != nil {
+		if !c.workers.submit(func() {
+			c.handler.handle(ctx, req, nextWriter, makeRPCError(c.version, c.indent), done, c.handleChanOut)
+		}) {
+			if frame.ID == nil {
+				log.Warnw("worker pool queue full, dropping notification", "method", frame.Method)
+			} else {
+				makeRPCError(c.version, c.indent)(nextWriter, &req, ServerBusy, xerrors.New("server busy: worker pool queue full"))
+			}
+			done(false)
+		}
+		return
+	}
+
+	go c.handler.handle(ctx, req, nextWriter, makeRPCError(c.version, c.indent), done, c.handleChanOut)
+}
+
+// acquireCallSlot reserves a slot for executing a call, returns false if the
+// connection has reached maxInflight concurrently executing calls
+func (c *wsConn) acquireCallSlot() bool {
+	c.handlingLk.Lock()
+	defer c.handlingLk.Unlock()
+
+	if c.maxInflight > 0 && c.handlingCalls >= c.maxInflight {
+		return false
+	}
+	c.handlingCalls++
+	return true
+}
+
+func (c *wsConn) releaseCallSlot() {
+	c.handlingLk.Lock()
+	defer c.handlingLk.Unlock()
+
+	c.handlingCalls--
 }
 
 // handleFrame handles all incoming messages (calls and responses)
@@ -510,42 +924,56 @@ func (c *wsConn) handleFrame(ctx context.Context, frame frame) {
 	// "" - response
 	// "xrpc.*" - builtin
 	// anything else - incoming remote call
+	//
+	// Ids of our calls (inflight) and of remote calls (handling) are tracked
+	// separately, so both sides can use the same ids
 	switch frame.Method {
 	case "": // Response to our call
 		c.handleResponse(frame)
-	case wsCancel:
+	case wsCancel, rpcCancel:
 		c.cancelCtx(frame)
 	case chValue:
 		c.handleChanMessage(frame)
 	case chClose:
 		c.handleChanClose(frame)
+	case chTrailer:
+		c.handleChanTrailer(frame)
+	case wsProgress:
+		c.handleProgress(frame)
+	case wsNotificationError:
+		c.handleNotificationError(frame)
 	default: // Remote call
 		c.handleCall(ctx, frame)
 	}
 }
 
 func (c *wsConn) closeInFlight() {
+	c.failInFlight("handler: websocket connection closed")
+
+	c.handlingLk.Lock()
+	for _, cancel := range c.handling {
+		cancel()
+	}
+	c.handling = map[interface{}]context.CancelFunc{}
+	c.handlingLk.Unlock()
+
+}
+
+// failInFlight fails all in-flight requests with the given message
+func (c *wsConn) failInFlight(msg string) {
 	c.inflightLk.Lock()
 	for id, req := range c.inflight {
 		req.ready <- clientResponse{
 			Jsonrpc: "2.0",
 			ID:      id,
 			Error: &respError{
-				Message: "handler: websocket connection closed",
+				Message: msg,
 				Code:    eTempWSError,
 			},
 		}
 	}
 	c.inflight = map[interface{}]clientRequest{}
 	c.inflightLk.Unlock()
-
-	c.handlingLk.Lock()
-	for _, cancel := range c.handling {
-		cancel()
-	}
-	c.handling = map[interface{}]context.CancelFunc{}
-	c.handlingLk.Unlock()
-
 }
 
 func (c *wsConn) closeChans() {
@@ -561,7 +989,7 @@ func (c *wsConn) closeChans() {
 
 		c.chanHandlersLk.Unlock()
 
-		hnd.cb(nil, false)
+		hnd.cb(nil, false, xerrors.New("websocket connection closed"))
 
 		hnd.lk.Unlock()
 		c.chanHandlersLk.Lock()
@@ -667,10 +1095,17 @@ func (c *wsConn) readFrame(ctx context.Context, r io.Reader) {
 	// use a autoResetReader in case the read takes a long time
 	buf, err := io.ReadAll(c.autoResetReader(r)) // todo buffer pool
 	if err != nil {
+		if errors.Is(err, websocket.ErrReadLimit) {
+			err = ErrResponseTooLarge
+		}
 		c.readError <- xerrors.Errorf("reading frame into a buffer: %w", err)
 		return
 	}
 
+	if c.envelope != nil {
+		buf = c.envelope.decode(buf)
+	}
+
 	c.frameExecQueue <- buf
 	if len(c.frameExecQueue) > cap(c.frameExecQueue)/2 {
 		log.Warnw("frame executor queue is backlogged", "queued", len(c.frameExecQueue), "cap", cap(c.frameExecQueue))
@@ -686,9 +1121,15 @@ func (c *wsConn) frameExecutor(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case buf := <-c.frameExecQueue:
+			if (c.batches || c.notifyBatches) && isJSONArray(buf) {
+				c.handleBatch(ctx, buf)
+				continue
+			}
+
 			var frame frame
 			if err := json.Unmarshal(buf, &frame); err != nil {
 				log.Warnw("failed to unmarshal frame", "error", err)
+				c.protocolError(ctx, buf, xerrors.Errorf("parsing frame: %w", err))
 				// todo send invalid request response
 				continue
 			}
@@ -697,6 +1138,7 @@ func (c *wsConn) frameExecutor(ctx context.Context) {
 			frame.ID, err = normalizeID(frame.ID)
 			if err != nil {
 				log.Warnw("failed to normalize frame id", "error", err)
+				c.protocolError(ctx, buf, xerrors.Errorf("failed to parse ID: %w", err))
 				// todo send invalid request response
 				continue
 			}
@@ -706,6 +1148,39 @@ func (c *wsConn) frameExecutor(ctx context.Context) {
 	}
 }
 
+// protocolError reports a rejected frame to the protocol error handler of the
+// server, if there is one
+func (c *wsConn) protocolError(ctx context.Context, raw []byte, reason error) {
+	if h, ok := c.handler.(interface {
+		protocolError(ctx context.Context, raw []byte, reason error)
+	}); ok {
+		h.protocolError(ctx, raw, reason)
+	}
+}
+
+// handleBatch handles each frame of a batch separately, responses are sent as
+// soon as each call completes
+func (c *wsConn) handleBatch(ctx context.Context, buf []byte) {
+	var frames []frame
+	if err := json.Unmarshal(buf, &frames); err != nil {
+		log.Warnw("failed to unmarshal batch frame", "error", err)
+		c.protocolError(ctx, buf, xerrors.Errorf("parsing batch: %w", err))
+		return
+	}
+
+	ctx = withBatchSize(ctx, len(frames))
+	for _, frame := range frames {
+		var err error
+		frame.ID, err = normalizeID(frame.ID)
+		if err != nil {
+			log.Warnw("failed to normalize batch frame id", "error", err)
+			continue
+		}
+
+		c.handleFrame(ctx, frame)
+	}
+}
+
 var maxQueuedFrames = 256
 
 func (c *wsConn) handleWsConn(ctx context.Context) {
@@ -721,8 +1196,11 @@ func (c *wsConn) handleWsConn(ctx context.Context) {
 	c.pongs = make(chan struct{}, 1)
 
 	c.registerCh = make(chan outChanReg)
+	c.subs = map[uint64]outSub{}
 	defer close(c.exiting)
 
+	ctx = context.WithValue(ctx, connectionKey{}, &Connection{conn: c})
+
 	// ////
 
 	// on close, make sure to return from all pending calls, and cancel context
@@ -735,6 +1213,10 @@ func (c *wsConn) handleWsConn(ctx context.Context) {
 	c.stopPings = c.setupPings()
 	defer c.stopPings()
 
+	if c.notifications != nil {
+		defer c.stopNotifications()
+	}
+
 	var timeoutTimer *time.Timer
 	if c.timeout != 0 {
 		timeoutTimer = time.NewTimer(c.timeout)
@@ -778,15 +1260,23 @@ func (c *wsConn) handleWsConn(ctx context.Context) {
 			}
 
 			log.Debugw("websocket error", "error", err, "lastAction", action, "time", time.Since(start))
+			if errors.Is(err, ErrResponseTooLarge) {
+				c.failInFlight("handler: " + err.Error())
+			}
 			// only client needs to reconnect
 			if !c.tryReconnect(ctx) {
+				c.closeErr = err
 				return // failed to reconnect
 			}
 		case rerr := <-c.readError:
 			action = "read-error"
 
 			log.Debugw("websocket error", "error", rerr, "lastAction", action, "time", time.Since(start))
+			if errors.Is(rerr, ErrResponseTooLarge) {
+				c.failInFlight("handler: " + rerr.Error())
+			}
 			if !c.tryReconnect(ctx) {
+				c.closeErr = rerr
 				return // failed to reconnect
 			}
 		case req := <-c.requests:
@@ -846,6 +1336,7 @@ func (c *wsConn) handleWsConn(ctx context.Context) {
 			log.Errorw("Connection timeout", "remote", c.conn.RemoteAddr(), "lastAction", action)
 			// The server side does not perform the reconnect operation, so need to exit
 			if c.connFactory == nil {
+				c.closeErr = errConnTimeout
 				return
 			}
 			// The client performs the reconnect operation, and if it exits it cannot start a handleWsConn again, so it does not need to exit
@@ -872,6 +1363,8 @@ func (c *wsConn) handleWsConn(ctx context.Context) {
 	}
 }
 
+var errConnTimeout = errors.New("websocket connection timed out")
+
 var onReadDeadlineResetInterval = 5 * time.Second
 
 // autoResetReader wraps a reader and resets the read deadline on if needed when doing large reads.
@@ -0,0 +1,218 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// redactedValue replaces values of redacted fields in logged messages
+const redactedValue = "***"
+
+// WireLogEntry is a message logged by a WireLogger
+type WireLogEntry struct {
+	// Method is the method of the call the message belongs to
+	Method string
+	// Response is true for messages sent by the server (responses, errors and
+	// progress notifications), false for requests
+	Response bool
+
+	// Data is the JSON message, with redacted fields masked (see
+	// WithLogRedaction). Requests are re-encoded after parsing, so they may
+	// differ in formatting from the bytes received. See WithWireLogFormat for
+	// controlling the formatting.
+	Data []byte
+}
+
+// WireLogger is called with each request handled by the server, and each
+// message sent in response, see WithWireLogger. It's called synchronously from
+// the call, so it shouldn't block.
+type WireLogger func(ctx context.Context, entry WireLogEntry)
+
+// WireLogFormat is the formatting of messages passed to the wire logger, see
+// WithWireLogFormat
+type WireLogFormat int
+
+const (
+	// WireLogAsIs passes messages formatted as sent on the wire
+	WireLogAsIs WireLogFormat = iota
+	// WireLogCompact removes insignificant whitespace, so that each message is
+	// a single line
+	WireLogCompact
+	// WireLogIndent pretty-prints messages, indenting with two spaces
+	WireLogIndent
+)
+
+// format formats the message, messages which aren't valid JSON are returned
+// unchanged
+func (f WireLogFormat) format(msg []byte) []byte {
+	var buf bytes.Buffer
+	var err error
+	switch f {
+	case WireLogCompact:
+		err = json.Compact(&buf, msg)
+	case WireLogIndent:
+		err = json.Indent(&buf, msg, "", "  ")
+	default:
+		return msg
+	}
+	if err != nil {
+		return msg
+	}
+	return buf.Bytes()
+}
+
+// redactionRule is what is masked in logged messages of a method
+type redactionRule struct {
+	// fields are object keys masked at any depth inside params and result
+	fields map[string]struct{}
+	// params are positions of params masked in requests with positional
+	// params, see WithLogParamRedaction
+	params map[int]struct{}
+}
+
+func (r redactionRule) empty() bool {
+	return len(r.fields) == 0 && len(r.params) == 0
+}
+
+// redactionRules are the redaction rules by method; the "" method applies to
+// all methods
+type redactionRules map[string]*redactionRule
+
+func (rr redactionRules) add(method string) *redactionRule {
+	r, ok := rr[method]
+	if !ok {
+		r = &redactionRule{fields: map[string]struct{}{}, params: map[int]struct{}{}}
+		rr[method] = r
+	}
+	return r
+}
+
+func (rr redactionRules) rule(method string) redactionRule {
+	m, all := rr[method], rr[""]
+	switch {
+	case m == nil && all == nil:
+		return redactionRule{}
+	case all == nil:
+		return *m
+	case m == nil:
+		return *all
+	}
+
+	out := redactionRule{fields: map[string]struct{}{}, params: map[int]struct{}{}}
+	for _, r := range []*redactionRule{m, all} {
+		for f := range r.fields {
+			out.fields[f] = struct{}{}
+		}
+		for i := range r.params {
+			out.params[i] = struct{}{}
+		}
+	}
+	return out
+}
+
+// redact masks values of the rule fields, at any depth inside params and
+// result of the message, and params at the rule positions of requests.
+// Messages which can't be parsed are replaced entirely, so that nothing
+// sensitive leaks.
+func redact(msg []byte, rule redactionRule, request bool) []byte {
+	if rule.empty() {
+		return msg
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+
+	var v map[string]interface{}
+	if err := dec.Decode(&v); err != nil {
+		return []byte(`"` + redactedValue + `"`)
+	}
+
+	if params, ok := v["params"].([]interface{}); ok && request {
+		for i := range params {
+			if _, ok := rule.params[i]; ok {
+				params[i] = redactedValue
+			}
+		}
+	}
+	for _, k := range []string{"params", "result"} {
+		if p, ok := v[k]; ok {
+			v[k] = redactValue(p, rule.fields)
+		}
+	}
+
+	out, err := json.Marshal(v)
+	if err != nil {
+		return []byte(`"` + redactedValue + `"`)
+	}
+	return out
+}
+
+func redactValue(v interface{}, fields map[string]struct{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if _, ok := fields[k]; ok {
+				v[k] = redactedValue
+				continue
+			}
+			v[k] = redactValue(e, fields)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = redactValue(e, fields)
+		}
+	}
+	return v
+}
+
+// logRequest logs the request with the wire logger
+func (s *handler) logRequest(ctx context.Context, req request) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		log.Warnf("marshaling request for wire log failed: %s", err)
+		return
+	}
+
+	s.wireLogger(ctx, WireLogEntry{
+		Method: req.Method,
+		Data:   s.wireLogFormat.format(redact(data, s.redaction.rule(req.Method), true)),
+	})
+}
+
+// loggingWriter wraps the writer of a call to log each message written with
+// the wire logger
+func (s *handler) loggingWriter(ctx context.Context, method string, w func(func(io.Writer))) func(func(io.Writer)) {
+	return func(cb func(io.Writer)) {
+		var buf bytes.Buffer
+		w(func(out io.Writer) {
+			if hw, ok := out.(http.ResponseWriter); ok {
+				// keep http status codes working
+				cb(teeResponseWriter{ResponseWriter: hw, tee: &buf})
+			} else {
+				cb(io.MultiWriter(out, &buf))
+			}
+		})
+
+		if buf.Len() == 0 {
+			return
+		}
+		s.wireLogger(ctx, WireLogEntry{
+			Method:   method,
+			Response: true,
+			Data:     s.wireLogFormat.format(redact(bytes.TrimSpace(buf.Bytes()), s.redaction.rule(method), false)),
+		})
+	}
+}
+
+type teeResponseWriter struct {
+	http.ResponseWriter
+	tee *bytes.Buffer
+}
+
+func (w teeResponseWriter) Write(b []byte) (int, error) {
+	w.tee.Write(b)
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,79 @@
+package jsonrpc
+
+import (
+	"sync"
+)
+
+// workerPool executes calls dispatched from all websocket connections of a
+// server on a fixed number of goroutines, see WithWorkerPool
+type workerPool struct {
+	size  int
+	queue chan func()
+
+	startOnce sync.Once
+	workers   sync.WaitGroup
+
+	// lk guards closing the queue against submit sending to it
+	lk     sync.RWMutex
+	closed bool
+}
+
+func newWorkerPool(size, queueLimit int) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+	if queueLimit < 0 {
+		queueLimit = 0
+	}
+
+	return &workerPool{
+		size:  size,
+		queue: make(chan func(), queueLimit),
+	}
+}
+
+// submit queues the call for execution, it returns false if the queue is full.
+// After the pool is closed calls run on their own goroutines; they're only
+// submitted while the server drains, which rejects them right away.
+func (p *workerPool) submit(run func()) bool {
+	p.lk.RLock()
+	defer p.lk.RUnlock()
+
+	if p.closed {
+		go run()
+		return true
+	}
+
+	p.startOnce.Do(func() {
+		p.workers.Add(p.size)
+		for i := 0; i < p.size; i++ {
+			go p.worker()
+		}
+	})
+
+	select {
+	case p.queue <- run:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *workerPool) worker() {
+	defer p.workers.Done()
+	for run := range p.queue {
+		run()
+	}
+}
+
+// close stops the workers once they executed the queued calls
+func (p *workerPool) close() {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.queue)
+}